@@ -0,0 +1,149 @@
+// Package events contains the CloudEvents published by the todo server on
+// every change. Consumers can use Decode to get the typed payload of a
+// received event.
+package events
+
+import (
+	"fmt"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	TypeCreatedV1 = "net.krizic.todo.created.v1"
+	TypeUpdatedV1 = "net.krizic.todo.updated.v1"
+	TypeDeletedV1 = "net.krizic.todo.deleted.v1"
+	TypeCreatedV2 = "net.krizic.todo.created.v2"
+	TypeUpdatedV2 = "net.krizic.todo.updated.v2"
+	TypeDeletedV2 = "net.krizic.todo.deleted.v2"
+
+	// DefaultSource is the source of events published by the todo server
+	DefaultSource = "/todo/server"
+	// SchemaBaseUrl is the location of the JSON schemas in the schemas directory
+	SchemaBaseUrl = "https://raw.githubusercontent.com/dkrizic/todo/main/api/events/schemas/"
+)
+
+// Todo is the representation of a todo inside of a v1 event
+type Todo struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+}
+
+// TodoV2 is the representation of a todo inside of a v2 event, it adds the
+// list and the tags
+type TodoV2 struct {
+	Id          string   `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Status      string   `json:"status"`
+	List        string   `json:"list,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// CreatedV1 is the data of a net.krizic.todo.created.v1 event
+type CreatedV1 struct {
+	Todo Todo `json:"todo"`
+}
+
+// UpdatedV1 is the data of a net.krizic.todo.updated.v1 event
+type UpdatedV1 struct {
+	// Before is nil if the todo did not exist before the update
+	Before *Todo `json:"before"`
+	After  Todo  `json:"after"`
+}
+
+// DeletedV1 is the data of a net.krizic.todo.deleted.v1 event
+type DeletedV1 struct {
+	Todo Todo `json:"todo"`
+}
+
+// CreatedV2 is the data of a net.krizic.todo.created.v2 event
+type CreatedV2 struct {
+	Todo TodoV2 `json:"todo"`
+}
+
+// UpdatedV2 is the data of a net.krizic.todo.updated.v2 event
+type UpdatedV2 struct {
+	// Before is nil if the todo did not exist before the update
+	Before *TodoV2 `json:"before"`
+	After  TodoV2  `json:"after"`
+}
+
+// DeletedV2 is the data of a net.krizic.todo.deleted.v2 event
+type DeletedV2 struct {
+	Todo TodoV2 `json:"todo"`
+}
+
+// SchemaUrl returns the dataschema of an event type
+func SchemaUrl(eventType string) string {
+	return SchemaBaseUrl + eventType + ".json"
+}
+
+func NewCreatedV1(source string, todo Todo) (cloudevents.Event, error) {
+	return newEvent(source, TypeCreatedV1, todo.Id, CreatedV1{Todo: todo})
+}
+
+func NewUpdatedV1(source string, before *Todo, after Todo) (cloudevents.Event, error) {
+	return newEvent(source, TypeUpdatedV1, after.Id, UpdatedV1{Before: before, After: after})
+}
+
+func NewDeletedV1(source string, todo Todo) (cloudevents.Event, error) {
+	return newEvent(source, TypeDeletedV1, todo.Id, DeletedV1{Todo: todo})
+}
+
+func NewCreatedV2(source string, todo TodoV2) (cloudevents.Event, error) {
+	return newEvent(source, TypeCreatedV2, todo.Id, CreatedV2{Todo: todo})
+}
+
+func NewUpdatedV2(source string, before *TodoV2, after TodoV2) (cloudevents.Event, error) {
+	return newEvent(source, TypeUpdatedV2, after.Id, UpdatedV2{Before: before, After: after})
+}
+
+func NewDeletedV2(source string, todo TodoV2) (cloudevents.Event, error) {
+	return newEvent(source, TypeDeletedV2, todo.Id, DeletedV2{Todo: todo})
+}
+
+func newEvent(source string, eventType string, subject string, data interface{}) (cloudevents.Event, error) {
+	event := cloudevents.NewEvent(cloudevents.VersionV1)
+	event.SetID(uuid.New().String())
+	event.SetSource(source)
+	event.SetType(eventType)
+	event.SetSubject(subject)
+	event.SetTime(time.Now().UTC())
+	event.SetDataSchema(SchemaUrl(eventType))
+	err := event.SetData(cloudevents.ApplicationJSON, data)
+	if err != nil {
+		return event, err
+	}
+	return event, event.Validate()
+}
+
+// Decode returns the typed data of an event, one of *CreatedV1, *UpdatedV1,
+// *DeletedV1, *CreatedV2, *UpdatedV2 or *DeletedV2
+func Decode(event cloudevents.Event) (interface{}, error) {
+	var data interface{}
+	switch event.Type() {
+	case TypeCreatedV1:
+		data = &CreatedV1{}
+	case TypeUpdatedV1:
+		data = &UpdatedV1{}
+	case TypeDeletedV1:
+		data = &DeletedV1{}
+	case TypeCreatedV2:
+		data = &CreatedV2{}
+	case TypeUpdatedV2:
+		data = &UpdatedV2{}
+	case TypeDeletedV2:
+		data = &DeletedV2{}
+	default:
+		return nil, fmt.Errorf("unknown event type %q", event.Type())
+	}
+	err := event.DataAs(data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"encoding/json"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"testing"
+)
+
+// test that an event survives the structured JSON encoding
+func TestRoundTrip(t *testing.T) {
+	before := &Todo{Id: "1", Title: "before"}
+	event, err := NewUpdatedV1(DefaultSource, before, Todo{Id: "1", Title: "after", Status: "DONE"})
+	if err != nil {
+		t.Fatalf("Error creating event: %v", err)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Error encoding event: %v", err)
+	}
+
+	received := cloudevents.NewEvent()
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatalf("Error decoding event: %v", err)
+	}
+	if received.Subject() != "1" || received.DataSchema() != SchemaUrl(TypeUpdatedV1) {
+		t.Errorf("Unexpected subject %v or dataschema %v", received.Subject(), received.DataSchema())
+	}
+	decoded, err := Decode(received)
+	if err != nil {
+		t.Fatalf("Error decoding data: %v", err)
+	}
+	updated, ok := decoded.(*UpdatedV1)
+	if !ok {
+		t.Fatalf("Expected *UpdatedV1, got %T", decoded)
+	}
+	if updated.Before.Title != "before" || updated.After.Status != "DONE" {
+		t.Errorf("Unexpected data %+v", updated)
+	}
+}
+
+// test that a v2 event carries the list and the tags and a v1 event does not
+func TestVersions(t *testing.T) {
+	event, err := NewCreatedV2(DefaultSource, TodoV2{Id: "1", Title: "title", List: "home", Tags: []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("Error creating event: %v", err)
+	}
+	if event.DataSchema() != SchemaUrl(TypeCreatedV2) {
+		t.Errorf("Expected dataschema %v, got %v", SchemaUrl(TypeCreatedV2), event.DataSchema())
+	}
+	decoded, err := Decode(event)
+	if err != nil {
+		t.Fatalf("Error decoding data: %v", err)
+	}
+	created, ok := decoded.(*CreatedV2)
+	if !ok {
+		t.Fatalf("Expected *CreatedV2, got %T", decoded)
+	}
+	if created.Todo.List != "home" || len(created.Todo.Tags) != 2 {
+		t.Errorf("Unexpected data %+v", created)
+	}
+
+	event, err = NewCreatedV1(DefaultSource, Todo{Id: "1", Title: "title"})
+	if err != nil {
+		t.Fatalf("Error creating event: %v", err)
+	}
+	expected := `{"todo":{"id":"1","title":"title","description":"","status":""}}`
+	if string(event.Data()) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(event.Data()))
+	}
+}
+
+// test that every event type has a valid schema
+func TestSchemas(t *testing.T) {
+	for _, eventType := range []string{TypeCreatedV1, TypeUpdatedV1, TypeDeletedV1, TypeCreatedV2, TypeUpdatedV2, TypeDeletedV2} {
+		data, err := Schema(eventType)
+		if err != nil {
+			t.Fatalf("Error reading schema: %v", err)
+		}
+		schema := map[string]interface{}{}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("Invalid schema for %v: %v", eventType, err)
+		}
+		if schema["$id"] != SchemaUrl(eventType) {
+			t.Errorf("Expected $id %v, got %v", SchemaUrl(eventType), schema["$id"])
+		}
+	}
+}
@@ -0,0 +1,17 @@
+module github.com/dkrizic/todo/api/events
+
+go 1.21
+
+require (
+	github.com/cloudevents/sdk-go/v2 v2.14.0
+	github.com/google/uuid v1.4.0
+)
+
+require (
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	go.uber.org/atomic v1.4.0 // indirect
+	go.uber.org/multierr v1.1.0 // indirect
+	go.uber.org/zap v1.10.0 // indirect
+)
@@ -0,0 +1,18 @@
+package events
+
+import (
+	"embed"
+	"fmt"
+)
+
+//go:embed schemas/*.json
+var schemas embed.FS
+
+// Schema returns the JSON schema of the data of an event type
+func Schema(eventType string) ([]byte, error) {
+	data, err := schemas.ReadFile("schemas/" + eventType + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("no schema for event type %q", eventType)
+	}
+	return data, nil
+}
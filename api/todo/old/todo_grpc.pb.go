@@ -1,7 +1,7 @@
 // Code generated by protoc-gen-go-grpc. DO NOT EDIT.
 // versions:
 // - protoc-gen-go-grpc v1.2.0
-// - protoc             v3.21.12
+// - protoc             (unknown)
 // source: todo.proto
 
 package todo
@@ -27,6 +27,8 @@ type ToDoServiceClient interface {
 	GetAll(ctx context.Context, in *GetAllRequest, opts ...grpc.CallOption) (*GetAllResponse, error)
 	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Watch streams the changes, the live feed over HTTP is /api/v1/todos/events
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (ToDoService_WatchClient, error)
 }
 
 type toDoServiceClient struct {
@@ -82,6 +84,38 @@ func (c *toDoServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts
 	return out, nil
 }
 
+func (c *toDoServiceClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (ToDoService_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ToDoService_ServiceDesc.Streams[0], "/todo.ToDoService/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &toDoServiceWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ToDoService_WatchClient interface {
+	Recv() (*WatchResponse, error)
+	grpc.ClientStream
+}
+
+type toDoServiceWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *toDoServiceWatchClient) Recv() (*WatchResponse, error) {
+	m := new(WatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // ToDoServiceServer is the server API for ToDoService service.
 // All implementations must embed UnimplementedToDoServiceServer
 // for forward compatibility
@@ -91,6 +125,8 @@ type ToDoServiceServer interface {
 	GetAll(context.Context, *GetAllRequest) (*GetAllResponse, error)
 	Get(context.Context, *GetRequest) (*GetResponse, error)
 	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Watch streams the changes, the live feed over HTTP is /api/v1/todos/events
+	Watch(*WatchRequest, ToDoService_WatchServer) error
 	mustEmbedUnimplementedToDoServiceServer()
 }
 
@@ -113,6 +149,9 @@ func (UnimplementedToDoServiceServer) Get(context.Context, *GetRequest) (*GetRes
 func (UnimplementedToDoServiceServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
 }
+func (UnimplementedToDoServiceServer) Watch(*WatchRequest, ToDoService_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
 func (UnimplementedToDoServiceServer) mustEmbedUnimplementedToDoServiceServer() {}
 
 // UnsafeToDoServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -216,6 +255,27 @@ func _ToDoService_Delete_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ToDoService_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ToDoServiceServer).Watch(m, &toDoServiceWatchServer{stream})
+}
+
+type ToDoService_WatchServer interface {
+	Send(*WatchResponse) error
+	grpc.ServerStream
+}
+
+type toDoServiceWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *toDoServiceWatchServer) Send(m *WatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // ToDoService_ServiceDesc is the grpc.ServiceDesc for ToDoService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -244,6 +304,12 @@ var ToDoService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _ToDoService_Delete_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _ToDoService_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "todo.proto",
 }
@@ -2,23 +2,71 @@ package main
 
 import (
 	"context"
-	todo "github.com/dkrizic/todo/api/todo"
+	"flag"
+	todo "github.com/dkrizic/todo/api"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	address := flag.String("address", "todo.krizic.net:443", "The address of the gRPC server")
+	watch := flag.Bool("watch", false, "Watch the changes instead of creating a todo")
+	tlsConfig := &TLSConfig{}
+	flag.BoolVar(&tlsConfig.Enabled, "tls", false, "Connect with TLS, implied by the file flags")
+	flag.StringVar(&tlsConfig.CAFile, "tls-ca-file", "", "The PEM CA bundle to verify the server, the system pool if empty")
+	flag.StringVar(&tlsConfig.CertFile, "tls-cert-file", "", "The PEM client certificate for mutual TLS, reloaded when it changes")
+	flag.StringVar(&tlsConfig.KeyFile, "tls-key-file", "", "The PEM client key for mutual TLS")
+	flag.StringVar(&tlsConfig.ServerName, "tls-server-name", "", "The name to verify the server certificate for, the host of the address if empty")
+	flag.StringVar(&tlsConfig.MinVersion, "tls-min-version", "1.2", "The minimum TLS version (1.0, 1.1, 1.2, 1.3)")
+	flag.Parse()
+
 	log.Info("Starting app")
-	// cc, err := grpc.Dial("localhost:9090", grpc.WithInsecure())
-	cc, err := grpc.Dial("todo.krizic.net:443", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	transportCredentials, err := NewCredentials(tlsConfig)
+	if err != nil {
+		log.WithError(err).Fatal("Error loading the TLS configuration")
+	}
+	cc, err := grpc.Dial(*address,
+		grpc.WithTransportCredentials(transportCredentials),
+		// detect broken connections while watching, the server allows a ping every 10 seconds
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
 	if err != nil {
 		log.WithError(err).Fatal("Error connecting to server")
 	}
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	tc := todo.NewToDoServiceClient(cc)
 
+	if *watch {
+		err := Watch(ctx, tc, &todo.WatchRequest{Api: "v1", InitialSnapshot: true}, func(resp *todo.WatchResponse) error {
+			switch event := resp.Event.(type) {
+			case *todo.WatchResponse_Snapshot:
+				log.WithField("id", event.Snapshot.Id).WithField("title", event.Snapshot.Title).Info("Got todo")
+			case *todo.WatchResponse_SnapshotEnd:
+				log.Info("Snapshot complete")
+			case *todo.WatchResponse_Change:
+				log.WithFields(log.Fields{
+					"revision":   resp.Revision,
+					"changeType": event.Change.ChangeType,
+				}).Info("Got change")
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Fatal("Error watching todos")
+		}
+		return
+	}
+
 	_, err = tc.Create(ctx, &todo.CreateOrUpdateRequest{
 		Api: "v1",
 		Todo: &todo.ToDo{
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often the client certificate is checked for changes
+const reloadInterval = 10 * time.Second
+
+type TLSConfig struct {
+	Enabled bool
+	// CAFile verifies the server certificate, the system pool is used if empty
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mutual TLS, it is reloaded when it changes
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the server certificate is verified for
+	ServerName string
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, defaults to 1.2
+	MinVersion string
+}
+
+// NewCredentials returns the transport credentials of the configuration,
+// plaintext if TLS is not enabled and no file is given
+func NewCredentials(config *TLSConfig) (credentials.TransportCredentials, error) {
+	if !config.Enabled && config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" {
+		return insecure.NewCredentials(), nil
+	}
+	minVersion, err := parseVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: config.ServerName,
+	}
+	if config.CAFile != "" {
+		data, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := newCertificate(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificate.get(), nil
+		}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func parseVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "", "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s, use 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// certificate loads the client certificate again when the size or
+// modification time of its files changed, at most once per reloadInterval
+type certificate struct {
+	certFile    string
+	keyFile     string
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	version     string
+	checked     time.Time
+}
+
+func newCertificate(certFile string, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	version, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.certificate, c.version, c.checked = &loaded, version, time.Now()
+	return c, nil
+}
+
+func (c *certificate) get() *tls.Certificate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.checked) < reloadInterval {
+		return c.certificate
+	}
+	c.checked = time.Now()
+	version, err := c.stat()
+	if err != nil || version == c.version {
+		return c.certificate
+	}
+	loaded, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// the key may not be rotated yet
+		log.WithError(err).Warn("Failed to reload the client certificate, keeping the previous one")
+		return c.certificate
+	}
+	c.certificate, c.version = &loaded, version
+	log.WithField("certFile", c.certFile).Info("Reloaded the client certificate")
+	return c.certificate
+}
+
+func (c *certificate) stat() (string, error) {
+	var version strings.Builder
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&version, "%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return version.String(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	todo "github.com/dkrizic/todo/api"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Watch calls handle for every response and reconnects when the stream breaks.
+// It resumes after the revision of the last received change, so the snapshot is
+// only sent again if no change was received yet. Watch returns when the context
+// is done, handle fails or the server rejects the request.
+func Watch(ctx context.Context, client todo.ToDoServiceClient, req *todo.WatchRequest, handle func(*todo.WatchResponse) error) error {
+	req = proto.Clone(req).(*todo.WatchRequest)
+	delay := minReconnectDelay
+	for {
+		err := watchOnce(ctx, client, req, func(resp *todo.WatchResponse) error {
+			delay = minReconnectDelay
+			if resp.Revision != "" {
+				req.Revision = resp.Revision
+			}
+			return handle(resp)
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := status.FromError(err); !ok {
+			// returned by handle
+			return err
+		}
+		switch status.Code(err) {
+		case codes.InvalidArgument, codes.Unimplemented, codes.PermissionDenied, codes.Unauthenticated:
+			return err
+		}
+		log.WithError(err).WithField("revision", req.Revision).WithField("delay", delay).Warn("Watch interrupted, reconnecting")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// watchOnce runs a single stream until it ends, errors of the stream are gRPC statuses
+func watchOnce(ctx context.Context, client todo.ToDoServiceClient, req *todo.WatchRequest, handle func(*todo.WatchResponse) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Watch(ctx, req)
+	if err != nil {
+		return status.Convert(err).Err()
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			// a stream ended by the server without error is resumed as well
+			return status.Convert(err).Err()
+		}
+		if err := handle(resp); err != nil {
+			return err
+		}
+	}
+}
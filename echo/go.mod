@@ -1,9 +1,10 @@
 module github.com/dkrizic/todo/echo
 
-go 1.19
+go 1.21
 
 require (
 	github.com/cloudevents/sdk-go/v2 v2.14.0
+	github.com/dkrizic/todo/api/events v0.0.0-00010101000000-000000000000
 	github.com/gorilla/mux v1.8.1
 	github.com/pytimer/mux-logrus v0.0.0-20200505085744-ce5a5e748151
 	github.com/sirupsen/logrus v1.9.3
@@ -25,12 +26,10 @@ require (
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
-	go.opentelemetry.io/otel/exporters/otlp/internal/retry v1.17.0 // indirect
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.20.0 // indirect
 	go.opentelemetry.io/otel/metric v1.20.0 // indirect
 	go.opentelemetry.io/otel/trace v1.20.0 // indirect
 	go.opentelemetry.io/proto/otlp v1.0.0 // indirect
-	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.26.0 // indirect
 	golang.org/x/net v0.18.0 // indirect
@@ -43,3 +42,5 @@ require (
 )
 
 replace github.com/dkrizic/todo/api/todo => ../api/todo
+
+replace github.com/dkrizic/todo/api/events => ../api/events
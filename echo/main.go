@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/dkrizic/todo/api/events"
 	"github.com/gorilla/mux"
 	muxlogrus "github.com/pytimer/mux-logrus"
 	log "github.com/sirupsen/logrus"
@@ -137,8 +138,9 @@ func NotificationHandler(w http.ResponseWriter, r *http.Request) {
 	dumpHeaders(r)
 	event, err := cloudevents.NewEventFromHTTPRequest(r)
 	if err != nil {
-		log.Print("failed to parse CloudEvent from request: %v", err)
+		log.WithError(err).Warn("failed to parse CloudEvent from request")
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 	log.WithFields(log.Fields{
 		"time":            event.Time(),
@@ -152,6 +154,25 @@ func NotificationHandler(w http.ResponseWriter, r *http.Request) {
 		"data":            string(event.Data()),
 	}).Info("Received event")
 
+	data, err := events.Decode(*event)
+	if err != nil {
+		log.WithError(err).Warn("failed to decode event data")
+	}
+	switch change := data.(type) {
+	case *events.CreatedV1:
+		log.WithField("id", change.Todo.Id).WithField("title", change.Todo.Title).Info("Todo created")
+	case *events.UpdatedV1:
+		log.WithField("id", change.After.Id).WithField("title", change.After.Title).Info("Todo updated")
+	case *events.DeletedV1:
+		log.WithField("id", change.Todo.Id).Info("Todo deleted")
+	case *events.CreatedV2:
+		log.WithField("id", change.Todo.Id).WithField("title", change.Todo.Title).WithField("list", change.Todo.List).Info("Todo created")
+	case *events.UpdatedV2:
+		log.WithField("id", change.After.Id).WithField("title", change.After.Title).WithField("list", change.After.List).Info("Todo updated")
+	case *events.DeletedV2:
+		log.WithField("id", change.Todo.Id).Info("Todo deleted")
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
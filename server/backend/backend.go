@@ -1,74 +1,190 @@
 package backend
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/dkrizic/todo/server/backend/delta"
+	"github.com/dkrizic/todo/server/backend/feed"
+	"github.com/dkrizic/todo/server/backend/health"
+	"github.com/dkrizic/todo/server/backend/metrics"
+	"github.com/dkrizic/todo/server/backend/outbox"
 	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/webhook"
 	chi "github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
 	"net/http"
+	"time"
 )
 
 type Backend struct {
-	HttpPort       int
-	GrpcPort       int
-	HealthPort     int
-	MetricsPort    int
+	HttpPort    int
+	GrpcPort    int
+	HealthPort  int
+	MetricsPort int
+	// HttpTLS, GrpcTLS and MetricsTLS serve the ports with TLS if set, see tlsconfig
+	HttpTLS        *tls.Config
+	GrpcTLS        *tls.Config
+	MetricsTLS     *tls.Config
 	TracingEnabled bool
 	Implementation repository.TodoRepository
+	Webhooks       *webhook.Dispatcher
+	Relay          *outbox.Relay
+	Feed           feed.Broker
+	Sync           delta.Store
+	Backup         Backuper
+	History        HistoryReader
+	Inventory      *metrics.Inventory
+	// Health are the probes served by HealthServer on the health port, both are
+	// started before the backend
+	Health       *health.Probes
+	HealthServer *HealthServer
+	// ShutdownDelay is the time between reporting not ready and draining the
+	// requests, so that the load balancers stop sending new ones
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds the drain, the flush and the OnShutdown functions together
+	ShutdownTimeout time.Duration
+	// OnShutdown is called in order after the requests drained and the changes were published
+	OnShutdown []func(ctx context.Context) error
 }
 
 var ActiveBackend Backend
 
-func (backend Backend) Start() (err error) {
+// Start serves until the context is done or a server fails and then shuts
+// down gracefully, see shutdown
+func (backend Backend) Start(ctx context.Context) (err error) {
 	log.WithFields(log.Fields{
 		"httpPort":       backend.HttpPort,
+		"grpcPort":       backend.GrpcPort,
 		"healthPort":     backend.HealthPort,
 		"metricsPort":    backend.MetricsPort,
 		"implementation": backend.Implementation.Name(),
 	}).Info("Starting backend")
 	log.WithField("implementation", backend.Implementation.Name()).Info("Backend name")
 
+	// the background work continues while the requests drain
+	workers, stopWorkers := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopWorkers()
+
 	mux := chi.NewRouter()
+	mux.Use(httpMetrics)
 	mux.HandleFunc("/swagger-ui/swagger.json", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "swagger.json")
 	})
 
 	mux.Handle("/api/v1/todos", otelhttp.NewHandler(http.HandlerFunc(TodosHandler), "todos"))
+	if backend.Feed != nil {
+		backend.Feed.Start(workers)
+	}
+	// long lived, so not traced
+	mux.HandleFunc("/api/v1/todos/events", TodoEventsHandler)
+	mux.HandleFunc("/api/v1/todos/events/ws", TodoWebSocketHandler)
 	mux.Handle("/api/v1/todos/{id}", otelhttp.NewHandler(http.HandlerFunc(TodoHandler), "todo"))
-	mux.Handle("/swagger-ui/", http.StripPrefix("/swagger-ui/", http.FileServer(http.Dir("swagger-ui"))))
-	backendServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", backend.HttpPort),
-		Handler: mux,
+	if backend.Sync != nil {
+		mux.Handle("/api/v1/sync", otelhttp.NewHandler(http.HandlerFunc(SyncHandler), "sync"))
+	}
+	if backend.Webhooks != nil {
+		backend.Webhooks.Start(workers)
+		mux.Handle("/api/v1/webhooks", otelhttp.NewHandler(http.HandlerFunc(WebhooksHandler), "webhooks"))
+		mux.Handle("/api/v1/webhooks/{id}", otelhttp.NewHandler(http.HandlerFunc(WebhookHandler), "webhook"))
+		mux.Handle("/api/v1/webhooks/{id}/deliveries", otelhttp.NewHandler(http.HandlerFunc(WebhookDeliveriesHandler), "webhook-deliveries"))
+	}
+	if backend.Relay != nil {
+		backend.Relay.Start(workers)
 	}
-	log.WithField("httpPort", backend.HttpPort).Info("Serving HTTP and gRPC gateway")
-	go func() {
-		log.Fatal(backendServer.ListenAndServe())
-	}()
+	if backend.Inventory != nil {
+		backend.Inventory.Start(workers)
+	}
+	mux.Handle("/swagger-ui/", http.StripPrefix("/swagger-ui/", http.FileServer(http.Dir("swagger-ui"))))
 
 	metricsmux := http.NewServeMux()
 	metricsmux.Handle("/metrics", promhttp.Handler())
-	metricsServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", backend.MetricsPort),
-		Handler: metricsmux,
+	if backend.Backup != nil {
+		metricsmux.HandleFunc("/admin/backup", BackupHandler)
 	}
-	go func() {
-		log.Fatal(metricsServer.ListenAndServe())
-	}()
-	log.WithField("metricsPort", backend.MetricsPort).Info("Serving metrics")
 
-	healthmux := http.NewServeMux()
-	healthmux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+	// listen before reporting the start, so that a port in use fails the startup
+	servers := &servers{
+		http:    &http.Server{Handler: mux, TLSConfig: backend.HttpTLS},
+		metrics: &http.Server{Handler: metricsmux, TLSConfig: backend.MetricsTLS},
+	}
+	httpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", backend.HttpPort))
+	if err != nil {
+		return err
+	}
+	metricsListener, err := net.Listen("tcp", fmt.Sprintf(":%d", backend.MetricsPort))
+	if err != nil {
+		httpListener.Close()
+		return err
+	}
+	var grpcListener net.Listener
+	if backend.GrpcPort > 0 {
+		grpcListener, err = net.Listen("tcp", fmt.Sprintf(":%d", backend.GrpcPort))
+		if err != nil {
+			httpListener.Close()
+			metricsListener.Close()
+			return err
+		}
+		var options []grpc.ServerOption
+		if backend.GrpcTLS != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(backend.GrpcTLS)))
+		}
+		servers.grpc = NewGrpcServer(options...)
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	log.WithField("httpPort", backend.HttpPort).WithField("tls", backend.HttpTLS != nil).Info("Serving HTTP and gRPC gateway")
+	group.Go(func() error {
+		return serveHttp(servers.http, httpListener)
 	})
-	healthServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", backend.HealthPort),
-		Handler: healthmux,
+	if servers.grpc != nil {
+		log.WithField("grpcPort", backend.GrpcPort).WithField("tls", backend.GrpcTLS != nil).Info("Serving gRPC")
+		group.Go(func() error {
+			return servers.grpc.Serve(grpcListener)
+		})
+	}
+	log.WithField("metricsPort", backend.MetricsPort).WithField("tls", backend.MetricsTLS != nil).Info("Serving metrics")
+	group.Go(func() error {
+		return serveHttp(servers.metrics, metricsListener)
+	})
+	if backend.HealthServer != nil {
+		group.Go(func() error {
+			select {
+			case err := <-backend.HealthServer.served:
+				return err
+			case <-groupCtx.Done():
+				return nil
+			}
+		})
+	}
+	if backend.Health != nil {
+		backend.Health.Started()
 	}
-	log.WithField("healthPort", backend.HealthPort).Info("Serving health")
-	log.Fatal(healthServer.ListenAndServe())
+	group.Go(func() error {
+		<-groupCtx.Done()
+		return backend.shutdown(servers, stopWorkers)
+	})
+	return group.Wait()
+}
 
-	return nil
+// serveHttp serves TLS if the server has a TLS configuration and returns nil once it was shut down
+func serveHttp(server *http.Server, listener net.Listener) error {
+	var err error
+	if server.TLSConfig != nil {
+		// the certificate comes from the configuration
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
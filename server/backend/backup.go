@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Backuper writes a consistent copy of all data while the backend keeps serving
+type Backuper interface {
+	Backup(ctx context.Context, w io.Writer) (int64, error)
+}
+
+// BackupHandler streams the backup as a download. It is served on the metrics
+// port only and only if the backend was started with the backup enabled.
+func BackupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("backend").Start(r.Context(), "backup")
+	defer span.End()
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := fmt.Sprintf("todo-%s.db", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	written, err := ActiveBackend.Backup.Backup(ctx, w)
+	if err != nil {
+		// the status is already sent if anything was written
+		log.WithError(err).WithField("bytes", written).Error("Error while writing backup")
+		span.RecordError(err)
+		if written == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"time"
+)
+
+// todosBucket maps the id to the todo as JSON, its sequence is the revision
+// of the last change. The index buckets map <value>\x00<id> to nothing.
+var (
+	todosBucket  = []byte("todos")
+	statusBucket = []byte("status")
+	tagsBucket   = []byte("tags")
+	listsBucket  = []byte("lists")
+)
+
+const separator = 0
+
+type server struct {
+	db *bolt.DB
+}
+
+type Config struct {
+	// Path is the database file, created if it does not exist
+	Path string
+	// Timeout is how long to wait for the file lock of another process
+	Timeout time.Duration
+	// NoSync skips the fsync after every transaction, faster but not durable
+	NoSync bool
+}
+
+func NewServer(config *Config) (*server, error) {
+	log.WithField("path", config.Path).WithField("noSync", config.NoSync).Info("Creating new bolt server")
+	db, err := bolt.Open(config.Path, 0o600, &bolt.Options{
+		Timeout: config.Timeout,
+		NoSync:  config.NoSync,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{todosBucket, statusBucket, tagsBucket, listsBucket, webhooksBucket, deliveriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	myServer := &server{
+		db: db,
+	}
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer, nil
+}
+
+func (s *server) Name() string {
+	return "bolt"
+}
+
+func (s *server) Close() error {
+	return s.db.Close()
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "Create")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Creating new todo")
+	todo, err := s.write(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "Update")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Updating todo")
+	todo, err := s.write(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+// write replaces the todo and its index entries in one transaction
+func (s *server) write(req *repository.CreateOrUpdateRequest) (*repository.Todo, error) {
+	todo := *req.Todo
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		todos := tx.Bucket(todosBucket)
+		before, err := readTodo(todos, todo.Id)
+		if err != nil {
+			return err
+		}
+		if !matchesRevision(before, req.IfRevision) || (req.IfAbsent && before != nil) {
+			return repository.ErrConflict
+		}
+		if before != nil {
+			if err := unindex(tx, before); err != nil {
+				return err
+			}
+		}
+		todo.Revision, err = todos.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(&todo)
+		if err != nil {
+			return err
+		}
+		if err := todos.Put([]byte(todo.Id), data); err != nil {
+			return err
+		}
+		return index(tx, &todo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &todo, nil
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "GetAll")
+	defer span.End()
+	todos := []*repository.Todo{}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		skip := req.Offset
+		return s.scan(tx, req, func(todo *repository.Todo) bool {
+			if !req.Matches(todo) {
+				return true
+			}
+			if skip > 0 {
+				skip--
+				return true
+			}
+			todos = append(todos, todo)
+			return req.Limit <= 0 || len(todos) < req.Limit
+		})
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("todos", len(todos)))
+	log.WithField("count", len(todos)).Info("Getting all todos")
+	return &repository.GetAllResponse{
+		Todos: todos,
+	}, nil
+}
+
+// scan calls visit for the todos in the order of their ids until it returns
+// false. With a filter only the todos of the most selective index are read.
+func (s *server) scan(tx *bolt.Tx, req *repository.GetAllRequest, visit func(todo *repository.Todo) bool) error {
+	todos := tx.Bucket(todosBucket)
+	bucket, value := indexFor(req)
+	if bucket == nil {
+		cursor := todos.Cursor()
+		for key, data := cursor.First(); key != nil; key, data = cursor.Next() {
+			todo := &repository.Todo{}
+			if err := json.Unmarshal(data, todo); err != nil {
+				return err
+			}
+			if !visit(todo) {
+				return nil
+			}
+		}
+		return nil
+	}
+	prefix := indexKey(value, "")
+	cursor := tx.Bucket(bucket).Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		todo, err := readTodo(todos, string(key[len(prefix):]))
+		if err != nil {
+			return err
+		}
+		if todo != nil && !visit(todo) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// indexFor picks the index for the filters, tags are usually the most selective
+func indexFor(req *repository.GetAllRequest) ([]byte, string) {
+	switch {
+	case req.Tag != "":
+		return tagsBucket, req.Tag
+	case req.Status != "":
+		return statusBucket, req.Status
+	case req.List != "":
+		return listsBucket, req.List
+	}
+	return nil, ""
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "Get")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Getting todo")
+	var todo *repository.Todo
+	err = s.db.View(func(tx *bolt.Tx) error {
+		todo, err = readTodo(tx.Bucket(todosBucket), req.Id)
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.GetResponse{
+		Todo: todo,
+	}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "Delete")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Deleting todo")
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		todos := tx.Bucket(todosBucket)
+		before, err := readTodo(todos, req.Id)
+		if err != nil {
+			return err
+		}
+		if !matchesRevision(before, req.IfRevision) {
+			return repository.ErrConflict
+		}
+		if before == nil {
+			return nil
+		}
+		if err := unindex(tx, before); err != nil {
+			return err
+		}
+		if _, err := todos.NextSequence(); err != nil {
+			return err
+		}
+		return todos.Delete([]byte(req.Id))
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.DeleteResponse{
+		Id: req.Id,
+	}, nil
+}
+
+// Backup writes a consistent copy of the database while writers continue
+func (s *server) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "Backup")
+	defer span.End()
+	var written int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		written, err = tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		return written, err
+	}
+	span.SetAttributes(attribute.Int64("bytes", written))
+	log.WithField("bytes", written).Info("Wrote backup")
+	return written, nil
+}
+
+func readTodo(todos *bolt.Bucket, id string) (*repository.Todo, error) {
+	data := todos.Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	todo := &repository.Todo{}
+	if err := json.Unmarshal(data, todo); err != nil {
+		return nil, err
+	}
+	return todo, nil
+}
+
+func matchesRevision(todo *repository.Todo, revision uint64) bool {
+	return revision == 0 || (todo != nil && todo.Revision == revision)
+}
+
+func indexKey(value string, id string) []byte {
+	key := make([]byte, 0, len(value)+1+len(id))
+	key = append(key, value...)
+	key = append(key, separator)
+	return append(key, id...)
+}
+
+// entries returns the index entries of the todo by bucket, empty values are not indexed
+func entries(todo *repository.Todo) map[string][][]byte {
+	entries := map[string][][]byte{}
+	if todo.Status != "" {
+		entries[string(statusBucket)] = append(entries[string(statusBucket)], indexKey(todo.Status, todo.Id))
+	}
+	if todo.List != "" {
+		entries[string(listsBucket)] = append(entries[string(listsBucket)], indexKey(todo.List, todo.Id))
+	}
+	for _, tag := range todo.Tags {
+		entries[string(tagsBucket)] = append(entries[string(tagsBucket)], indexKey(tag, todo.Id))
+	}
+	return entries
+}
+
+func index(tx *bolt.Tx, todo *repository.Todo) error {
+	for bucket, keys := range entries(todo) {
+		for _, key := range keys {
+			if err := tx.Bucket([]byte(bucket)).Put(key, []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func unindex(tx *bolt.Tx, todo *repository.Todo) error {
+	for bucket, keys := range entries(todo) {
+		for _, key := range keys {
+			if err := tx.Bucket([]byte(bucket)).Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"github.com/dkrizic/todo/server/backend/webhook/webhooktest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBolt(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewServer(&Config{Path: filepath.Join(dir, "todo.bolt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, todo := range []*repository.Todo{
+		{Id: "1", Status: "ACTIVE", Tags: []string{"a", "b"}},
+		{Id: "2", Status: repository.StatusCompleted, Tags: []string{"a"}},
+		{Id: "3", Status: "ACTIVE"},
+	} {
+		if _, err := s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: todo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tagged, _ := s.GetAll(ctx, &repository.GetAllRequest{Tag: "a", Status: "ACTIVE"})
+	if len(tagged.Todos) != 1 || tagged.Todos[0].Id != "1" {
+		t.Errorf("Expected todo 1, got %+v", tagged.Todos)
+	}
+	page, _ := s.GetAll(ctx, &repository.GetAllRequest{Status: "ACTIVE", Offset: 1, Limit: 5})
+	if len(page.Todos) != 1 || page.Todos[0].Id != "3" {
+		t.Errorf("Expected todo 3, got %+v", page.Todos)
+	}
+
+	// the old index entries are removed on update
+	updated, err := s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Status: repository.StatusCompleted}, IfRevision: 1})
+	if err != nil || updated.Todo.Revision != 4 {
+		t.Fatalf("Expected revision 4, got %+v %v", updated, err)
+	}
+	if tagged, _ := s.GetAll(ctx, &repository.GetAllRequest{Tag: "b"}); len(tagged.Todos) != 0 {
+		t.Errorf("Expected no todo with tag b, got %+v", tagged.Todos)
+	}
+	if _, err := s.Delete(ctx, &repository.DeleteRequest{Id: "2", IfRevision: 1}); err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	s.Delete(ctx, &repository.DeleteRequest{Id: "2"})
+	if completed, _ := s.GetAll(ctx, &repository.GetAllRequest{Status: repository.StatusCompleted}); len(completed.Todos) != 1 {
+		t.Errorf("Expected one completed todo, got %+v", completed.Todos)
+	}
+
+	backup := &bytes.Buffer{}
+	if _, err := s.Backup(ctx, backup); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "backup.bolt")
+	os.WriteFile(path, backup.Bytes(), 0o600)
+	restored, err := NewServer(&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	all, _ := restored.GetAll(ctx, &repository.GetAllRequest{})
+	if len(all.Todos) != 2 || all.Todos[0].Id != "1" {
+		t.Errorf("Expected the backup to hold todos 1 and 3, got %+v", all.Todos)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		s, err := NewServer(&Config{Path: filepath.Join(t.TempDir(), "todo.bolt"), NoSync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestWebhookStore(t *testing.T) {
+	webhooktest.Run(t, func(t *testing.T) webhook.Store {
+		s, err := NewServer(&Config{Path: filepath.Join(t.TempDir(), "todo.bolt")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s.WebhookStore()
+	})
+}
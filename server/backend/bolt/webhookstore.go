@@ -0,0 +1,173 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"sort"
+)
+
+// webhooksBucket maps the id to the subscription as JSON, deliveriesBucket
+// has a bucket per subscription that maps a sequence to the delivery
+var (
+	webhooksBucket   = []byte("webhooks")
+	deliveriesBucket = []byte("webhook_deliveries")
+)
+
+type webhookStore struct {
+	db *bolt.DB
+}
+
+// WebhookStore returns a store that keeps the webhook subscriptions in the same file
+func (s *server) WebhookStore() webhook.Store {
+	return &webhookStore{db: s.db}
+}
+
+func (ws *webhookStore) CreateSubscription(ctx context.Context, subscription *webhook.Subscription) error {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "CreateSubscription")
+	defer span.End()
+	return ws.db.Update(func(tx *bolt.Tx) error {
+		return putSubscription(tx, subscription)
+	})
+}
+
+func (ws *webhookStore) UpdateSubscription(ctx context.Context, subscription *webhook.Subscription) error {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "UpdateSubscription")
+	defer span.End()
+	return ws.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(webhooksBucket).Get([]byte(subscription.Id)) == nil {
+			return webhook.ErrNotFound
+		}
+		return putSubscription(tx, subscription)
+	})
+}
+
+func (ws *webhookStore) GetSubscription(ctx context.Context, id string) (*webhook.Subscription, error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "GetSubscription")
+	defer span.End()
+	subscription := &webhook.Subscription{}
+	err := ws.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(webhooksBucket).Get([]byte(id))
+		if data == nil {
+			return webhook.ErrNotFound
+		}
+		return json.Unmarshal(data, subscription)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func (ws *webhookStore) ListSubscriptions(ctx context.Context) ([]*webhook.Subscription, error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "ListSubscriptions")
+	defer span.End()
+	subscriptions := []*webhook.Subscription{}
+	err := ws.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(key []byte, data []byte) error {
+			subscription := &webhook.Subscription{}
+			if err := json.Unmarshal(data, subscription); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+	return subscriptions, nil
+}
+
+func (ws *webhookStore) DeleteSubscription(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "DeleteSubscription")
+	defer span.End()
+	return ws.db.Update(func(tx *bolt.Tx) error {
+		subscriptions := tx.Bucket(webhooksBucket)
+		if subscriptions.Get([]byte(id)) == nil {
+			return webhook.ErrNotFound
+		}
+		if err := subscriptions.Delete([]byte(id)); err != nil {
+			return err
+		}
+		deliveries := tx.Bucket(deliveriesBucket)
+		if deliveries.Bucket([]byte(id)) == nil {
+			return nil
+		}
+		return deliveries.DeleteBucket([]byte(id))
+	})
+}
+
+// AddDelivery keeps the last webhook.MaxDeliveries deliveries of the subscription
+func (ws *webhookStore) AddDelivery(ctx context.Context, delivery *webhook.Delivery) error {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "AddDelivery")
+	defer span.End()
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return ws.db.Update(func(tx *bolt.Tx) error {
+		deliveries, err := tx.Bucket(deliveriesBucket).CreateBucketIfNotExists([]byte(delivery.SubscriptionId))
+		if err != nil {
+			return err
+		}
+		sequence, err := deliveries.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := deliveries.Put(binary.BigEndian.AppendUint64(nil, sequence), data); err != nil {
+			return err
+		}
+		// the oldest ones come first
+		keys := [][]byte{}
+		deliveries.ForEach(func(key []byte, data []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		for len(keys) > webhook.MaxDeliveries {
+			if err := deliveries.Delete(keys[0]); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		return nil
+	})
+}
+
+func (ws *webhookStore) ListDeliveries(ctx context.Context, subscriptionId string) ([]*webhook.Delivery, error) {
+	ctx, span := otel.Tracer("bolt").Start(ctx, "ListDeliveries")
+	defer span.End()
+	deliveries := []*webhook.Delivery{}
+	err := ws.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket).Bucket([]byte(subscriptionId))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, data []byte) error {
+			delivery := &webhook.Delivery{}
+			if err := json.Unmarshal(data, delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func putSubscription(tx *bolt.Tx, subscription *webhook.Subscription) error {
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(webhooksBucket).Put([]byte(subscription.Id), data)
+}
@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"sync"
+	"time"
+)
+
+const (
+	kindGet  = "get"
+	kindList = "list"
+)
+
+var (
+	hitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_cache_hits_total",
+		Help: "Reads answered from the cache",
+	}, []string{"kind"})
+	missesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_cache_misses_total",
+		Help: "Reads passed on to the backend",
+	}, []string{"kind"})
+	evictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_cache_evictions_total",
+		Help: "Entries removed because the cache was full",
+	})
+	invalidationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_cache_invalidations_total",
+		Help: "Invalidations by a write of this instance (local) or of another one (remote)",
+	}, []string{"source"})
+	entriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_cache_entries",
+		Help: "The number of entries in the cache",
+	})
+)
+
+// server caches Get and GetAll of the original in a bounded LRU. Every write
+// drops the todo and all cached lists, here and through the invalidator in
+// the other instances.
+type server struct {
+	original    repository.TodoRepository
+	invalidator Invalidator
+	// unsubscribe ends the subscription of the invalidator
+	unsubscribe context.CancelFunc
+	ttl         time.Duration
+	maxEntries  int
+	lock        sync.Mutex
+	entries     map[string]*list.Element
+	// recent has the most recently used entry at the front
+	recent *list.List
+	// generation changes with every invalidation, a read that started in an
+	// older generation does not store its result and lists of an older one are stale
+	generation uint64
+}
+
+type entry struct {
+	key        string
+	todo       *repository.Todo
+	todos      []*repository.Todo
+	list       bool
+	generation uint64
+	expires    time.Time
+}
+
+type Config struct {
+	Original repository.TodoRepository
+	// MaxEntries bounds the number of cached todos and lists
+	MaxEntries int
+	// TTL bounds how long an entry is used, also for changes no invalidation was received for
+	TTL time.Duration
+	// Invalidator shares the invalidations with other instances if set
+	Invalidator Invalidator
+}
+
+func NewServer(config *Config) *server {
+	log.WithField("maxEntries", config.MaxEntries).WithField("ttl", config.TTL).Info("Creating new cache server")
+	myServer := &server{
+		original:    config.Original,
+		invalidator: config.Invalidator,
+		ttl:         config.TTL,
+		maxEntries:  max(config.MaxEntries, 1),
+		entries:     map[string]*list.Element{},
+		recent:      list.New(),
+		unsubscribe: func() {},
+	}
+	if myServer.invalidator != nil {
+		var ctx context.Context
+		ctx, myServer.unsubscribe = context.WithCancel(context.Background())
+		go myServer.invalidator.Subscribe(ctx, func(id string) {
+			invalidationsTotal.WithLabelValues("remote").Inc()
+			myServer.drop(id)
+		})
+	}
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer
+}
+
+func (s *server) Name() string {
+	return fmt.Sprintf("Cache(%s)", s.original.Name())
+}
+
+// Close ends the subscription to the other instances, the original is not closed
+func (s *server) Close() error {
+	s.unsubscribe()
+	return nil
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("cache").Start(ctx, "Create")
+	defer span.End()
+	defer s.invalidate(ctx, req.Todo.Id)
+	return s.original.Create(ctx, req)
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("cache").Start(ctx, "Update")
+	defer span.End()
+	defer s.invalidate(ctx, req.Todo.Id)
+	return s.original.Update(ctx, req)
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("cache").Start(ctx, "Delete")
+	defer span.End()
+	defer s.invalidate(ctx, req.Id)
+	return s.original.Delete(ctx, req)
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("cache").Start(ctx, "Get")
+	defer span.End()
+	key := kindGet + "\x00" + req.Id
+	if cached, ok := s.lookup(key); ok {
+		hitsTotal.WithLabelValues(kindGet).Inc()
+		span.SetAttributes(attribute.Bool("hit", true))
+		return &repository.GetResponse{Todo: copyTodo(cached.todo)}, nil
+	}
+	missesTotal.WithLabelValues(kindGet).Inc()
+	generation := s.currentGeneration()
+	resp, err = s.original.Get(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	// a missing todo is cached as well, every create checks for one
+	s.store(&entry{key: key, todo: copyTodo(resp.Todo), generation: generation})
+	return resp, nil
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("cache").Start(ctx, "GetAll")
+	defer span.End()
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%d\x00%d", kindList, req.List, req.Status, req.Tag, req.Limit, req.Offset)
+	if cached, ok := s.lookup(key); ok {
+		hitsTotal.WithLabelValues(kindList).Inc()
+		span.SetAttributes(attribute.Bool("hit", true))
+		return &repository.GetAllResponse{Todos: copyTodos(cached.todos)}, nil
+	}
+	missesTotal.WithLabelValues(kindList).Inc()
+	generation := s.currentGeneration()
+	resp, err = s.original.GetAll(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s.store(&entry{key: key, todos: copyTodos(resp.Todos), list: true, generation: generation})
+	return resp, nil
+}
+
+// invalidate drops the todo here and in the other instances
+func (s *server) invalidate(ctx context.Context, id string) {
+	invalidationsTotal.WithLabelValues("local").Inc()
+	s.drop(id)
+	if s.invalidator == nil {
+		return
+	}
+	if err := s.invalidator.Publish(ctx, id); err != nil {
+		log.WithError(err).WithField("id", id).Warn("Failed to publish cache invalidation")
+	}
+}
+
+// drop removes the todo and makes all lists stale, an empty id drops everything
+func (s *server) drop(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.generation++
+	if id == "" {
+		s.entries = map[string]*list.Element{}
+		s.recent.Init()
+	} else if element, ok := s.entries[kindGet+"\x00"+id]; ok {
+		s.remove(element)
+	}
+	entriesGauge.Set(float64(len(s.entries)))
+}
+
+func (s *server) currentGeneration() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.generation
+}
+
+func (s *server) lookup(key string) (*entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	cached := element.Value.(*entry)
+	stale := cached.list && cached.generation != s.generation
+	if stale || time.Now().After(cached.expires) {
+		s.remove(element)
+		entriesGauge.Set(float64(len(s.entries)))
+		return nil, false
+	}
+	s.recent.MoveToFront(element)
+	return cached, true
+}
+
+// store adds the entry unless there was an invalidation since the read started
+func (s *server) store(cached *entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cached.generation != s.generation {
+		return
+	}
+	cached.expires = time.Now().Add(s.ttl)
+	if element, ok := s.entries[cached.key]; ok {
+		s.remove(element)
+	}
+	s.entries[cached.key] = s.recent.PushFront(cached)
+	for len(s.entries) > s.maxEntries {
+		s.remove(s.recent.Back())
+		evictionsTotal.Inc()
+	}
+	entriesGauge.Set(float64(len(s.entries)))
+}
+
+func (s *server) remove(element *list.Element) {
+	s.recent.Remove(element)
+	delete(s.entries, element.Value.(*entry).key)
+}
+
+func copyTodo(todo *repository.Todo) *repository.Todo {
+	if todo == nil {
+		return nil
+	}
+	copied := *todo
+	if todo.Tags != nil {
+		copied.Tags = append([]string{}, todo.Tags...)
+	}
+	return &copied
+}
+
+func copyTodos(todos []*repository.Todo) []*repository.Todo {
+	copied := make([]*repository.Todo, len(todos))
+	for i, todo := range todos {
+		copied[i] = copyTodo(todo)
+	}
+	return copied
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/memory"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// counting counts the reads that reach the original
+type counting struct {
+	repository.TodoRepository
+	reads atomic.Int64
+}
+
+func (c *counting) Get(ctx context.Context, req *repository.GetRequest) (*repository.GetResponse, error) {
+	c.reads.Add(1)
+	return c.TodoRepository.Get(ctx, req)
+}
+
+func (c *counting) GetAll(ctx context.Context, req *repository.GetAllRequest) (*repository.GetAllResponse, error) {
+	c.reads.Add(1)
+	return c.TodoRepository.GetAll(ctx, req)
+}
+
+func newOriginal(t *testing.T) *counting {
+	t.Helper()
+	original, err := memory.NewServer(&memory.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &counting{TodoRepository: original}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	original := newOriginal(t)
+	s := NewServer(&Config{Original: original, MaxEntries: 2, TTL: time.Minute})
+
+	// a missing todo is cached and dropped by the create
+	s.Get(ctx, &repository.GetRequest{Id: "1"})
+	s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "First"}})
+	got, _ := s.Get(ctx, &repository.GetRequest{Id: "1"})
+	if got.Todo == nil || got.Todo.Title != "First" {
+		t.Fatalf("Expected the created todo, got %+v", got.Todo)
+	}
+	got.Todo.Title = "Changed by the caller"
+	s.Get(ctx, &repository.GetRequest{Id: "1"})
+	all, _ := s.GetAll(ctx, &repository.GetAllRequest{})
+	s.GetAll(ctx, &repository.GetAllRequest{})
+	if reads := original.reads.Load(); reads != 3 {
+		t.Errorf("Expected 3 reads of the original, got %d", reads)
+	}
+	if len(all.Todos) != 1 || all.Todos[0].Title != "First" {
+		t.Errorf("Unexpected todos %+v", all.Todos)
+	}
+
+	// any write makes the lists stale
+	s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "2"}})
+	all, _ = s.GetAll(ctx, &repository.GetAllRequest{})
+	if len(all.Todos) != 2 {
+		t.Errorf("Expected 2 todos after the write, got %d", len(all.Todos))
+	}
+
+	// the least recently used entry is evicted
+	original.reads.Store(0)
+	s.Get(ctx, &repository.GetRequest{Id: "1"})
+	s.Get(ctx, &repository.GetRequest{Id: "2"})
+	s.GetAll(ctx, &repository.GetAllRequest{})
+	if reads := original.reads.Load(); reads != 2 {
+		t.Errorf("Expected 2 reads of the original, got %d", reads)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	original := newOriginal(t)
+	s := NewServer(&Config{Original: original, MaxEntries: 10, TTL: 10 * time.Millisecond})
+	s.Get(ctx, &repository.GetRequest{Id: "1"})
+	s.Get(ctx, &repository.GetRequest{Id: "1"})
+	time.Sleep(20 * time.Millisecond)
+	s.Get(ctx, &repository.GetRequest{Id: "1"})
+	if reads := original.reads.Load(); reads != 2 {
+		t.Errorf("Expected 2 reads of the original, got %d", reads)
+	}
+}
+
+func TestCacheInvalidator(t *testing.T) {
+	ctx := context.Background()
+	original := newOriginal(t)
+	invalidator := NewLocalInvalidator()
+	first := NewServer(&Config{Original: original, MaxEntries: 10, TTL: time.Minute, Invalidator: invalidator})
+	second := NewServer(&Config{Original: original, MaxEntries: 10, TTL: time.Minute, Invalidator: invalidator})
+	// wait for the subscriptions
+	time.Sleep(10 * time.Millisecond)
+
+	first.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "First"}})
+	second.Get(ctx, &repository.GetRequest{Id: "1"})
+	first.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Second"}})
+	got, _ := second.Get(ctx, &repository.GetRequest{Id: "1"})
+	if got.Todo == nil || got.Todo.Title != "Second" {
+		t.Errorf("Expected the update of the other instance, got %+v", got.Todo)
+	}
+
+	// closed caches end their subscriptions
+	first.Close()
+	second.Close()
+	local := invalidator.(*localInvalidator)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		local.lock.RLock()
+		subscribers := len(local.subscribers)
+		local.lock.RUnlock()
+		if subscribers == 0 {
+			return
+		}
+	}
+	t.Errorf("Expected no subscriptions after Close")
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		return NewServer(&Config{Original: newOriginal(t), MaxEntries: 100, TTL: time.Minute})
+	})
+}
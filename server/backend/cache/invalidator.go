@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// Invalidator shares the ids of changed todos between the caches of all instances
+type Invalidator interface {
+	// Publish tells every subscriber that the todo changed
+	Publish(ctx context.Context, id string) error
+	// Subscribe calls drop for every published id until the context is done,
+	// an empty id means that invalidations may have been missed
+	Subscribe(ctx context.Context, drop func(id string))
+}
+
+// localInvalidator delivers the invalidations within the process, for
+// changes that do not go through the cache like edits of a watched directory
+type localInvalidator struct {
+	lock        sync.RWMutex
+	subscribers map[int]func(id string)
+	next        int
+}
+
+func NewLocalInvalidator() Invalidator {
+	return &localInvalidator{subscribers: map[int]func(id string){}}
+}
+
+func (l *localInvalidator) Publish(ctx context.Context, id string) error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for _, drop := range l.subscribers {
+		drop(id)
+	}
+	return nil
+}
+
+func (l *localInvalidator) Subscribe(ctx context.Context, drop func(id string)) {
+	l.lock.Lock()
+	key := l.next
+	l.next++
+	l.subscribers[key] = drop
+	l.lock.Unlock()
+	<-ctx.Done()
+	l.lock.Lock()
+	delete(l.subscribers, key)
+	l.lock.Unlock()
+}
@@ -0,0 +1,235 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/hashicorp/raft"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The API lets followers forward to the leader. Every endpoint answers 503
+// on a node that is not the leader, the caller looks up the leader again.
+const (
+	applyPath     = "/cluster/apply"
+	readIndexPath = "/cluster/read-index"
+	joinPath      = "/cluster/join"
+)
+
+var (
+	errNoLeader = errors.New("no cluster leader")
+	// errIsLeader is returned by forward if this node became the leader
+	errIsLeader = errors.New("this node is the cluster leader")
+)
+
+type readIndexResponse struct {
+	Index uint64
+}
+
+type joinRequest struct {
+	ID      string
+	Address string
+}
+
+func (s *server) serveAPI() error {
+	listener, err := net.Listen("tcp", s.apiAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+applyPath, s.handleApply)
+	mux.HandleFunc("POST "+readIndexPath, s.handleReadIndex)
+	mux.HandleFunc("POST "+joinPath, s.handleJoin)
+	s.api = &http.Server{Handler: mux, TLSConfig: s.tls}
+	go func() {
+		var err error
+		if s.tls != nil {
+			err = s.api.ServeTLS(listener, "", "")
+		} else {
+			err = s.api.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Cluster API failed")
+		}
+	}()
+	return nil
+}
+
+func (s *server) handleApply(w http.ResponseWriter, r *http.Request) {
+	cmd := &command{}
+	if err := json.NewDecoder(r.Body).Decode(cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cmd.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.raft.State() != raft.Leader {
+		http.Error(w, raft.ErrNotLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	res, err := s.applyLocal(cmd)
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	json.NewEncoder(w).Encode(res.Todo)
+}
+
+func (s *server) handleReadIndex(w http.ResponseWriter, r *http.Request) {
+	if s.raft.State() != raft.Leader {
+		http.Error(w, raft.ErrNotLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	index, err := s.readIndex()
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	json.NewEncoder(w).Encode(&readIndexResponse{Index: index})
+}
+
+// handleJoin adds the node as voter, a follower passes the request on to the leader
+func (s *server) handleJoin(w http.ResponseWriter, r *http.Request) {
+	req := &joinRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if s.raft.State() == raft.Leader {
+		log.WithField("node", req.ID).WithField("address", req.Address).Info("Adding node to the cluster")
+		err = s.raft.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.Address), 0, s.timeout).Error()
+	} else {
+		err = s.forward(r.Context(), joinPath, req, nil)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) forwardApply(ctx context.Context, cmd *command) (*result, error) {
+	todo := &repository.Todo{}
+	err := s.forward(ctx, applyPath, cmd, todo)
+	if err != nil {
+		return nil, err
+	}
+	return &result{Todo: todo}, nil
+}
+
+func (s *server) forwardReadIndex(ctx context.Context) (uint64, error) {
+	resp := &readIndexResponse{}
+	if err := s.forward(ctx, readIndexPath, struct{}{}, resp); err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
+
+// join asks a member to add this node, the member may still be starting
+func (s *server) join(address string, bindAddr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	req := &joinRequest{ID: s.id, Address: bindAddr}
+	for {
+		retry, err := s.post(ctx, address, joinPath, req, nil)
+		if !retry {
+			return err
+		}
+		log.WithError(err).WithField("address", address).Debug("Retrying to join the cluster")
+		if err := pause(ctx); err != nil {
+			return fmt.Errorf("failed to join the cluster at %s: %w", address, err)
+		}
+	}
+}
+
+// forward sends the request to the leader. It waits for a leader until the
+// timeout, but does not repeat a request that may already have been applied.
+func (s *server) forward(ctx context.Context, path string, body any, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	for {
+		_, leader := s.raft.LeaderWithID()
+		if string(leader) == s.id {
+			return errIsLeader
+		}
+		if address := s.state.member(string(leader)); leader != "" && address != "" {
+			retry, err := s.post(ctx, address, path, body, out)
+			if !retry {
+				return err
+			}
+		}
+		if err := pause(ctx); err != nil {
+			return errNoLeader
+		}
+	}
+}
+
+// post returns retry if the node refused the request because it is not the leader
+func (s *server) post(ctx context.Context, address string, path string, body any, out any) (bool, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	scheme := "http://"
+	if s.tls != nil {
+		scheme = "https://"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+address+path, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return path == joinPath, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out == nil {
+			return false, nil
+		}
+		return false, json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNoContent:
+		return false, nil
+	case http.StatusServiceUnavailable:
+		return true, errNoLeader
+	case http.StatusConflict:
+		return false, repository.ErrConflict
+	case http.StatusInsufficientStorage:
+		return false, repository.ErrCapacityExceeded
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return false, fmt.Errorf("%s%s failed with %s: %s", address, path, resp.Status, bytes.TrimSpace(message))
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, repository.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, repository.ErrCapacityExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, errNoLeader), errors.Is(err, errIsLeader):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func pause(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
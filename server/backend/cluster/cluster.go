@@ -0,0 +1,437 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server replicates the todos to all nodes with Raft. Reads are served from
+// the local state, writes are applied by the leader, followers forward them.
+type server struct {
+	id                string
+	apiAddr           string
+	tls               *tls.Config
+	raft              *raft.Raft
+	state             *state
+	timeout           time.Duration
+	linearizableReads bool
+	api               *http.Server
+	client            *http.Client
+	closers           []io.Closer
+	// leadership receives true when this node becomes leader
+	leadership chan bool
+	done       chan struct{}
+	closed     sync.Once
+}
+
+type Config struct {
+	// ID is the unique and stable name of this node
+	ID string
+	// BindAddr is the host:port of the Raft transport, it must be reachable by the other nodes
+	BindAddr string
+	// APIAddr is the host:port other nodes forward writes to, it must be reachable by the other nodes
+	APIAddr string
+	// Peers bootstraps a new cluster, each is id=raft-host:port. All nodes of
+	// the initial cluster get the same list, it is ignored once there is state.
+	Peers []string
+	// Join is the API address of a member, a new node asks it to be added
+	Join string
+	// DataDir keeps the Raft log and the snapshots, if empty they are in memory
+	// and a restarted node gets everything from the others
+	DataDir string
+	// LinearizableReads confirms with the leader that the local state is up to date before a read
+	LinearizableReads bool
+	// MaxEntries rejects new todos once reached, 0 is unlimited
+	MaxEntries int
+	// Timeout limits forwarding, applying and waiting for a leader
+	Timeout time.Duration
+	// TLS and ClientTLS secure the Raft transport and the API with mutual TLS,
+	// TLS must require client certificates. Without them both are plaintext
+	// and unauthenticated, anyone who reaches them can change the todos.
+	TLS       *tls.Config
+	ClientTLS *tls.Config
+	// Raft overrides the default Raft settings, used by the tests
+	Raft *raft.Config
+}
+
+func NewServer(config *Config) (*server, error) {
+	log.WithFields(log.Fields{
+		"id":       config.ID,
+		"bindAddr": config.BindAddr,
+		"apiAddr":  config.APIAddr,
+		"peers":    config.Peers,
+		"join":     config.Join,
+		"dataDir":  config.DataDir,
+	}).Info("Creating new cluster server")
+	if config.ID == "" || config.BindAddr == "" || config.APIAddr == "" {
+		return nil, errors.New("cluster id, bind address and API address are required")
+	}
+	if (config.TLS == nil) != (config.ClientTLS == nil) {
+		return nil, errors.New("cluster TLS needs both the server and the client configuration")
+	}
+	if config.TLS == nil {
+		log.Warn("The cluster transport and API are not authenticated, do not expose their addresses")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	myServer := &server{
+		id:                config.ID,
+		apiAddr:           config.APIAddr,
+		state:             newState(config.MaxEntries),
+		timeout:           timeout,
+		linearizableReads: config.LinearizableReads,
+		tls:               config.TLS,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: config.ClientTLS},
+		},
+		leadership: make(chan bool, 1),
+		done:       make(chan struct{}),
+	}
+	raftConfig := raft.DefaultConfig()
+	if config.Raft != nil {
+		copied := *config.Raft
+		raftConfig = &copied
+	}
+	raftConfig.LocalID = raft.ServerID(config.ID)
+	raftConfig.Logger = newLogger()
+	raftConfig.NotifyCh = myServer.leadership
+
+	var logs raft.LogStore
+	var stable raft.StableStore
+	var snapshots raft.SnapshotStore
+	if config.DataDir != "" {
+		if err := os.MkdirAll(config.DataDir, 0o755); err != nil {
+			return nil, err
+		}
+		store, err := raftboltdb.NewBoltStore(filepath.Join(config.DataDir, "raft.db"))
+		if err != nil {
+			return nil, err
+		}
+		myServer.closers = append(myServer.closers, store)
+		logs, stable = store, store
+		snapshots, err = raft.NewFileSnapshotStoreWithLogger(config.DataDir, 2, raftConfig.Logger)
+		if err != nil {
+			myServer.closeAll()
+			return nil, err
+		}
+	} else {
+		store := raft.NewInmemStore()
+		logs, stable = store, store
+		snapshots = raft.NewInmemSnapshotStore()
+	}
+
+	advertise, err := net.ResolveTCPAddr("tcp", config.BindAddr)
+	if err != nil {
+		myServer.closeAll()
+		return nil, err
+	}
+	var transport *raft.NetworkTransport
+	if config.TLS != nil {
+		var stream *tlsStreamLayer
+		stream, err = newTLSStreamLayer(config.BindAddr, advertise, config.TLS, config.ClientTLS)
+		if err == nil {
+			transport = raft.NewNetworkTransportWithLogger(stream, 3, timeout, raftConfig.Logger)
+		}
+	} else {
+		transport, err = raft.NewTCPTransportWithLogger(config.BindAddr, advertise, 3, timeout, raftConfig.Logger)
+	}
+	if err != nil {
+		myServer.closeAll()
+		return nil, err
+	}
+	myServer.closers = append(myServer.closers, transport)
+
+	if len(config.Peers) > 0 {
+		configuration, err := bootstrapConfiguration(config.ID, config.BindAddr, config.Peers)
+		if err != nil {
+			myServer.closeAll()
+			return nil, err
+		}
+		err = raft.BootstrapCluster(raftConfig, logs, stable, snapshots, transport, configuration)
+		if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			myServer.closeAll()
+			return nil, err
+		}
+	}
+
+	myServer.raft, err = raft.NewRaft(raftConfig, myServer.state, logs, stable, snapshots, transport)
+	if err != nil {
+		myServer.closeAll()
+		return nil, err
+	}
+	if err := myServer.serveAPI(); err != nil {
+		myServer.Close()
+		return nil, err
+	}
+	go myServer.registerOnLeadership()
+	if config.Join != "" {
+		if err := myServer.join(config.Join, config.BindAddr); err != nil {
+			myServer.Close()
+			return nil, err
+		}
+	}
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer, nil
+}
+
+// bootstrapConfiguration parses the peers, the node itself is added if missing
+func bootstrapConfiguration(id string, bindAddr string, peers []string) (raft.Configuration, error) {
+	configuration := raft.Configuration{}
+	self := false
+	for _, peer := range peers {
+		peerID, address, ok := strings.Cut(peer, "=")
+		if !ok || peerID == "" || address == "" {
+			return configuration, fmt.Errorf("invalid peer %q, expected id=host:port", peer)
+		}
+		self = self || peerID == id
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			ID:      raft.ServerID(peerID),
+			Address: raft.ServerAddress(address),
+		})
+	}
+	if !self {
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			ID:      raft.ServerID(id),
+			Address: raft.ServerAddress(bindAddr),
+		})
+	}
+	return configuration, nil
+}
+
+// newLogger passes the Raft logs to the standard output, debug logs only if
+// the server logs at debug level
+func newLogger() hclog.Logger {
+	level := hclog.Warn
+	if log.IsLevelEnabled(log.DebugLevel) {
+		level = hclog.Debug
+	}
+	return hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  level,
+		Output: log.StandardLogger().Out,
+	})
+}
+
+// registerOnLeadership publishes the API address whenever this node becomes leader
+func (s *server) registerOnLeadership() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case leader := <-s.leadership:
+			if !leader {
+				continue
+			}
+			log.WithField("id", s.id).Info("Became cluster leader")
+			data, _ := json.Marshal(&command{Op: opRegister, Node: s.id, Address: s.apiAddr})
+			if err := s.raft.Apply(data, s.timeout).Error(); err != nil {
+				log.WithError(err).Warn("Failed to register as leader")
+			}
+		}
+	}
+}
+
+func (s *server) Name() string {
+	return "cluster"
+}
+
+// Close leaves the cluster running on the other nodes, it can be called more than once
+func (s *server) Close() (err error) {
+	s.closed.Do(func() {
+		if s.api != nil {
+			s.api.Close()
+		}
+		err = s.raft.Shutdown().Error()
+		close(s.done)
+		s.closeAll()
+	})
+	return err
+}
+
+func (s *server) closeAll() {
+	for _, closer := range s.closers {
+		closer.Close()
+	}
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("cluster").Start(ctx, "Create")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Creating new todo")
+	res, err := s.apply(ctx, &command{Op: opCreate, Todo: req.Todo, IfRevision: req.IfRevision, IfAbsent: req.IfAbsent})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: res.Todo,
+	}, nil
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("cluster").Start(ctx, "Update")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Updating todo")
+	res, err := s.apply(ctx, &command{Op: opUpdate, Todo: req.Todo, IfRevision: req.IfRevision, IfAbsent: req.IfAbsent})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: res.Todo,
+	}, nil
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("cluster").Start(ctx, "GetAll")
+	defer span.End()
+	if err := s.read(ctx); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	s.state.lock.RLock()
+	todos := make([]*repository.Todo, 0, len(s.state.Todos))
+	for _, todo := range s.state.Todos {
+		todos = append(todos, copyTodo(todo))
+	}
+	s.state.lock.RUnlock()
+	todos = repository.Select(todos, req)
+	span.SetAttributes(attribute.Int("todos", len(todos)))
+	log.WithField("count", len(todos)).Info("Getting all todos")
+	return &repository.GetAllResponse{
+		Todos: todos,
+	}, nil
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("cluster").Start(ctx, "Get")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Getting todo")
+	if err := s.read(ctx); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	todo, ok := s.state.Todos[req.Id]
+	if !ok {
+		return &repository.GetResponse{}, nil
+	}
+	return &repository.GetResponse{
+		Todo: copyTodo(todo),
+	}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("cluster").Start(ctx, "Delete")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Deleting todo")
+	_, err = s.apply(ctx, &command{Op: opDelete, Id: req.Id, IfRevision: req.IfRevision})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.DeleteResponse{
+		Id: req.Id,
+	}, nil
+}
+
+// apply commits the command on the leader, directly or by forwarding it
+func (s *server) apply(ctx context.Context, cmd *command) (*result, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	for {
+		if s.raft.State() == raft.Leader {
+			res, err := s.applyLocal(cmd)
+			// not appended to the log, safe to send to the new leader
+			if !errors.Is(err, raft.ErrNotLeader) {
+				return res, err
+			}
+		}
+		res, err := s.forwardApply(ctx, cmd)
+		if !errors.Is(err, errIsLeader) {
+			return res, err
+		}
+		// while the leadership changes the state and the leader can disagree
+		if err := pause(ctx); err != nil {
+			return nil, errNoLeader
+		}
+	}
+}
+
+func (s *server) applyLocal(cmd *command) (*result, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	future := s.raft.Apply(data, s.timeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	res := future.Response().(*result)
+	return res, res.Err
+}
+
+// read waits until the local state includes every write acknowledged before
+// the read started, if linearizable reads are enabled
+func (s *server) read(ctx context.Context) error {
+	if !s.linearizableReads {
+		return nil
+	}
+	var index uint64
+	var err error
+	if s.raft.State() == raft.Leader {
+		index, err = s.readIndex()
+	} else {
+		index, err = s.forwardReadIndex(ctx)
+		if errors.Is(err, errIsLeader) {
+			index, err = s.readIndex()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.timeout)
+	for s.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("local state did not reach index %d", index)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// readIndex confirms the leadership with a barrier and returns the index
+// that is applied once it returns
+func (s *server) readIndex() (uint64, error) {
+	if err := s.raft.Barrier(s.timeout).Error(); err != nil {
+		return 0, err
+	}
+	return s.raft.AppliedIndex(), nil
+}
@@ -0,0 +1,283 @@
+package cluster
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"github.com/hashicorp/raft"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func fastRaft() *raft.Config {
+	config := raft.DefaultConfig()
+	config.HeartbeatTimeout = 100 * time.Millisecond
+	config.ElectionTimeout = 100 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	return config
+}
+
+// startCluster starts the nodes in process and waits for the first leader
+func startCluster(t *testing.T, nodes int, options ...func(*Config)) []*server {
+	configs := []*Config{}
+	peers := []string{}
+	for i := range nodes {
+		config := &Config{
+			ID:                fmt.Sprintf("node%d", i),
+			BindAddr:          freeAddr(t),
+			APIAddr:           freeAddr(t),
+			LinearizableReads: true,
+			Timeout:           5 * time.Second,
+			Raft:              fastRaft(),
+		}
+		for _, option := range options {
+			option(config)
+		}
+		configs = append(configs, config)
+		peers = append(peers, config.ID+"="+config.BindAddr)
+	}
+	servers := []*server{}
+	for _, config := range configs {
+		config.Peers = peers
+		s, err := NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		servers = append(servers, s)
+	}
+	leader(t, servers)
+	return servers
+}
+
+func leader(t *testing.T, servers []*server) *server {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, s := range servers {
+			if s.raft.State() == raft.Leader && s.state.member(s.id) != "" {
+				return s
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("No leader elected")
+	return nil
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+	servers := startCluster(t, 3)
+	var follower *server
+	for _, s := range servers {
+		if s.raft.State() != raft.Leader {
+			follower = s
+		}
+	}
+
+	// a follower forwards the write, the others read it right away
+	created, err := follower.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Replicated"}})
+	if err != nil || created.Todo.Revision != 1 {
+		t.Fatalf("Expected revision 1, got %+v %v", created, err)
+	}
+	for _, s := range servers {
+		got, err := s.Get(ctx, &repository.GetRequest{Id: "1"})
+		if err != nil || got.Todo == nil || got.Todo.Title != "Replicated" {
+			t.Errorf("Expected the todo on %s, got %+v %v", s.id, got, err)
+		}
+	}
+	if _, err := follower.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1"}, IfRevision: 5}); err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+
+	// the remaining nodes elect a new leader and keep accepting writes
+	old := leader(t, servers)
+	old.Close()
+	remaining := []*server{}
+	for _, s := range servers {
+		if s != old {
+			remaining = append(remaining, s)
+		}
+	}
+	leader(t, remaining)
+	if _, err := remaining[0].Delete(ctx, &repository.DeleteRequest{Id: "1", IfRevision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range remaining {
+		all, err := s.GetAll(ctx, &repository.GetAllRequest{})
+		if err != nil || len(all.Todos) != 0 {
+			t.Errorf("Expected no todos on %s, got %+v %v", s.id, all, err)
+		}
+	}
+}
+
+// test that the apply endpoint refuses commands that would break the log
+func TestInvalidCommands(t *testing.T) {
+	s := leader(t, startCluster(t, 1))
+	for _, body := range []string{`{"Op":"create"}`, `{"Op":"update","Todo":{}}`, `{"Op":"delete"}`, `{"Op":"register","Node":"node0","Address":"127.0.0.1:1"}`} {
+		resp, err := http.Post("http://"+s.apiAddr+applyPath, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %d for %s, got %d", http.StatusBadRequest, body, resp.StatusCode)
+		}
+	}
+	if address := s.state.member(s.id); address != s.apiAddr {
+		t.Errorf("Expected the leader to stay registered at %s, got %s", s.apiAddr, address)
+	}
+	if res := s.state.Apply(&raft.Log{Data: []byte(`{"Op":"create"}`)}); res.(*result).Err == nil {
+		t.Errorf("Expected an error for a create without a todo")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	ctx := context.Background()
+	servers := startCluster(t, 1)
+	if _, err := servers[0].Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	joined, err := NewServer(&Config{
+		ID:                "joined",
+		BindAddr:          freeAddr(t),
+		APIAddr:           freeAddr(t),
+		Join:              servers[0].apiAddr,
+		LinearizableReads: true,
+		Timeout:           5 * time.Second,
+		Raft:              fastRaft(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joined.Close()
+	got, err := joined.Get(ctx, &repository.GetRequest{Id: "1"})
+	if err != nil || got.Todo == nil {
+		t.Errorf("Expected the todo on the new node, got %+v %v", got, err)
+	}
+}
+
+// newTLS returns the server and client configuration of a node certificate
+// for 127.0.0.1 that is signed by a new CA
+func newTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert},
+		&tls.Config{Certificates: []tls.Certificate{certificate}, RootCAs: pool}
+}
+
+func TestTLS(t *testing.T) {
+	ctx := context.Background()
+	serverTLS, clientTLS := newTLS(t)
+	servers := startCluster(t, 2, func(config *Config) {
+		config.TLS, config.ClientTLS = serverTLS, clientTLS
+	})
+	var follower *server
+	for _, s := range servers {
+		if s.raft.State() != raft.Leader {
+			follower = s
+		}
+	}
+	// forwarded over the API and replicated over the transport
+	if _, err := follower.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		got, err := s.Get(ctx, &repository.GetRequest{Id: "1"})
+		if err != nil || got.Todo == nil {
+			t.Errorf("Expected the todo on %s, got %+v %v", s.id, got, err)
+		}
+	}
+
+	// the API refuses plaintext and clients without a certificate
+	body := `{"ID":"intruder","Address":"127.0.0.1:1"}`
+	if resp, err := http.Post("http://"+follower.apiAddr+joinPath, "application/json", strings.NewReader(body)); err == nil && resp.StatusCode < 300 {
+		t.Errorf("Expected a plaintext join to fail, got %s", resp.Status)
+	}
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: clientTLS.RootCAs}}}
+	if _, err := anonymous.Post("https://"+follower.apiAddr+joinPath, "application/json", strings.NewReader(body)); err == nil {
+		t.Error("Expected a join without client certificate to fail")
+	}
+	// so does the transport
+	leaderAddr, _ := follower.raft.LeaderWithID()
+	if conn, err := tls.Dial("tcp", string(leaderAddr), &tls.Config{RootCAs: clientTLS.RootCAs}); err == nil {
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Expected the transport to refuse a client without certificate")
+		}
+		conn.Close()
+	}
+	if _, err := NewServer(&Config{ID: "half", BindAddr: freeAddr(t), APIAddr: freeAddr(t), TLS: serverTLS}); err == nil {
+		t.Error("Expected TLS without a client configuration to fail")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		servers := startCluster(t, 3)
+		// a follower, so that the writes are forwarded
+		for _, s := range servers {
+			if s.raft.State() != raft.Leader {
+				return s
+			}
+		}
+		return servers[0]
+	})
+}
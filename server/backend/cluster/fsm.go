@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/hashicorp/raft"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sync"
+)
+
+const (
+	opCreate = "create"
+	opUpdate = "update"
+	opDelete = "delete"
+	// opRegister records the API address of a node, every new leader
+	// registers itself so that the followers know where to forward writes
+	opRegister = "register"
+)
+
+// command is an entry of the Raft log
+type command struct {
+	Op         string
+	Todo       *repository.Todo `json:",omitempty"`
+	Id         string           `json:",omitempty"`
+	IfRevision uint64           `json:",omitempty"`
+	IfAbsent   bool             `json:",omitempty"`
+	Node       string           `json:",omitempty"`
+	Address    string           `json:",omitempty"`
+}
+
+// errInvalidCommand is returned for a create or update without a todo
+var errInvalidCommand = errors.New("invalid cluster command")
+
+// validate accepts only the commands a follower forwards, register is only
+// proposed by the leader itself
+func (c *command) validate() error {
+	switch c.Op {
+	case opCreate, opUpdate:
+		if c.Todo == nil || c.Todo.Id == "" {
+			return fmt.Errorf("%w: %s needs a todo with an id", errInvalidCommand, c.Op)
+		}
+		return nil
+	case opDelete:
+		if c.Id == "" {
+			return fmt.Errorf("%w: delete needs an id", errInvalidCommand)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %q cannot be forwarded", errInvalidCommand, c.Op)
+}
+
+// result is what applying a command returns on the node that proposed it
+type result struct {
+	Todo *repository.Todo
+	Err  error
+}
+
+// state is the replicated state machine. Every node applies the same commands
+// in the same order, so the revisions and the outcome of the revision checks
+// are the same everywhere.
+type state struct {
+	lock       sync.RWMutex
+	maxEntries int
+	Todos      map[string]*repository.Todo
+	Sequence   uint64
+	// Members maps the node ids to their API addresses
+	Members map[string]string
+}
+
+func newState(maxEntries int) *state {
+	return &state{
+		maxEntries: maxEntries,
+		Todos:      map[string]*repository.Todo{},
+		Members:    map[string]string{},
+	}
+}
+
+func (s *state) Apply(entry *raft.Log) any {
+	cmd := command{}
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		log.WithError(err).WithField("index", entry.Index).Error("Skipping invalid log entry")
+		return &result{Err: err}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch cmd.Op {
+	case opCreate, opUpdate:
+		// entries of older versions were not validated
+		if cmd.Todo == nil {
+			log.WithField("op", cmd.Op).WithField("index", entry.Index).Error("Skipping command without a todo")
+			return &result{Err: errInvalidCommand}
+		}
+		before := s.Todos[cmd.Todo.Id]
+		if !matchesRevision(before, cmd.IfRevision) || (cmd.IfAbsent && before != nil) {
+			return &result{Err: repository.ErrConflict}
+		}
+		if before == nil && s.maxEntries > 0 && len(s.Todos) >= s.maxEntries {
+			return &result{Err: repository.ErrCapacityExceeded}
+		}
+		s.Sequence++
+		todo := copyTodo(cmd.Todo)
+		todo.Revision = s.Sequence
+		s.Todos[todo.Id] = todo
+		return &result{Todo: copyTodo(todo)}
+	case opDelete:
+		before := s.Todos[cmd.Id]
+		if !matchesRevision(before, cmd.IfRevision) {
+			return &result{Err: repository.ErrConflict}
+		}
+		if before != nil {
+			s.Sequence++
+			delete(s.Todos, cmd.Id)
+		}
+		return &result{}
+	case opRegister:
+		s.Members[cmd.Node] = cmd.Address
+		return &result{}
+	}
+	log.WithField("op", cmd.Op).WithField("index", entry.Index).Warn("Skipping unknown command")
+	return &result{}
+}
+
+func (s *state) Snapshot() (raft.FSMSnapshot, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot(data), nil
+}
+
+func (s *state) Restore(reader io.ReadCloser) error {
+	defer reader.Close()
+	restored := newState(s.maxEntries)
+	if err := json.NewDecoder(reader).Decode(restored); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Todos = restored.Todos
+	s.Sequence = restored.Sequence
+	s.Members = restored.Members
+	log.WithField("todos", len(s.Todos)).WithField("sequence", s.Sequence).Info("Restored snapshot")
+	return nil
+}
+
+func (s *state) member(id string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Members[id]
+}
+
+// snapshot is the state serialized while holding the lock
+type snapshot []byte
+
+func (s snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s snapshot) Release() {}
+
+func matchesRevision(todo *repository.Todo, revision uint64) bool {
+	return revision == 0 || (todo != nil && todo.Revision == revision)
+}
+
+func copyTodo(todo *repository.Todo) *repository.Todo {
+	copied := *todo
+	if todo.Tags != nil {
+		copied.Tags = append([]string{}, todo.Tags...)
+	}
+	return &copied
+}
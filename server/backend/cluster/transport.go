@@ -0,0 +1,32 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"github.com/hashicorp/raft"
+	"net"
+	"time"
+)
+
+// tlsStreamLayer carries the Raft transport over mutual TLS
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	client    *tls.Config
+}
+
+func newTLSStreamLayer(bindAddr string, advertise net.Addr, server *tls.Config, client *tls.Config) (*tlsStreamLayer, error) {
+	listener, err := tls.Listen("tcp", bindAddr, server)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsStreamLayer{Listener: listener, advertise: advertise, client: client}, nil
+}
+
+// Addr is the address the other nodes reach this one at
+func (t *tlsStreamLayer) Addr() net.Addr {
+	return t.advertise
+}
+
+func (t *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), t.client)
+}
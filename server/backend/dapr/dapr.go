@@ -0,0 +1,451 @@
+package dapr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	dapr "github.com/dapr/go-sdk/client"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Every todo is stored as JSON at todoPrefix + id. indexKey holds the ids of
+// all todos for stores without query support, sequenceKey the last revision.
+const (
+	todoPrefix  = "todo:"
+	indexKey    = "todos:index"
+	sequenceKey = "todos:sequence"
+	// retries of a read-modify-write that lost against another writer
+	retries = 20
+)
+
+var errRetry = errors.New("too many concurrent writers")
+
+// server keeps the todos in a Dapr state store. Writes use first-write-wins
+// with the ETag that was read, so concurrent instances never lose an update.
+type server struct {
+	client    dapr.Client
+	storeName string
+	// queryUnsupported is set once the store rejected a query
+	queryUnsupported atomic.Bool
+}
+
+type Config struct {
+	// StoreName is the name of the Dapr state store component
+	StoreName string
+	// Address of the sidecar gRPC API, if empty DAPR_GRPC_PORT is used
+	Address string
+	// Client is used instead of connecting to Address if set
+	Client dapr.Client
+}
+
+func NewServer(config *Config) (*server, error) {
+	log.WithField("storeName", config.StoreName).WithField("address", config.Address).Info("Creating new dapr server")
+	client := config.Client
+	if client == nil {
+		var err error
+		if config.Address != "" {
+			client, err = dapr.NewClientWithAddress(config.Address)
+		} else {
+			client, err = dapr.NewClient()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	myServer := &server{
+		client:    client,
+		storeName: config.StoreName,
+	}
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer, nil
+}
+
+func (s *server) Name() string {
+	return "dapr"
+}
+
+// Check asks the sidecar for its metadata to see that it is reachable
+func (s *server) Check(ctx context.Context) error {
+	_, err := s.client.GetMetadata(ctx)
+	return err
+}
+
+func (s *server) Close() error {
+	s.client.Close()
+	return nil
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("dapr").Start(ctx, "Create")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Creating new todo")
+	todo, err := s.write(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("dapr").Start(ctx, "Update")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Updating todo")
+	todo, err := s.write(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+// write adds the id to the index first, a todo is never stored without being
+// listed. An id in the index without a todo is skipped when listing.
+func (s *server) write(ctx context.Context, req *repository.CreateOrUpdateRequest) (*repository.Todo, error) {
+	todo := *req.Todo
+	for attempt := range retries {
+		if err := wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+		before, etag, err := s.readTodo(ctx, todo.Id)
+		if err != nil {
+			return nil, err
+		}
+		if !matchesRevision(before, req.IfRevision) || (req.IfAbsent && before != nil) {
+			return nil, repository.ErrConflict
+		}
+		if before == nil {
+			if err := s.updateIndex(ctx, todo.Id, true); err != nil {
+				return nil, err
+			}
+		}
+		todo.Revision, err = s.nextRevision(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(&todo)
+		if err != nil {
+			return nil, err
+		}
+		err = s.client.SaveStateWithETag(ctx, s.storeName, todoPrefix+todo.Id, data, etag, nil, dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if isETagMismatch(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &todo, nil
+	}
+	return nil, errRetry
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("dapr").Start(ctx, "GetAll")
+	defer span.End()
+	var todos []*repository.Todo
+	if (req.Status != "" || req.List != "") && !s.queryUnsupported.Load() {
+		todos, err = s.query(ctx, req)
+		if isQueryUnsupported(err) {
+			log.WithError(err).Info("State store does not support queries, using the index")
+			s.queryUnsupported.Store(true)
+			todos, err = s.list(ctx)
+		}
+	} else {
+		todos, err = s.list(ctx)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	todos = repository.Select(todos, req)
+	span.SetAttributes(attribute.Int("todos", len(todos)))
+	log.WithField("count", len(todos)).Info("Getting all todos")
+	return &repository.GetAllResponse{
+		Todos: todos,
+	}, nil
+}
+
+// list reads all todos of the index with a bulk get
+func (s *server) list(ctx context.Context) ([]*repository.Todo, error) {
+	ids, _, err := s.readIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	todos := []*repository.Todo{}
+	if len(ids) == 0 {
+		return todos, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = todoPrefix + id
+	}
+	items, err := s.client.GetBulkState(ctx, s.storeName, keys, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Error != "" {
+			return nil, fmt.Errorf("failed to get %s: %s", item.Key, item.Error)
+		}
+		if len(item.Value) == 0 {
+			continue
+		}
+		todo := &repository.Todo{}
+		if err := json.Unmarshal(item.Value, todo); err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, nil
+}
+
+// query lets the store filter by status and list, tags and paging are
+// applied afterwards because the query language cannot match array elements
+func (s *server) query(ctx context.Context, req *repository.GetAllRequest) ([]*repository.Todo, error) {
+	filters := []map[string]any{}
+	if req.Status != "" {
+		filters = append(filters, map[string]any{"EQ": map[string]string{"Status": req.Status}})
+	}
+	if req.List != "" {
+		filters = append(filters, map[string]any{"EQ": map[string]string{"List": req.List}})
+	}
+	filter := filters[0]
+	if len(filters) > 1 {
+		filter = map[string]any{"AND": filters}
+	}
+	todos := []*repository.Todo{}
+	token := ""
+	for {
+		query := map[string]any{"filter": filter}
+		if token != "" {
+			query["page"] = map[string]string{"token": token}
+		}
+		data, err := json.Marshal(query)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.QueryStateAlpha1(ctx, s.storeName, string(data), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range resp.Results {
+			if item.Error != "" {
+				return nil, fmt.Errorf("failed to query %s: %s", item.Key, item.Error)
+			}
+			if !strings.HasPrefix(item.Key, todoPrefix) {
+				continue
+			}
+			todo := &repository.Todo{}
+			if err := json.Unmarshal(item.Value, todo); err != nil {
+				return nil, err
+			}
+			todos = append(todos, todo)
+		}
+		if resp.Token == "" || len(resp.Results) == 0 {
+			return todos, nil
+		}
+		token = resp.Token
+	}
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("dapr").Start(ctx, "Get")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Getting todo")
+	todo, _, err := s.readTodo(ctx, req.Id)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.GetResponse{
+		Todo: todo,
+	}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("dapr").Start(ctx, "Delete")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Deleting todo")
+	err = s.delete(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.DeleteResponse{
+		Id: req.Id,
+	}, nil
+}
+
+func (s *server) delete(ctx context.Context, req *repository.DeleteRequest) error {
+	for attempt := range retries {
+		if err := wait(ctx, attempt); err != nil {
+			return err
+		}
+		before, etag, err := s.readTodo(ctx, req.Id)
+		if err != nil {
+			return err
+		}
+		if !matchesRevision(before, req.IfRevision) {
+			return repository.ErrConflict
+		}
+		if before == nil {
+			return nil
+		}
+		if _, err := s.nextRevision(ctx); err != nil {
+			return err
+		}
+		var match *dapr.ETag
+		if etag != "" {
+			match = &dapr.ETag{Value: etag}
+		}
+		err = s.client.DeleteStateWithETag(ctx, s.storeName, todoPrefix+req.Id, match, nil, &dapr.StateOptions{Concurrency: dapr.StateConcurrencyFirstWrite})
+		if isETagMismatch(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return s.updateIndex(ctx, req.Id, false)
+	}
+	return errRetry
+}
+
+func (s *server) readTodo(ctx context.Context, id string) (*repository.Todo, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, todoPrefix+id, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(item.Value) == 0 {
+		return nil, "", nil
+	}
+	todo := &repository.Todo{}
+	if err := json.Unmarshal(item.Value, todo); err != nil {
+		return nil, "", err
+	}
+	return todo, item.Etag, nil
+}
+
+func (s *server) readIndex(ctx context.Context) ([]string, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, indexKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	ids := []string{}
+	if len(item.Value) > 0 {
+		if err := json.Unmarshal(item.Value, &ids); err != nil {
+			return nil, "", err
+		}
+	}
+	return ids, item.Etag, nil
+}
+
+// updateIndex adds or removes the id
+func (s *server) updateIndex(ctx context.Context, id string, add bool) error {
+	for attempt := range retries {
+		if err := wait(ctx, attempt); err != nil {
+			return err
+		}
+		ids, etag, err := s.readIndex(ctx)
+		if err != nil {
+			return err
+		}
+		updated := make([]string, 0, len(ids)+1)
+		for _, other := range ids {
+			if other != id {
+				updated = append(updated, other)
+			}
+		}
+		if add {
+			updated = append(updated, id)
+		} else if len(updated) == len(ids) {
+			return nil
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		err = s.client.SaveStateWithETag(ctx, s.storeName, indexKey, data, etag, nil, dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if !isETagMismatch(err) {
+			return err
+		}
+	}
+	return errRetry
+}
+
+// nextRevision increments the sequence shared by all todos
+func (s *server) nextRevision(ctx context.Context) (uint64, error) {
+	for attempt := range retries {
+		if err := wait(ctx, attempt); err != nil {
+			return 0, err
+		}
+		item, err := s.client.GetState(ctx, s.storeName, sequenceKey, nil)
+		if err != nil {
+			return 0, err
+		}
+		var sequence uint64
+		if len(item.Value) > 0 {
+			sequence, err = strconv.ParseUint(string(item.Value), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+		}
+		sequence++
+		err = s.client.SaveStateWithETag(ctx, s.storeName, sequenceKey, []byte(strconv.FormatUint(sequence, 10)), item.Etag, nil, dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if isETagMismatch(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return sequence, nil
+	}
+	return 0, errRetry
+}
+
+// wait backs off with jitter before a retry, so that writers racing for the
+// same key do not collide again
+func wait(ctx context.Context, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(rand.Int64N(int64(min(attempt, 10)) * int64(5*time.Millisecond)))):
+		return nil
+	}
+}
+
+func matchesRevision(todo *repository.Todo, revision uint64) bool {
+	return revision == 0 || (todo != nil && todo.Revision == revision)
+}
+
+// isETagMismatch tells if another writer changed the key since it was read
+func isETagMismatch(err error) bool {
+	return err != nil && status.Code(errors.Unwrap(err)) == codes.Aborted
+}
+
+// isQueryUnsupported tells if the store or the sidecar has no query API
+func isQueryUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := status.Code(errors.Unwrap(err))
+	return code == codes.Unimplemented || strings.Contains(err.Error(), "does not support querying")
+}
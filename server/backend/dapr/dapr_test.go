@@ -0,0 +1,206 @@
+package dapr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	commonpb "github.com/dapr/dapr/pkg/proto/common/v1"
+	pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeSidecar is an in-memory state store behind the Dapr gRPC API. The
+// etag of a key is its version, query only supports EQ and AND.
+type fakeSidecar struct {
+	pb.UnimplementedDaprServer
+	lock     sync.Mutex
+	values   map[string][]byte
+	versions map[string]int
+	noQuery  bool
+}
+
+func (f *fakeSidecar) GetState(ctx context.Context, req *pb.GetStateRequest) (*pb.GetStateResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	resp := &pb.GetStateResponse{Data: f.values[req.Key]}
+	if version, ok := f.versions[req.Key]; ok {
+		resp.Etag = strconv.Itoa(version)
+	}
+	return resp, nil
+}
+
+func (f *fakeSidecar) GetBulkState(ctx context.Context, req *pb.GetBulkStateRequest) (*pb.GetBulkStateResponse, error) {
+	resp := &pb.GetBulkStateResponse{}
+	for _, key := range req.Keys {
+		item, _ := f.GetState(ctx, &pb.GetStateRequest{Key: key})
+		resp.Items = append(resp.Items, &pb.BulkStateItem{Key: key, Data: item.Data, Etag: item.Etag})
+	}
+	return resp, nil
+}
+
+func (f *fakeSidecar) SaveState(ctx context.Context, req *pb.SaveStateRequest) (*emptypb.Empty, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, item := range req.States {
+		if item.Etag != nil && item.Etag.Value != strconv.Itoa(f.versions[item.Key]) {
+			return nil, status.Errorf(codes.Aborted, "possible etag mismatch for %s", item.Key)
+		}
+		// first write without an etag only inserts, like the redis component
+		_, exists := f.values[item.Key]
+		if item.Etag == nil && exists && item.GetOptions().GetConcurrency() == commonpb.StateOptions_CONCURRENCY_FIRST_WRITE {
+			return nil, status.Errorf(codes.Aborted, "possible etag mismatch for %s", item.Key)
+		}
+		f.values[item.Key] = item.Value
+		f.versions[item.Key]++
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeSidecar) DeleteState(ctx context.Context, req *pb.DeleteStateRequest) (*emptypb.Empty, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if req.Etag != nil && req.Etag.Value != strconv.Itoa(f.versions[req.Key]) {
+		return nil, status.Errorf(codes.Aborted, "possible etag mismatch for %s", req.Key)
+	}
+	delete(f.values, req.Key)
+	delete(f.versions, req.Key)
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeSidecar) QueryStateAlpha1(ctx context.Context, req *pb.QueryStateRequest) (*pb.QueryStateResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.noQuery {
+		return nil, status.Error(codes.Internal, "state store does not support querying")
+	}
+	query := struct {
+		Filter struct {
+			EQ  map[string]string
+			AND []struct{ EQ map[string]string }
+		}
+	}{}
+	if err := json.Unmarshal([]byte(req.Query), &query); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	conditions := []map[string]string{query.Filter.EQ}
+	for _, and := range query.Filter.AND {
+		conditions = append(conditions, and.EQ)
+	}
+	resp := &pb.QueryStateResponse{}
+	for key, value := range f.values {
+		fields := map[string]any{}
+		if json.Unmarshal(value, &fields) != nil {
+			continue
+		}
+		matches := true
+		for _, condition := range conditions {
+			for field, expected := range condition {
+				matches = matches && fields[field] == expected
+			}
+		}
+		if matches {
+			resp.Results = append(resp.Results, &pb.QueryStateItem{Key: key, Data: value})
+		}
+	}
+	return resp, nil
+}
+
+func startSidecar(t *testing.T) (*fakeSidecar, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar := &fakeSidecar{values: map[string][]byte{}, versions: map[string]int{}}
+	grpcServer := grpc.NewServer()
+	pb.RegisterDaprServer(grpcServer, sidecar)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return sidecar, listener.Addr().String()
+}
+
+func TestDapr(t *testing.T) {
+	ctx := context.Background()
+	sidecar, address := startSidecar(t)
+	s, err := NewServer(&Config{StoreName: "statestore", Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, todo := range []*repository.Todo{
+		{Id: "1", Status: "ACTIVE", List: "home", Tags: []string{"a"}},
+		{Id: "2", Status: repository.StatusCompleted, List: "home"},
+		{Id: "3", Status: "ACTIVE", List: "work"},
+	} {
+		if _, err := s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: todo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queried, err := s.GetAll(ctx, &repository.GetAllRequest{Status: "ACTIVE", List: "home"})
+	if err != nil || len(queried.Todos) != 1 || queried.Todos[0].Id != "1" {
+		t.Errorf("Expected todo 1, got %+v %v", queried, err)
+	}
+	if _, err := s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1"}, IfRevision: 2}); err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if _, err := s.Delete(ctx, &repository.DeleteRequest{Id: "2", IfRevision: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// without query support the index is used
+	sidecar.noQuery = true
+	active, err := s.GetAll(ctx, &repository.GetAllRequest{Status: "ACTIVE", Limit: 1, Offset: 1})
+	if err != nil || len(active.Todos) != 1 || active.Todos[0].Id != "3" {
+		t.Errorf("Expected todo 3, got %+v %v", active, err)
+	}
+
+	// concurrent instances get distinct revisions and lose no todo
+	other, _ := NewServer(&Config{StoreName: "statestore", Address: address})
+	defer other.Close()
+	revisions := sync.Map{}
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			instance := s
+			if i%2 == 0 {
+				instance = other
+			}
+			resp, err := instance.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: fmt.Sprintf("c%d", i)}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, loaded := revisions.LoadOrStore(resp.Todo.Revision, i); loaded {
+				t.Errorf("Revision %d was handed out twice", resp.Todo.Revision)
+			}
+		}()
+	}
+	wg.Wait()
+	all, _ := s.GetAll(ctx, &repository.GetAllRequest{})
+	if len(all.Todos) != 22 {
+		t.Errorf("Expected 22 todos, got %d", len(all.Todos))
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		_, address := startSidecar(t)
+		s, err := NewServer(&Config{StoreName: "statestore", Address: address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
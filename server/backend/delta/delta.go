@@ -0,0 +1,32 @@
+package delta
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+)
+
+const (
+	DefaultLimit = 500
+	MaxLimit     = 5000
+)
+
+// Changes are the todos that changed after a token
+type Changes struct {
+	Upserts []*repository.Todo
+	// Deletes are the ids of the deleted todos (tombstones)
+	Deletes []string
+	// Token is passed as since to get the next changes
+	Token string
+	// Reset tells the client to replace its local state, set if since was
+	// empty or unknown to the server
+	Reset bool
+	// More is set if the limit was reached, the client should ask again right away
+	More bool
+}
+
+// Store is implemented by backends that keep a global change sequence. They
+// set the revision of every todo and honor IfRevision and IfAbsent on writes.
+type Store interface {
+	// Changes returns the changes after the token, ordered by their revision
+	Changes(ctx context.Context, since string, limit int) (*Changes, error)
+}
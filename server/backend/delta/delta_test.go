@@ -0,0 +1,136 @@
+package delta_test
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/delta"
+	"github.com/dkrizic/todo/server/backend/memory"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	base := &repository.Todo{Id: "1", Title: "title", Description: "description", Tags: []string{"a"}}
+	server := &repository.Todo{Id: "1", Title: "server title", Description: "description", Tags: []string{"a"}}
+	local := &repository.Todo{Id: "1", Title: "title", Description: "local description", Tags: []string{"a", "b"}}
+
+	merged, write, conflicts := delta.Merge(server, base, local)
+	if !write || len(conflicts) != 0 {
+		t.Fatalf("Expected a write without conflicts, got %v %v", write, conflicts)
+	}
+	if merged.Title != "server title" || merged.Description != "local description" || len(merged.Tags) != 2 {
+		t.Errorf("Unexpected merge result %+v", merged)
+	}
+
+	local.Title = "local title"
+	merged, write, conflicts = delta.Merge(server, base, local)
+	if !write || len(conflicts) != 1 || conflicts[0].Field != "title" || conflicts[0].Server != "server title" {
+		t.Fatalf("Expected a conflict on the title, got %v", conflicts)
+	}
+	if merged.Title != "server title" {
+		t.Errorf("Expected the server title to be kept, got %v", merged.Title)
+	}
+
+	// deleted on the client after the server changed it
+	_, write, conflicts = delta.Merge(server, base, nil)
+	if write || len(conflicts) != 1 || conflicts[0].Field != delta.TodoField {
+		t.Errorf("Expected a conflict on the todo, got %v %v", write, conflicts)
+	}
+	// deleted on the client without changes on the server
+	merged, write, _ = delta.Merge(base, base, nil)
+	if !write || merged != nil {
+		t.Errorf("Expected a deletion, got %v %v", write, merged)
+	}
+}
+
+func TestPushAndChanges(t *testing.T) {
+	ctx := context.Background()
+	repo, err := memory.NewServer(&memory.Config{MaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := repo.Changes(ctx, "", delta.DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Reset {
+		t.Errorf("Expected a reset without token")
+	}
+
+	created, err := delta.Push(ctx, repo, delta.PushChange{Id: "push-1", Todo: &repository.Todo{Title: "offline"}})
+	if err != nil || !created.Applied || created.Todo.Revision == 0 {
+		t.Fatalf("Expected the todo to be created, got %+v %v", created, err)
+	}
+	base := *created.Todo
+	changed := base
+	changed.Description = "changed offline"
+	updated, err := delta.Push(ctx, repo, delta.PushChange{Id: "push-1", Base: &base, Todo: &changed})
+	if err != nil || !updated.Applied || updated.Todo.Description != "changed offline" {
+		t.Fatalf("Expected the todo to be updated, got %+v %v", updated, err)
+	}
+	deleted, err := delta.Push(ctx, repo, delta.PushChange{Id: "push-1", Base: updated.Todo})
+	if err != nil || !deleted.Applied || deleted.Todo != nil {
+		t.Fatalf("Expected the todo to be deleted, got %+v %v", deleted, err)
+	}
+
+	changes, err := repo.Changes(ctx, first.Token, delta.DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.Reset || len(changes.Upserts) != 0 || len(changes.Deletes) != 1 || changes.Deletes[0] != "push-1" {
+		t.Errorf("Expected only the tombstone, got %+v", changes)
+	}
+	again, _ := repo.Changes(ctx, changes.Token, delta.DefaultLimit)
+	if len(again.Upserts)+len(again.Deletes) != 0 || again.Token != changes.Token {
+		t.Errorf("Expected no further changes, got %+v", again)
+	}
+}
+
+func TestConditionalWrite(t *testing.T) {
+	ctx := context.Background()
+	repo, err := memory.NewServer(&memory.Config{MaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := repo.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "conditional-1"}})
+	stale := resp.Todo.Revision
+	repo.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "conditional-1", Title: "newer"}})
+	_, err = repo.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "conditional-1"}, IfRevision: stale})
+	if err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+}
+
+// racingRepo creates the todo on behalf of another client right after the first Get
+type racingRepo struct {
+	repository.TodoRepository
+	other *repository.Todo
+}
+
+func (r *racingRepo) Get(ctx context.Context, req *repository.GetRequest) (*repository.GetResponse, error) {
+	resp, err := r.TodoRepository.Get(ctx, req)
+	if r.other != nil {
+		r.TodoRepository.Create(ctx, &repository.CreateOrUpdateRequest{Todo: r.other})
+		r.other = nil
+	}
+	return resp, err
+}
+
+func TestPushConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	memory, err := memory.NewServer(&memory.Config{MaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &racingRepo{TodoRepository: memory, other: &repository.Todo{Id: "race-1", Title: "other", Description: "other description"}}
+	result, err := delta.Push(ctx, repo, delta.PushChange{Id: "race-1", Todo: &repository.Todo{Title: "mine"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Field != "title" {
+		t.Errorf("Expected a conflict on the title, got %+v", result.Conflicts)
+	}
+	resp, _ := memory.Get(ctx, &repository.GetRequest{Id: "race-1"})
+	if resp.Todo.Title != "other" || resp.Todo.Description != "other description" {
+		t.Errorf("Expected the todo of the other client to be kept, got %+v", resp.Todo)
+	}
+}
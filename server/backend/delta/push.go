@@ -0,0 +1,195 @@
+package delta
+
+import (
+	"context"
+	"errors"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"go.opentelemetry.io/otel"
+	"slices"
+)
+
+// maxAttempts is how often a push is merged again if the todo changes concurrently
+const maxAttempts = 3
+
+// TodoField is used as field of a conflict that concerns the whole todo
+const TodoField = "todo"
+
+// PushChange is a change made on the client
+type PushChange struct {
+	Id string
+	// Base is the todo as the client received it from the last sync, nil if
+	// the todo was created on the client
+	Base *repository.Todo
+	// Todo is the todo on the client, nil if it was deleted on the client
+	Todo *repository.Todo
+}
+
+// Conflict is a field that was changed on the client and on the server
+type Conflict struct {
+	Field  string
+	Base   interface{}
+	Client interface{}
+	Server interface{}
+}
+
+// PushResult tells the client what happened to a change
+type PushResult struct {
+	Id string
+	// Applied is set if the server stored the (partly) merged change
+	Applied bool
+	// Todo is the todo on the server after the push, nil if it does not exist
+	Todo *repository.Todo
+	// Conflicts lists the fields where the server value was kept
+	Conflicts []Conflict
+	Error     string
+}
+
+type field struct {
+	name  string
+	value func(todo *repository.Todo) interface{}
+	equal func(a *repository.Todo, b *repository.Todo) bool
+	copy  func(to *repository.Todo, from *repository.Todo)
+}
+
+var fields = []field{
+	{
+		name:  "title",
+		value: func(todo *repository.Todo) interface{} { return todo.Title },
+		equal: func(a *repository.Todo, b *repository.Todo) bool { return a.Title == b.Title },
+		copy:  func(to *repository.Todo, from *repository.Todo) { to.Title = from.Title },
+	},
+	{
+		name:  "description",
+		value: func(todo *repository.Todo) interface{} { return todo.Description },
+		equal: func(a *repository.Todo, b *repository.Todo) bool { return a.Description == b.Description },
+		copy:  func(to *repository.Todo, from *repository.Todo) { to.Description = from.Description },
+	},
+	{
+		name:  "status",
+		value: func(todo *repository.Todo) interface{} { return todo.Status },
+		equal: func(a *repository.Todo, b *repository.Todo) bool { return a.Status == b.Status },
+		copy:  func(to *repository.Todo, from *repository.Todo) { to.Status = from.Status },
+	},
+	{
+		name:  "list",
+		value: func(todo *repository.Todo) interface{} { return todo.List },
+		equal: func(a *repository.Todo, b *repository.Todo) bool { return a.List == b.List },
+		copy:  func(to *repository.Todo, from *repository.Todo) { to.List = from.List },
+	},
+	{
+		name:  "tags",
+		value: func(todo *repository.Todo) interface{} { return todo.Tags },
+		equal: func(a *repository.Todo, b *repository.Todo) bool { return slices.Equal(a.Tags, b.Tags) },
+		copy:  func(to *repository.Todo, from *repository.Todo) { to.Tags = slices.Clone(from.Tags) },
+	},
+}
+
+// Merge does a three way merge of the client change into the server todo. A
+// field changed on the client is taken unless the server changed it to
+// something else since base. It returns the todo to store (nil deletes it),
+// whether anything has to be written and the conflicting fields.
+func Merge(server *repository.Todo, base *repository.Todo, local *repository.Todo) (merged *repository.Todo, write bool, conflicts []Conflict) {
+	switch {
+	case local == nil && server == nil:
+		return nil, false, nil
+	case local == nil:
+		if base != nil && sameFields(server, base) {
+			return nil, true, nil
+		}
+		// changed on the server, deleted on the client
+		return server, false, []Conflict{{Field: TodoField, Base: base, Client: nil, Server: server}}
+	case server == nil:
+		if base == nil {
+			created := *local
+			return &created, true, nil
+		}
+		// deleted on the server, changed on the client
+		return nil, false, []Conflict{{Field: TodoField, Base: base, Client: local, Server: nil}}
+	}
+	if base == nil {
+		base = &repository.Todo{}
+	}
+	result := *server
+	for _, f := range fields {
+		if f.equal(local, base) {
+			continue
+		}
+		if f.equal(server, base) || f.equal(server, local) {
+			f.copy(&result, local)
+			continue
+		}
+		conflicts = append(conflicts, Conflict{
+			Field:  f.name,
+			Base:   f.value(base),
+			Client: f.value(local),
+			Server: f.value(server),
+		})
+	}
+	return &result, !sameFields(&result, server), conflicts
+}
+
+// Push merges a client change and writes it with the revision it was merged
+// against, the merge is repeated if the todo changed in between
+func Push(ctx context.Context, repo repository.TodoRepository, change PushChange) (*PushResult, error) {
+	ctx, span := otel.Tracer("delta").Start(ctx, "Push")
+	defer span.End()
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		current, err := repo.Get(ctx, &repository.GetRequest{Id: change.Id})
+		if err != nil {
+			return nil, err
+		}
+		merged, write, conflicts := Merge(current.Todo, change.Base, change.Todo)
+		result := &PushResult{
+			Id:        change.Id,
+			Todo:      current.Todo,
+			Conflicts: conflicts,
+		}
+		if !write {
+			return result, nil
+		}
+		var revision uint64
+		if current.Todo != nil {
+			revision = current.Todo.Revision
+		}
+		switch {
+		case merged == nil:
+			_, err = repo.Delete(ctx, &repository.DeleteRequest{Id: change.Id, IfRevision: revision})
+			result.Todo = nil
+		case current.Todo == nil:
+			// a todo created by another client in between is a conflict
+			merged.Id = change.Id
+			merged.Revision = 0
+			var resp *repository.CreateOrUpdateResponse
+			resp, err = repo.Create(ctx, &repository.CreateOrUpdateRequest{Todo: merged, IfAbsent: true})
+			if err == nil {
+				result.Todo = resp.Todo
+			}
+		default:
+			merged.Revision = 0
+			var resp *repository.CreateOrUpdateResponse
+			resp, err = repo.Update(ctx, &repository.CreateOrUpdateRequest{Todo: merged, IfRevision: revision})
+			if err == nil {
+				result.Todo = resp.Todo
+			}
+		}
+		if errors.Is(err, repository.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		result.Applied = true
+		return result, nil
+	}
+	return nil, repository.ErrConflict
+}
+
+func sameFields(a *repository.Todo, b *repository.Todo) bool {
+	for _, f := range fields {
+		if !f.equal(a, b) {
+			return false
+		}
+	}
+	return true
+}
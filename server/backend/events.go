@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/feed"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	keepaliveInterval = 15 * time.Second
+	writeTimeout      = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// feedAvailable answers 501 if the backend has no live feed
+func feedAvailable(w http.ResponseWriter) bool {
+	if ActiveBackend.Feed == nil {
+		log.WithField("implementation", ActiveBackend.Implementation.Name()).Error("Backend has no live feed")
+		w.WriteHeader(http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// TodoEventsHandler streams the changes as Server-Sent Events
+func TodoEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !feedAvailable(w) {
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx := r.Context()
+	filter := feed.NewFilter(r.URL.Query())
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	events, err := ActiveBackend.Feed.Subscribe(ctx, lastEventId)
+	if err != nil {
+		log.WithError(err).WithField("lastEventId", lastEventId).Warn("Unable to subscribe to change feed")
+		writeError(ctx, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.WithField("lastEventId", lastEventId).Info("Client subscribed to change feed")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				// the client reconnects and resumes with the last event id
+				return
+			}
+			if !filter.Matches(event.Change) {
+				continue
+			}
+			data, err := json.Marshal(event.Change)
+			if err != nil {
+				log.WithError(err).Error("Error while converting change to json")
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, strings.ToLower(string(event.Change.ChangeType)), data)
+			flusher.Flush()
+		}
+	}
+}
+
+// TodoWebSocketHandler streams the changes as JSON messages over a WebSocket
+func TodoWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !feedAvailable(w) {
+		return
+	}
+	filter := feed.NewFilter(r.URL.Query())
+	lastEventId := r.URL.Query().Get("lastEventId")
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).Warn("Unable to upgrade to websocket")
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// the client is not expected to send anything, reading detects when it goes away
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	events, err := ActiveBackend.Feed.Subscribe(ctx, lastEventId)
+	if err != nil {
+		log.WithError(err).WithField("lastEventId", lastEventId).Warn("Unable to subscribe to change feed")
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(writeTimeout))
+		return
+	}
+	log.WithField("lastEventId", lastEventId).Info("Client subscribed to change feed via websocket")
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "resume with lastEventId"), time.Now().Add(writeTimeout))
+				return
+			}
+			if !filter.Matches(event.Change) {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+	}
+}
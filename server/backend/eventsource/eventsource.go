@@ -0,0 +1,305 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"sync"
+	"time"
+)
+
+// retries of a write that lost the race for the next sequence
+const retries = 10
+
+// server projects the stream of the store into the current state. Before
+// every operation it applies the events other instances appended.
+type server struct {
+	store         Store
+	snapshotEvery uint64
+	// lock guards the projection, it is held while appending so that the
+	// sequence of an event is always the next one
+	lock          sync.Mutex
+	todos         map[string]*repository.Todo
+	sequence      uint64
+	lastTime      time.Time
+	sinceSnapshot uint64
+}
+
+type Config struct {
+	Store Store
+	// SnapshotEvery is the number of events between two snapshots, 0 disables them
+	SnapshotEvery int
+}
+
+func NewServer(ctx context.Context, config *Config) (*server, error) {
+	log.WithField("snapshotEvery", config.SnapshotEvery).Info("Creating new event sourced server")
+	myServer := &server{
+		store:         config.Store,
+		snapshotEvery: uint64(max(config.SnapshotEvery, 0)),
+		todos:         map[string]*repository.Todo{},
+	}
+	snapshot, err := config.Store.LoadSnapshot(ctx, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		for _, todo := range snapshot.Todos {
+			myServer.todos[todo.Id] = copyTodo(todo)
+		}
+		myServer.sequence = snapshot.Sequence
+		myServer.lastTime = snapshot.Time
+	}
+	replayed, err := myServer.catchUp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"snapshot": myServer.sequence - replayed,
+		"replayed": replayed,
+		"todos":    len(myServer.todos),
+	}).Info("Rebuilt state from the event stream")
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer, nil
+}
+
+func (s *server) Name() string {
+	return "eventsource"
+}
+
+// catchUp applies the events appended since the last one seen, the lock must be held
+func (s *server) catchUp(ctx context.Context) (uint64, error) {
+	var applied uint64
+	var gap error
+	err := s.store.Read(ctx, s.sequence, func(event *Event) bool {
+		if event.Sequence != s.sequence+1 {
+			gap = errors.New("event stream has a gap")
+			return false
+		}
+		s.apply(event)
+		applied++
+		return true
+	})
+	if err == nil {
+		err = gap
+	}
+	return applied, err
+}
+
+func (s *server) apply(event *Event) {
+	switch event.Change.ChangeType {
+	case repository.ChangeTypeDelete:
+		delete(s.todos, event.Change.Before.Id)
+	default:
+		s.todos[event.Change.After.Id] = copyTodo(event.Change.After)
+	}
+	s.sequence = event.Sequence
+	s.lastTime = event.Time
+	s.sinceSnapshot++
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("eventsource").Start(ctx, "Create")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Creating new todo")
+	todo, err := s.write(ctx, req.Todo.Id, req.Todo, req.IfRevision, req.IfAbsent)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("eventsource").Start(ctx, "Update")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Updating todo")
+	todo, err := s.write(ctx, req.Todo.Id, req.Todo, req.IfRevision, req.IfAbsent)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+// write appends the change of the todo, a nil todo deletes it
+func (s *server) write(ctx context.Context, id string, todo *repository.Todo, ifRevision uint64, ifAbsent bool) (*repository.Todo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for range retries {
+		if _, err := s.catchUp(ctx); err != nil {
+			return nil, err
+		}
+		before := s.todos[id]
+		if !matchesRevision(before, ifRevision) || (ifAbsent && before != nil) {
+			return nil, repository.ErrConflict
+		}
+		event := &Event{
+			Sequence: s.sequence + 1,
+			Time:     time.Now().UTC(),
+		}
+		switch {
+		case todo == nil && before == nil:
+			return nil, nil
+		case todo == nil:
+			event.Change = repository.Change{Before: copyTodo(before), ChangeType: repository.ChangeTypeDelete}
+		case before == nil:
+			event.Change = repository.Change{After: copyTodo(todo), ChangeType: repository.ChangeTypeCreate}
+		default:
+			event.Change = repository.Change{Before: copyTodo(before), After: copyTodo(todo), ChangeType: repository.ChangeTypeUpdate}
+		}
+		if event.Change.After != nil {
+			event.Change.After.Revision = event.Sequence
+		}
+		err := s.store.Append(ctx, event)
+		if errors.Is(err, ErrSequence) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.apply(event)
+		s.snapshot(ctx)
+		if event.Change.After == nil {
+			return nil, nil
+		}
+		return copyTodo(event.Change.After), nil
+	}
+	return nil, ErrSequence
+}
+
+// snapshot saves the state every snapshotEvery events, failures only make the next start slower
+func (s *server) snapshot(ctx context.Context) {
+	if s.snapshotEvery == 0 || s.sinceSnapshot < s.snapshotEvery {
+		return
+	}
+	snapshot := &Snapshot{
+		Sequence: s.sequence,
+		Time:     s.lastTime,
+		Todos:    make([]*repository.Todo, 0, len(s.todos)),
+	}
+	for _, todo := range s.todos {
+		snapshot.Todos = append(snapshot.Todos, copyTodo(todo))
+	}
+	if err := s.store.SaveSnapshot(ctx, snapshot); err != nil {
+		log.WithError(err).Warn("Failed to save snapshot")
+		return
+	}
+	s.sinceSnapshot = 0
+	log.WithField("sequence", snapshot.Sequence).WithField("todos", len(snapshot.Todos)).Info("Saved snapshot")
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("eventsource").Start(ctx, "GetAll")
+	defer span.End()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.catchUp(ctx); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	todos := make([]*repository.Todo, 0, len(s.todos))
+	for _, todo := range s.todos {
+		todos = append(todos, copyTodo(todo))
+	}
+	todos = repository.Select(todos, req)
+	span.SetAttributes(attribute.Int("todos", len(todos)))
+	log.WithField("count", len(todos)).Info("Getting all todos")
+	return &repository.GetAllResponse{
+		Todos: todos,
+	}, nil
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("eventsource").Start(ctx, "Get")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Getting todo")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.catchUp(ctx); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	todo, ok := s.todos[req.Id]
+	if !ok {
+		return &repository.GetResponse{}, nil
+	}
+	return &repository.GetResponse{
+		Todo: copyTodo(todo),
+	}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("eventsource").Start(ctx, "Delete")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Deleting todo")
+	_, err = s.write(ctx, req.Id, nil, req.IfRevision, false)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.DeleteResponse{
+		Id: req.Id,
+	}, nil
+}
+
+// GetAsOf replays the stream up to the time, starting at the newest snapshot before it
+func (s *server) GetAsOf(ctx context.Context, id string, asOf time.Time) (*repository.Todo, error) {
+	ctx, span := otel.Tracer("eventsource").Start(ctx, "GetAsOf")
+	defer span.End()
+	log.WithField("id", id).WithField("asOf", asOf).Info("Getting todo as of")
+	var todo *repository.Todo
+	var after uint64
+	snapshot, err := s.store.LoadSnapshot(ctx, asOf)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if snapshot != nil {
+		after = snapshot.Sequence
+		for _, candidate := range snapshot.Todos {
+			if candidate.Id == id {
+				todo = candidate
+			}
+		}
+	}
+	err = s.store.Read(ctx, after, func(event *Event) bool {
+		if event.Time.After(asOf) {
+			return false
+		}
+		switch {
+		case event.Change.After != nil && event.Change.After.Id == id:
+			todo = event.Change.After
+		case event.Change.ChangeType == repository.ChangeTypeDelete && event.Change.Before.Id == id:
+			todo = nil
+		}
+		return true
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if todo == nil {
+		return nil, nil
+	}
+	return copyTodo(todo), nil
+}
+
+func matchesRevision(todo *repository.Todo, revision uint64) bool {
+	return revision == 0 || (todo != nil && todo.Revision == revision)
+}
+
+func copyTodo(todo *repository.Todo) *repository.Todo {
+	copied := *todo
+	if todo.Tags != nil {
+		copied.Tags = append([]string{}, todo.Tags...)
+	}
+	return &copied
+}
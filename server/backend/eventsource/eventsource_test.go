@@ -0,0 +1,78 @@
+package eventsource
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"testing"
+	"time"
+)
+
+func TestEventSourcing(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	s, err := NewServer(ctx, &Config{Store: store, SnapshotEvery: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "First"}})
+	time.Sleep(2 * time.Millisecond)
+	beforeUpdate := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Second"}})
+	s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "2"}})
+	time.Sleep(2 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	if _, err := s.Delete(ctx, &repository.DeleteRequest{Id: "1", IfRevision: 1}); err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	s.Delete(ctx, &repository.DeleteRequest{Id: "1", IfRevision: 2})
+
+	for _, test := range []struct {
+		asOf  time.Time
+		title string
+	}{
+		{asOf: beforeUpdate, title: "First"},
+		{asOf: beforeDelete, title: "Second"},
+	} {
+		todo, err := s.GetAsOf(ctx, "1", test.asOf)
+		if err != nil || todo == nil || todo.Title != test.title {
+			t.Errorf("Expected %s as of %s, got %+v %v", test.title, test.asOf, todo, err)
+		}
+	}
+	if todo, _ := s.GetAsOf(ctx, "1", time.Now()); todo != nil {
+		t.Errorf("Expected the deleted todo to be gone, got %+v", todo)
+	}
+	if todo, _ := s.GetAsOf(ctx, "1", beforeUpdate.Add(-time.Hour)); todo != nil {
+		t.Errorf("Expected no todo before it was created, got %+v", todo)
+	}
+
+	// a second instance rebuilds the state from the snapshot and the tail,
+	// writes of one are seen by the other
+	other, err := NewServer(ctx, &Config{Store: store, SnapshotEvery: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "2", Title: "Other"}, IfRevision: 3}); err != nil {
+		t.Fatal(err)
+	}
+	created, err := s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "3"}})
+	if err != nil || created.Todo.Revision != 6 {
+		t.Errorf("Expected revision 6, got %+v %v", created, err)
+	}
+	all, _ := other.GetAll(ctx, &repository.GetAllRequest{})
+	if len(all.Todos) != 2 || all.Todos[0].Title != "Other" || all.Todos[1].Id != "3" {
+		t.Errorf("Unexpected todos %+v", all.Todos)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		s, err := NewServer(context.Background(), &Config{Store: NewMemoryStore(), SnapshotEvery: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
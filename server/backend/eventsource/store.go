@@ -0,0 +1,97 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"sync"
+	"time"
+)
+
+// SnapshotsKept is the number of snapshots a store keeps, reads of older
+// points in time replay the stream from the start
+const SnapshotsKept = 10
+
+// ErrSequence is returned by Append if the event does not directly follow
+// the last one of the stream, another writer was faster
+var ErrSequence = errors.New("event sequence is already taken")
+
+// Event is an entry of the stream. The sequences start at 1 and have no gaps,
+// the sequence is also the revision of the todo after the change.
+type Event struct {
+	Sequence uint64
+	Time     time.Time
+	Change   repository.Change
+}
+
+// Snapshot is the state after the event with the sequence, Time is the time of that event
+type Snapshot struct {
+	Sequence uint64
+	Time     time.Time
+	Todos    []*repository.Todo
+}
+
+// Store is the append-only stream of changes, the source of truth of the repository
+type Store interface {
+	// Append adds the event to the end of the stream
+	Append(ctx context.Context, event *Event) error
+	// Read calls visit for every event after the sequence in order until it returns false
+	Read(ctx context.Context, after uint64, visit func(event *Event) bool) error
+	SaveSnapshot(ctx context.Context, snapshot *Snapshot) error
+	// LoadSnapshot returns the newest snapshot not newer than at, or the
+	// newest of all if at is zero. It returns nil if there is none.
+	LoadSnapshot(ctx context.Context, at time.Time) (*Snapshot, error)
+}
+
+// memoryStore keeps the stream in the local process
+type memoryStore struct {
+	lock      sync.RWMutex
+	events    []*Event
+	snapshots []*Snapshot
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) Append(ctx context.Context, event *Event) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if event.Sequence != uint64(len(m.events))+1 {
+		return ErrSequence
+	}
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryStore) Read(ctx context.Context, after uint64, visit func(event *Event) bool) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, event := range m.events[min(after, uint64(len(m.events))):] {
+		if !visit(event) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) SaveSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.snapshots = append(m.snapshots, snapshot)
+	if len(m.snapshots) > SnapshotsKept {
+		m.snapshots = m.snapshots[len(m.snapshots)-SnapshotsKept:]
+	}
+	return nil
+}
+
+func (m *memoryStore) LoadSnapshot(ctx context.Context, at time.Time) (*Snapshot, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for i := len(m.snapshots) - 1; i >= 0; i-- {
+		if at.IsZero() || !m.snapshots[i].Time.After(at) {
+			return m.snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
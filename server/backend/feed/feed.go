@@ -0,0 +1,98 @@
+package feed
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"sync"
+)
+
+// subscriberBuffer is the number of events a subscriber may lag behind before it is dropped
+const subscriberBuffer = 256
+
+// Event is a change with the id that can be used to resume the feed
+type Event struct {
+	Id     string
+	Change repository.Change
+}
+
+// Broker distributes changes to the subscribers of the live feed
+type Broker interface {
+	// Start runs background work of the broker until the context is done
+	Start(ctx context.Context)
+	Publish(ctx context.Context, change repository.Change) error
+	// Subscribe returns all events after lastEventId (if still known) followed
+	// by the live events. The channel is closed when the context is done or
+	// the subscriber is too slow, it should then resubscribe with the id of the
+	// last received event.
+	Subscribe(ctx context.Context, lastEventId string) (<-chan Event, error)
+	// Close ends all subscriptions on shutdown, the subscribers resume on another instance
+	Close()
+}
+
+// Hub fans out events to the subscribers inside of this process
+type Hub struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// Subscribe registers a subscriber that first receives the replayed events
+func (h *Hub) Subscribe(ctx context.Context, replay []Event) <-chan Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	subscriber := make(chan Event, len(replay)+subscriberBuffer)
+	if h.closed {
+		close(subscriber)
+		return subscriber
+	}
+	for _, event := range replay {
+		subscriber <- event
+	}
+	h.subscribers[subscriber] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		h.remove(subscriber)
+	}()
+	return subscriber
+}
+
+func (h *Hub) remove(subscriber chan Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.subscribers[subscriber]; ok {
+		delete(h.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// Broadcast sends the event to all subscribers and drops the ones that cannot keep up
+func (h *Hub) Broadcast(event Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// too slow, the subscriber has to resume from its last event
+			delete(h.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Close ends all subscriptions and the ones made afterwards
+func (h *Hub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+	for subscriber := range h.subscribers {
+		delete(h.subscribers, subscriber)
+		close(subscriber)
+	}
+}
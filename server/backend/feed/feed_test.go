@@ -0,0 +1,102 @@
+package feed
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func change(id string, list string, tags ...string) repository.Change {
+	return repository.Change{
+		After:      &repository.Todo{Id: id, List: list, Tags: tags},
+		ChangeType: repository.ChangeTypeCreate,
+	}
+}
+
+func receive(t *testing.T, events <-chan Event) Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("No event received")
+	}
+	return Event{}
+}
+
+// test that a subscriber resumes after the last event it has seen
+func TestMemoryBrokerResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := NewMemoryBroker(10)
+	id := broker.(*memoryBroker).eventId
+	broker.Publish(ctx, change("1", ""))
+	broker.Publish(ctx, change("2", ""))
+	broker.Publish(ctx, change("3", ""))
+
+	events, _ := broker.Subscribe(ctx, id(1))
+	if event := receive(t, events); event.Id != id(2) || event.Change.After.Id != "2" {
+		t.Errorf("Expected event 2, got %v", event.Id)
+	}
+	if event := receive(t, events); event.Id != id(3) {
+		t.Errorf("Expected event 3, got %v", event.Id)
+	}
+	broker.Publish(ctx, change("4", ""))
+	if event := receive(t, events); event.Id != id(4) {
+		t.Errorf("Expected live event 4, got %v", event.Id)
+	}
+
+	// an id of a previous process replays everything
+	restarted, _ := broker.Subscribe(ctx, "previous-3")
+	if event := receive(t, restarted); event.Change.After.Id != "1" {
+		t.Errorf("Expected event 1 after restart, got %v", event.Change.After.Id)
+	}
+
+	cancel()
+	waitClosed := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-waitClosed:
+			t.Fatal("Channel not closed after cancel")
+		}
+	}
+}
+
+// test that closing the broker ends all subscriptions, also the ones made afterwards
+func TestMemoryBrokerClose(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker(10)
+	events, _ := broker.Subscribe(ctx, "")
+	broker.Close()
+	if _, ok := <-events; ok {
+		t.Error("Expected the subscription to be closed")
+	}
+	late, _ := broker.Subscribe(ctx, "")
+	if _, ok := <-late; ok {
+		t.Error("Expected a subscription after the close to be closed")
+	}
+}
+
+// test the filter on list, tags and ids
+func TestFilter(t *testing.T) {
+	filter := NewFilter(url.Values{"list": {"work"}, "tag": {"a", "b"}})
+	if !filter.Matches(change("1", "work", "a", "b", "c")) {
+		t.Error("Expected todo with all tags in list to match")
+	}
+	if filter.Matches(change("1", "work", "a")) {
+		t.Error("Expected todo with missing tag not to match")
+	}
+	if filter.Matches(change("1", "home", "a", "b")) {
+		t.Error("Expected todo in other list not to match")
+	}
+	filter = NewFilter(url.Values{"id": {"1", "2"}})
+	deleted := repository.Change{Before: &repository.Todo{Id: "2"}, ChangeType: repository.ChangeTypeDelete}
+	if !filter.Matches(deleted) {
+		t.Error("Expected deleted todo to match by id")
+	}
+}
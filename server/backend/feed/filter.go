@@ -0,0 +1,55 @@
+package feed
+
+import (
+	"github.com/dkrizic/todo/server/backend/repository"
+	"net/url"
+)
+
+// Filter selects the events a subscriber is interested in, empty fields match everything
+type Filter struct {
+	Ids  []string
+	List string
+	// Tags must all be present on the todo
+	Tags []string
+}
+
+// NewFilter reads the filter from the query parameters id, list and tag
+func NewFilter(query url.Values) Filter {
+	return Filter{
+		Ids:  query["id"],
+		List: query.Get("list"),
+		Tags: query["tag"],
+	}
+}
+
+// Matches checks the todo after the change, or before it for deletions
+func (f Filter) Matches(change repository.Change) bool {
+	todo := change.After
+	if todo == nil {
+		todo = change.Before
+	}
+	if todo == nil {
+		return false
+	}
+	if len(f.Ids) > 0 && !contains(f.Ids, todo.Id) {
+		return false
+	}
+	if f.List != "" && f.List != todo.List {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !contains(todo.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package feed
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryBroker keeps the last events of this process in a ring buffer. The
+// event ids are <epoch>-<sequence>, the epoch changes with every start so that
+// ids of a previous process are not mistaken for current ones.
+type memoryBroker struct {
+	mutex    sync.Mutex
+	hub      *Hub
+	epoch    string
+	sequence uint64
+	history  []Event
+	size     int
+}
+
+// NewMemoryBroker creates a broker that only sees the changes of the local process
+func NewMemoryBroker(historySize int) Broker {
+	if historySize <= 0 {
+		historySize = 1000
+	}
+	return &memoryBroker{
+		hub:   NewHub(),
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:  historySize,
+	}
+}
+
+func (m *memoryBroker) Start(ctx context.Context) {
+}
+
+func (m *memoryBroker) Close() {
+	m.hub.Close()
+}
+
+func (m *memoryBroker) Publish(ctx context.Context, change repository.Change) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sequence++
+	event := Event{
+		Id:     m.eventId(m.sequence),
+		Change: change,
+	}
+	m.history = append(m.history, event)
+	if len(m.history) > m.size {
+		m.history = m.history[len(m.history)-m.size:]
+	}
+	m.hub.Broadcast(event)
+	return nil
+}
+
+func (m *memoryBroker) Subscribe(ctx context.Context, lastEventId string) (<-chan Event, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	replay := []Event{}
+	if lastEventId != "" {
+		// an id of another process or an unparsable one replays the whole history
+		last := m.sequenceOf(lastEventId)
+		for _, event := range m.history {
+			if m.sequenceOf(event.Id) > last {
+				replay = append(replay, event)
+			}
+		}
+	}
+	return m.hub.Subscribe(ctx, replay), nil
+}
+
+func (m *memoryBroker) eventId(sequence uint64) string {
+	return m.epoch + "-" + strconv.FormatUint(sequence, 10)
+}
+
+func (m *memoryBroker) sequenceOf(id string) uint64 {
+	epoch, sequence, _ := strings.Cut(id, "-")
+	if epoch != m.epoch {
+		return 0
+	}
+	s, _ := strconv.ParseUint(sequence, 10, 64)
+	return s
+}
@@ -0,0 +1,250 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	pb "github.com/dkrizic/todo/api"
+	"github.com/dkrizic/todo/server/backend/feed"
+	"github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const grpcApiVersion = "v1"
+
+// grpcServer serves the repository and the change feed over gRPC
+type grpcServer struct {
+	pb.UnimplementedToDoServiceServer
+}
+
+// NewGrpcServer creates the gRPC server. Idle connections are pinged so that
+// dead watchers are detected, clients may ping every 10 seconds.
+func NewGrpcServer(options ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    30 * time.Second,
+			Timeout: 10 * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}, options...)...)
+	pb.RegisterToDoServiceServer(server, &grpcServer{})
+	return server
+}
+
+func (g *grpcServer) Create(ctx context.Context, req *pb.CreateOrUpdateRequest) (*pb.CreateOrUpdateResponse, error) {
+	ctx, span := otel.Tracer("grpc").Start(ctx, "Create")
+	defer span.End()
+	if req.Todo == nil || req.Todo.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "todo with id is required")
+	}
+	resp, err := ActiveBackend.Implementation.Create(ctx, &repository.CreateOrUpdateRequest{
+		Todo: fromProto(req.Todo, ""),
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, grpcWriteError(err)
+	}
+	return &pb.CreateOrUpdateResponse{Api: grpcApiVersion, Todo: toProto(resp.Todo)}, nil
+}
+
+func (g *grpcServer) Update(ctx context.Context, req *pb.CreateOrUpdateRequest) (*pb.CreateOrUpdateResponse, error) {
+	ctx, span := otel.Tracer("grpc").Start(ctx, "Update")
+	defer span.End()
+	if req.Todo == nil || req.Todo.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "todo with id is required")
+	}
+	existing, err := ActiveBackend.Implementation.Get(ctx, &repository.GetRequest{Id: req.Todo.Id})
+	if err != nil {
+		span.RecordError(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if existing.Todo == nil {
+		return nil, status.Errorf(codes.NotFound, "todo %s not found", req.Todo.Id)
+	}
+	// the status is not part of the gRPC api, keep the stored one
+	resp, err := ActiveBackend.Implementation.Update(ctx, &repository.CreateOrUpdateRequest{
+		Todo: fromProto(req.Todo, existing.Todo.Status),
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, grpcWriteError(err)
+	}
+	return &pb.CreateOrUpdateResponse{Api: grpcApiVersion, Todo: toProto(resp.Todo)}, nil
+}
+
+func (g *grpcServer) GetAll(ctx context.Context, req *pb.GetAllRequest) (*pb.GetAllResponse, error) {
+	ctx, span := otel.Tracer("grpc").Start(ctx, "GetAll")
+	defer span.End()
+	resp, err := ActiveBackend.Implementation.GetAll(ctx, &repository.GetAllRequest{})
+	if err != nil {
+		span.RecordError(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	todos := make([]*pb.ToDo, 0, len(resp.Todos))
+	for _, todo := range resp.Todos {
+		todos = append(todos, toProto(todo))
+	}
+	return &pb.GetAllResponse{Api: grpcApiVersion, Todos: todos}, nil
+}
+
+func (g *grpcServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	ctx, span := otel.Tracer("grpc").Start(ctx, "Get")
+	defer span.End()
+	resp, err := ActiveBackend.Implementation.Get(ctx, &repository.GetRequest{Id: req.Id})
+	if err != nil {
+		span.RecordError(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if resp.Todo == nil {
+		return nil, status.Errorf(codes.NotFound, "todo %s not found", req.Id)
+	}
+	return &pb.GetResponse{Api: grpcApiVersion, Todo: toProto(resp.Todo)}, nil
+}
+
+func (g *grpcServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	ctx, span := otel.Tracer("grpc").Start(ctx, "Delete")
+	defer span.End()
+	if _, err := ActiveBackend.Implementation.Delete(ctx, &repository.DeleteRequest{Id: req.Id}); err != nil {
+		span.RecordError(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.DeleteResponse{Api: grpcApiVersion, Id: req.Id}, nil
+}
+
+// Watch sends the optional snapshot followed by the changes. Sending blocks
+// while the client does not read (HTTP/2 flow control), a client that falls
+// too far behind is dropped from the feed and gets Unavailable, it then
+// resumes with the revision of the last change it received.
+func (g *grpcServer) Watch(req *pb.WatchRequest, stream pb.ToDoService_WatchServer) error {
+	ctx := stream.Context()
+	if ActiveBackend.Feed == nil {
+		return status.Error(codes.Unimplemented, "the backend has no change feed")
+	}
+	filter := feed.Filter{
+		Ids:  req.Ids,
+		List: req.List,
+		Tags: req.Tags,
+	}
+	// subscribe before the snapshot so that no change is lost in between,
+	// changes made during the snapshot may already be contained in it
+	events, err := ActiveBackend.Feed.Subscribe(ctx, req.Revision)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	llog := log.WithField("revision", req.Revision)
+	llog.Info("Client started watch")
+
+	if req.InitialSnapshot && req.Revision == "" {
+		if err := sendSnapshot(ctx, stream, filter); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// the client went away or cancelled
+			llog.Info("Client stopped watch")
+			return status.FromContextError(ctx.Err()).Err()
+		case event, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return status.FromContextError(ctx.Err()).Err()
+				}
+				return status.Error(codes.Unavailable, "watch fell behind, resume from the last revision")
+			}
+			if !filter.Matches(event.Change) {
+				continue
+			}
+			err := stream.Send(&pb.WatchResponse{
+				Api:      grpcApiVersion,
+				Revision: event.Id,
+				Event:    &pb.WatchResponse_Change{Change: toProtoChange(event.Change)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendSnapshot(ctx context.Context, stream pb.ToDoService_WatchServer, filter feed.Filter) error {
+	ctx, span := otel.Tracer("grpc").Start(ctx, "Watch/Snapshot")
+	defer span.End()
+	all, err := ActiveBackend.Implementation.GetAll(ctx, &repository.GetAllRequest{})
+	if err != nil {
+		span.RecordError(err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	for _, todo := range all.Todos {
+		if !filter.Matches(repository.Change{After: todo}) {
+			continue
+		}
+		err := stream.Send(&pb.WatchResponse{
+			Api:   grpcApiVersion,
+			Event: &pb.WatchResponse_Snapshot{Snapshot: toProto(todo)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return stream.Send(&pb.WatchResponse{
+		Api:   grpcApiVersion,
+		Event: &pb.WatchResponse_SnapshotEnd{SnapshotEnd: &pb.SnapshotEnd{}},
+	})
+}
+
+// grpcWriteError returns ResourceExhausted if the backend is full
+func grpcWriteError(err error) error {
+	if errors.Is(err, repository.ErrCapacityExceeded) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func toProto(todo *repository.Todo) *pb.ToDo {
+	if todo == nil {
+		return nil
+	}
+	return &pb.ToDo{
+		Id:          todo.Id,
+		Title:       todo.Title,
+		Description: todo.Description,
+		List:        todo.List,
+		Tags:        todo.Tags,
+	}
+}
+
+func fromProto(todo *pb.ToDo, todoStatus string) *repository.Todo {
+	return &repository.Todo{
+		Id:          todo.Id,
+		Title:       todo.Title,
+		Description: todo.Description,
+		Status:      todoStatus,
+		List:        todo.List,
+		Tags:        todo.Tags,
+	}
+}
+
+func toProtoChange(change repository.Change) *pb.Change {
+	changeType := pb.ChangeType_CREATE
+	switch change.ChangeType {
+	case repository.ChangeTypeUpdate:
+		changeType = pb.ChangeType_UPDATE
+	case repository.ChangeTypeDelete:
+		changeType = pb.ChangeType_DELETE
+	}
+	return &pb.Change{
+		Api:        grpcApiVersion,
+		Before:     toProto(change.Before),
+		After:      toProto(change.After),
+		ChangeType: changeType,
+	}
+}
@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"context"
+	pb "github.com/dkrizic/todo/api"
+	"github.com/dkrizic/todo/server/backend/feed"
+	"github.com/dkrizic/todo/server/backend/memory"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+func startGrpc(t *testing.T) pb.ToDoServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewGrpcServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewToDoServiceClient(conn)
+}
+
+func recv(t *testing.T, stream pb.ToDoService_WatchClient) *pb.WatchResponse {
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestWatch(t *testing.T) {
+	broker := feed.NewMemoryBroker(10)
+	repo, err := memory.NewServer(&memory.Config{MaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ActiveBackend = Backend{
+		Implementation: repo,
+		Feed:           broker,
+	}
+	client := startGrpc(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Create(ctx, &pb.CreateOrUpdateRequest{Todo: &pb.ToDo{Id: "watch-1", Title: "first", List: "work"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	watchCtx, stop := context.WithCancel(ctx)
+	stream, err := client.Watch(watchCtx, &pb.WatchRequest{InitialSnapshot: true, List: "work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := recv(t, stream); resp.GetSnapshot().GetId() != "watch-1" {
+		t.Fatalf("expected snapshot of watch-1, got %v", resp)
+	}
+	if resp := recv(t, stream); resp.GetSnapshotEnd() == nil {
+		t.Fatalf("expected end of snapshot, got %v", resp)
+	}
+
+	second := &repository.Todo{Id: "watch-2", Title: "second", List: "work"}
+	broker.Publish(ctx, repository.Change{ChangeType: repository.ChangeTypeCreate, After: &repository.Todo{Id: "other", List: "home"}})
+	broker.Publish(ctx, repository.Change{ChangeType: repository.ChangeTypeCreate, After: second})
+	resp := recv(t, stream)
+	if resp.GetChange().GetAfter().GetId() != "watch-2" || resp.GetChange().GetChangeType() != pb.ChangeType_CREATE {
+		t.Fatalf("expected creation of watch-2, got %v", resp)
+	}
+	revision := resp.Revision
+	stop()
+
+	// changes while disconnected are delivered after resuming
+	broker.Publish(ctx, repository.Change{ChangeType: repository.ChangeTypeDelete, Before: second})
+	stream, err = client.Watch(ctx, &pb.WatchRequest{InitialSnapshot: true, Revision: revision, List: "work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = recv(t, stream)
+	if resp.GetChange().GetChangeType() != pb.ChangeType_DELETE || resp.GetChange().GetBefore().GetId() != "watch-2" {
+		t.Fatalf("expected deletion of watch-2 without snapshot, got %v", resp)
+	}
+}
@@ -0,0 +1,20 @@
+package health
+
+import (
+	"context"
+	"fmt"
+)
+
+// DiskSpace fails if less than minFree bytes are available to the file system of path
+func DiskSpace(path string, minFree uint64) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		free, err := freeSpace(path)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("only %d bytes free in %s, need %d", free, path, minFree)
+		}
+		return nil
+	})
+}
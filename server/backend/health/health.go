@@ -0,0 +1,222 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOk       = "ok"
+	StatusFailed   = "failed"
+	StatusStarting = "starting"
+	StatusDraining = "draining"
+)
+
+// Checker is implemented by the dependencies the server needs to answer requests
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc turns a function into a Checker
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+type Config struct {
+	// Timeout of a single check, defaults to 2s
+	Timeout time.Duration
+	// CacheTTL is how long the result of a check is reused, defaults to 5s
+	CacheTTL time.Duration
+}
+
+// Probes answers the liveness, readiness and startup probes. The server is
+// not ready before Started is called, so that loading the data is not cut
+// short by a liveness probe and no traffic arrives before it is done, and
+// after Draining is called, so that no new traffic arrives during shutdown.
+type Probes struct {
+	timeout   time.Duration
+	cacheTTL  time.Duration
+	started   atomic.Bool
+	draining  atomic.Bool
+	lock      sync.Mutex
+	liveness  []*check
+	readiness []*check
+}
+
+// check caches the last result of a checker
+type check struct {
+	name    string
+	checker Checker
+	lock    sync.Mutex
+	result  Result
+}
+
+type Result struct {
+	Status string
+	Error  string
+	// Duration of the check, cached results keep the duration of the check that produced them
+	Duration string
+	Checked  time.Time
+}
+
+type Report struct {
+	Status string
+	Checks map[string]Result
+}
+
+func NewProbes(config *Config) *Probes {
+	probes := &Probes{
+		timeout:  config.Timeout,
+		cacheTTL: config.CacheTTL,
+	}
+	if probes.timeout <= 0 {
+		probes.timeout = 2 * time.Second
+	}
+	if probes.cacheTTL <= 0 {
+		probes.cacheTTL = 5 * time.Second
+	}
+	return probes
+}
+
+// AddLiveness adds a check whose failure means the process has to be restarted
+func (p *Probes) AddLiveness(name string, checker Checker) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.liveness = append(p.liveness, &check{name: name, checker: checker})
+}
+
+// AddReadiness adds a check whose failure means the process cannot answer requests right now
+func (p *Probes) AddReadiness(name string, checker Checker) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.readiness = append(p.readiness, &check{name: name, checker: checker})
+}
+
+// Started marks the end of the initialization
+func (p *Probes) Started() {
+	if !p.started.Swap(true) {
+		log.Info("Startup finished")
+	}
+}
+
+// Draining marks the start of the shutdown
+func (p *Probes) Draining() {
+	if !p.draining.Swap(true) {
+		log.Info("Draining, reporting not ready")
+	}
+}
+
+func (p *Probes) Live(ctx context.Context) Report {
+	return p.run(ctx, p.checks(&p.liveness))
+}
+
+func (p *Probes) Ready(ctx context.Context) Report {
+	if !p.started.Load() {
+		return Report{Status: StatusStarting}
+	}
+	if p.draining.Load() {
+		return Report{Status: StatusDraining}
+	}
+	return p.run(ctx, p.checks(&p.readiness))
+}
+
+func (p *Probes) Startup(ctx context.Context) Report {
+	if !p.started.Load() {
+		return Report{Status: StatusStarting}
+	}
+	return Report{Status: StatusOk}
+}
+
+func (p *Probes) checks(checks *[]*check) []*check {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return *checks
+}
+
+// run runs the checks in parallel, the report fails if any check fails
+func (p *Probes) run(ctx context.Context, checks []*check) Report {
+	ctx, span := otel.Tracer("health").Start(ctx, "Check")
+	defer span.End()
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = check.run(ctx, p.timeout, p.cacheTTL)
+		}()
+	}
+	wg.Wait()
+	report := Report{Status: StatusOk, Checks: map[string]Result{}}
+	for i, check := range checks {
+		report.Checks[check.name] = results[i]
+		if results[i].Status != StatusOk {
+			report.Status = StatusFailed
+		}
+	}
+	return report
+}
+
+// run returns the cached result if it is recent enough, probes arriving
+// while the check runs wait for it instead of running it again
+func (c *check) run(ctx context.Context, timeout time.Duration, cacheTTL time.Duration) Result {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.result.Checked.IsZero() && time.Since(c.result.Checked) < cacheTTL {
+		return c.result
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	err := c.checker.Check(ctx)
+	result := Result{
+		Status:   StatusOk,
+		Duration: time.Since(start).String(),
+		Checked:  time.Now(),
+	}
+	if err != nil {
+		result.Status = StatusFailed
+		result.Error = err.Error()
+	}
+	if result.Status != c.result.Status {
+		llog := log.WithField("check", c.name)
+		if err != nil {
+			llog.WithError(err).Warn("Health check failed")
+		} else {
+			llog.Info("Health check succeeded")
+		}
+	}
+	c.result = result
+	return result
+}
+
+// Handler serves /livez, /readyz and /startupz with a JSON report of every
+// check, 503 if it is not ok. /health is the liveness probe of older charts.
+func (p *Probes) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", p.handle(p.Live))
+	mux.HandleFunc("/health", p.handle(p.Live))
+	mux.HandleFunc("/readyz", p.handle(p.Ready))
+	mux.HandleFunc("/startupz", p.handle(p.Startup))
+	return mux
+}
+
+func (p *Probes) handle(probe func(ctx context.Context) Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := probe(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != StatusOk {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
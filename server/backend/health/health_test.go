@@ -0,0 +1,90 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, handler http.Handler, path string) (int, Report) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	var report Report
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code, report
+}
+
+func TestProbes(t *testing.T) {
+	probes := NewProbes(&Config{CacheTTL: time.Minute})
+	var calls atomic.Int64
+	var failure atomic.Value
+	failure.Store("")
+	probes.AddReadiness("redis", CheckerFunc(func(ctx context.Context) error {
+		calls.Add(1)
+		if message := failure.Load().(string); message != "" {
+			return errors.New(message)
+		}
+		return nil
+	}))
+	handler := probes.Handler()
+
+	// alive but not ready while starting
+	if code, _ := probe(t, handler, "/livez"); code != http.StatusOK {
+		t.Errorf("Expected a live server while starting, got %d", code)
+	}
+	for _, path := range []string{"/readyz", "/startupz"} {
+		if code, report := probe(t, handler, path); code != http.StatusServiceUnavailable || report.Status != StatusStarting {
+			t.Errorf("Expected %s to be starting, got %d %+v", path, code, report)
+		}
+	}
+
+	probes.Started()
+	code, report := probe(t, handler, "/readyz")
+	if code != http.StatusOK || report.Checks["redis"].Status != StatusOk {
+		t.Errorf("Expected a ready server, got %d %+v", code, report)
+	}
+
+	// the result is cached
+	failure.Store("connection refused")
+	probe(t, handler, "/readyz")
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 check, got %d", calls.Load())
+	}
+
+	probes.Draining()
+	if code, report := probe(t, handler, "/readyz"); code != http.StatusServiceUnavailable || report.Status != StatusDraining {
+		t.Errorf("Expected a draining server, got %d %+v", code, report)
+	}
+}
+
+func TestProbesFailure(t *testing.T) {
+	probes := NewProbes(&Config{Timeout: 10 * time.Millisecond})
+	probes.AddReadiness("slow", CheckerFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	probes.AddReadiness("disk", DiskSpace(t.TempDir(), math.MaxUint64))
+	probes.Started()
+	code, report := probe(t, probes.Handler(), "/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != StatusFailed {
+		t.Fatalf("Expected a failed readiness, got %d %+v", code, report)
+	}
+	for _, name := range []string{"slow", "disk"} {
+		if result := report.Checks[name]; result.Status != StatusFailed || result.Error == "" {
+			t.Errorf("Expected %s to fail with an error, got %+v", name, result)
+		}
+	}
+	// liveness does not depend on the backends
+	if code, _ := probe(t, probes.Handler(), "/livez"); code != http.StatusOK {
+		t.Errorf("Expected a live server, got %d", code)
+	}
+}
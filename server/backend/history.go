@@ -0,0 +1,13 @@
+package backend
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"time"
+)
+
+// HistoryReader is implemented by backends that keep every change, it
+// returns the todo as it was at the time or nil if it did not exist
+type HistoryReader interface {
+	GetAsOf(ctx context.Context, id string, asOf time.Time) (*repository.Todo, error)
+}
@@ -0,0 +1,46 @@
+package backend
+
+import (
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_http_requests_total",
+		Help: "HTTP requests by route and status code",
+	}, []string{"method", "route", "code"})
+	httpRequestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_http_request_duration_seconds",
+		Help:    "Duration of the HTTP requests by route, streams count until they are closed",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// unmatchedRoute is the label of requests no route matched, so that unknown paths do not create new series
+const unmatchedRoute = "unmatched"
+
+// httpMetrics counts the requests by the chi route pattern, e.g. /api/v1/todos/{id}
+func httpMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// keeps http.Flusher and http.Hijacker of w for the feed and the websocket
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		route := unmatchedRoute
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil && routeContext.RoutePattern() != "" {
+			route = routeContext.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		httpRequestsTotal.WithLabelValues(r.Method, route, strconv.Itoa(code)).Inc()
+		httpRequestDurationSeconds.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
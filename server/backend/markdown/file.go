@@ -0,0 +1,140 @@
+package markdown
+
+import (
+	"bytes"
+	"fmt"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	extension = ".md"
+	delimiter = "---"
+)
+
+// frontMatter is the YAML header of a todo file, the body is the description
+type frontMatter struct {
+	Id       string    `yaml:"id"`
+	Title    string    `yaml:"title"`
+	Status   string    `yaml:"status,omitempty"`
+	List     string    `yaml:"list,omitempty"`
+	Tags     []string  `yaml:"tags,omitempty"`
+	Revision uint64    `yaml:"revision,omitempty"`
+	Created  time.Time `yaml:"created,omitempty"`
+	Updated  time.Time `yaml:"updated,omitempty"`
+}
+
+// document is a todo together with the file it is stored in
+type document struct {
+	todo    *repository.Todo
+	file    string
+	created time.Time
+	updated time.Time
+}
+
+// fileName escapes the id so that it is a single file name that is not hidden
+func fileName(id string) string {
+	name := url.PathEscape(id)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name + extension
+}
+
+// isTodoFile skips hidden files, which includes the temporary files of writes
+func isTodoFile(name string) bool {
+	return strings.HasSuffix(name, extension) && !strings.HasPrefix(name, ".")
+}
+
+func render(doc *document) ([]byte, error) {
+	header, err := yaml.Marshal(&frontMatter{
+		Id:       doc.todo.Id,
+		Title:    doc.todo.Title,
+		Status:   doc.todo.Status,
+		List:     doc.todo.List,
+		Tags:     doc.todo.Tags,
+		Revision: doc.todo.Revision,
+		Created:  doc.created,
+		Updated:  doc.updated,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString(delimiter + "\n")
+	buffer.Write(header)
+	buffer.WriteString(delimiter + "\n\n")
+	buffer.WriteString(doc.todo.Description)
+	if doc.todo.Description != "" {
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes(), nil
+}
+
+// parse reads a todo file. A file without front matter is only a description,
+// its id is taken from the file name.
+func parse(name string, data []byte) (*document, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	id, err := url.PathUnescape(strings.TrimSuffix(name, extension))
+	if err != nil {
+		id = strings.TrimSuffix(name, extension)
+	}
+	header := frontMatter{Id: id}
+	body := text
+	if strings.HasPrefix(text, delimiter+"\n") {
+		rest := text[len(delimiter)+1:]
+		end := strings.Index(rest, "\n"+delimiter)
+		if end < 0 {
+			return nil, fmt.Errorf("front matter of %s is not closed", name)
+		}
+		if err := yaml.Unmarshal([]byte(rest[:end+1]), &header); err != nil {
+			return nil, fmt.Errorf("invalid front matter in %s: %w", name, err)
+		}
+		body = rest[end+1+len(delimiter):]
+		body = strings.TrimPrefix(strings.TrimPrefix(body, "\n"), "\n")
+		if header.Id == "" {
+			header.Id = id
+		}
+	}
+	return &document{
+		todo: &repository.Todo{
+			Id:          header.Id,
+			Title:       header.Title,
+			Description: strings.TrimSuffix(body, "\n"),
+			Status:      header.Status,
+			List:        header.List,
+			Tags:        header.Tags,
+			Revision:    header.Revision,
+		},
+		file:    name,
+		created: header.Created,
+		updated: header.Updated,
+	}, nil
+}
+
+// writeFileAtomic writes to a hidden temporary file first, readers and the
+// watcher never see a half written todo
+func writeFileAtomic(dir string, name string, data []byte) error {
+	temp, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(dir, name))
+}
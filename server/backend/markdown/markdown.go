@@ -0,0 +1,274 @@
+package markdown
+
+import (
+	"context"
+	"encoding/json"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// server keeps one Markdown file per todo in a directory and a copy of all
+// of them in memory. Changes made to the files by others are picked up by
+// the watcher.
+type server struct {
+	dir  string
+	lock sync.RWMutex
+	// documents by id, files maps the file names to the ids
+	documents map[string]*document
+	files     map[string]string
+	// sequence is the highest revision handed out, revisions holds the
+	// revisions of external edits, which are not in the front matter. Both
+	// are kept in the state file so that revisions survive a restart.
+	sequence  uint64
+	revisions map[string]uint64
+}
+
+// stateFile is hidden, so it is not taken for a todo
+const stateFile = ".revisions.json"
+
+type state struct {
+	Sequence  uint64            `json:"sequence"`
+	Revisions map[string]uint64 `json:"revisions,omitempty"`
+}
+
+type Config struct {
+	// Dir holds the todo files, it is created if it does not exist
+	Dir string
+}
+
+func NewServer(config *Config) (*server, error) {
+	log.WithField("dir", config.Dir).Info("Creating new markdown server")
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	myServer := &server{
+		dir:       config.Dir,
+		documents: map[string]*document{},
+		files:     map[string]string{},
+		revisions: map[string]uint64{},
+	}
+	if err := myServer.loadState(); err != nil {
+		return nil, err
+	}
+	if err := myServer.load(); err != nil {
+		return nil, err
+	}
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer, nil
+}
+
+func (s *server) Name() string {
+	return "markdown"
+}
+
+// load reads all todo files, files that cannot be parsed are skipped
+func (s *server) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isTodoFile(entry.Name()) {
+			continue
+		}
+		doc, err := s.read(entry.Name())
+		if err != nil {
+			log.WithError(err).WithField("file", entry.Name()).Warn("Skipping todo file")
+			continue
+		}
+		if existing, ok := s.documents[doc.todo.Id]; ok {
+			log.WithField("id", doc.todo.Id).WithField("file", doc.file).WithField("other", existing.file).Warn("Duplicate todo id")
+			delete(s.files, existing.file)
+		}
+		doc.todo.Revision = max(doc.todo.Revision, s.revisions[doc.todo.Id])
+		s.documents[doc.todo.Id] = doc
+		s.files[doc.file] = doc.todo.Id
+		s.sequence = max(s.sequence, doc.todo.Revision)
+	}
+	log.WithField("todos", len(s.documents)).Info("Loaded todo files")
+	return nil
+}
+
+func (s *server) loadState() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var loaded state
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	s.sequence = loaded.Sequence
+	if loaded.Revisions != nil {
+		s.revisions = loaded.Revisions
+	}
+	return nil
+}
+
+// saveState has to be called with the lock held
+func (s *server) saveState() error {
+	data, err := json.Marshal(&state{Sequence: s.sequence, Revisions: s.revisions})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.dir, stateFile, data)
+}
+
+func (s *server) read(name string) (*document, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return parse(name, data)
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("markdown").Start(ctx, "Create")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Creating new todo")
+	todo, err := s.write(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("markdown").Start(ctx, "Update")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Updating todo")
+	todo, err := s.write(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+// write stores the todo in its existing file or in a new one named after the id
+func (s *server) write(req *repository.CreateOrUpdateRequest) (*repository.Todo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	before := s.documents[req.Todo.Id]
+	if !matchesRevision(before, req.IfRevision) || (req.IfAbsent && before != nil) {
+		return nil, repository.ErrConflict
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	doc := &document{
+		todo:    copyTodo(req.Todo),
+		file:    fileName(req.Todo.Id),
+		created: now,
+		updated: now,
+	}
+	if before != nil {
+		doc.file = before.file
+		doc.created = before.created
+	}
+	doc.todo.Revision = s.sequence + 1
+	data, err := render(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(s.dir, doc.file, data); err != nil {
+		return nil, err
+	}
+	// the front matter has the revision now
+	s.sequence = doc.todo.Revision
+	delete(s.revisions, doc.todo.Id)
+	s.documents[doc.todo.Id] = doc
+	s.files[doc.file] = doc.todo.Id
+	return copyTodo(doc.todo), nil
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("markdown").Start(ctx, "GetAll")
+	defer span.End()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	todos := make([]*repository.Todo, 0, len(s.documents))
+	for _, doc := range s.documents {
+		todos = append(todos, copyTodo(doc.todo))
+	}
+	log.WithField("count", len(todos)).Info("Getting all todos")
+	return &repository.GetAllResponse{
+		Todos: repository.Select(todos, req),
+	}, nil
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("markdown").Start(ctx, "Get")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Getting todo")
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	doc, ok := s.documents[req.Id]
+	if !ok {
+		return &repository.GetResponse{}, nil
+	}
+	return &repository.GetResponse{
+		Todo: copyTodo(doc.todo),
+	}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("markdown").Start(ctx, "Delete")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Deleting todo")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	doc := s.documents[req.Id]
+	if !matchesRevision(doc, req.IfRevision) {
+		return nil, repository.ErrConflict
+	}
+	if doc != nil {
+		// the revision of the delete is saved first, it must not be reused
+		s.sequence++
+		delete(s.revisions, req.Id)
+		if err := s.saveState(); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		if err := os.Remove(filepath.Join(s.dir, doc.file)); err != nil && !os.IsNotExist(err) {
+			span.RecordError(err)
+			return nil, err
+		}
+		delete(s.documents, req.Id)
+		delete(s.files, doc.file)
+	}
+	return &repository.DeleteResponse{
+		Id: req.Id,
+	}, nil
+}
+
+func matchesRevision(doc *document, revision uint64) bool {
+	return revision == 0 || (doc != nil && doc.todo.Revision == revision)
+}
+
+func copyTodo(todo *repository.Todo) *repository.Todo {
+	copied := *todo
+	if todo.Tags != nil {
+		copied.Tags = append([]string{}, todo.Tags...)
+	}
+	return &copied
+}
+
+// sameContent ignores the revision, it tells if a file event is a real edit
+func sameContent(a *repository.Todo, b *repository.Todo) bool {
+	return a.Id == b.Id && a.Title == b.Title && a.Description == b.Description &&
+		a.Status == b.Status && a.List == b.List && slices.Equal(a.Tags, b.Tags)
+}
@@ -0,0 +1,110 @@
+package markdown
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarkdown(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewServer(&Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	todo := &repository.Todo{Id: "a/b", Title: "Shop", Description: "Milk\n\nBread", Status: "ACTIVE", Tags: []string{"home"}}
+	if _, err := s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: todo}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "a%2Fb.md"))
+	if err != nil || !strings.HasSuffix(string(data), "---\n\nMilk\n\nBread\n") {
+		t.Fatalf("Unexpected file %q %v", data, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the todo file, got %d entries", len(entries))
+	}
+
+	// a new server reads the files back
+	s, err = NewServer(&Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := s.Get(ctx, &repository.GetRequest{Id: "a/b"})
+	if got.Todo == nil || got.Todo.Description != todo.Description || got.Todo.Tags[0] != "home" || got.Todo.Revision != 1 {
+		t.Fatalf("Unexpected todo %+v", got.Todo)
+	}
+	if _, err := s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: todo, IfRevision: 2}); err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+
+	changes := make(chan repository.Change, 10)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err = s.Watch(watchCtx, func(ctx context.Context, change repository.Change) error {
+		changes <- change
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// own writes are not reported again
+	if _, err := s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "a/b", Title: "Shopping"}}); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "new.md"), []byte("Written in an editor\n"), 0o644)
+	change := receive(t, changes)
+	if change.ChangeType != repository.ChangeTypeCreate || change.After.Id != "new" || change.After.Description != "Written in an editor" {
+		t.Errorf("Unexpected change %+v", change)
+	}
+	os.Remove(filepath.Join(dir, "a%2Fb.md"))
+	change = receive(t, changes)
+	if change.ChangeType != repository.ChangeTypeDelete || change.Before.Title != "Shopping" {
+		t.Errorf("Unexpected change %+v", change)
+	}
+	all, _ := s.GetAll(ctx, &repository.GetAllRequest{})
+	if len(all.Todos) != 1 || all.Todos[0].Id != "new" {
+		t.Errorf("Expected only the new todo, got %+v", all.Todos)
+	}
+
+	// the revisions of the edit and the delete survive a restart
+	cancel()
+	s, err = NewServer(&Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = s.Get(ctx, &repository.GetRequest{Id: "new"})
+	if got.Todo == nil || got.Todo.Revision != 3 {
+		t.Fatalf("Expected revision 3, got %+v", got.Todo)
+	}
+	created, err := s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "next"}})
+	if err != nil || created.Todo.Revision != 5 {
+		t.Errorf("Expected revision 5, got %+v %v", created, err)
+	}
+}
+
+func receive(t *testing.T, changes chan repository.Change) repository.Change {
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("No change received")
+		return repository.Change{}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		s, err := NewServer(&Config{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,139 @@
+package markdown
+
+import (
+	"context"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// debounce collects the events of an editor saving a file into one reload
+const debounce = 100 * time.Millisecond
+
+// Watch picks up todo files changed outside of the server and hands every
+// change to publish. It returns once the watcher is set up and stops when
+// the context is done.
+func (s *server) Watch(ctx context.Context, publish func(ctx context.Context, change repository.Change) error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(s.dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	log.WithField("dir", s.dir).Info("Watching todo files")
+	go func() {
+		defer watcher.Close()
+		timers := map[string]*time.Timer{}
+		for {
+			select {
+			case <-ctx.Done():
+				for _, timer := range timers {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(event.Name)
+				if !isTodoFile(name) {
+					continue
+				}
+				if timer, ok := timers[name]; ok {
+					timer.Reset(debounce)
+					continue
+				}
+				timers[name] = time.AfterFunc(debounce, func() {
+					if ctx.Err() != nil {
+						return
+					}
+					for _, change := range s.reload(ctx, name) {
+						if err := publish(ctx, change); err != nil {
+							log.WithError(err).WithField("file", name).Warn("Failed to publish change")
+						}
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("Watching todo files failed")
+			}
+		}
+	}()
+	return nil
+}
+
+// reload brings the cache in line with the file and returns the changes.
+// Writes of the server itself leave the content unchanged and return nothing.
+func (s *server) reload(ctx context.Context, name string) []repository.Change {
+	ctx, span := otel.Tracer("markdown").Start(ctx, "reload")
+	defer span.End()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changes := []repository.Change{}
+	doc, err := s.read(name)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", name).Warn("Ignoring invalid todo file")
+		return changes
+	}
+	// the file is gone or now holds another todo
+	if id, ok := s.files[name]; ok && (doc == nil || doc.todo.Id != id) {
+		before := s.documents[id]
+		s.sequence++
+		delete(s.documents, id)
+		delete(s.files, name)
+		delete(s.revisions, id)
+		changes = append(changes, repository.Change{
+			Before:     copyTodo(before.todo),
+			ChangeType: repository.ChangeTypeDelete,
+		})
+	}
+	if doc == nil {
+		if len(changes) > 0 {
+			s.persist(name)
+		}
+		return changes
+	}
+	before := s.documents[doc.todo.Id]
+	if before != nil && before.file != name {
+		log.WithField("id", doc.todo.Id).WithField("file", name).WithField("other", before.file).Warn("Duplicate todo id")
+		if len(changes) > 0 {
+			s.persist(name)
+		}
+		return changes
+	}
+	if before != nil && sameContent(before.todo, doc.todo) {
+		return changes
+	}
+	s.sequence++
+	doc.todo.Revision = s.sequence
+	s.revisions[doc.todo.Id] = s.sequence
+	s.persist(name)
+	s.documents[doc.todo.Id] = doc
+	s.files[name] = doc.todo.Id
+	change := repository.Change{
+		After:      copyTodo(doc.todo),
+		ChangeType: repository.ChangeTypeCreate,
+	}
+	if before != nil {
+		change.Before = copyTodo(before.todo)
+		change.ChangeType = repository.ChangeTypeUpdate
+	}
+	log.WithField("id", doc.todo.Id).WithField("file", name).WithField("type", change.ChangeType).Info("Todo file changed")
+	return append(changes, change)
+}
+
+// persist saves the revisions of an external change, the file has changed
+// already so a failure can only be logged
+func (s *server) persist(name string) {
+	if err := s.saveState(); err != nil {
+		log.WithError(err).WithField("file", name).Warn("Failed to save the revisions")
+	}
+}
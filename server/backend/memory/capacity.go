@@ -0,0 +1,91 @@
+package memory
+
+import (
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// what happens if a new todo does not fit anymore
+const (
+	// EvictionReject fails the write with repository.ErrCapacityExceeded
+	EvictionReject = "reject"
+	// EvictionLRU removes the todo that was read or written least recently
+	EvictionLRU = "lru"
+	// EvictionCompleted removes the completed todo with the oldest change and
+	// rejects the write if no todo is completed
+	EvictionCompleted = "completed"
+)
+
+var (
+	entriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_memory_entries",
+		Help: "The number of todos stored in memory",
+	})
+	capacityGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_memory_capacity",
+		Help: "The maximum number of todos stored in memory, 0 is unlimited",
+	})
+	evictedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_memory_evictions_total",
+		Help: "The number of todos removed to make room for new ones",
+	})
+	rejectedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_memory_rejected_total",
+		Help: "The number of new todos rejected because the memory was full",
+	})
+)
+
+// reserve makes room for a new todo, must be called with the lock held
+func (s *server) reserve() error {
+	if s.maxEntries <= 0 || s.count < s.maxEntries {
+		return nil
+	}
+	victim := ""
+	switch s.eviction {
+	case EvictionLRU:
+		victim = s.leastRecentlyUsed()
+	case EvictionCompleted:
+		victim = s.oldestCompleted()
+	}
+	if victim == "" {
+		rejectedCounter.Inc()
+		return repository.ErrCapacityExceeded
+	}
+	log.WithField("id", victim).WithField("eviction", s.eviction).Info("Evicting todo")
+	if err := s.remove(victim); err != nil {
+		return err
+	}
+	evictedCounter.Inc()
+	return nil
+}
+
+func (s *server) leastRecentlyUsed() string {
+	victim := ""
+	var oldest int64
+	for _, shard := range s.shards {
+		for id, stored := range shard.entries {
+			if accessed := stored.accessed.Load(); victim == "" || accessed < oldest {
+				victim, oldest = id, accessed
+			}
+		}
+	}
+	return victim
+}
+
+func (s *server) oldestCompleted() string {
+	victim := ""
+	var oldest uint64
+	for _, shard := range s.shards {
+		for id, stored := range shard.entries {
+			if stored.todo.Status != repository.StatusCompleted {
+				continue
+			}
+			if victim == "" || stored.todo.Revision < oldest {
+				victim, oldest = id, stored.todo.Revision
+			}
+		}
+	}
+	return victim
+}
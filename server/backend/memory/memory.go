@@ -2,39 +2,158 @@ package memory
 
 import (
 	"context"
+	"github.com/dkrizic/todo/server/backend/outbox"
 	repository "github.com/dkrizic/todo/server/backend/repository"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
-	"golang.org/x/exp/maps"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var todoMap = map[string]*repository.Todo{}
+const (
+	// DefaultShards is the number of shards if none are configured
+	DefaultShards = 16
+	// DefaultTombstoneRetention is the number of revisions deletions are kept for sync
+	DefaultTombstoneRetention = 10000
+)
 
+// server keeps the todos in shards so that readers of different todos do not
+// contend. Writers are serialized by lock, which also guards the revisions,
+// the tombstones and the outbox, and only lock the shard they change. Code
+// holding lock may read all shards without their locks.
 type server struct {
+	lock       sync.RWMutex
+	shards     []*shard
+	count      int
 	maxEntries int
+	eviction   string
+	outbox     *outboxStore
+	// sequence is the revision of the last change, tombstones keep the
+	// revision of the deletion for the todos deleted after the horizon
+	sequence   uint64
+	tombstones map[string]uint64
+	horizon    uint64
+	retention  uint64
+	// epoch is part of the sync tokens, tokens of a previous process cause a reset
+	epoch string
+	// clock orders the accesses for the LRU eviction
+	clock atomic.Int64
+	// wal is nil without a data directory
+	wal         *wal
+	dataDir     string
+	snapshotted uint64
+	// snapshotLock serializes snapshots
+	snapshotLock sync.Mutex
+	stop         chan struct{}
+	background   sync.WaitGroup
+}
+
+type shard struct {
+	lock    sync.RWMutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	todo     *repository.Todo
+	accessed atomic.Int64
+}
+
+type Config struct {
+	// MaxEntries is the maximum number of todos, 0 is unlimited
+	MaxEntries int
+	// Eviction decides what happens if MaxEntries is reached, EvictionReject by default
+	Eviction string
+	// Shards is the number of shards, DefaultShards if 0
+	Shards int
+	// Outbox records every change together with the todo
+	Outbox bool
+	// DataDir keeps the snapshots and the write-ahead log, nothing is persisted if empty
+	DataDir string
+	// Fsync is one of FsyncAlways (default), FsyncInterval and FsyncNever
+	Fsync string
+	// SnapshotInterval is the time between two snapshots, 0 only snapshots on Close
+	SnapshotInterval time.Duration
+	// TombstoneRetention is the number of revisions a deletion is kept for sync,
+	// DefaultTombstoneRetention if 0
+	TombstoneRetention uint64
 }
 
-func NewServer(maxEntries int) *server {
-	log.WithField("maxEntries", maxEntries).Info("Creating new memory server")
+func NewServer(config *Config) (*server, error) {
+	log.WithFields(log.Fields{
+		"maxEntries":         config.MaxEntries,
+		"eviction":           config.Eviction,
+		"shards":             config.Shards,
+		"outbox":             config.Outbox,
+		"dataDir":            config.DataDir,
+		"fsync":              config.Fsync,
+		"snapshotInterval":   config.SnapshotInterval,
+		"tombstoneRetention": config.TombstoneRetention,
+	}).Info("Creating new memory server")
+	shards := config.Shards
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	eviction := config.Eviction
+	if eviction == "" {
+		eviction = EvictionReject
+	}
+	retention := config.TombstoneRetention
+	if retention == 0 {
+		retention = DefaultTombstoneRetention
+	}
 	myServer := &server{
-		maxEntries: maxEntries,
+		shards:     make([]*shard, shards),
+		maxEntries: config.MaxEntries,
+		eviction:   eviction,
+		tombstones: map[string]uint64{},
+		retention:  retention,
+		epoch:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		dataDir:    config.DataDir,
+		stop:       make(chan struct{}),
+	}
+	for i := range myServer.shards {
+		myServer.shards[i] = &shard{entries: map[string]*entry{}}
+	}
+	if config.Outbox {
+		myServer.outbox = &outboxStore{lock: &myServer.lock, log: myServer.log}
+	}
+	capacityGauge.Set(float64(config.MaxEntries))
+	entriesGauge.Set(0)
+	if config.DataDir != "" {
+		if err := myServer.restore(config.Fsync); err != nil {
+			return nil, err
+		}
+		myServer.startBackground(config.Fsync, config.SnapshotInterval)
 	}
 	// ensure server implements the inteface
 	var _ repository.TodoRepository = myServer
-	return myServer
+	return myServer, nil
 }
 
 func (s *server) Name() string {
 	return "memory"
 }
+
+func (s *server) shardOf(id string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
 func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
 	ctx, span := otel.Tracer("memory").Start(ctx, "Create")
 	defer span.End()
 	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Creating new todo")
-	// add to map
-	todoMap[req.Todo.Id] = req.Todo
+	todo, err := s.write(req, repository.ChangeTypeCreate)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
 	return &repository.CreateOrUpdateResponse{
-		Todo: req.Todo,
+		Todo: todo,
 	}, nil
 }
 
@@ -42,22 +161,88 @@ func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateReque
 	ctx, span := otel.Tracer("memory").Start(ctx, "Update")
 	defer span.End()
 	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Updating todo")
-	todoMap[req.Todo.Id] = req.Todo
+	todo, err := s.write(req, repository.ChangeTypeUpdate)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
 	return &repository.CreateOrUpdateResponse{
-		Todo: req.Todo,
+		Todo: todo,
 	}, nil
 }
 
+// write stores a copy of the todo and returns another one
+func (s *server) write(req *repository.CreateOrUpdateRequest, changeType repository.ChangeType) (*repository.Todo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.matchesRevision(req.Todo.Id, req.IfRevision) {
+		return nil, repository.ErrConflict
+	}
+	shard := s.shardOf(req.Todo.Id)
+	before, exists := shard.entries[req.Todo.Id]
+	if exists && req.IfAbsent {
+		return nil, repository.ErrConflict
+	}
+	if !exists {
+		if err := s.reserve(); err != nil {
+			return nil, err
+		}
+	}
+	todo := copyTodo(req.Todo)
+	todo.Revision = s.sequence + 1
+	var change *outbox.Record
+	if exists {
+		change = s.change(before.todo, todo, changeType)
+	} else {
+		change = s.change(nil, todo, changeType)
+	}
+	if err := s.log(&logRecord{Sequence: todo.Revision, Todo: todo, Outbox: change}); err != nil {
+		return nil, err
+	}
+	s.enqueue(change)
+	s.put(todo)
+	return copyTodo(todo), nil
+}
+
+// enqueue adds the record to the outbox if there is one, must be called with the lock held
+func (s *server) enqueue(change *outbox.Record) {
+	if s.outbox != nil && change != nil {
+		s.outbox.apply(&logRecord{Outbox: change})
+	}
+}
+
+// put stores the todo under its revision, must be called with the lock held
+func (s *server) put(todo *repository.Todo) {
+	s.sequence = todo.Revision
+	delete(s.tombstones, todo.Id)
+	stored := &entry{todo: todo}
+	stored.accessed.Store(s.clock.Add(1))
+	shard := s.shardOf(todo.Id)
+	shard.lock.Lock()
+	if _, exists := shard.entries[todo.Id]; !exists {
+		s.count++
+	}
+	shard.entries[todo.Id] = stored
+	shard.lock.Unlock()
+	entriesGauge.Set(float64(s.count))
+}
+
 func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
 	ctx, span := otel.Tracer("memory").Start(ctx, "GetAll")
 	defer span.End()
-	log.WithField("count", len(todoMap)).Info("Getting all todos")
-	// convert map of todoMap to slice
-	_, span2 := otel.Tracer("memory").Start(ctx, "GetAll/mapValues")
-	todos := maps.Values(todoMap)
-	defer span2.End()
+	todos := []*repository.Todo{}
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		for _, stored := range shard.entries {
+			if req.Matches(stored.todo) {
+				todos = append(todos, copyTodo(stored.todo))
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	log.WithField("count", len(todos)).Info("Getting all todos")
 	return &repository.GetAllResponse{
-		Todos: todos,
+		Todos: repository.Select(todos, req),
 	}, nil
 }
 
@@ -65,8 +250,16 @@ func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *rep
 	ctx, span := otel.Tracer("memory").Start(ctx, "Get")
 	defer span.End()
 	log.WithField("id", req.Id).Info("Getting todo")
+	shard := s.shardOf(req.Id)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	stored, ok := shard.entries[req.Id]
+	if !ok {
+		return &repository.GetResponse{}, nil
+	}
+	stored.accessed.Store(s.clock.Add(1))
 	return &repository.GetResponse{
-		Todo: todoMap[req.Id],
+		Todo: copyTodo(stored.todo),
 	}, nil
 }
 
@@ -74,8 +267,70 @@ func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (res
 	ctx, span := otel.Tracer("memory").Start(ctx, "Delete")
 	defer span.End()
 	log.WithField("id", req.Id).Info("Deleting todo")
-	delete(todoMap, req.Id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.matchesRevision(req.Id, req.IfRevision) {
+		return nil, repository.ErrConflict
+	}
+	if err := s.remove(req.Id); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
 	return &repository.DeleteResponse{
 		Id: req.Id,
 	}, nil
 }
+
+// remove deletes the todo if it exists, must be called with the lock held
+func (s *server) remove(id string) error {
+	before, ok := s.shardOf(id).entries[id]
+	if !ok {
+		return nil
+	}
+	sequence := s.sequence + 1
+	change := s.change(before.todo, nil, repository.ChangeTypeDelete)
+	if err := s.log(&logRecord{Sequence: sequence, Deleted: id, Outbox: change}); err != nil {
+		return err
+	}
+	s.enqueue(change)
+	s.drop(id, sequence)
+	return nil
+}
+
+// drop deletes the todo and keeps its tombstone, must be called with the lock held
+func (s *server) drop(id string, sequence uint64) {
+	s.sequence = sequence
+	s.tombstones[id] = sequence
+	// pruning every retention revisions keeps between one and two of them
+	if s.sequence > s.horizon+2*s.retention {
+		s.prune()
+	}
+	shard := s.shardOf(id)
+	shard.lock.Lock()
+	if _, exists := shard.entries[id]; exists {
+		delete(shard.entries, id)
+		s.count--
+	}
+	shard.lock.Unlock()
+	entriesGauge.Set(float64(s.count))
+}
+
+// prune drops the tombstones older than the retention, clients that synced
+// before the new horizon get a reset. Must be called with the lock held.
+func (s *server) prune() {
+	s.horizon = s.sequence - s.retention
+	for id, sequence := range s.tombstones {
+		if sequence <= s.horizon {
+			delete(s.tombstones, id)
+		}
+	}
+}
+
+// copyTodo copies the todo including its tags, callers never share the stored todos
+func copyTodo(todo *repository.Todo) *repository.Todo {
+	copied := *todo
+	if todo.Tags != nil {
+		copied.Tags = append([]string{}, todo.Tags...)
+	}
+	return &copied
+}
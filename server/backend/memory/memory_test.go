@@ -0,0 +1,217 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func create(t *testing.T, s *server, todo *repository.Todo) error {
+	t.Helper()
+	_, err := s.Create(context.Background(), &repository.CreateOrUpdateRequest{Todo: todo})
+	return err
+}
+
+func newServer(t *testing.T, config *Config) *server {
+	t.Helper()
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	s := newServer(t, &Config{Shards: 4})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := fmt.Sprintf("%d-%d", i, j)
+				create(t, s, &repository.Todo{Id: id, Tags: []string{"a"}})
+				s.Get(context.Background(), &repository.GetRequest{Id: id})
+				s.GetAll(context.Background(), &repository.GetAllRequest{})
+			}
+		}(i)
+	}
+	wg.Wait()
+	all, _ := s.GetAll(context.Background(), &repository.GetAllRequest{})
+	if len(all.Todos) != 400 {
+		t.Errorf("Expected 400 todos, got %d", len(all.Todos))
+	}
+}
+
+func TestCopies(t *testing.T) {
+	s := newServer(t, &Config{})
+	todo := &repository.Todo{Id: "1", Title: "title", Tags: []string{"a"}}
+	create(t, s, todo)
+	todo.Title = "changed"
+	todo.Tags[0] = "changed"
+	got, _ := s.Get(context.Background(), &repository.GetRequest{Id: "1"})
+	got.Todo.Tags[0] = "changed"
+	again, _ := s.Get(context.Background(), &repository.GetRequest{Id: "1"})
+	if again.Todo.Title != "title" || again.Todo.Tags[0] != "a" {
+		t.Errorf("Expected the stored todo to be unchanged, got %+v", again.Todo)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	reject := newServer(t, &Config{MaxEntries: 2})
+	create(t, reject, &repository.Todo{Id: "1"})
+	create(t, reject, &repository.Todo{Id: "2"})
+	if err := create(t, reject, &repository.Todo{Id: "3"}); err != repository.ErrCapacityExceeded {
+		t.Errorf("Expected the capacity to be exceeded, got %v", err)
+	}
+	if err := create(t, reject, &repository.Todo{Id: "2", Title: "update"}); err != nil {
+		t.Errorf("Expected an update of a full store to work, got %v", err)
+	}
+
+	lru := newServer(t, &Config{MaxEntries: 2, Eviction: EvictionLRU})
+	create(t, lru, &repository.Todo{Id: "1"})
+	create(t, lru, &repository.Todo{Id: "2"})
+	lru.Get(context.Background(), &repository.GetRequest{Id: "1"})
+	if err := create(t, lru, &repository.Todo{Id: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := lru.Get(context.Background(), &repository.GetRequest{Id: "2"}); got.Todo != nil {
+		t.Errorf("Expected the least recently used todo to be evicted")
+	}
+
+	completed := newServer(t, &Config{MaxEntries: 2, Eviction: EvictionCompleted})
+	create(t, completed, &repository.Todo{Id: "1"})
+	create(t, completed, &repository.Todo{Id: "2", Status: repository.StatusCompleted})
+	if err := create(t, completed, &repository.Todo{Id: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := create(t, completed, &repository.Todo{Id: "4"}); err != repository.ErrCapacityExceeded {
+		t.Errorf("Expected a rejection without completed todos, got %v", err)
+	}
+	if got, _ := completed.Get(context.Background(), &repository.GetRequest{Id: "2"}); got.Todo != nil {
+		t.Errorf("Expected the completed todo to be evicted")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	s := newServer(t, &Config{DataDir: dir})
+	create(t, s, &repository.Todo{Id: "1", Title: "first"})
+	create(t, s, &repository.Todo{Id: "2", Title: "second"})
+	if err := s.takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	create(t, s, &repository.Todo{Id: "3", Title: "third"})
+	s.Delete(context.Background(), &repository.DeleteRequest{Id: "1"})
+	s.wal.close()
+
+	// a crash in the middle of a write leaves half a frame behind
+	paths, _ := segments(dir)
+	file, err := os.OpenFile(paths[len(paths)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(frame([]byte(`{"Sequence":99}`))[:10])
+	file.Close()
+
+	restored := newServer(t, &Config{DataDir: dir})
+	all, _ := restored.GetAll(context.Background(), &repository.GetAllRequest{})
+	if len(all.Todos) != 2 {
+		t.Fatalf("Expected 2 todos, got %+v", all.Todos)
+	}
+	if got, _ := restored.Get(context.Background(), &repository.GetRequest{Id: "3"}); got.Todo == nil || got.Todo.Revision != 3 {
+		t.Errorf("Expected todo 3 with revision 3, got %+v", got.Todo)
+	}
+	if restored.sequence != 4 || restored.tombstones["1"] != 4 || restored.epoch != s.epoch {
+		t.Errorf("Expected sequence, tombstones and epoch to be restored")
+	}
+	create(t, restored, &repository.Todo{Id: "4"})
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again := newServer(t, &Config{DataDir: dir})
+	if got, _ := again.Get(context.Background(), &repository.GetRequest{Id: "4"}); got.Todo == nil || got.Todo.Revision != 5 {
+		t.Errorf("Expected todo 4 after appending to a repaired log, got %+v", got.Todo)
+	}
+	if paths, _ := segments(dir); len(paths) != 1 {
+		t.Errorf("Expected the snapshot on close to compact the log, got %v", paths)
+	}
+}
+
+// test that the pending changes survive a crash and a snapshot
+func TestOutboxPersistence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := newServer(t, &Config{DataDir: dir, Outbox: true})
+	create(t, s, &repository.Todo{Id: "1"})
+	create(t, s, &repository.Todo{Id: "2"})
+	pending, _ := s.outbox.Pending(ctx, 10)
+	if err := s.outbox.Ack(ctx, pending[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	failed := pending[1]
+	failed.Attempts, failed.Delivered = 2, []string{"sender"}
+	if err := s.outbox.Fail(ctx, failed); err != nil {
+		t.Fatal(err)
+	}
+	s.Delete(ctx, &repository.DeleteRequest{Id: "1"})
+	s.wal.close()
+
+	restored := newServer(t, &Config{DataDir: dir, Outbox: true})
+	pending, _ = restored.outbox.Pending(ctx, 10)
+	if len(pending) != 2 || pending[0].Id != failed.Id || pending[0].Attempts != 2 || len(pending[0].Delivered) != 1 {
+		t.Fatalf("Expected the failed create of 2 and the delete of 1, got %+v", pending)
+	}
+	if pending[1].Change.ChangeType != repository.ChangeTypeDelete || pending[1].Change.Before.Id != "1" {
+		t.Errorf("Expected the delete of 1, got %+v", pending[1].Change)
+	}
+	if err := restored.outbox.DeadLetter(ctx, pending[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again := newServer(t, &Config{DataDir: dir, Outbox: true})
+	if depth, _ := again.outbox.Depth(ctx); depth != 1 || len(again.outbox.deadLetters) != 1 {
+		t.Errorf("Expected one pending record and one dead letter, got %d %d", depth, len(again.outbox.deadLetters))
+	}
+}
+
+// test that old tombstones are pruned and clients behind them get a reset
+func TestTombstones(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t, &Config{TombstoneRetention: 2})
+	for _, id := range []string{"a", "b", "c"} {
+		create(t, s, &repository.Todo{Id: id})
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		s.Delete(ctx, &repository.DeleteRequest{Id: id})
+	}
+	create(t, s, &repository.Todo{Id: "d"})
+	create(t, s, &repository.Todo{Id: "e"})
+	s.Delete(ctx, &repository.DeleteRequest{Id: "d"})
+	if s.horizon != 7 || len(s.tombstones) != 1 || s.tombstones["d"] != 9 {
+		t.Fatalf("Expected only the tombstone of d after horizon 7, got %v %v", s.horizon, s.tombstones)
+	}
+	changes, err := s.Changes(ctx, s.token(6), 10)
+	if err != nil || !changes.Reset || len(changes.Upserts) != 1 {
+		t.Errorf("Expected a reset behind the horizon, got %+v %v", changes, err)
+	}
+	changes, err = s.Changes(ctx, s.token(7), 10)
+	if err != nil || changes.Reset || len(changes.Deletes) != 1 || changes.Deletes[0] != "d" {
+		t.Errorf("Expected the delete of d, got %+v %v", changes, err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		return newServer(t, &Config{})
+	})
+}
@@ -0,0 +1,122 @@
+package memory
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/outbox"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// outboxStore keeps the pending changes in the order they were written. It
+// shares the lock of the server so that a todo and its change are always
+// written together, and its log so that they are persisted in the same frame.
+type outboxStore struct {
+	lock        *sync.RWMutex
+	log         func(record *logRecord) error
+	records     []*outbox.Record
+	deadLetters []*outbox.Record
+}
+
+// Outbox returns the outbox of the server or nil if it is disabled
+func (s *server) Outbox() outbox.Store {
+	if s.outbox == nil {
+		return nil
+	}
+	return s.outbox
+}
+
+// change creates the outbox record of a change, nil if the outbox is disabled
+func (s *server) change(before *repository.Todo, after *repository.Todo, changeType repository.ChangeType) *outbox.Record {
+	if s.outbox == nil {
+		return nil
+	}
+	return &outbox.Record{
+		Id: uuid.New().String(),
+		Change: repository.Change{
+			Before:     before,
+			After:      after,
+			ChangeType: changeType,
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func (o *outboxStore) Pending(ctx context.Context, limit int) ([]*outbox.Record, error) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	if limit > len(o.records) {
+		limit = len(o.records)
+	}
+	records := make([]*outbox.Record, 0, limit)
+	for _, record := range o.records[:limit] {
+		copied := *record
+		records = append(records, &copied)
+	}
+	return records, nil
+}
+
+func (o *outboxStore) Ack(ctx context.Context, id string) error {
+	return o.update(&logRecord{Acked: id})
+}
+
+func (o *outboxStore) Fail(ctx context.Context, record *outbox.Record) error {
+	copied := *record
+	return o.update(&logRecord{Failed: &copied})
+}
+
+func (o *outboxStore) DeadLetter(ctx context.Context, record *outbox.Record) error {
+	copied := *record
+	return o.update(&logRecord{DeadLettered: &copied})
+}
+
+// update logs and applies the change of a pending record
+func (o *outboxStore) update(record *logRecord) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.indexOf(record.outboxId()) < 0 {
+		return outbox.ErrNotFound
+	}
+	if err := o.log(record); err != nil {
+		return err
+	}
+	o.apply(record)
+	return nil
+}
+
+// apply adds a new record or changes a pending one, must be called with the lock held
+func (o *outboxStore) apply(record *logRecord) {
+	if record.Outbox != nil {
+		o.records = append(o.records, record.Outbox)
+		return
+	}
+	index := o.indexOf(record.outboxId())
+	if index < 0 {
+		return
+	}
+	switch {
+	case record.Failed != nil:
+		o.records[index] = record.Failed
+	case record.DeadLettered != nil:
+		o.records = append(o.records[:index], o.records[index+1:]...)
+		o.deadLetters = append(o.deadLetters, record.DeadLettered)
+	default:
+		o.records = append(o.records[:index], o.records[index+1:]...)
+	}
+}
+
+func (o *outboxStore) Depth(ctx context.Context) (int, error) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return len(o.records), nil
+}
+
+func (o *outboxStore) indexOf(id string) int {
+	for i, record := range o.records {
+		if record.Id == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,299 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/outbox"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const epochFile = "epoch"
+
+// snapshot is the complete state up to Sequence, the log continues after it
+type snapshot struct {
+	Sequence    uint64
+	Todos       []*repository.Todo
+	Tombstones  map[string]uint64
+	Horizon     uint64
+	Outbox      []*outbox.Record
+	DeadLetters []*outbox.Record
+}
+
+func snapshotName(sequence uint64) string {
+	return fmt.Sprintf("snapshot-%020d.snap", sequence)
+}
+
+// restore loads the newest snapshot, replays the log after it and opens the
+// log for new changes. A damaged end of the last segment is what a crash
+// during a write leaves behind, it is cut off. Damage anywhere else fails.
+func (s *server) restore(fsync string) error {
+	if err := os.MkdirAll(s.dataDir, 0o700); err != nil {
+		return err
+	}
+	if err := s.restoreEpoch(); err != nil {
+		return err
+	}
+	state, err := loadSnapshot(s.dataDir)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		for _, todo := range state.Todos {
+			s.put(todo)
+		}
+		for id, sequence := range state.Tombstones {
+			s.tombstones[id] = sequence
+		}
+		s.sequence = state.Sequence
+		s.horizon = state.Horizon
+		s.snapshotted = state.Sequence
+		if s.outbox != nil {
+			s.outbox.records = state.Outbox
+			s.outbox.deadLetters = state.DeadLetters
+		} else if len(state.Outbox) > 0 {
+			log.WithField("records", len(state.Outbox)).Warn("Dropping the pending outbox records, the outbox is disabled")
+		}
+	}
+
+	paths, err := segments(s.dataDir)
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	for i, path := range paths {
+		// a snapshot starts a new segment, the outbox updates of the older ones are in it
+		snapshotted := segmentFirst(path) <= s.snapshotted
+		offset, err := readSegment(path, func(record *logRecord) {
+			if record.Todo == nil && record.Deleted == "" {
+				if !snapshotted && s.outbox != nil {
+					s.outbox.apply(record)
+				}
+				return
+			}
+			if record.Sequence <= s.sequence {
+				return
+			}
+			if record.Todo != nil {
+				s.put(record.Todo)
+			} else {
+				s.drop(record.Deleted, record.Sequence)
+			}
+			s.enqueue(record.Outbox)
+			replayed++
+		})
+		if errors.Is(err, errCorrupted) && i == len(paths)-1 {
+			log.WithField("segment", path).WithField("offset", offset).Warn("Cutting off the corrupted end of the log")
+			if err := os.Truncate(path, offset); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay %s at offset %d: %w", path, offset, err)
+		}
+	}
+	log.WithFields(log.Fields{
+		"todos":    s.count,
+		"sequence": s.sequence,
+		"replayed": replayed,
+	}).Info("Restored memory backend")
+
+	if fsync == "" {
+		fsync = FsyncAlways
+	}
+	s.wal, err = openWAL(s.dataDir, fsync, s.sequence+1)
+	return err
+}
+
+// restoreEpoch keeps the sync tokens valid across restarts, the revisions survive them now
+func (s *server) restoreEpoch() error {
+	path := filepath.Join(s.dataDir, epochFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		s.epoch = strings.TrimSpace(string(data))
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(s.dataDir, epochFile, []byte(s.epoch))
+}
+
+func loadSnapshot(dir string) (*snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "snapshot-*.snap"))
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	sort.Strings(paths)
+	path := paths[len(paths)-1]
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	payload, err := readFrame(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	state := &snapshot{}
+	if err := json.Unmarshal(payload, state); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// log appends the change to the write-ahead log, must be called with the lock held
+func (s *server) log(record *logRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(record)
+}
+
+// takeSnapshot writes the state and removes the log segments it contains.
+// Writers are only blocked while the state is collected.
+func (s *server) takeSnapshot() error {
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+	s.lock.Lock()
+	if s.sequence == s.snapshotted {
+		s.lock.Unlock()
+		return nil
+	}
+	// stored todos are never changed, only replaced, so they can be shared
+	state := &snapshot{
+		Sequence:   s.sequence,
+		Todos:      make([]*repository.Todo, 0, s.count),
+		Tombstones: make(map[string]uint64, len(s.tombstones)),
+		Horizon:    s.horizon,
+	}
+	for _, shard := range s.shards {
+		for _, stored := range shard.entries {
+			state.Todos = append(state.Todos, stored.todo)
+		}
+	}
+	for id, sequence := range s.tombstones {
+		state.Tombstones[id] = sequence
+	}
+	// pending records are never changed, only replaced, too
+	if s.outbox != nil {
+		state.Outbox = append(state.Outbox, s.outbox.records...)
+		state.DeadLetters = append(state.DeadLetters, s.outbox.deadLetters...)
+	}
+	err := s.wal.rotate(s.sequence + 1)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	name := snapshotName(state.Sequence)
+	if err := writeFileAtomic(s.dataDir, name, frame(payload)); err != nil {
+		return err
+	}
+	s.snapshotted = state.Sequence
+	log.WithField("sequence", state.Sequence).WithField("todos", len(state.Todos)).Info("Wrote snapshot")
+	return s.compact(name, segmentName(state.Sequence+1))
+}
+
+// compact removes the snapshots and segments older than the given ones
+func (s *server) compact(snapshot string, segment string) error {
+	snapshots, err := filepath.Glob(filepath.Join(s.dataDir, "snapshot-*.snap"))
+	if err != nil {
+		return err
+	}
+	paths, err := segments(s.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, path := range snapshots {
+		if filepath.Base(path) < snapshot {
+			os.Remove(path)
+		}
+	}
+	for _, path := range paths {
+		if filepath.Base(path) < segment {
+			os.Remove(path)
+		}
+	}
+	return syncDir(s.dataDir)
+}
+
+func writeFileAtomic(dir string, name string, data []byte) error {
+	temp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (s *server) startBackground(fsync string, snapshotInterval time.Duration) {
+	if fsync == FsyncInterval {
+		s.background.Add(1)
+		go s.every(time.Second, func() {
+			if err := s.wal.sync(); err != nil {
+				log.WithError(err).Error("Failed to sync the log")
+			}
+		})
+	}
+	if snapshotInterval > 0 {
+		s.background.Add(1)
+		go s.every(snapshotInterval, func() {
+			if err := s.takeSnapshot(); err != nil {
+				log.WithError(err).Error("Failed to write snapshot")
+			}
+		})
+	}
+}
+
+func (s *server) every(interval time.Duration, run func()) {
+	defer s.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
+
+// Close writes a last snapshot and closes the log
+func (s *server) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+	close(s.stop)
+	s.background.Wait()
+	if err := s.takeSnapshot(); err != nil {
+		return err
+	}
+	return s.wal.close()
+}
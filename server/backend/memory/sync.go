@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/delta"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"go.opentelemetry.io/otel"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// matchesRevision must be called with the lock held
+func (s *server) matchesRevision(id string, revision uint64) bool {
+	if revision == 0 {
+		return true
+	}
+	stored, ok := s.shardOf(id).entries[id]
+	return ok && stored.todo.Revision == revision
+}
+
+type syncEntry struct {
+	id       string
+	revision uint64
+	todo     *repository.Todo
+}
+
+func (s *server) Changes(ctx context.Context, since string, limit int) (*delta.Changes, error) {
+	ctx, span := otel.Tracer("memory").Start(ctx, "Changes")
+	defer span.End()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	last, known := s.parseToken(since)
+	entries := []syncEntry{}
+	for _, shard := range s.shards {
+		for id, stored := range shard.entries {
+			if stored.todo.Revision > last {
+				entries = append(entries, syncEntry{id: id, revision: stored.todo.Revision, todo: stored.todo})
+			}
+		}
+	}
+	if known {
+		// a reset replaces the local state, tombstones are not needed then
+		for id, revision := range s.tombstones {
+			if revision > last {
+				entries = append(entries, syncEntry{id: id, revision: revision})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].revision < entries[j].revision
+	})
+
+	changes := &delta.Changes{
+		Upserts: []*repository.Todo{},
+		Deletes: []string{},
+		Reset:   !known,
+		Token:   s.token(s.sequence),
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		changes.More = true
+		changes.Token = s.token(entries[len(entries)-1].revision)
+	}
+	for _, entry := range entries {
+		if entry.todo != nil {
+			changes.Upserts = append(changes.Upserts, copyTodo(entry.todo))
+		} else {
+			changes.Deletes = append(changes.Deletes, entry.id)
+		}
+	}
+	return changes, nil
+}
+
+func (s *server) token(revision uint64) string {
+	return s.epoch + "-" + strconv.FormatUint(revision, 10)
+}
+
+// parseToken returns the revision of the token and false if it is empty, was
+// issued by another process or is older than the pruned tombstones
+func (s *server) parseToken(since string) (uint64, bool) {
+	tokenEpoch, revision, _ := strings.Cut(since, "-")
+	if tokenEpoch != s.epoch {
+		return 0, false
+	}
+	last, err := strconv.ParseUint(revision, 10, 64)
+	if err != nil || last > s.sequence || last < s.horizon {
+		return 0, false
+	}
+	return last, true
+}
@@ -0,0 +1,250 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/outbox"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// when the write-ahead log is flushed to disk
+const (
+	// FsyncAlways syncs every change before it is acknowledged
+	FsyncAlways = "always"
+	// FsyncInterval syncs once per second, a crash loses at most the last second
+	FsyncInterval = "interval"
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever = "never"
+)
+
+// frameHeaderSize is the length and the CRC32 of the payload in front of every
+// frame, a length above maxFrameSize can only be garbage
+const (
+	frameHeaderSize = 8
+	maxFrameSize    = 64 << 20
+)
+
+// errCorrupted is returned for a frame that is cut off or fails its checksum
+var errCorrupted = errors.New("corrupted frame")
+
+// logRecord is a single change, either Todo or Deleted is set together with
+// the Outbox record of the change, or one of the outbox updates alone
+type logRecord struct {
+	Sequence     uint64
+	Todo         *repository.Todo
+	Deleted      string
+	Outbox       *outbox.Record
+	Acked        string
+	Failed       *outbox.Record
+	DeadLettered *outbox.Record
+}
+
+// outboxId is the pending record an outbox update changes
+func (r *logRecord) outboxId() string {
+	switch {
+	case r.Failed != nil:
+		return r.Failed.Id
+	case r.DeadLettered != nil:
+		return r.DeadLettered.Id
+	}
+	return r.Acked
+}
+
+// wal appends the changes to segments named after their first sequence. A
+// snapshot starts a new segment, the older ones are removed once the
+// snapshot is written.
+type wal struct {
+	mutex  sync.Mutex
+	dir    string
+	fsync  string
+	file   *os.File
+	offset int64
+	dirty  bool
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("wal-%020d.log", first)
+}
+
+// segmentFirst returns the first sequence of the segment
+func segmentFirst(path string) uint64 {
+	var first uint64
+	fmt.Sscanf(filepath.Base(path), "wal-%020d.log", &first)
+	return first
+}
+
+// segments returns the paths of all segments, oldest first
+func segments(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func openWAL(dir string, fsync string, first uint64) (*wal, error) {
+	w := &wal{dir: dir, fsync: fsync}
+	if err := w.open(first); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wal) open(first uint64) error {
+	file, err := os.OpenFile(filepath.Join(w.dir, segmentName(first)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.offset = info.Size()
+	return nil
+}
+
+// append writes the record and, depending on the policy, syncs it. A failed
+// write is cut off again so that the next record does not follow garbage.
+func (w *wal) append(record *logRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.file.Write(frame(payload))
+	if err == nil && w.fsync == FsyncAlways {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		w.file.Truncate(w.offset)
+		return fmt.Errorf("failed to write the log: %w", err)
+	}
+	w.offset += int64(frameHeaderSize + len(payload))
+	w.dirty = true
+	return nil
+}
+
+// sync flushes the changes written since the last sync
+func (w *wal) sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// rotate continues in a new segment starting at first
+func (w *wal) rotate(first uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return w.open(first)
+}
+
+func (w *wal) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func frame(payload []byte) []byte {
+	data := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	copy(data[frameHeaderSize:], payload)
+	return data
+}
+
+// readFrame returns io.EOF at the end and errCorrupted for a damaged frame
+func readFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, errCorrupted
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxFrameSize {
+		return nil, errCorrupted
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errCorrupted
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorrupted
+	}
+	return payload, nil
+}
+
+// readSegment calls apply for every record and returns the offset after the
+// last intact one together with errCorrupted if damaged data follows
+func readSegment(path string, apply func(record *logRecord)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		record := &logRecord{}
+		if err := json.Unmarshal(payload, record); err != nil {
+			return offset, errCorrupted
+		}
+		apply(record)
+		offset += int64(frameHeaderSize + len(payload))
+	}
+}
+
+// syncDir makes created, renamed and removed files durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
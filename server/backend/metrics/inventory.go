@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"time"
+)
+
+var todos = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "todo_todos",
+	Help: "Number of todos by status, counted every inventory interval",
+}, []string{"status"})
+
+const (
+	// noStatus is the label of todos without a status
+	noStatus = "none"
+	// otherStatus is the label of the statuses the API does not define, the
+	// status is free text and must not create a series per value
+	otherStatus = "other"
+)
+
+// knownStatuses are the statuses of the API, they get their own label
+var knownStatuses = map[string]bool{
+	"ACTIVE":                   true,
+	repository.StatusCompleted: true,
+	"DELETED":                  true,
+}
+
+// Inventory counts the todos of a backend periodically. A backend does not
+// know its counts by status, so all todos are read each time.
+type Inventory struct {
+	repository repository.TodoRepository
+	interval   time.Duration
+}
+
+func NewInventory(repository repository.TodoRepository, interval time.Duration) *Inventory {
+	return &Inventory{
+		repository: repository,
+		interval:   interval,
+	}
+}
+
+// Start counts the todos right away and then every interval until the context is done
+func (i *Inventory) Start(ctx context.Context) {
+	log.WithField("interval", i.interval).Info("Starting inventory")
+	go func() {
+		ticker := time.NewTicker(i.interval)
+		defer ticker.Stop()
+		for {
+			if err := i.Count(ctx); err != nil {
+				log.WithError(err).Warn("Failed to count todos")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Count reads all todos and sets the gauges, statuses no longer in use are removed
+func (i *Inventory) Count(ctx context.Context) error {
+	ctx, span := otel.Tracer("metrics").Start(ctx, "Count")
+	defer span.End()
+	resp, err := i.repository.GetAll(ctx, &repository.GetAllRequest{})
+	if err != nil {
+		return err
+	}
+	counts := map[string]int{}
+	for _, todo := range resp.Todos {
+		status := todo.Status
+		switch {
+		case status == "":
+			status = noStatus
+		case !knownStatuses[status]:
+			status = otherStatus
+		}
+		counts[status]++
+	}
+	todos.Reset()
+	for status, count := range counts {
+		todos.WithLabelValues(status).Set(float64(count))
+	}
+	return nil
+}
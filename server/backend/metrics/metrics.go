@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"time"
+)
+
+var (
+	durationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_repository_duration_seconds",
+		Help:    "Duration of the operations of the backend",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"backend", "operation"})
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_repository_errors_total",
+		Help: "Failed operations of the backend by type of error",
+	}, []string{"backend", "operation", "type"})
+)
+
+// server measures every operation of the original
+type server struct {
+	original repository.TodoRepository
+	backend  string
+}
+
+type Config struct {
+	Original repository.TodoRepository
+}
+
+func NewServer(config *Config) *server {
+	log.WithField("original", config.Original.Name()).Info("Creating new metrics server")
+	myServer := &server{
+		original: config.Original,
+		backend:  config.Original.Name(),
+	}
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer
+}
+
+func (s *server) Name() string {
+	return fmt.Sprintf("Metrics(%s)", s.original.Name())
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("metrics").Start(ctx, "Create")
+	defer span.End()
+	defer s.observe("create", time.Now(), &err)
+	return s.original.Create(ctx, req)
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("metrics").Start(ctx, "Update")
+	defer span.End()
+	defer s.observe("update", time.Now(), &err)
+	return s.original.Update(ctx, req)
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("metrics").Start(ctx, "GetAll")
+	defer span.End()
+	defer s.observe("getall", time.Now(), &err)
+	return s.original.GetAll(ctx, req)
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("metrics").Start(ctx, "Get")
+	defer span.End()
+	defer s.observe("get", time.Now(), &err)
+	return s.original.Get(ctx, req)
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("metrics").Start(ctx, "Delete")
+	defer span.End()
+	defer s.observe("delete", time.Now(), &err)
+	return s.original.Delete(ctx, req)
+}
+
+// observe records the duration and the error of an operation, err is read when the operation returned
+func (s *server) observe(operation string, start time.Time, err *error) {
+	durationSeconds.WithLabelValues(s.backend, operation).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		errorsTotal.WithLabelValues(s.backend, operation, ErrorType(*err)).Inc()
+	}
+}
+
+// ErrorType is the label of an error, unknown errors are "other"
+func ErrorType(err error) string {
+	switch {
+	case errors.Is(err, repository.ErrConflict):
+		return "conflict"
+	case errors.Is(err, repository.ErrCapacityExceeded):
+		return "capacity"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "other"
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/memory"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func newOriginal(t *testing.T) repository.TodoRepository {
+	t.Helper()
+	original, err := memory.NewServer(&memory.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return original
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	original := newOriginal(t)
+	s := NewServer(&Config{Original: original})
+	name := original.Name()
+	conflicts := testutil.ToFloat64(errorsTotal.WithLabelValues(name, "update", "conflict"))
+
+	s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1"}})
+	_, err := s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1"}, IfRevision: 42})
+	if err == nil {
+		t.Fatal("Expected a conflict")
+	}
+	if count := testutil.CollectAndCount(durationSeconds); count < 2 {
+		t.Errorf("Expected a histogram for create and update, got %d", count)
+	}
+	if got := testutil.ToFloat64(errorsTotal.WithLabelValues(name, "update", "conflict")) - conflicts; got != 1 {
+		t.Errorf("Expected 1 conflict, got %v", got)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	ctx := context.Background()
+	original := newOriginal(t)
+	for _, todo := range []*repository.Todo{
+		{Id: "1", Status: repository.StatusCompleted},
+		{Id: "2", Status: repository.StatusCompleted},
+		{Id: "3"},
+		{Id: "4", Status: "waiting for Bob"},
+		{Id: "5", Status: "later"},
+	} {
+		original.Create(ctx, &repository.CreateOrUpdateRequest{Todo: todo})
+	}
+	inventory := NewInventory(original, time.Minute)
+	if err := inventory.Count(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(todos.WithLabelValues(repository.StatusCompleted)); got != 2 {
+		t.Errorf("Expected 2 completed todos, got %v", got)
+	}
+	if got := testutil.ToFloat64(todos.WithLabelValues(noStatus)); got != 1 {
+		t.Errorf("Expected 1 todo without status, got %v", got)
+	}
+	if got := testutil.ToFloat64(todos.WithLabelValues(otherStatus)); got != 2 {
+		t.Errorf("Expected 2 todos with another status, got %v", got)
+	}
+
+	// a status without todos disappears
+	for _, id := range []string{"3", "4", "5"} {
+		original.Delete(ctx, &repository.DeleteRequest{Id: id})
+	}
+	inventory.Count(ctx)
+	if count := testutil.CollectAndCount(todos); count != 1 {
+		t.Errorf("Expected 1 status, got %d", count)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		return NewServer(&Config{Original: newOriginal(t)})
+	})
+}
@@ -0,0 +1,218 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"os"
+	"path/filepath"
+)
+
+// DefaultBatchSize is the number of todos read per page
+const DefaultBatchSize = 500
+
+// Checkpoint is the progress of a backfill, saved after every page. The
+// pages are ordered by id so everything up to LastId has been copied.
+type Checkpoint struct {
+	LastId string
+	Offset int
+	Copied int
+	// Unchanged counts the todos that were already equal in the target
+	Unchanged int
+}
+
+type MigrateConfig struct {
+	From repository.TodoRepository
+	To   repository.TodoRepository
+	// BatchSize is the page size, DefaultBatchSize if 0
+	BatchSize int
+	// CheckpointFile resumes an interrupted backfill, nothing is saved if empty
+	CheckpointFile string
+}
+
+// Backfill copies every todo of From to To that is missing or different
+// there. Todos deleted in From are not removed from To, the mirror does that
+// for deletes while it runs and Verify reports the leftovers.
+func Backfill(ctx context.Context, config *MigrateConfig) (*Checkpoint, error) {
+	ctx, span := otel.Tracer("mirror").Start(ctx, "Backfill")
+	defer span.End()
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	checkpoint, err := loadCheckpoint(config.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint.Offset > 0 {
+		log.WithField("lastId", checkpoint.LastId).WithField("copied", checkpoint.Copied).Info("Resuming backfill from checkpoint")
+	}
+	// go back one page, deletes since the checkpoint shift the todos to lower offsets
+	offset := max(checkpoint.Offset-batchSize, 0)
+	for {
+		page, err := config.From.GetAll(ctx, &repository.GetAllRequest{Limit: batchSize, Offset: offset})
+		if err != nil {
+			return checkpoint, err
+		}
+		for _, todo := range page.Todos {
+			if checkpoint.Offset > 0 && todo.Id <= checkpoint.LastId {
+				continue
+			}
+			copied, err := copyTodo(ctx, config.To, todo)
+			if err != nil {
+				return checkpoint, err
+			}
+			if copied {
+				checkpoint.Copied++
+			} else {
+				checkpoint.Unchanged++
+			}
+			checkpoint.LastId = todo.Id
+		}
+		offset += len(page.Todos)
+		checkpoint.Offset = offset
+		if err := saveCheckpoint(config.CheckpointFile, checkpoint); err != nil {
+			return checkpoint, err
+		}
+		log.WithFields(log.Fields{
+			"offset":    offset,
+			"copied":    checkpoint.Copied,
+			"unchanged": checkpoint.Unchanged,
+		}).Info("Backfilled page")
+		if len(page.Todos) < batchSize {
+			return checkpoint, nil
+		}
+	}
+}
+
+// copyTodo writes the todo to the repository unless it is already there
+func copyTodo(ctx context.Context, to repository.TodoRepository, todo *repository.Todo) (bool, error) {
+	existing, err := to.Get(ctx, &repository.GetRequest{Id: todo.Id})
+	if err != nil {
+		return false, err
+	}
+	if Equal(existing.Todo, todo) {
+		return false, nil
+	}
+	copied := *todo
+	copied.Revision = 0
+	_, err = to.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &copied})
+	return err == nil, err
+}
+
+// Report lists the ids that differ between the two repositories
+type Report struct {
+	Checked int
+	// Missing are in From but not in To
+	Missing []string
+	// Different have other content in To
+	Different []string
+	// Extra are in To but not in From
+	Extra []string
+}
+
+func (r *Report) Ok() bool {
+	return len(r.Missing) == 0 && len(r.Different) == 0 && len(r.Extra) == 0
+}
+
+// Verify compares the repositories in both directions. Writes while it runs
+// can show up as differences, run it again once the writes went through both.
+func Verify(ctx context.Context, config *MigrateConfig) (*Report, error) {
+	ctx, span := otel.Tracer("mirror").Start(ctx, "Verify")
+	defer span.End()
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	report := &Report{}
+	err := visit(ctx, config.From, batchSize, func(todo *repository.Todo) error {
+		report.Checked++
+		other, err := config.To.Get(ctx, &repository.GetRequest{Id: todo.Id})
+		if err != nil {
+			return err
+		}
+		switch {
+		case other.Todo == nil:
+			report.Missing = append(report.Missing, todo.Id)
+		case !Equal(todo, other.Todo):
+			report.Different = append(report.Different, todo.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = visit(ctx, config.To, batchSize, func(todo *repository.Todo) error {
+		other, err := config.From.Get(ctx, &repository.GetRequest{Id: todo.Id})
+		if err != nil {
+			return err
+		}
+		if other.Todo == nil {
+			report.Extra = append(report.Extra, todo.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func visit(ctx context.Context, from repository.TodoRepository, batchSize int, visitor func(todo *repository.Todo) error) error {
+	for offset := 0; ; offset += batchSize {
+		page, err := from.GetAll(ctx, &repository.GetAllRequest{Limit: batchSize, Offset: offset})
+		if err != nil {
+			return err
+		}
+		for _, todo := range page.Todos {
+			if err := visitor(todo); err != nil {
+				return err
+			}
+		}
+		if len(page.Todos) < batchSize {
+			return nil
+		}
+	}
+}
+
+func loadCheckpoint(file string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{}
+	if file == "" {
+		return checkpoint, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return checkpoint, json.Unmarshal(data, checkpoint)
+}
+
+// saveCheckpoint replaces the file atomically so that a crash keeps the previous one
+func saveCheckpoint(file string, checkpoint *Checkpoint) error {
+	if file == "" {
+		return nil
+	}
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
@@ -0,0 +1,236 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// shadowTimeout bounds a shadow read, it runs after the response was sent
+	shadowTimeout = 5 * time.Second
+	// secondaryTimeout bounds a write to the secondary, it does not end with the request
+	secondaryTimeout = 5 * time.Second
+)
+
+var (
+	secondaryErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_mirror_secondary_errors_total",
+		Help: "Writes and shadow reads that failed on the secondary backend",
+	}, []string{"op"})
+	divergenceTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_mirror_divergence_total",
+		Help: "Shadow reads whose result differed from the primary backend",
+	}, []string{"op"})
+)
+
+// server writes to the primary and then to the secondary, reads are served
+// by the primary. The primary is the source of truth: a failed write on the
+// secondary is only logged and counted, the migration backfill repairs it.
+// Writes of the same id are serialized so that the secondary sees them in
+// the order of the primary, but only within this process. With several
+// replicas or failed writes only the backfill and verify of the migration
+// make both backends converge.
+type server struct {
+	primary     repository.TodoRepository
+	secondary   repository.TodoRepository
+	shadowReads bool
+	locks       [64]sync.Mutex
+}
+
+type Config struct {
+	Primary   repository.TodoRepository
+	Secondary repository.TodoRepository
+	// ShadowReads also reads from the secondary and reports results that differ
+	ShadowReads bool
+}
+
+func NewServer(config *Config) *server {
+	log.WithFields(log.Fields{
+		"primary":     config.Primary.Name(),
+		"secondary":   config.Secondary.Name(),
+		"shadowReads": config.ShadowReads,
+	}).Info("Creating new mirror server")
+	myServer := &server{
+		primary:     config.Primary,
+		secondary:   config.Secondary,
+		shadowReads: config.ShadowReads,
+	}
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer
+}
+
+func (s *server) Name() string {
+	return fmt.Sprintf("Mirror(%s, %s)", s.primary.Name(), s.secondary.Name())
+}
+
+func (s *server) lockOf(id string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return &s.locks[hash.Sum32()%uint32(len(s.locks))]
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("mirror").Start(ctx, "Create")
+	defer span.End()
+	lock := s.lockOf(req.Todo.Id)
+	lock.Lock()
+	defer lock.Unlock()
+	resp, err = s.primary.Create(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s.mirror(ctx, "create", resp.Todo)
+	return resp, nil
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("mirror").Start(ctx, "Update")
+	defer span.End()
+	lock := s.lockOf(req.Todo.Id)
+	lock.Lock()
+	defer lock.Unlock()
+	resp, err = s.primary.Update(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s.mirror(ctx, "update", resp.Todo)
+	return resp, nil
+}
+
+// mirror writes the todo as the primary stored it, the secondary has its own
+// revisions so the write is unconditional. A client that goes away after the
+// primary write does not cancel it.
+func (s *server) mirror(ctx context.Context, op string, todo *repository.Todo) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), secondaryTimeout)
+	defer cancel()
+	copied := *todo
+	copied.Revision = 0
+	_, err := s.secondary.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &copied})
+	if err != nil {
+		secondaryErrorsTotal.WithLabelValues(op).Inc()
+		log.WithError(err).WithField("id", todo.Id).WithField("op", op).Warn("Failed to mirror todo to the secondary backend")
+	}
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("mirror").Start(ctx, "Delete")
+	defer span.End()
+	lock := s.lockOf(req.Id)
+	lock.Lock()
+	defer lock.Unlock()
+	resp, err = s.primary.Delete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	secondaryCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), secondaryTimeout)
+	defer cancel()
+	_, err = s.secondary.Delete(secondaryCtx, &repository.DeleteRequest{Id: req.Id})
+	if err != nil {
+		secondaryErrorsTotal.WithLabelValues("delete").Inc()
+		log.WithError(err).WithField("id", req.Id).Warn("Failed to delete todo on the secondary backend")
+	}
+	return resp, nil
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("mirror").Start(ctx, "Get")
+	defer span.End()
+	resp, err = s.primary.Get(ctx, req)
+	if err != nil || !s.shadowReads {
+		return resp, err
+	}
+	expected := resp.Todo
+	s.shadow(ctx, "get", func(ctx context.Context) error {
+		shadow, err := s.secondary.Get(ctx, req)
+		if err != nil {
+			return err
+		}
+		if Equal(expected, shadow.Todo) {
+			return nil
+		}
+		// a write since the primary was read is not a divergence
+		current, err := s.primary.Get(ctx, req)
+		if err != nil {
+			return err
+		}
+		if Equal(expected, current.Todo) {
+			divergenceTotal.WithLabelValues("get").Inc()
+			log.WithFields(log.Fields{
+				"id":        req.Id,
+				"primary":   expected,
+				"secondary": shadow.Todo,
+			}).Warn("Secondary backend diverges from the primary")
+		}
+		return nil
+	})
+	return resp, nil
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("mirror").Start(ctx, "GetAll")
+	defer span.End()
+	resp, err = s.primary.GetAll(ctx, req)
+	if err != nil || !s.shadowReads {
+		return resp, err
+	}
+	expected := resp.Todos
+	s.shadow(ctx, "getall", func(ctx context.Context) error {
+		shadow, err := s.secondary.GetAll(ctx, req)
+		if err != nil {
+			return err
+		}
+		if slices.EqualFunc(expected, shadow.Todos, Equal) {
+			return nil
+		}
+		current, err := s.primary.GetAll(ctx, req)
+		if err != nil {
+			return err
+		}
+		if slices.EqualFunc(expected, current.Todos, Equal) {
+			divergenceTotal.WithLabelValues("getall").Inc()
+			log.WithFields(log.Fields{
+				"primary":   len(expected),
+				"secondary": len(shadow.Todos),
+			}).Warn("Secondary backend diverges from the primary")
+		}
+		return nil
+	})
+	return resp, nil
+}
+
+// shadow reads from the secondary in the background so that it never slows down the response
+func (s *server) shadow(ctx context.Context, op string, read func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+	go func() {
+		defer cancel()
+		ctx, span := otel.Tracer("mirror").Start(ctx, "Shadow")
+		defer span.End()
+		if err := read(ctx); err != nil {
+			secondaryErrorsTotal.WithLabelValues(op).Inc()
+			log.WithError(err).WithField("op", op).Warn("Shadow read on the secondary backend failed")
+		}
+	}()
+}
+
+// Equal compares two todos without their revisions, every backend counts its own
+func Equal(a *repository.Todo, b *repository.Todo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Id == b.Id &&
+		a.Title == b.Title &&
+		a.Description == b.Description &&
+		a.Status == b.Status &&
+		a.List == b.List &&
+		slices.Equal(a.Tags, b.Tags)
+}
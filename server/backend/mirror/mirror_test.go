@@ -0,0 +1,134 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/memory"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"path/filepath"
+	"testing"
+)
+
+func newMemory(t *testing.T) repository.TodoRepository {
+	t.Helper()
+	s, err := memory.NewServer(&memory.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func get(t *testing.T, r repository.TodoRepository, id string) *repository.Todo {
+	t.Helper()
+	resp, err := r.Get(context.Background(), &repository.GetRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Todo
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newMemory(t), newMemory(t)
+	s := NewServer(&Config{Primary: primary, Secondary: secondary})
+
+	secondary.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "0"}})
+	s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "First", Tags: []string{"a"}}})
+	s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Second", Tags: []string{"a"}}})
+	s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "2"}})
+	s.Delete(ctx, &repository.DeleteRequest{Id: "2"})
+	if todo := get(t, secondary, "1"); !Equal(todo, get(t, primary, "1")) {
+		t.Errorf("Expected the update on the secondary, got %+v", todo)
+	}
+	if todo := get(t, secondary, "2"); todo != nil {
+		t.Errorf("Expected the delete on the secondary, got %+v", todo)
+	}
+	// a conflict on the primary is not mirrored
+	_, err := s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Third"}, IfRevision: 1})
+	if err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if todo := get(t, secondary, "1"); todo.Title != "Second" {
+		t.Errorf("Expected the secondary to be unchanged, got %+v", todo)
+	}
+
+	report, err := Verify(ctx, &MigrateConfig{From: primary, To: secondary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || len(report.Extra) != 1 || report.Extra[0] != "0" || len(report.Missing)+len(report.Different) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+// canceled fails writes whose context is done, like a backend on the network
+type canceled struct {
+	repository.TodoRepository
+}
+
+func (c canceled) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (*repository.CreateOrUpdateResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.TodoRepository.Update(ctx, req)
+}
+
+// test that a client going away after the primary write does not skip the secondary
+func TestCanceledRequest(t *testing.T) {
+	primary, secondary := newMemory(t), newMemory(t)
+	s := NewServer(&Config{Primary: primary, Secondary: canceled{secondary}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "First"}}); err != nil {
+		t.Fatal(err)
+	}
+	if todo := get(t, secondary, "1"); todo == nil || todo.Title != "First" {
+		t.Errorf("Expected the todo on the secondary, got %+v", todo)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	from, to := newMemory(t), newMemory(t)
+	for i := range 25 {
+		from.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: fmt.Sprintf("%02d", i), Title: "Todo"}})
+	}
+	to.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "03", Title: "Todo"}})
+	to.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "04", Title: "Old"}})
+	config := &MigrateConfig{From: from, To: to, BatchSize: 10, CheckpointFile: filepath.Join(t.TempDir(), "checkpoint")}
+
+	// an interrupted run left a checkpoint after the first page
+	saveCheckpoint(config.CheckpointFile, &Checkpoint{LastId: "09", Offset: 10, Copied: 9, Unchanged: 1})
+	checkpoint, err := Backfill(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Copied != 24 || checkpoint.Offset != 25 || checkpoint.LastId != "24" {
+		t.Errorf("Unexpected checkpoint %+v", checkpoint)
+	}
+	report, _ := Verify(ctx, config)
+	if report.Ok() || len(report.Missing) != 8 || len(report.Different) != 1 {
+		t.Errorf("Expected the skipped first page to differ, got %+v", report)
+	}
+
+	// a new run copies what is missing and keeps what is equal
+	config.CheckpointFile = ""
+	checkpoint, err = Backfill(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Copied != 9 || checkpoint.Unchanged != 16 {
+		t.Errorf("Unexpected checkpoint %+v", checkpoint)
+	}
+	report, _ = Verify(ctx, config)
+	if !report.Ok() || report.Checked != 25 {
+		t.Errorf("Expected no differences, got %+v", report)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		return NewServer(&Config{Primary: newMemory(t), Secondary: newMemory(t), ShadowReads: true})
+	})
+}
@@ -3,23 +3,54 @@ package notification
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/dkrizic/todo/api/events"
+	"github.com/dkrizic/todo/server/backend/feed"
 	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/webhook"
 	"github.com/dkrizic/todo/server/sender"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
+	"slices"
 )
 
+// the targets of a change, see DeliverPending
+const (
+	TargetSender   = "sender"
+	TargetWebhooks = "webhooks"
+	TargetFeed     = "feed"
+)
+
+var notificationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "todo_notifications_total",
+	Help: "Changes handed to the sender, the webhooks and the feed by result",
+}, []string{"target", "result"})
+
 type server struct {
 	original repository.TodoRepository
-	sender   *sender.Sender
+	sender   sender.Publisher
 	enabled  bool
+	webhooks *webhook.Dispatcher
+	feed     feed.Broker
+	outbox   bool
 }
 
 type NotificationConfig struct {
 	Original repository.TodoRepository
-	Sender   *sender.Sender
+	Sender   sender.Publisher
 	Enabled  bool
+	// Webhooks receives every change if set, independent of Enabled
+	Webhooks *webhook.Dispatcher
+	// Feed receives every change if set, independent of Enabled
+	Feed feed.Broker
+	// Outbox is set if the original records its changes in an outbox. The
+	// changes are then published by the relay through Deliver instead of
+	// right after the write.
+	Outbox bool
 }
 
 func NewServer(config *NotificationConfig) *server {
@@ -27,6 +58,9 @@ func NewServer(config *NotificationConfig) *server {
 		original: config.Original,
 		sender:   config.Sender,
 		enabled:  config.Enabled,
+		webhooks: config.Webhooks,
+		feed:     config.Feed,
+		outbox:   config.Outbox,
 	}
 	// ensure server implements the interface
 	var _ repository.TodoRepository = myServer
@@ -40,6 +74,9 @@ func (s *server) Name() string {
 func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
 	ctx, span := otel.Tracer("notification").Start(ctx, "Create")
 	defer span.End()
+	if s.outbox {
+		return s.original.Create(ctx, req)
+	}
 	before, err3 := s.original.Get(ctx, &repository.GetRequest{Id: req.Todo.Id})
 	if err3 != nil {
 		span.RecordError(err3)
@@ -48,17 +85,11 @@ func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateReque
 	}
 	resp, err = s.original.Create(ctx, req)
 	if err == nil {
-		if s.enabled {
-			change := repository.Change{
-				Before:     before.Todo,
-				After:      resp.Todo,
-				ChangeType: "CREATE",
-			}
-			err2 := s.send(ctx, change)
-			if err2 != nil {
-				log.WithError(err2).Warn("Failed to send notification")
-			}
-		}
+		s.publish(ctx, repository.Change{
+			Before:     before.Todo,
+			After:      resp.Todo,
+			ChangeType: repository.ChangeTypeCreate,
+		})
 		return resp, nil
 	}
 	span.RecordError(err)
@@ -68,6 +99,9 @@ func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateReque
 func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
 	ctx, span := otel.Tracer("notification").Start(ctx, "Update")
 	defer span.End()
+	if s.outbox {
+		return s.original.Update(ctx, req)
+	}
 	before, err3 := s.original.Get(ctx, &repository.GetRequest{Id: req.Todo.Id})
 	if err3 != nil {
 		log.WithError(err3).Error("Failed to get todo before deleting")
@@ -75,17 +109,11 @@ func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateReque
 	}
 	resp, err = s.original.Update(ctx, req)
 	if err == nil {
-		if s.enabled {
-			change := repository.Change{
-				Before:     before.Todo,
-				After:      resp.Todo,
-				ChangeType: "UPDATE",
-			}
-			err2 := s.send(ctx, change)
-			if err2 != nil {
-				log.WithError(err2).Warn("Failed to send notification")
-			}
-		}
+		s.publish(ctx, repository.Change{
+			Before:     before.Todo,
+			After:      resp.Todo,
+			ChangeType: repository.ChangeTypeUpdate,
+		})
 	}
 	return resp, err
 }
@@ -105,28 +133,79 @@ func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *rep
 func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
 	ctx, span := otel.Tracer("notification").Start(ctx, "Delete")
 	defer span.End()
+	if s.outbox {
+		return s.original.Delete(ctx, req)
+	}
 	before, err3 := s.original.Get(ctx, &repository.GetRequest{Id: req.Id})
 	if err3 != nil {
 		log.WithError(err3).Error("Failed to get todo before deleting")
 		return nil, err3
 	}
 	resp, err = s.original.Delete(ctx, req)
-	if err == nil {
-		if s.enabled {
-			change := repository.Change{
-				Before:     before.Todo,
-				After:      nil,
-				ChangeType: "DELETE",
-			}
-			err2 := s.send(ctx, change)
-			if err2 != nil {
-				log.WithError(err2).Warn("Failed to send notification")
-			}
-		}
+	// nothing has changed if the todo did not exist
+	if err == nil && before.Todo != nil {
+		s.publish(ctx, repository.Change{
+			Before:     before.Todo,
+			After:      nil,
+			ChangeType: repository.ChangeTypeDelete,
+		})
 	}
 	return resp, err
 }
 
+// publish hands the change to the sender and to the webhooks, failures are only logged
+func (s *server) publish(ctx context.Context, change repository.Change) {
+	err := s.Deliver(ctx, change)
+	if err != nil {
+		log.WithError(err).Warn("Failed to publish change")
+	}
+}
+
+// Deliver hands the change to the sender, the webhooks and the live feed
+func (s *server) Deliver(ctx context.Context, change repository.Change) error {
+	_, err := s.DeliverPending(ctx, change, nil)
+	return err
+}
+
+// DeliverPending hands the change to every target that is not in delivered,
+// independent of each other, so that a sender outage does not hold back the
+// webhooks and the feed. It returns the targets that received the change so
+// far and the failures of the others.
+func (s *server) DeliverPending(ctx context.Context, change repository.Change, delivered []string) ([]string, error) {
+	delivered = slices.Clone(delivered)
+	var errs []error
+	deliver := func(target string, publish func(ctx context.Context, change repository.Change) error) {
+		if slices.Contains(delivered, target) {
+			return
+		}
+		err := publish(ctx, change)
+		count(target, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to deliver to %s: %w", target, err))
+			return
+		}
+		delivered = append(delivered, target)
+	}
+	if s.enabled {
+		deliver(TargetSender, s.send)
+	}
+	if s.webhooks != nil {
+		deliver(TargetWebhooks, s.webhooks.Dispatch)
+	}
+	if s.feed != nil {
+		deliver(TargetFeed, s.feed.Publish)
+	}
+	return delivered, errors.Join(errs...)
+}
+
+func count(target string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	notificationsTotal.WithLabelValues(target, result).Inc()
+}
+
 func (s *server) send(ctx context.Context, change repository.Change) (err error) {
 	ctx, span := otel.Tracer("notification").Start(ctx, "send")
 	defer span.End()
@@ -135,15 +214,49 @@ func (s *server) send(ctx context.Context, change repository.Change) (err error)
 		return err
 	}
 	log.WithField("change", string(data)).Info("Sending notification")
-	err = s.sender.SendNotification(ctx, data)
-	return nil
+	return s.sender.Publish(ctx, data)
 }
 
+// convert creates the structured CloudEvent for a change
 func convert(change repository.Change) (data []byte, err error) {
-	data, err = json.Marshal(change)
+	var event cloudevents.Event
+	switch change.ChangeType {
+	case repository.ChangeTypeCreate:
+		event, err = events.NewCreatedV2(events.DefaultSource, toEventTodo(change.After))
+	case repository.ChangeTypeUpdate:
+		var before *events.TodoV2
+		if change.Before != nil {
+			todo := toEventTodo(change.Before)
+			before = &todo
+		}
+		event, err = events.NewUpdatedV2(events.DefaultSource, before, toEventTodo(change.After))
+	case repository.ChangeTypeDelete:
+		event, err = events.NewDeletedV2(events.DefaultSource, toEventTodo(change.Before))
+	default:
+		err = fmt.Errorf("unknown change type %q", change.ChangeType)
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to create event for change")
+		return nil, err
+	}
+	data, err = json.Marshal(event)
 	if err != nil {
 		log.WithError(err).Error("Failed to convert change to json")
 		return nil, err
 	}
 	return data, nil
 }
+
+func toEventTodo(todo *repository.Todo) events.TodoV2 {
+	if todo == nil {
+		return events.TodoV2{}
+	}
+	return events.TodoV2{
+		Id:          todo.Id,
+		Title:       todo.Title,
+		Description: todo.Description,
+		Status:      todo.Status,
+		List:        todo.List,
+		Tags:        todo.Tags,
+	}
+}
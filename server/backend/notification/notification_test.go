@@ -1,10 +1,66 @@
 package notification
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/dkrizic/todo/api/events"
+	"github.com/dkrizic/todo/server/backend/feed"
 	repository "github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/sender"
+	"slices"
 	"testing"
 )
 
+// brokenPublisher fails until it is repaired
+type brokenPublisher struct {
+	*sender.MemoryPublisher
+	broken bool
+}
+
+func (b *brokenPublisher) Publish(ctx context.Context, message []byte) error {
+	if b.broken {
+		return errors.New("sidecar not reachable")
+	}
+	return b.MemoryPublisher.Publish(ctx, message)
+}
+
+// test that a failing sender does not hold back the feed and that a retry only sends to the failed targets
+func TestDeliverPending(t *testing.T) {
+	ctx := context.Background()
+	publisher := &brokenPublisher{MemoryPublisher: sender.NewMemoryPublisher(), broken: true}
+	broker := feed.NewMemoryBroker(10)
+	events, err := broker.Subscribe(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(&NotificationConfig{Sender: publisher, Enabled: true, Feed: broker})
+	change := repository.Change{After: &repository.Todo{Id: "1"}, ChangeType: repository.ChangeTypeCreate}
+
+	delivered, err := s.DeliverPending(ctx, change, nil)
+	if err == nil || !slices.Equal(delivered, []string{TargetFeed}) {
+		t.Fatalf("Expected only the feed to receive the change, got %v %v", delivered, err)
+	}
+	if event := <-events; event.Change.After.Id != "1" {
+		t.Errorf("Expected the change in the feed, got %+v", event)
+	}
+
+	publisher.broken = false
+	delivered, err = s.DeliverPending(ctx, change, delivered)
+	if err != nil || len(delivered) != 2 {
+		t.Fatalf("Expected the retry to succeed, got %v %v", delivered, err)
+	}
+	if len(publisher.Messages()) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(publisher.Messages()))
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected the retry to skip the feed, got %+v", event)
+	default:
+	}
+}
+
 // test convert function
 func TestConvert(t *testing.T) {
 	// create dummy change object
@@ -15,25 +71,39 @@ func TestConvert(t *testing.T) {
 			Description: "description",
 		},
 		After: &repository.Todo{
-			Id:          "2",
-			Title:       "title",
+			Id:          "1",
+			Title:       "new title",
 			Description: "description",
+			Status:      "DONE",
 		},
-		ChangeType: "UPDATE",
+		ChangeType: repository.ChangeTypeUpdate,
 	}
 
-	// convert todo object to json
+	// convert change object to json
 	data, err := convert(change)
 	if err != nil {
 		t.Errorf("Error converting change object to json: %v", err)
 	}
 
-	// convert data to string
-	str := string(data)
+	// parse the structured cloud event
+	event := cloudevents.NewEvent()
+	err = json.Unmarshal(data, &event)
+	if err != nil {
+		t.Fatalf("Error parsing cloud event: %v", err)
+	}
+	if event.Type() != events.TypeUpdatedV2 {
+		t.Errorf("Expected type %v, got %v", events.TypeUpdatedV2, event.Type())
+	}
+	if event.Subject() != "1" {
+		t.Errorf("Expected subject 1, got %v", event.Subject())
+	}
+	if event.DataSchema() != events.SchemaUrl(events.TypeUpdatedV2) {
+		t.Errorf("Expected dataschema %v, got %v", events.SchemaUrl(events.TypeUpdatedV2), event.DataSchema())
+	}
 
 	// compare data with expected value
-	expected := "{\"Before\":{\"Id\":\"1\",\"Title\":\"title\",\"Description\":\"description\",\"Status\":\"\"},\"After\":{\"Id\":\"2\",\"Title\":\"title\",\"Description\":\"description\",\"Status\":\"\"},\"ChangeType\":\"UPDATE\"}"
-	if str != expected {
-		t.Errorf("Expected %v, got %v", expected, str)
+	expected := "{\"before\":{\"id\":\"1\",\"title\":\"title\",\"description\":\"description\",\"status\":\"\"},\"after\":{\"id\":\"1\",\"title\":\"new title\",\"description\":\"description\",\"status\":\"DONE\"}}"
+	if string(event.Data()) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(event.Data()))
 	}
 }
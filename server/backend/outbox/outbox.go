@@ -0,0 +1,40 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"time"
+)
+
+var ErrNotFound = errors.New("outbox record not found")
+
+// Record is a change that has been written together with the todo and
+// still has to be published
+type Record struct {
+	Id        string
+	Change    repository.Change
+	CreatedAt time.Time
+	// Attempts counts the failed publish attempts
+	Attempts  int
+	LastError string
+	// NextAttemptAt is the earliest time of the next publish attempt
+	NextAttemptAt time.Time
+	// Delivered are the targets that already received the change, retries skip them
+	Delivered []string
+}
+
+// Store is implemented by backends that write change records in the same
+// transaction as the todo itself
+type Store interface {
+	// Pending returns up to limit records in the order they were written
+	Pending(ctx context.Context, limit int) ([]*Record, error)
+	// Ack removes a published record
+	Ack(ctx context.Context, id string) error
+	// Fail stores the updated attempt counters of a record
+	Fail(ctx context.Context, record *Record) error
+	// DeadLetter moves a record that cannot be published out of the outbox
+	DeadLetter(ctx context.Context, record *Record) error
+	// Depth returns the number of pending records
+	Depth(ctx context.Context) (int, error)
+}
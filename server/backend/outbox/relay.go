@@ -0,0 +1,225 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"sync"
+	"time"
+)
+
+var (
+	depthGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_outbox_depth",
+		Help: "The number of changes waiting in the outbox",
+	})
+	ageGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_outbox_oldest_age_seconds",
+		Help: "The age of the oldest change waiting in the outbox",
+	})
+	publishedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_outbox_published_total",
+		Help: "The number of changes published from the outbox",
+	})
+	failedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_outbox_publish_failures_total",
+		Help: "The number of failed attempts to publish a change from the outbox",
+	})
+	deadLetterCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_outbox_dead_letters_total",
+		Help: "The number of changes moved to the dead letter queue",
+	})
+)
+
+// PublishFunc publishes a single change to the targets that are not in
+// delivered and returns the targets that received it so far. An error leads
+// to a retry of the others.
+type PublishFunc func(ctx context.Context, change repository.Change, delivered []string) ([]string, error)
+
+type RelayConfig struct {
+	Store   Store
+	Publish PublishFunc
+	// Interval is the time between two polls of the outbox
+	Interval time.Duration
+	// BatchSize is the maximum number of records handled per poll
+	BatchSize int
+	// MaxAttempts moves a record to the dead letters after that many failed attempts
+	MaxAttempts int
+	// InitialBackoff is the wait time after the first failed attempt, it doubles on every retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait time between two attempts
+	MaxBackoff time.Duration
+}
+
+// Relay publishes the records of an outbox in order and acknowledges them
+type Relay struct {
+	// lock keeps the poll and the flush from publishing the same record twice
+	lock           sync.Mutex
+	store          Store
+	publish        PublishFunc
+	interval       time.Duration
+	batchSize      int
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func NewRelay(config *RelayConfig) *Relay {
+	relay := &Relay{
+		store:          config.Store,
+		publish:        config.Publish,
+		interval:       config.Interval,
+		batchSize:      config.BatchSize,
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: config.InitialBackoff,
+		maxBackoff:     config.MaxBackoff,
+	}
+	if relay.interval <= 0 {
+		relay.interval = time.Second
+	}
+	if relay.batchSize <= 0 {
+		relay.batchSize = 100
+	}
+	if relay.maxAttempts <= 0 {
+		relay.maxAttempts = 1
+	}
+	if relay.initialBackoff <= 0 {
+		relay.initialBackoff = time.Second
+	}
+	if relay.maxBackoff < relay.initialBackoff {
+		relay.maxBackoff = relay.initialBackoff
+	}
+	log.WithFields(log.Fields{
+		"interval":    relay.interval,
+		"batchSize":   relay.batchSize,
+		"maxAttempts": relay.maxAttempts,
+	}).Info("Outbox relay created")
+	return relay
+}
+
+// Start polls the outbox until the context is done
+func (r *Relay) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Process(ctx)
+			}
+		}
+	}()
+}
+
+// Process publishes pending records in order. It stops at the first record
+// that fails, so that consumers never see the changes of a todo out of order.
+func (r *Relay) Process(ctx context.Context) {
+	r.process(ctx)
+}
+
+// Flush publishes the pending records until the outbox is empty. It is
+// called on shutdown and fails if a record cannot be published right now.
+func (r *Relay) Flush(ctx context.Context) error {
+	for {
+		handled, err := r.process(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to flush outbox: %w", err)
+		}
+		if handled == 0 {
+			return nil
+		}
+	}
+}
+
+// process returns the number of records that left the outbox and the reason it stopped early
+func (r *Relay) process(ctx context.Context) (handled int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ctx, span := otel.Tracer("outbox").Start(ctx, "Process")
+	defer span.End()
+	defer r.updateMetrics(ctx)
+	records, err := r.store.Pending(ctx, r.batchSize)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read outbox")
+		span.RecordError(err)
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int("records", len(records)))
+	for _, record := range records {
+		if time.Now().Before(record.NextAttemptAt) {
+			return handled, fmt.Errorf("record %s waits for its next attempt", record.Id)
+		}
+		llog := log.WithFields(log.Fields{
+			"record":     record.Id,
+			"changeType": record.Change.ChangeType,
+			"attempts":   record.Attempts,
+			"delivered":  record.Delivered,
+		})
+		delivered, err := r.publish(ctx, record.Change, record.Delivered)
+		if err == nil {
+			if err := r.store.Ack(ctx, record.Id); err != nil {
+				llog.WithError(err).Warn("Failed to acknowledge outbox record")
+				return handled, err
+			}
+			publishedCounter.Inc()
+			handled++
+			continue
+		}
+		failedCounter.Inc()
+		record.Delivered = delivered
+		record.Attempts++
+		record.LastError = err.Error()
+		if record.Attempts >= r.maxAttempts {
+			llog.WithError(err).Error("Giving up on outbox record, moving it to the dead letters")
+			if err := r.store.DeadLetter(ctx, record); err != nil {
+				llog.WithError(err).Warn("Failed to dead letter outbox record")
+				return handled, err
+			}
+			deadLetterCounter.Inc()
+			handled++
+			continue
+		}
+		record.NextAttemptAt = time.Now().Add(r.backoff(record.Attempts))
+		llog.WithError(err).WithField("nextAttemptAt", record.NextAttemptAt).Warn("Failed to publish outbox record")
+		if err := r.store.Fail(ctx, record); err != nil {
+			llog.WithError(err).Warn("Failed to update outbox record")
+		}
+		return handled, err
+	}
+	return handled, nil
+}
+
+func (r *Relay) backoff(attempts int) time.Duration {
+	backoff := r.initialBackoff
+	for i := 1; i < attempts && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.maxBackoff {
+		backoff = r.maxBackoff
+	}
+	return backoff
+}
+
+func (r *Relay) updateMetrics(ctx context.Context) {
+	depth, err := r.store.Depth(ctx)
+	if err != nil {
+		return
+	}
+	depthGauge.Set(float64(depth))
+	records, err := r.store.Pending(ctx, 1)
+	if err != nil {
+		return
+	}
+	if len(records) == 0 {
+		ageGauge.Set(0)
+		return
+	}
+	ageGauge.Set(time.Since(records[0].CreatedAt).Seconds())
+}
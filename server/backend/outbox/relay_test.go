@@ -0,0 +1,128 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	records     []*Record
+	deadLetters []*Record
+}
+
+func (f *fakeStore) Pending(ctx context.Context, limit int) ([]*Record, error) {
+	if limit > len(f.records) {
+		limit = len(f.records)
+	}
+	return append([]*Record(nil), f.records[:limit]...), nil
+}
+
+func (f *fakeStore) Ack(ctx context.Context, id string) error {
+	for i, record := range f.records {
+		if record.Id == id {
+			f.records = append(f.records[:i], f.records[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (f *fakeStore) Fail(ctx context.Context, record *Record) error {
+	return nil
+}
+
+func (f *fakeStore) DeadLetter(ctx context.Context, record *Record) error {
+	f.deadLetters = append(f.deadLetters, record)
+	return f.Ack(ctx, record.Id)
+}
+
+func (f *fakeStore) Depth(ctx context.Context) (int, error) {
+	return len(f.records), nil
+}
+
+func newRecord(id string) *Record {
+	return &Record{
+		Id: id,
+		Change: repository.Change{
+			After:      &repository.Todo{Id: id},
+			ChangeType: repository.ChangeTypeCreate,
+		},
+		CreatedAt: time.Now(),
+	}
+}
+
+// test that records are published in order and a failing record blocks the ones behind it
+func TestRelayOrderAndDeadLetter(t *testing.T) {
+	store := &fakeStore{records: []*Record{newRecord("1"), newRecord("2"), newRecord("3")}}
+	published := []string{}
+	relay := NewRelay(&RelayConfig{
+		Store: store,
+		Publish: func(ctx context.Context, change repository.Change, delivered []string) ([]string, error) {
+			if change.After.Id == "2" {
+				return []string{"feed"}, errors.New("broken")
+			}
+			published = append(published, change.After.Id)
+			return nil, nil
+		},
+		MaxAttempts:    2,
+		InitialBackoff: time.Nanosecond,
+	})
+
+	relay.Process(context.Background())
+	if len(published) != 1 || published[0] != "1" {
+		t.Fatalf("Expected only 1 to be published, got %v", published)
+	}
+	if len(store.records) != 2 || store.records[0].Attempts != 1 {
+		t.Fatalf("Expected 2 to be retried, got %v records", len(store.records))
+	}
+	if delivered := store.records[0].Delivered; len(delivered) != 1 || delivered[0] != "feed" {
+		t.Fatalf("Expected the retry to skip the feed, got %v", delivered)
+	}
+
+	time.Sleep(time.Millisecond)
+	relay.Process(context.Background())
+	if len(published) != 2 || published[1] != "3" {
+		t.Fatalf("Expected 3 to be published after 2, got %v", published)
+	}
+	if len(store.deadLetters) != 1 || store.deadLetters[0].Id != "2" {
+		t.Fatalf("Expected 2 to be dead lettered, got %v", store.deadLetters)
+	}
+	if len(store.records) != 0 {
+		t.Errorf("Expected an empty outbox, got %v records", len(store.records))
+	}
+}
+
+// test that a flush empties the outbox and fails on a record that cannot be published
+func TestRelayFlush(t *testing.T) {
+	store := &fakeStore{}
+	for i := 0; i < 5; i++ {
+		store.records = append(store.records, newRecord(string(rune('a'+i))))
+	}
+	published := 0
+	relay := NewRelay(&RelayConfig{
+		Store: store,
+		Publish: func(ctx context.Context, change repository.Change, delivered []string) ([]string, error) {
+			if change.After.Id == "e" {
+				return nil, errors.New("broken")
+			}
+			published++
+			return nil, nil
+		},
+		BatchSize:   2,
+		MaxAttempts: 10,
+	})
+	if err := relay.Flush(context.Background()); err == nil {
+		t.Error("Expected the failing record to fail the flush")
+	}
+	if published != 4 || len(store.records) != 1 {
+		t.Errorf("Expected 4 published records and 1 left, got %d and %d", published, len(store.records))
+	}
+
+	store.records = nil
+	if err := relay.Flush(context.Background()); err != nil {
+		t.Errorf("Expected an empty outbox to flush, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package backend
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// HealthServer serves the probes from before the backend is created until
+// the end of its shutdown, so that the startup probe answers while it loads
+type HealthServer struct {
+	server *http.Server
+	served chan error
+}
+
+// ServeHealth listens before it returns, a port in use is returned as error.
+// The probes are then served in the background.
+func ServeHealth(port int, handler http.Handler, config *tls.Config) (*HealthServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	healthServer := &HealthServer{
+		server: &http.Server{Handler: handler, TLSConfig: config},
+		served: make(chan error, 1),
+	}
+	go func() {
+		healthServer.served <- serveHttp(healthServer.server, listener)
+	}()
+	return healthServer, nil
+}
@@ -0,0 +1,132 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	redis "github.com/go-redis/redis/v9"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ModeSingle   = "single"
+	ModeSentinel = "sentinel"
+	ModeCluster  = "cluster"
+)
+
+type TLSConfig struct {
+	Enabled bool
+	// CAFile verifies the server certificate, the system pool is used if empty
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mutual TLS
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// newClient creates the client for the mode of the configuration
+func newClient(config *Config) (redis.UniversalClient, error) {
+	addrs := config.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{config.Host + ":" + strconv.Itoa(config.Port)}
+	}
+	options := &redis.UniversalOptions{
+		Addrs:            addrs,
+		DB:               config.DB,
+		Username:         config.User,
+		Password:         config.Pass,
+		MasterName:       config.SentinelMaster,
+		SentinelUsername: config.SentinelUser,
+		SentinelPassword: config.SentinelPass,
+		PoolSize:         config.PoolSize,
+		MinIdleConns:     config.MinIdleConns,
+		DialTimeout:      config.DialTimeout,
+		ReadTimeout:      config.ReadTimeout,
+		WriteTimeout:     config.WriteTimeout,
+	}
+	if config.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+	switch config.Mode {
+	case "", ModeSingle:
+		if len(addrs) > 1 {
+			return nil, fmt.Errorf("mode %s needs exactly one address, got %d", ModeSingle, len(addrs))
+		}
+		return redis.NewClient(options.Simple()), nil
+	case ModeSentinel:
+		if config.SentinelMaster == "" {
+			return nil, fmt.Errorf("mode %s needs the name of the master", ModeSentinel)
+		}
+		return redis.NewFailoverClient(options.Failover()), nil
+	case ModeCluster:
+		if config.DB != 0 {
+			return nil, fmt.Errorf("mode %s only supports database 0", ModeCluster)
+		}
+		return redis.NewClusterClient(options.Cluster()), nil
+	}
+	return nil, fmt.Errorf("unknown mode %s", config.Mode)
+}
+
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		data, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// connect pings redis until it answers, waiting longer after every failure
+func connect(ctx context.Context, client redis.UniversalClient, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := client.Ping(ctx).Err()
+		if err == nil {
+			return nil
+		}
+		log.WithError(err).WithField("attempt", attempt).WithField("backoff", backoff).Warn("Failed to connect to redis, retrying")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to connect to redis within %s: %w", timeout, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// clusterKeyPrefix makes sure that all keys are in the same hash slot, the
+// transactions of the server span several keys
+func clusterKeyPrefix(prefix string) string {
+	if strings.Contains(prefix, "{") {
+		return prefix
+	}
+	return "{" + strings.TrimSuffix(prefix, ":") + "}:"
+}
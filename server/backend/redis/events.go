@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/eventsource"
+	redis "github.com/go-redis/redis/v9"
+	"go.opentelemetry.io/otel"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventsKeyPrefix   = "events:"
+	eventsStreamKey   = eventsKeyPrefix + "stream"
+	eventsSnapshotKey = eventsKeyPrefix + "snapshots"
+	eventField        = "event"
+	// eventsReadBatch is the number of events read per XRANGE
+	eventsReadBatch = 1000
+)
+
+// eventStore keeps the events in a redis stream, the stream id of an event is
+// <sequence>-0 so that redis rejects a second event with the same sequence.
+// The snapshots are a sorted set scored by the time of their last event.
+type eventStore struct {
+	redis redis.UniversalClient
+	keys  keyspace
+}
+
+// EventStore returns the stream for the event sourced repository
+func (s *server) EventStore() eventsource.Store {
+	return &eventStore{
+		redis: s.RedisAdapter.redis,
+		keys:  s.RedisAdapter.keys,
+	}
+}
+
+func (e *eventStore) Append(ctx context.Context, event *eventsource.Event) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Events/Append")
+	defer span.End()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	err = e.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: e.keys.key(eventsStreamKey),
+		ID:     fmt.Sprintf("%d-0", event.Sequence),
+		Values: map[string]interface{}{eventField: data},
+	}).Err()
+	if err != nil && strings.Contains(err.Error(), "equal or smaller") {
+		return eventsource.ErrSequence
+	}
+	return err
+}
+
+func (e *eventStore) Read(ctx context.Context, after uint64, visit func(event *eventsource.Event) bool) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Events/Read")
+	defer span.End()
+	start := fmt.Sprintf("%d-1", after)
+	for {
+		messages, err := e.redis.XRangeN(ctx, e.keys.key(eventsStreamKey), start, "+", eventsReadBatch).Result()
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			event := &eventsource.Event{}
+			data, _ := message.Values[eventField].(string)
+			if err := json.Unmarshal([]byte(data), event); err != nil {
+				return fmt.Errorf("invalid event %s: %w", message.ID, err)
+			}
+			if !visit(event) {
+				return nil
+			}
+		}
+		if len(messages) < eventsReadBatch {
+			return nil
+		}
+		sequence, _ := splitStreamId(messages[len(messages)-1].ID)
+		start = strconv.FormatUint(sequence, 10) + "-1"
+	}
+}
+
+func (e *eventStore) SaveSnapshot(ctx context.Context, snapshot *eventsource.Snapshot) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Events/SaveSnapshot")
+	defer span.End()
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	key := e.keys.key(eventsSnapshotKey)
+	pipe := e.redis.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(snapshot.Time.UnixMilli()), Member: data})
+	pipe.ZRemRangeByRank(ctx, key, 0, -eventsource.SnapshotsKept-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (e *eventStore) LoadSnapshot(ctx context.Context, at time.Time) (*eventsource.Snapshot, error) {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Events/LoadSnapshot")
+	defer span.End()
+	upper := "+inf"
+	if !at.IsZero() {
+		upper = strconv.FormatInt(at.UnixMilli(), 10)
+	}
+	members, err := e.redis.ZRevRangeByScore(ctx, e.keys.key(eventsSnapshotKey), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: upper,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		snapshot := &eventsource.Snapshot{}
+		if err := json.Unmarshal([]byte(member), snapshot); err != nil {
+			return nil, err
+		}
+		// the score has millisecond precision
+		if at.IsZero() || !snapshot.Time.After(at) {
+			return snapshot, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dkrizic/todo/server/backend/feed"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	redis "github.com/go-redis/redis/v9"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	feedKeyPrefix = "feed:"
+	feedStreamKey = feedKeyPrefix + "stream"
+	feedField     = "change"
+)
+
+// feedBroker publishes the changes to a redis stream. Every replica reads
+// the stream and fans the events out to its local subscribers, the stream
+// ids are the event ids.
+type feedBroker struct {
+	redis  redis.UniversalClient
+	keys   keyspace
+	hub    *feed.Hub
+	maxLen int64
+}
+
+// Feed returns a broker that shares the changes between all replicas
+func (s *server) Feed(maxLen int64) feed.Broker {
+	if maxLen <= 0 {
+		maxLen = 10000
+	}
+	return &feedBroker{
+		redis:  s.RedisAdapter.redis,
+		keys:   s.RedisAdapter.keys,
+		hub:    feed.NewHub(),
+		maxLen: maxLen,
+	}
+}
+
+func (f *feedBroker) Start(ctx context.Context) {
+	go f.read(ctx)
+}
+
+func (f *feedBroker) Close() {
+	f.hub.Close()
+}
+
+func (f *feedBroker) Publish(ctx context.Context, change repository.Change) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Feed/Publish")
+	defer span.End()
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return f.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: f.keys.key(feedStreamKey),
+		MaxLen: f.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{feedField: data},
+	}).Err()
+}
+
+func (f *feedBroker) Subscribe(ctx context.Context, lastEventId string) (<-chan feed.Event, error) {
+	live := f.hub.Subscribe(ctx, nil)
+	if lastEventId == "" {
+		return live, nil
+	}
+	// subscribe before reading the history, the overlap is skipped below
+	messages, err := f.redis.XRange(ctx, f.keys.key(feedStreamKey), "("+lastEventId, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	replay := toEvents(messages)
+	events := make(chan feed.Event)
+	go func() {
+		defer close(events)
+		last := lastEventId
+		for _, event := range replay {
+			select {
+			case events <- event:
+				last = event.Id
+			case <-ctx.Done():
+				return
+			}
+		}
+		for event := range live {
+			if compareStreamIds(event.Id, last) <= 0 {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// read follows the stream and broadcasts every entry to the local subscribers
+func (f *feedBroker) read(ctx context.Context) {
+	lastId := "$"
+	for {
+		streams, err := f.redis.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{f.keys.key(feedStreamKey), lastId},
+			Count:   100,
+			Block:   5 * time.Second,
+		}).Result()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to read change feed from redis")
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, stream := range streams {
+			for _, event := range toEvents(stream.Messages) {
+				f.hub.Broadcast(event)
+				lastId = event.Id
+			}
+		}
+	}
+}
+
+func toEvents(messages []redis.XMessage) []feed.Event {
+	events := make([]feed.Event, 0, len(messages))
+	for _, message := range messages {
+		data, ok := message.Values[feedField].(string)
+		if !ok {
+			continue
+		}
+		change := repository.Change{}
+		if err := json.Unmarshal([]byte(data), &change); err != nil {
+			log.WithError(err).WithField("id", message.ID).Warn("Skipping unreadable change in feed")
+			continue
+		}
+		events = append(events, feed.Event{Id: message.ID, Change: change})
+	}
+	return events
+}
+
+// compareStreamIds compares two stream ids of the form <milliseconds>-<sequence>
+func compareStreamIds(a string, b string) int {
+	aMillis, aSequence := splitStreamId(a)
+	bMillis, bSequence := splitStreamId(b)
+	switch {
+	case aMillis != bMillis:
+		if aMillis < bMillis {
+			return -1
+		}
+		return 1
+	case aSequence != bSequence:
+		if aSequence < bSequence {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func splitStreamId(id string) (uint64, uint64) {
+	millis, sequence, _ := strings.Cut(id, "-")
+	m, _ := strconv.ParseUint(millis, 10, 64)
+	s, _ := strconv.ParseUint(sequence, 10, 64)
+	return m, s
+}
@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/cache"
+	redis "github.com/go-redis/redis/v9"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"time"
+)
+
+const cacheInvalidationChannel = "cache:invalidate"
+
+// cacheInvalidator broadcasts the ids of changed todos over pub/sub. Messages
+// sent while a replica is disconnected are lost, so a (re)subscription drops
+// the whole cache of that replica.
+type cacheInvalidator struct {
+	redis redis.UniversalClient
+	keys  keyspace
+}
+
+// CacheInvalidator returns the invalidator that keeps the caches of all replicas consistent
+func (s *server) CacheInvalidator() cache.Invalidator {
+	return &cacheInvalidator{
+		redis: s.RedisAdapter.redis,
+		keys:  s.RedisAdapter.keys,
+	}
+}
+
+func (c *cacheInvalidator) Publish(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Cache/Publish")
+	defer span.End()
+	return c.redis.Publish(ctx, c.keys.key(cacheInvalidationChannel), id).Err()
+}
+
+func (c *cacheInvalidator) Subscribe(ctx context.Context, drop func(id string)) {
+	pubsub := c.redis.Subscribe(ctx, c.keys.key(cacheInvalidationChannel))
+	defer pubsub.Close()
+	for {
+		received, err := pubsub.Receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to receive cache invalidations from redis")
+			time.Sleep(time.Second)
+			continue
+		}
+		switch message := received.(type) {
+		case *redis.Subscription:
+			drop("")
+		case *redis.Message:
+			drop(message.Payload)
+		}
+	}
+}
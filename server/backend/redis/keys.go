@@ -0,0 +1,24 @@
+package redis
+
+// keyspace puts all keys of the server below a common prefix, so that the
+// todos can share a redis database with other applications
+type keyspace struct {
+	prefix string
+}
+
+const (
+	DefaultKeyPrefix = "todo:"
+	todoKeyPrefix    = "todo:"
+	// indexKey is a set with the ids of all todos
+	indexKey = "index"
+	// schemaKey holds the version of the layout, see migrate.go
+	schemaKey = "schema"
+)
+
+func (k keyspace) key(name string) string {
+	return k.prefix + name
+}
+
+func (k keyspace) todo(id string) string {
+	return k.prefix + todoKeyPrefix + id
+}
@@ -0,0 +1,173 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	redis "github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	schemaVersion    = 2
+	migrationLockKey = "migration:lock"
+	migrationLockTTL = time.Minute
+)
+
+// Schema version 1 kept every todo as a hash with title and description under
+// its bare id. The keys of the webhooks, the outbox, the feed and sync had no
+// prefix either.
+var legacyKeys = []string{
+	webhookSubscriptionsKey,
+	outboxQueueKey,
+	outboxRecordsKey,
+	outboxDeadKey,
+	feedStreamKey,
+	syncSequenceKey,
+	syncIndexKey,
+}
+
+var legacyKeyPrefixes = []string{webhookKeyPrefix, outboxKeyPrefix, feedKeyPrefix, syncKeyPrefix}
+
+// migrate upgrades the data to the current schema version. Only one replica
+// migrates, the others wait until it is done.
+func migrate(ctx context.Context, client redis.UniversalClient, keys keyspace) error {
+	owner := uuid.New().String()
+	for {
+		version, err := client.Get(ctx, keys.key(schemaKey)).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if version >= schemaVersion {
+			return nil
+		}
+		acquired, err := client.SetNX(ctx, keys.key(migrationLockKey), owner, migrationLockTTL).Result()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		log.Info("Waiting for another replica to migrate the redis data")
+		time.Sleep(time.Second)
+	}
+	defer client.Del(ctx, keys.key(migrationLockKey))
+
+	if _, cluster := client.(*redis.ClusterClient); cluster {
+		// schema version 1 never ran in a cluster, there is nothing to move
+		return client.Set(ctx, keys.key(schemaKey), schemaVersion, 0).Err()
+	}
+	log.WithField("version", schemaVersion).WithField("prefix", keys.prefix).Info("Migrating redis data")
+	if err := migrateLegacyKeys(ctx, client, keys); err != nil {
+		return err
+	}
+	migrated, err := migrateTodos(ctx, client, keys)
+	if err != nil {
+		return err
+	}
+	log.WithField("todos", migrated).Info("Migrated redis data")
+	return client.Set(ctx, keys.key(schemaKey), schemaVersion, 0).Err()
+}
+
+// migrateLegacyKeys moves the keys of webhooks, outbox, feed and sync below the prefix
+func migrateLegacyKeys(ctx context.Context, client redis.UniversalClient, keys keyspace) error {
+	legacy := append([]string{}, legacyKeys...)
+	var cursor uint64
+	for {
+		found, next, err := client.Scan(ctx, cursor, webhookDeliveriesKey+"*", 100).Result()
+		if err != nil {
+			return err
+		}
+		legacy = append(legacy, found...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	for _, key := range legacy {
+		renamed, err := client.RenameNX(ctx, key, keys.key(key)).Result()
+		if err != nil && !isNoSuchKey(err) {
+			return fmt.Errorf("failed to move %s: %w", key, err)
+		}
+		if renamed {
+			log.WithField("key", key).Info("Moved key below prefix")
+		}
+	}
+	return nil
+}
+
+// migrateTodos moves the todo hashes below the prefix, adds them to the index
+// and gives them a revision
+func migrateTodos(ctx context.Context, client redis.UniversalClient, keys keyspace) (int, error) {
+	migrated := 0
+	var cursor uint64
+	for {
+		found, next, err := client.Scan(ctx, cursor, "", 100).Result()
+		if err != nil {
+			return migrated, err
+		}
+		for _, key := range found {
+			if !isLegacyTodoKey(key, keys) {
+				continue
+			}
+			ok, err := migrateTodo(ctx, client, keys, key)
+			if err != nil {
+				return migrated, fmt.Errorf("failed to migrate %s: %w", key, err)
+			}
+			if ok {
+				migrated++
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return migrated, nil
+		}
+	}
+}
+
+func migrateTodo(ctx context.Context, client redis.UniversalClient, keys keyspace, key string) (bool, error) {
+	keyType, err := client.Type(ctx, key).Result()
+	if err != nil || keyType != "hash" {
+		return false, err
+	}
+	values, err := client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	_, hasTitle := values[title]
+	_, hasDescription := values[description]
+	if !hasTitle && !hasDescription {
+		// not a todo of this application
+		return false, nil
+	}
+	todo := &repository.Todo{
+		Id:          key,
+		Title:       values[title],
+		Description: values[description],
+	}
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if _, err := writeTodo(ctx, pipe, keys, todo); err != nil {
+			return err
+		}
+		pipe.Del(ctx, key)
+		return nil
+	})
+	return err == nil, err
+}
+
+func isLegacyTodoKey(key string, keys keyspace) bool {
+	if strings.HasPrefix(key, keys.prefix) {
+		return false
+	}
+	for _, prefix := range legacyKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNoSuchKey(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such key")
+}
@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dkrizic/todo/server/backend/outbox"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	redis "github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"time"
+)
+
+const (
+	outboxKeyPrefix  = "outbox:"
+	outboxQueueKey   = outboxKeyPrefix + "queue"
+	outboxRecordsKey = outboxKeyPrefix + "records"
+	outboxDeadKey    = outboxKeyPrefix + "dead"
+	outboxLockKey    = outboxKeyPrefix + "lock"
+	// outboxLockTTL is the time a replica keeps relaying after its last poll
+	outboxLockTTL = 30 * time.Second
+)
+
+// leadScript acquires the relay lock or extends it if this replica still
+// owns it. The check and the extension are atomic, so that a lock that
+// expired and was taken by another replica is never extended.
+var leadScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseScript deletes the relay lock only if this replica owns it
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// outboxStore keeps the ids of pending records in a list and the records
+// themselves in a hash. Only one replica relays at a time, it is elected
+// through a lock key that expires if the replica goes away.
+type outboxStore struct {
+	redis redis.UniversalClient
+	keys  keyspace
+	owner string
+}
+
+func newOutboxStore(adapter *RedisAdapter) *outboxStore {
+	return &outboxStore{
+		redis: adapter.redis,
+		keys:  adapter.keys,
+		owner: uuid.New().String(),
+	}
+}
+
+// Outbox returns the outbox of the server or nil if it is disabled
+func (s *server) Outbox() outbox.Store {
+	if s.outbox == nil {
+		return nil
+	}
+	return s.outbox
+}
+
+// appendRecord queues a change in the same transaction as the todo
+func appendRecord(ctx context.Context, pipe redis.Pipeliner, keys keyspace, before *repository.Todo, after *repository.Todo, changeType repository.ChangeType) error {
+	record := &outbox.Record{
+		Id: uuid.New().String(),
+		Change: repository.Change{
+			Before:     before,
+			After:      after,
+			ChangeType: changeType,
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	pipe.HSet(ctx, keys.key(outboxRecordsKey), record.Id, data)
+	pipe.RPush(ctx, keys.key(outboxQueueKey), record.Id)
+	return nil
+}
+
+func (o *outboxStore) Pending(ctx context.Context, limit int) ([]*outbox.Record, error) {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Outbox/Pending")
+	defer span.End()
+	leader, err := o.lead(ctx)
+	if err != nil || !leader {
+		return nil, err
+	}
+	ids, err := o.redis.LRange(ctx, o.keys.key(outboxQueueKey), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	values, err := o.redis.HMGet(ctx, o.keys.key(outboxRecordsKey), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*outbox.Record, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		record := &outbox.Record{}
+		if err := json.Unmarshal([]byte(data), record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (o *outboxStore) Ack(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Outbox/Ack")
+	defer span.End()
+	_, err := o.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, o.keys.key(outboxQueueKey), 1, id)
+		pipe.HDel(ctx, o.keys.key(outboxRecordsKey), id)
+		return nil
+	})
+	return err
+}
+
+func (o *outboxStore) Fail(ctx context.Context, record *outbox.Record) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Outbox/Fail")
+	defer span.End()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return o.redis.HSet(ctx, o.keys.key(outboxRecordsKey), record.Id, data).Err()
+}
+
+func (o *outboxStore) DeadLetter(ctx context.Context, record *outbox.Record) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Outbox/DeadLetter")
+	defer span.End()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = o.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, o.keys.key(outboxQueueKey), 1, record.Id)
+		pipe.HDel(ctx, o.keys.key(outboxRecordsKey), record.Id)
+		pipe.RPush(ctx, o.keys.key(outboxDeadKey), data)
+		return nil
+	})
+	return err
+}
+
+func (o *outboxStore) Depth(ctx context.Context) (int, error) {
+	depth, err := o.redis.LLen(ctx, o.keys.key(outboxQueueKey)).Result()
+	return int(depth), err
+}
+
+// lead acquires or extends the relay lock
+func (o *outboxStore) lead(ctx context.Context) (bool, error) {
+	led, err := leadScript.Run(ctx, o.redis, []string{o.keys.key(outboxLockKey)}, o.owner, outboxLockTTL.Milliseconds()).Int()
+	return led == 1, err
+}
+
+// release gives up the relay lock, so that another replica takes over right away
+func (o *outboxStore) release(ctx context.Context) error {
+	return releaseScript.Run(ctx, o.redis, []string{o.keys.key(outboxLockKey)}, o.owner).Err()
+}
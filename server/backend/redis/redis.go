@@ -2,70 +2,128 @@ package redis
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	repository "github.com/dkrizic/todo/server/backend/repository"
-	redis "github.com/go-redis/redis/v9"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"strconv"
-)
-
-const (
-	title       = "title"
-	description = "description"
+	"sort"
+	"time"
 )
 
 type server struct {
 	RedisAdapter *RedisAdapter
+	// outbox is nil if the outbox is disabled
+	outbox *outboxStore
 }
 
 type Config struct {
-	Host string
-	Port int
+	// Addrs are the host:port of the server, the sentinels or the cluster
+	// nodes, Host and Port are used if empty
+	Addrs []string
+	Host  string
+	Port  int
+	// Mode is one of ModeSingle (default), ModeSentinel and ModeCluster
+	Mode string
+	// User and Pass authenticate with an ACL user, only Pass for the default user
 	User string
 	Pass string
+	DB   int
+	TLS  TLSConfig
+	// SentinelMaster is the name of the master watched by the sentinels
+	SentinelMaster string
+	SentinelUser   string
+	SentinelPass   string
+	PoolSize       int
+	MinIdleConns   int
+	DialTimeout    time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	// ConnectTimeout is how long to retry the first connection, defaults to a minute
+	ConnectTimeout time.Duration
+	// Outbox records every change in the same transaction as the todo
+	Outbox bool
+	// KeyPrefix is put in front of all keys, defaults to DefaultKeyPrefix
+	KeyPrefix string
 }
 
-func NewServer(config *Config) *server {
+func NewServer(config *Config) (*server, error) {
 	llog := log.WithFields(
 		log.Fields{
-			"host": config.Host,
-			"port": config.Port,
-			"user": config.User,
+			"addrs":  config.Addrs,
+			"host":   config.Host,
+			"port":   config.Port,
+			"mode":   config.Mode,
+			"user":   config.User,
+			"db":     config.DB,
+			"tls":    config.TLS.Enabled,
+			"master": config.SentinelMaster,
 		},
 	)
 	llog.Info("Creating new redis server")
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     config.Host + ":" + strconv.Itoa(config.Port),
-		Password: config.Pass, // no password set
-		DB:       0,           // use default DB
-	})
+	rdb, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
 
 	// redisotel.InstrumentTracing(rdb, redisotel.WithAttributes(attribute.String("db", "redis"))
 	// redisotel.InstrumentMetrics(rdb, redisotel.WithAttributes(attribute.String("db", "redis"))
-	status := rdb.Ping(context.Background())
-	if status.Err() != nil {
-		llog.WithError(status.Err()).Fatal("Failed to connect to redis")
+	connectTimeout := config.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = time.Minute
+	}
+	if err := connect(context.Background(), rdb, connectTimeout); err != nil {
+		rdb.Close()
+		return nil, err
 	}
 	llog.Info("Connected to redis")
 
-	redisAdapter := &RedisAdapter{
-		redis: rdb,
+	keyPrefix := config.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = DefaultKeyPrefix
+	}
+	if config.Mode == ModeCluster {
+		keyPrefix = clusterKeyPrefix(keyPrefix)
+		llog.WithField("prefix", keyPrefix).Info("Using a hash tag as key prefix in cluster mode")
+	}
+	redisAdapter := NewRedisAdapter(rdb, keyPrefix)
+	redisAdapter.outbox = config.Outbox
+	if err := migrate(context.Background(), rdb, redisAdapter.keys); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("failed to migrate redis data: %w", err)
 	}
 
 	myServer := &server{
 		RedisAdapter: redisAdapter,
 	}
+	if config.Outbox {
+		myServer.outbox = newOutboxStore(redisAdapter)
+	}
 	// ensure server implements the interface
 	var _ repository.TodoRepository = myServer
-	return myServer
+	return myServer, nil
 }
 
 func (*server) Name() string {
 	return "redis"
 }
 
+// Close releases the relay lock and closes the connections to redis
+func (s *server) Close() error {
+	var err error
+	if s.outbox != nil {
+		err = s.outbox.release(context.Background())
+	}
+	return errors.Join(err, s.RedisAdapter.redis.Close())
+}
+
+// Check pings redis, the caller sets the timeout
+func (s *server) Check(ctx context.Context) error {
+	return s.RedisAdapter.redis.Ping(ctx).Err()
+}
+
 func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
 	ctx, span := otel.Tracer("redis").Start(ctx, "Create")
 	defer span.End()
@@ -75,9 +133,10 @@ func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateReque
 		"description": req.Todo.Description,
 	})
 	llog.Info("Creating todo")
-	_, current, err := s.RedisAdapter.WriteToRedis(ctx, req.Todo)
+	_, current, err := s.RedisAdapter.WriteToRedis(ctx, req.Todo, repository.ChangeTypeCreate, req.IfRevision, req.IfAbsent)
 	if err != nil {
-		llog.WithError(err).Fatal("Failed to create todo")
+		llog.WithError(err).Error("Failed to create todo")
+		span.RecordError(err)
 		return nil, err
 	}
 	return &repository.CreateOrUpdateResponse{
@@ -86,7 +145,7 @@ func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateReque
 }
 
 func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
-	ctx, span := otel.Tracer("redis").Start(ctx, "Create")
+	ctx, span := otel.Tracer("redis").Start(ctx, "Update")
 	defer span.End()
 	llog := log.WithFields(log.Fields{
 		"id":          req.Todo.Id,
@@ -94,7 +153,12 @@ func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateReque
 		"description": req.Todo.Description,
 	})
 	llog.Info("Updating todo")
-	_, current, err := s.RedisAdapter.WriteToRedis(ctx, req.Todo)
+	_, current, err := s.RedisAdapter.WriteToRedis(ctx, req.Todo, repository.ChangeTypeUpdate, req.IfRevision, req.IfAbsent)
+	if err != nil {
+		llog.WithError(err).Error("Failed to update todo")
+		span.RecordError(err)
+		return nil, err
+	}
 	return &repository.CreateOrUpdateResponse{
 		Todo: current,
 	}, nil
@@ -105,48 +169,23 @@ func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (res
 	defer span.End()
 	log.WithField("implementation", s.Name()).Info("Getting all todos")
 
-	var cursor uint64 = 0
-	todos := make([]*repository.Todo, 0)
-	for {
-		var keys []string
-		var err error
-		ctx2, span2 := otel.Tracer("redis").Start(ctx, "Scan")
-		keys, cursor, err = s.RedisAdapter.redis.Scan(ctx2, cursor, "", 10).Result()
-		span2.End()
-		if err != nil {
-			log.WithError(err).Fatal("Failed to get keys")
-			span.RecordError(err)
-			return nil, err
-		}
-		for _, key := range keys {
-			log.WithField("key", key).Info("Found key")
-			var title string
-			var description string
-			{
-				ctx2, span := otel.Tracer("redis").Start(ctx, "GetAll/ReadTitle")
-				span.SetAttributes(attribute.String("key", key))
-				title = s.RedisAdapter.redis.HGet(ctx2, key, title).Val()
-				span.End()
-			}
-			{
-				ctx2, span := otel.Tracer("redis").Start(ctx, "GetAll/ReadDescription")
-				span.SetAttributes(attribute.String("key", key))
-				description = s.RedisAdapter.redis.HGet(ctx2, key, description).Val()
-				span.End()
-			}
-			todos = append(todos, &repository.Todo{
-				Id:          key,
-				Title:       title,
-				Description: description,
-			})
-		}
-		if cursor == 0 {
-			break
-		}
+	keys := s.RedisAdapter.keys
+	ids, err := s.RedisAdapter.redis.SMembers(ctx, keys.key(indexKey)).Result()
+	if err != nil {
+		log.WithError(err).Error("Failed to get ids")
+		span.RecordError(err)
+		return nil, err
+	}
+	sort.Strings(ids)
+	span.SetAttributes(attribute.Int("ids", len(ids)))
+	todos, err := readTodos(ctx, s.RedisAdapter.redis, keys, ids)
+	if err != nil {
+		log.WithError(err).Error("Failed to get todos")
+		span.RecordError(err)
+		return nil, err
 	}
-
 	return &repository.GetAllResponse{
-		Todos: todos,
+		Todos: repository.Select(todos, req),
 	}, nil
 }
 
@@ -157,7 +196,7 @@ func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *rep
 	llog.WithField("id", req.Id).Info("Getting todo")
 	data, err := s.RedisAdapter.ReadFromRedis(ctx, req.Id)
 	if err != nil {
-		llog.WithError(err).Fatal("Failed to get todo")
+		llog.WithError(err).Error("Failed to get todo")
 		span.RecordError(err)
 		return nil, err
 	}
@@ -167,10 +206,15 @@ func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *rep
 }
 
 func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
-	ctx, span := otel.Tracer("redis").Start(ctx, "Get")
+	ctx, span := otel.Tracer("redis").Start(ctx, "Delete")
 	defer span.End()
 	log.WithField("id", req.Id).Info("Deleting todo")
-	s.RedisAdapter.redis.Del(ctx, req.Id)
+	_, err = s.RedisAdapter.DeleteFromRedis(ctx, req.Id, req.IfRevision)
+	if err != nil {
+		log.WithError(err).Error("Failed to delete todo")
+		span.RecordError(err)
+		return nil, err
+	}
 	return &repository.DeleteResponse{
 		Id: req.Id,
 	}, nil
@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"github.com/dkrizic/todo/server/backend/webhook/webhooktest"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		redis := miniredis.RunT(t)
+		s, err := NewServer(&Config{Addrs: []string{redis.Addr()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.RedisAdapter.redis.Close() })
+		return s
+	})
+}
+
+// test that only one replica relays and that an expired lock is not extended by its former owner
+func TestOutboxLock(t *testing.T) {
+	ctx := context.Background()
+	redis := miniredis.RunT(t)
+	newStore := func() *outboxStore {
+		s, err := NewServer(&Config{Addrs: []string{redis.Addr()}, Outbox: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.RedisAdapter.redis.Close() })
+		return s.outbox
+	}
+	first, second := newStore(), newStore()
+	if led, err := first.lead(ctx); err != nil || !led {
+		t.Fatalf("Expected the first replica to lead, got %v %v", led, err)
+	}
+	if led, _ := second.lead(ctx); led {
+		t.Fatal("Expected the second replica not to lead")
+	}
+
+	redis.FastForward(outboxLockTTL)
+	if led, _ := second.lead(ctx); !led {
+		t.Fatal("Expected the second replica to take over the expired lock")
+	}
+	if led, _ := first.lead(ctx); led {
+		t.Error("Expected the first replica not to extend the lock of the second")
+	}
+	first.release(ctx)
+	if led, _ := second.lead(ctx); !led {
+		t.Error("Expected the first replica not to release the lock of the second")
+	}
+	second.release(ctx)
+	if led, _ := first.lead(ctx); !led {
+		t.Error("Expected the released lock to be free")
+	}
+}
+
+func TestWebhookStore(t *testing.T) {
+	webhooktest.Run(t, func(t *testing.T) webhook.Store {
+		redis := miniredis.RunT(t)
+		s, err := NewServer(&Config{Addrs: []string{redis.Addr()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.RedisAdapter.redis.Close() })
+		return s.WebhookStore()
+	})
+}
@@ -1,63 +1,225 @@
 package redis
 
 import (
+	"encoding/json"
 	repository "github.com/dkrizic/todo/server/backend/repository"
 	redis "github.com/go-redis/redis/v9"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/net/context"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// fields of the hash that holds a todo
+const (
+	title       = "title"
+	description = "description"
+	status      = "status"
+	list        = "list"
+	tags        = "tags"
 )
 
 type RedisAdapter struct {
-	redis *redis.Client
+	redis redis.UniversalClient
+	keys  keyspace
+	// outbox records every change in the same transaction as the todo
+	outbox bool
 }
 
-func NewRedisAdapter(redis *redis.Client) *RedisAdapter {
+func NewRedisAdapter(redis redis.UniversalClient, keyPrefix string) *RedisAdapter {
 	return &RedisAdapter{
 		redis: redis,
+		keys:  keyspace{prefix: keyPrefix},
 	}
 }
 
-func (ra *RedisAdapter) ReadFromRedis(ctx context.Context, key string) (*repository.Todo, error) {
+func (ra *RedisAdapter) ReadFromRedis(ctx context.Context, id string) (*repository.Todo, error) {
 	ctx, span := otel.Tracer("redis").Start(ctx, "ReadFromRedis")
 	defer span.End()
-	res, err := ra.redis.Exists(ctx, key).Result()
+	return readTodo(ctx, ra.redis, ra.keys, id)
+}
+
+func readTodo(ctx context.Context, cmd redis.Cmdable, keys keyspace, id string) (*repository.Todo, error) {
+	values, err := cmd.HGetAll(ctx, keys.todo(id)).Result()
 	if err != nil {
 		return nil, err
 	}
-	if res == 0 {
+	return fromHash(id, values)
+}
+
+// readBatchSize is the number of todos read in one round trip
+const readBatchSize = 500
+
+// readTodos reads the todos in batches of pipelined HGETALLs, ids without a todo are skipped
+func readTodos(ctx context.Context, cmd redis.Cmdable, keys keyspace, ids []string) ([]*repository.Todo, error) {
+	todos := make([]*repository.Todo, 0, len(ids))
+	for start := 0; start < len(ids); start += readBatchSize {
+		batch := ids[start:min(start+readBatchSize, len(ids))]
+		results := make([]*redis.MapStringStringCmd, len(batch))
+		_, err := cmd.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, id := range batch {
+				results[i] = pipe.HGetAll(ctx, keys.todo(id))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range results {
+			todo, err := fromHash(batch[i], result.Val())
+			if err != nil {
+				return nil, err
+			}
+			if todo != nil {
+				todos = append(todos, todo)
+			}
+		}
+	}
+	return todos, nil
+}
+
+// fromHash returns nil for an empty hash, redis does not keep empty hashes
+func fromHash(id string, values map[string]string) (*repository.Todo, error) {
+	if len(values) == 0 {
 		return nil, nil
 	}
-	data := &repository.Todo{
-		Id:          key,
-		Title:       ra.redis.HGet(ctx, key, title).Val(),
-		Description: ra.redis.HGet(ctx, key, description).Val(),
+	todo := &repository.Todo{
+		Id:          id,
+		Title:       values[title],
+		Description: values[description],
+		Status:      values[status],
+		List:        values[list],
 	}
-	return data, nil
+	if values[tags] != "" {
+		if err := json.Unmarshal([]byte(values[tags]), &todo.Tags); err != nil {
+			return nil, err
+		}
+	}
+	todo.Revision, _ = strconv.ParseUint(values[revision], 10, 64)
+	return todo, nil
 }
 
-func (ra *RedisAdapter) WriteToRedis(ctx context.Context, todo *repository.Todo) (before *repository.Todo, current *repository.Todo, err error) {
-	ctx, span := otel.Tracer("redis").Start(ctx, "WriteToRedis")
-	defer span.End()
-	before, err = ra.ReadFromRedis(ctx, todo.Id)
+func toHash(todo *repository.Todo) (map[string]interface{}, error) {
+	values := map[string]interface{}{
+		title:       todo.Title,
+		description: todo.Description,
+		status:      todo.Status,
+		list:        todo.List,
+	}
+	if len(todo.Tags) > 0 {
+		data, err := json.Marshal(todo.Tags)
+		if err != nil {
+			return nil, err
+		}
+		values[tags] = data
+	}
+	return values, nil
+}
+
+// writeTodo replaces the todo in a transaction, the revision is set by nextRevision
+func writeTodo(ctx context.Context, pipe redis.Pipeliner, keys keyspace, todo *repository.Todo) (*redis.Cmd, error) {
+	values, err := toHash(todo)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	ra.redis.HSet(ctx, todo.Id, title, todo.Title)
-	ra.redis.HSet(ctx, todo.Id, description, todo.Description)
-	current = todo
+	pipe.Del(ctx, keys.todo(todo.Id))
+	pipe.HSet(ctx, keys.todo(todo.Id), values)
+	pipe.SAdd(ctx, keys.key(indexKey), todo.Id)
+	return nextRevision(ctx, pipe, keys, todo.Id), nil
+}
+
+// WriteToRedis stores the todo, with ifRevision set only if the stored todo has
+// that revision and with ifAbsent only if there is no stored todo
+func (ra *RedisAdapter) WriteToRedis(ctx context.Context, todo *repository.Todo, changeType repository.ChangeType, ifRevision uint64, ifAbsent bool) (before *repository.Todo, current *repository.Todo, err error) {
+	ctx, span := otel.Tracer("redis").Start(ctx, "WriteToRedis")
+	defer span.End()
+	var next *redis.Cmd
+	err = ra.retryWatch(ctx, ifRevision, func(tx *redis.Tx) error {
+		before, err = readTodo(ctx, tx, ra.keys, todo.Id)
+		if err != nil {
+			return err
+		}
+		if !matchesRevision(before, ifRevision) || (ifAbsent && before != nil) {
+			return repository.ErrConflict
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			next, err = writeTodo(ctx, pipe, ra.keys, todo)
+			if err != nil {
+				return err
+			}
+			if ra.outbox {
+				return appendRecord(ctx, pipe, ra.keys, before, todo, changeType)
+			}
+			return nil
+		})
+		return err
+	}, ra.keys.todo(todo.Id))
 	if err != nil {
 		return nil, nil, err
 	}
-	return before, current, nil
+	written := *todo
+	written.Revision, _ = next.Uint64()
+	return before, &written, nil
 }
 
-func (ra *RedisAdapter) DeleteFromRedis(ctx context.Context, key string) (before *repository.Todo, err error) {
+// DeleteFromRedis removes the todo, with ifRevision set only if the stored todo has that revision
+func (ra *RedisAdapter) DeleteFromRedis(ctx context.Context, id string, ifRevision uint64) (before *repository.Todo, err error) {
 	ctx, span := otel.Tracer("redis").Start(ctx, "DeleteFromRedis")
 	defer span.End()
-	before, err = ra.ReadFromRedis(ctx, key)
+	err = ra.retryWatch(ctx, ifRevision, func(tx *redis.Tx) error {
+		before, err = readTodo(ctx, tx, ra.keys, id)
+		if err != nil {
+			return err
+		}
+		if !matchesRevision(before, ifRevision) {
+			return repository.ErrConflict
+		}
+		if before == nil {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, ra.keys.todo(id))
+			pipe.SRem(ctx, ra.keys.key(indexKey), id)
+			nextRevision(ctx, pipe, ra.keys, id)
+			if ra.outbox {
+				return appendRecord(ctx, pipe, ra.keys, before, nil, repository.ChangeTypeDelete)
+			}
+			return nil
+		})
+		return err
+	}, ra.keys.todo(id))
 	if err != nil {
 		return nil, err
 	}
-	ra.redis.Del(ctx, key)
 	return before, nil
 }
+
+// watchRetries is the number of attempts of an unconditional write whose todo changed concurrently
+const watchRetries = 20
+
+// retryWatch runs the transaction until no other client changed the keys in
+// between. A conditional write is not retried, its revision is outdated.
+func (ra *RedisAdapter) retryWatch(ctx context.Context, ifRevision uint64, transaction func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 1; ; attempt++ {
+		err := ra.redis.Watch(ctx, transaction, keys...)
+		switch {
+		case err != redis.TxFailedErr:
+			return err
+		case ifRevision != 0:
+			return repository.ErrConflict
+		case attempt == watchRetries:
+			return err
+		}
+		// a random wait keeps the writers of a busy todo from colliding again
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rand.Int64N(int64(min(attempt, 10)) * int64(time.Millisecond)))):
+		}
+	}
+}
+
+func matchesRevision(todo *repository.Todo, revision uint64) bool {
+	return revision == 0 || (todo != nil && todo.Revision == revision)
+}
@@ -0,0 +1,103 @@
+package redis
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/delta"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	redis "github.com/go-redis/redis/v9"
+	"go.opentelemetry.io/otel"
+	"strconv"
+)
+
+const (
+	syncKeyPrefix   = "sync:"
+	syncSequenceKey = syncKeyPrefix + "sequence"
+	// syncIndexKey is a sorted set of all todo ids, deleted ones included,
+	// scored by the revision of their last change
+	syncIndexKey = syncKeyPrefix + "index"
+	revision     = "revision"
+)
+
+// syncScript assigns the next revision to a todo. It runs inside the
+// transaction of the write, so revisions become visible in order.
+var syncScript = redis.NewScript(`
+local sequence = redis.call('INCR', KEYS[1])
+redis.call('ZADD', KEYS[2], sequence, ARGV[1])
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('HSET', KEYS[3], 'revision', sequence)
+end
+return sequence
+`)
+
+// nextRevision queues the script in the transaction of a write
+func nextRevision(ctx context.Context, pipe redis.Pipeliner, keys keyspace, id string) *redis.Cmd {
+	return syncScript.Eval(ctx, pipe, []string{keys.key(syncSequenceKey), keys.key(syncIndexKey), keys.todo(id)}, id)
+}
+
+func (s *server) Changes(ctx context.Context, since string, limit int) (*delta.Changes, error) {
+	ctx, span := otel.Tracer("redis").Start(ctx, "Changes")
+	defer span.End()
+	client := s.RedisAdapter.redis
+	// read the sequence first, every change up to it is already in the index
+	current, err := client.Get(ctx, s.RedisAdapter.keys.key(syncSequenceKey)).Uint64()
+	if err != nil && err != redis.Nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	last, parseErr := strconv.ParseUint(since, 10, 64)
+	known := parseErr == nil && last <= current
+	if !known {
+		last = 0
+	}
+	entries, err := client.ZRangeByScoreWithScores(ctx, s.RedisAdapter.keys.key(syncIndexKey), &redis.ZRangeBy{
+		Min:   "(" + strconv.FormatUint(last, 10),
+		Max:   "+inf",
+		Count: int64(limit) + 1,
+	}).Result()
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	changes := &delta.Changes{
+		Upserts: []*repository.Todo{},
+		Deletes: []string{},
+		Reset:   !known,
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		changes.More = true
+	}
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.Member.(string))
+	}
+	todos, err := readTodos(ctx, client, s.RedisAdapter.keys, ids)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, todo := range todos {
+		existing[todo.Id] = true
+		changes.Upserts = append(changes.Upserts, todo)
+	}
+	// a reset replaces the local state, tombstones are not needed then
+	if known {
+		for _, id := range ids {
+			if !existing[id] {
+				changes.Deletes = append(changes.Deletes, id)
+			}
+		}
+	}
+	token := current
+	if len(entries) > 0 {
+		// changes written after reading the sequence may be included as well
+		newest := uint64(entries[len(entries)-1].Score)
+		if changes.More || newest > token {
+			token = newest
+		}
+	}
+	changes.Token = strconv.FormatUint(token, 10)
+	return changes, nil
+}
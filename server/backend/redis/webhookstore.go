@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	redis "github.com/go-redis/redis/v9"
+	"go.opentelemetry.io/otel"
+	"sort"
+)
+
+const (
+	webhookKeyPrefix        = "webhook:"
+	webhookSubscriptionsKey = webhookKeyPrefix + "subscriptions"
+	webhookDeliveriesKey    = webhookKeyPrefix + "deliveries:"
+)
+
+type webhookStore struct {
+	redis redis.UniversalClient
+	keys  keyspace
+}
+
+// WebhookStore returns a store that keeps the webhook subscriptions in the same redis
+func (s *server) WebhookStore() webhook.Store {
+	return &webhookStore{
+		redis: s.RedisAdapter.redis,
+		keys:  s.RedisAdapter.keys,
+	}
+}
+
+func (ws *webhookStore) CreateSubscription(ctx context.Context, subscription *webhook.Subscription) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "CreateSubscription")
+	defer span.End()
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	return ws.redis.HSet(ctx, ws.keys.key(webhookSubscriptionsKey), subscription.Id, data).Err()
+}
+
+func (ws *webhookStore) UpdateSubscription(ctx context.Context, subscription *webhook.Subscription) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "UpdateSubscription")
+	defer span.End()
+	exists, err := ws.redis.HExists(ctx, ws.keys.key(webhookSubscriptionsKey), subscription.Id).Result()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return webhook.ErrNotFound
+	}
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	return ws.redis.HSet(ctx, ws.keys.key(webhookSubscriptionsKey), subscription.Id, data).Err()
+}
+
+func (ws *webhookStore) GetSubscription(ctx context.Context, id string) (*webhook.Subscription, error) {
+	ctx, span := otel.Tracer("redis").Start(ctx, "GetSubscription")
+	defer span.End()
+	data, err := ws.redis.HGet(ctx, ws.keys.key(webhookSubscriptionsKey), id).Bytes()
+	if err == redis.Nil {
+		return nil, webhook.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	subscription := &webhook.Subscription{}
+	if err := json.Unmarshal(data, subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func (ws *webhookStore) ListSubscriptions(ctx context.Context) ([]*webhook.Subscription, error) {
+	ctx, span := otel.Tracer("redis").Start(ctx, "ListSubscriptions")
+	defer span.End()
+	values, err := ws.redis.HGetAll(ctx, ws.keys.key(webhookSubscriptionsKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := make([]*webhook.Subscription, 0, len(values))
+	for _, value := range values {
+		subscription := &webhook.Subscription{}
+		if err := json.Unmarshal([]byte(value), subscription); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+	return subscriptions, nil
+}
+
+func (ws *webhookStore) DeleteSubscription(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "DeleteSubscription")
+	defer span.End()
+	deleted, err := ws.redis.HDel(ctx, ws.keys.key(webhookSubscriptionsKey), id).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return webhook.ErrNotFound
+	}
+	return ws.redis.Del(ctx, ws.keys.key(webhookDeliveriesKey+id)).Err()
+}
+
+func (ws *webhookStore) AddDelivery(ctx context.Context, delivery *webhook.Delivery) error {
+	ctx, span := otel.Tracer("redis").Start(ctx, "AddDelivery")
+	defer span.End()
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	key := ws.keys.key(webhookDeliveriesKey + delivery.SubscriptionId)
+	_, err = ws.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, data)
+		pipe.LTrim(ctx, key, -webhook.MaxDeliveries, -1)
+		return nil
+	})
+	return err
+}
+
+func (ws *webhookStore) ListDeliveries(ctx context.Context, subscriptionId string) ([]*webhook.Delivery, error) {
+	ctx, span := otel.Tracer("redis").Start(ctx, "ListDeliveries")
+	defer span.End()
+	values, err := ws.redis.LRange(ctx, ws.keys.key(webhookDeliveriesKey+subscriptionId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*webhook.Delivery, 0, len(values))
+	for _, value := range values {
+		delivery := &webhook.Delivery{}
+		if err := json.Unmarshal([]byte(value), delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"slices"
+	"sort"
+)
+
+// Matches tells if the todo passes the filters of the request
+func (req *GetAllRequest) Matches(todo *Todo) bool {
+	if req.List != "" && todo.List != req.List {
+		return false
+	}
+	if req.Status != "" && todo.Status != req.Status {
+		return false
+	}
+	if req.Tag != "" && !slices.Contains(todo.Tags, req.Tag) {
+		return false
+	}
+	return true
+}
+
+// Select filters, orders and pages the todos for backends that cannot do it
+// while reading
+func Select(todos []*Todo, req *GetAllRequest) []*Todo {
+	selected := make([]*Todo, 0, len(todos))
+	for _, todo := range todos {
+		if req.Matches(todo) {
+			selected = append(selected, todo)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Id < selected[j].Id
+	})
+	if req.Offset > 0 {
+		selected = selected[min(req.Offset, len(selected)):]
+	}
+	if req.Limit > 0 && req.Limit < len(selected) {
+		selected = selected[:req.Limit]
+	}
+	return selected
+}
@@ -2,8 +2,17 @@ package repository
 
 import (
 	"context"
+	"errors"
 )
 
+// ErrConflict is returned if a conditional write finds a different revision
+var ErrConflict = errors.New("todo was changed concurrently")
+
+// ErrCapacityExceeded is returned if a backend is full and cannot store another todo
+var ErrCapacityExceeded = errors.New("capacity exceeded")
+
+// TodoRepository is implemented by every backend and decorator, the shared
+// semantics are checked by repositorytest.Run
 type TodoRepository interface {
 	Name() string
 	Create(ctx context.Context, req *CreateOrUpdateRequest) (resp *CreateOrUpdateResponse, err error)
@@ -18,16 +27,36 @@ type Todo struct {
 	Title       string
 	Description string
 	Status      string
+	// List is the name of the list the todo belongs to
+	List string
+	Tags []string
+	// Revision is the sequence number of the last change, set by backends supporting sync
+	Revision uint64
 }
 
+// StatusCompleted is the status of a done todo
+const StatusCompleted = "COMPLETED"
+
+type ChangeType string
+
+const (
+	ChangeTypeCreate ChangeType = "CREATE"
+	ChangeTypeUpdate ChangeType = "UPDATE"
+	ChangeTypeDelete ChangeType = "DELETE"
+)
+
 type Change struct {
 	Before     *Todo
 	After      *Todo
-	ChangeType string
+	ChangeType ChangeType
 }
 
 type CreateOrUpdateRequest struct {
 	Todo *Todo
+	// IfRevision only writes if the stored todo has this revision, 0 writes unconditionally
+	IfRevision uint64
+	// IfAbsent only writes if no todo with the id is stored
+	IfAbsent bool
 }
 
 type CreateOrUpdateResponse struct {
@@ -35,7 +64,13 @@ type CreateOrUpdateResponse struct {
 }
 
 type GetAllRequest struct {
-	// nothing
+	// List, Status and Tag only return the matching todos if set
+	List   string
+	Status string
+	Tag    string
+	// Limit is the maximum number of todos, 0 returns all. Todos are ordered by id.
+	Limit  int
+	Offset int
 }
 
 type GetAllResponse struct {
@@ -52,6 +87,8 @@ type GetResponse struct {
 
 type DeleteRequest struct {
 	Id string
+	// IfRevision only deletes if the stored todo has this revision, 0 deletes unconditionally
+	IfRevision uint64
 }
 
 type DeleteResponse struct {
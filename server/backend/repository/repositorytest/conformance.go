@@ -0,0 +1,406 @@
+// Package repositorytest is the conformance suite every TodoRepository has to pass
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Factory returns a new, empty repository for every test
+type Factory func(t *testing.T) repository.TodoRepository
+
+// Run checks the semantics all backends share:
+//   - Get of a missing todo returns a nil Todo and no error
+//   - Create and Update both store the todo whether it exists or not
+//   - every write gives the todo a new, higher revision
+//   - a write or delete with IfRevision fails with ErrConflict unless the
+//     stored todo has that revision, a missing todo never matches
+//   - a write with IfAbsent fails with ErrConflict if the todo is stored
+//   - Delete of a missing todo is no error
+//   - GetAll is ordered by id, filtered by list, status and tag and paged
+//   - returned todos are copies, changing them does not change the repository
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, r repository.TodoRepository)
+	}{
+		{"GetMissing", testGetMissing},
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateOverwrites", testCreateOverwrites},
+		{"UpdateCreates", testUpdateCreates},
+		{"Revisions", testRevisions},
+		{"ConditionalWrites", testConditionalWrites},
+		{"CreateIfAbsent", testCreateIfAbsent},
+		{"Delete", testDelete},
+		{"ConditionalDelete", testConditionalDelete},
+		{"Ordering", testOrdering},
+		{"Filters", testFilters},
+		{"Paging", testPaging},
+		{"Copies", testCopies},
+		{"ConcurrentWrites", testConcurrentWrites},
+		{"ConcurrentConditionalWrites", testConcurrentConditionalWrites},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, factory(t))
+		})
+	}
+}
+
+func create(t *testing.T, r repository.TodoRepository, todo *repository.Todo) *repository.Todo {
+	t.Helper()
+	resp, err := r.Create(context.Background(), &repository.CreateOrUpdateRequest{Todo: todo})
+	if err != nil {
+		t.Fatalf("Create %s: %v", todo.Id, err)
+	}
+	return resp.Todo
+}
+
+func get(t *testing.T, r repository.TodoRepository, id string) *repository.Todo {
+	t.Helper()
+	resp, err := r.Get(context.Background(), &repository.GetRequest{Id: id})
+	if err != nil {
+		t.Fatalf("Get %s: %v", id, err)
+	}
+	if resp == nil {
+		t.Fatalf("Get %s returned no response", id)
+	}
+	return resp.Todo
+}
+
+func getAll(t *testing.T, r repository.TodoRepository, req *repository.GetAllRequest) []*repository.Todo {
+	t.Helper()
+	resp, err := r.GetAll(context.Background(), req)
+	if err != nil {
+		t.Fatalf("GetAll %+v: %v", req, err)
+	}
+	return resp.Todos
+}
+
+func ids(todos []*repository.Todo) []string {
+	ids := make([]string, len(todos))
+	for i, todo := range todos {
+		ids[i] = todo.Id
+	}
+	return ids
+}
+
+// sameContent compares everything but the revision, a nil and an empty tag list are the same
+func sameContent(a *repository.Todo, b *repository.Todo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Id == b.Id &&
+		a.Title == b.Title &&
+		a.Description == b.Description &&
+		a.Status == b.Status &&
+		a.List == b.List &&
+		slices.Equal(a.Tags, b.Tags)
+}
+
+func full(id string) *repository.Todo {
+	return &repository.Todo{
+		Id:          id,
+		Title:       "Title " + id,
+		Description: "Description of " + id,
+		Status:      repository.StatusCompleted,
+		List:        "work",
+		Tags:        []string{"b", "a"},
+	}
+}
+
+func testGetMissing(t *testing.T, r repository.TodoRepository) {
+	if todo := get(t, r, "missing"); todo != nil {
+		t.Errorf("Expected no todo, got %+v", todo)
+	}
+	if todos := getAll(t, r, &repository.GetAllRequest{}); len(todos) != 0 {
+		t.Errorf("Expected no todos, got %d", len(todos))
+	}
+}
+
+func testCreateAndGet(t *testing.T, r repository.TodoRepository) {
+	todo := full("1")
+	created := create(t, r, todo)
+	if !sameContent(created, todo) {
+		t.Errorf("Create returned %+v, expected %+v", created, todo)
+	}
+	if got := get(t, r, "1"); !sameContent(got, todo) {
+		t.Errorf("Get returned %+v, expected %+v", got, todo)
+	} else if got.Revision != created.Revision {
+		t.Errorf("Get returned revision %d, Create %d", got.Revision, created.Revision)
+	}
+	// a todo with nothing but an id is a todo too
+	create(t, r, &repository.Todo{Id: "2"})
+	if got := get(t, r, "2"); got == nil || got.Id != "2" {
+		t.Errorf("Expected the empty todo, got %+v", got)
+	}
+}
+
+func testCreateOverwrites(t *testing.T, r repository.TodoRepository) {
+	create(t, r, full("1"))
+	replacement := &repository.Todo{Id: "1", Title: "Replaced"}
+	create(t, r, replacement)
+	if got := get(t, r, "1"); !sameContent(got, replacement) {
+		t.Errorf("Expected the second create to replace the todo, got %+v", got)
+	}
+	if todos := getAll(t, r, &repository.GetAllRequest{}); len(todos) != 1 {
+		t.Errorf("Expected one todo, got %d", len(todos))
+	}
+}
+
+func testUpdateCreates(t *testing.T, r repository.TodoRepository) {
+	todo := full("1")
+	_, err := r.Update(context.Background(), &repository.CreateOrUpdateRequest{Todo: todo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, r, "1"); !sameContent(got, todo) {
+		t.Errorf("Expected the update to create the todo, got %+v", got)
+	}
+}
+
+func testRevisions(t *testing.T, r repository.TodoRepository) {
+	ctx := context.Background()
+	first := create(t, r, full("1"))
+	if first.Revision == 0 {
+		t.Fatal("Expected a revision")
+	}
+	updated, err := r.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Updated"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Todo.Revision <= first.Revision {
+		t.Errorf("Expected a revision above %d, got %d", first.Revision, updated.Todo.Revision)
+	}
+	other := create(t, r, full("2"))
+	if other.Revision <= updated.Todo.Revision {
+		t.Errorf("Expected the revisions to grow across todos, got %d after %d", other.Revision, updated.Todo.Revision)
+	}
+}
+
+func testConditionalWrites(t *testing.T, r repository.TodoRepository) {
+	ctx := context.Background()
+	created := create(t, r, full("1"))
+	_, err := r.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Stale"}, IfRevision: created.Revision + 1000})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("Expected a conflict for a wrong revision, got %v", err)
+	}
+	if got := get(t, r, "1"); !sameContent(got, created) {
+		t.Errorf("Expected the todo to be unchanged, got %+v", got)
+	}
+	_, err = r.Create(ctx, &repository.CreateOrUpdateRequest{Todo: full("2"), IfRevision: 1})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("Expected a conflict for a missing todo, got %v", err)
+	}
+	if got := get(t, r, "2"); got != nil {
+		t.Errorf("Expected no todo after the conflict, got %+v", got)
+	}
+	updated, err := r.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Current"}, IfRevision: created.Revision})
+	if err != nil {
+		t.Fatalf("Expected the matching revision to be written, got %v", err)
+	}
+	if updated.Todo.Title != "Current" || get(t, r, "1").Title != "Current" {
+		t.Errorf("Expected the update, got %+v", updated.Todo)
+	}
+}
+
+func testCreateIfAbsent(t *testing.T, r repository.TodoRepository) {
+	ctx := context.Background()
+	created, err := r.Create(ctx, &repository.CreateOrUpdateRequest{Todo: full("1"), IfAbsent: true})
+	if err != nil {
+		t.Fatalf("Expected a missing todo to be created, got %v", err)
+	}
+	_, err = r.Create(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "Second"}, IfAbsent: true})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("Expected a conflict for a stored todo, got %v", err)
+	}
+	if got := get(t, r, "1"); !sameContent(got, created.Todo) {
+		t.Errorf("Expected the todo to be unchanged, got %+v", got)
+	}
+}
+
+func testDelete(t *testing.T, r repository.TodoRepository) {
+	ctx := context.Background()
+	create(t, r, full("1"))
+	create(t, r, full("2"))
+	resp, err := r.Delete(ctx, &repository.DeleteRequest{Id: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != "1" {
+		t.Errorf("Expected the id of the deleted todo, got %s", resp.Id)
+	}
+	if got := get(t, r, "1"); got != nil {
+		t.Errorf("Expected the todo to be gone, got %+v", got)
+	}
+	if todos := getAll(t, r, &repository.GetAllRequest{}); !slices.Equal(ids(todos), []string{"2"}) {
+		t.Errorf("Expected only todo 2, got %v", ids(todos))
+	}
+	if _, err := r.Delete(ctx, &repository.DeleteRequest{Id: "1"}); err != nil {
+		t.Errorf("Expected deleting a missing todo to succeed, got %v", err)
+	}
+	// a deleted todo can be created again
+	create(t, r, full("1"))
+	if got := get(t, r, "1"); got == nil {
+		t.Error("Expected the todo to be created again")
+	}
+}
+
+func testConditionalDelete(t *testing.T, r repository.TodoRepository) {
+	ctx := context.Background()
+	created := create(t, r, full("1"))
+	_, err := r.Delete(ctx, &repository.DeleteRequest{Id: "1", IfRevision: created.Revision + 1000})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if get(t, r, "1") == nil {
+		t.Error("Expected the todo to be kept after the conflict")
+	}
+	if _, err := r.Delete(ctx, &repository.DeleteRequest{Id: "missing", IfRevision: 1}); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("Expected a conflict for a missing todo, got %v", err)
+	}
+	if _, err := r.Delete(ctx, &repository.DeleteRequest{Id: "1", IfRevision: created.Revision}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, r, "1"); got != nil {
+		t.Errorf("Expected the todo to be gone, got %+v", got)
+	}
+}
+
+// testOrdering expects the byte order of the ids regardless of locale and collation
+func testOrdering(t *testing.T, r repository.TodoRepository) {
+	for _, id := range []string{"c", "a", "10", "b", "1", "2", "B", "a_b", "A", "a-b", "~x", "a.b", "Z"} {
+		create(t, r, full(id))
+	}
+	expected := []string{"1", "10", "2", "A", "B", "Z", "a", "a-b", "a.b", "a_b", "b", "c", "~x"}
+	if got := ids(getAll(t, r, &repository.GetAllRequest{})); !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func testFilters(t *testing.T, r repository.TodoRepository) {
+	create(t, r, &repository.Todo{Id: "1", List: "work", Status: repository.StatusCompleted, Tags: []string{"urgent"}})
+	create(t, r, &repository.Todo{Id: "2", List: "work", Tags: []string{"later", "urgent"}})
+	create(t, r, &repository.Todo{Id: "3", List: "home", Status: repository.StatusCompleted})
+	create(t, r, &repository.Todo{Id: "4"})
+	for _, test := range []struct {
+		req      *repository.GetAllRequest
+		expected []string
+	}{
+		{&repository.GetAllRequest{List: "work"}, []string{"1", "2"}},
+		{&repository.GetAllRequest{Status: repository.StatusCompleted}, []string{"1", "3"}},
+		{&repository.GetAllRequest{Tag: "urgent"}, []string{"1", "2"}},
+		{&repository.GetAllRequest{Tag: "later"}, []string{"2"}},
+		{&repository.GetAllRequest{List: "work", Status: repository.StatusCompleted}, []string{"1"}},
+		{&repository.GetAllRequest{List: "home", Tag: "urgent"}, []string{}},
+		{&repository.GetAllRequest{List: "none"}, []string{}},
+	} {
+		if got := ids(getAll(t, r, test.req)); !slices.Equal(got, test.expected) {
+			t.Errorf("Expected %v for %+v, got %v", test.expected, test.req, got)
+		}
+	}
+}
+
+func testPaging(t *testing.T, r repository.TodoRepository) {
+	for i := range 7 {
+		create(t, r, &repository.Todo{Id: fmt.Sprintf("%d", i), List: []string{"even", "odd"}[i%2]})
+	}
+	for _, test := range []struct {
+		req      *repository.GetAllRequest
+		expected []string
+	}{
+		{&repository.GetAllRequest{Limit: 3}, []string{"0", "1", "2"}},
+		{&repository.GetAllRequest{Limit: 3, Offset: 3}, []string{"3", "4", "5"}},
+		{&repository.GetAllRequest{Limit: 3, Offset: 6}, []string{"6"}},
+		{&repository.GetAllRequest{Limit: 3, Offset: 9}, []string{}},
+		{&repository.GetAllRequest{Offset: 5}, []string{"5", "6"}},
+		{&repository.GetAllRequest{List: "odd", Limit: 2, Offset: 1}, []string{"3", "5"}},
+	} {
+		if got := ids(getAll(t, r, test.req)); !slices.Equal(got, test.expected) {
+			t.Errorf("Expected %v for %+v, got %v", test.expected, test.req, got)
+		}
+	}
+}
+
+func testCopies(t *testing.T, r repository.TodoRepository) {
+	todo := full("1")
+	created := create(t, r, todo)
+	todo.Title = "Changed request"
+	todo.Tags[0] = "changed"
+	created.Title = "Changed response"
+	get(t, r, "1").Title = "Changed get"
+	getAll(t, r, &repository.GetAllRequest{})[0].Tags[0] = "changed"
+	if got := get(t, r, "1"); !sameContent(got, full("1")) {
+		t.Errorf("Expected the stored todo to be unchanged, got %+v", got)
+	}
+}
+
+func testConcurrentWrites(t *testing.T, r repository.TodoRepository) {
+	ctx := context.Background()
+	const writers, writes = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes*2)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				// every writer has its own todos and all share one
+				own := &repository.Todo{Id: fmt.Sprintf("%d-%d", w, i)}
+				if _, err := r.Create(ctx, &repository.CreateOrUpdateRequest{Todo: own}); err != nil {
+					errs <- err
+				}
+				shared := &repository.Todo{Id: "shared", Title: own.Id}
+				if _, err := r.Update(ctx, &repository.CreateOrUpdateRequest{Todo: shared}); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Unconditional write failed: %v", err)
+	}
+	if todos := getAll(t, r, &repository.GetAllRequest{}); len(todos) != writers*writes+1 {
+		t.Errorf("Expected %d todos, got %d", writers*writes+1, len(todos))
+	}
+}
+
+func testConcurrentConditionalWrites(t *testing.T, r repository.TodoRepository) {
+	ctx := context.Background()
+	created := create(t, r, full("1"))
+	const writers = 8
+	var wg sync.WaitGroup
+	results := make(chan error, writers)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Update(ctx, &repository.CreateOrUpdateRequest{
+				Todo:       &repository.Todo{Id: "1", Title: fmt.Sprintf("Writer %d", w)},
+				IfRevision: created.Revision,
+			})
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	won := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, repository.ErrConflict):
+			t.Errorf("Expected a conflict, got %v", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("Expected exactly one writer to win, got %d", won)
+	}
+}
@@ -3,14 +3,19 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dkrizic/todo/server/backend/repository"
 	"github.com/go-chi/chi/v5"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Error struct {
@@ -23,7 +28,14 @@ func TodosHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		log.WithField("Implementation", ActiveBackend.Implementation.Name()).Info("Getting all todos")
-		response, err := ActiveBackend.Implementation.GetAll(ctx, &repository.GetAllRequest{})
+		request, err := getAllRequestFromQuery(r)
+		if err != nil {
+			log.WithError(err).Error("Invalid query")
+			span.RecordError(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response, err := ActiveBackend.Implementation.GetAll(ctx, request)
 		if err != nil {
 			log.WithError(err).Error("Error while getting all todos")
 			span.RecordError(err)
@@ -65,12 +77,12 @@ func TodosHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		response, err := ActiveBackend.Implementation.Create(ctx, &repository.CreateOrUpdateRequest{
-			&todo,
+			Todo: &todo,
 		})
 		if err != nil {
 			log.WithError(err).Error("Error while creating todo")
 			span.RecordError(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusOfWriteError(err))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -88,6 +100,10 @@ func TodoHandler(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(attribute.KeyValue{Key: "id", Value: attribute.StringValue(id)})
 	switch r.Method {
 	case "GET":
+		if r.URL.Query().Has("asOf") {
+			todoAsOf(ctx, w, r, id)
+			return
+		}
 		log.WithField("id", id).Info("Getting todo by id")
 		response, err := ActiveBackend.Implementation.Get(ctx, &repository.GetRequest{
 			Id: id,
@@ -137,13 +153,13 @@ func TodoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		log.WithField("id", id).Info("Updating todo by id")
 		response, err := ActiveBackend.Implementation.Update(ctx, &repository.CreateOrUpdateRequest{
-			&todo,
+			Todo: &todo,
 		})
 		if err != nil {
 			log.WithError(err).Error("Error while updating todo")
 			span.SetStatus(codes.Error, err.Error())
 			span.RecordError(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusOfWriteError(err))
 			return
 		}
 		data, err = convertTodoStructToJson(ctx, response.Todo)
@@ -160,12 +176,14 @@ func TodoHandler(w http.ResponseWriter, r *http.Request) {
 		span.SetStatus(codes.Ok, "Todo updated successfully")
 	case "DELETE":
 		log.WithField("id", id).Info("Deleting todo by id")
-		_, err := ActiveBackend.Implementation.Delete(ctx, &repository.DeleteRequest{})
+		_, err := ActiveBackend.Implementation.Delete(ctx, &repository.DeleteRequest{
+			Id: id,
+		})
 		if err != nil {
 			log.WithError(err).Error("Error while deleting todo")
 			span.SetStatus(codes.Error, err.Error())
 			span.RecordError(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusOfWriteError(err))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -175,6 +193,71 @@ func TodoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// todoAsOf writes the todo as it was at the RFC 3339 time in the asOf parameter
+func todoAsOf(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) {
+	span := trace.SpanFromContext(ctx)
+	if ActiveBackend.History == nil {
+		log.WithField("implementation", ActiveBackend.Implementation.Name()).Error("Backend keeps no history")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	asOf, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("asOf"))
+	if err != nil {
+		log.WithError(err).Error("Invalid asOf")
+		span.RecordError(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.WithField("id", id).WithField("asOf", asOf).Info("Getting todo by id as of")
+	todo, err := ActiveBackend.History.GetAsOf(ctx, id, asOf)
+	if err != nil {
+		log.WithError(err).Error("Error while getting todo as of")
+		span.SetStatus(codes.Error, err.Error())
+		span.RecordError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, err := convertTodoStructToJson(ctx, todo)
+	if err != nil {
+		log.WithError(err).Error("Error while converting todo to json")
+		span.RecordError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getAllRequestFromQuery reads the filters list, status and tag and the paging limit and offset
+func getAllRequestFromQuery(r *http.Request) (*repository.GetAllRequest, error) {
+	query := r.URL.Query()
+	request := &repository.GetAllRequest{
+		List:   query.Get("list"),
+		Status: query.Get("status"),
+		Tag:    query.Get("tag"),
+	}
+	for name, value := range map[string]*int{"limit": &request.Limit, "offset": &request.Offset} {
+		if query.Get(name) == "" {
+			continue
+		}
+		number, err := strconv.Atoi(query.Get(name))
+		if err != nil || number < 0 {
+			return nil, fmt.Errorf("%s must be a number of at least 0", name)
+		}
+		*value = number
+	}
+	return request, nil
+}
+
+// statusOfWriteError returns 507 if the backend is full
+func statusOfWriteError(err error) int {
+	if errors.Is(err, repository.ErrCapacityExceeded) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
 // convert request data in json format to Todo struct
 func convertJsonToTodoStruct(ctx context.Context, jsonData []byte) (todo repository.Todo, err error) {
 	_, span := otel.Tracer("backend").Start(ctx, "convertJsonToTodoStruct")
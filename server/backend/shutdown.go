@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"net/http"
+	"time"
+)
+
+// defaultShutdownTimeout is used if the backend has no ShutdownTimeout
+const defaultShutdownTimeout = 30 * time.Second
+
+type servers struct {
+	http    *http.Server
+	grpc    *grpc.Server
+	metrics *http.Server
+}
+
+// shutdown reports not ready, waits for the load balancers to notice and
+// drains the requests. It then publishes the changes left in the outbox,
+// waits for the webhooks and calls OnShutdown. The metrics and the probes are
+// served until the end. All errors are returned together.
+func (backend Backend) shutdown(servers *servers, stopWorkers func()) error {
+	log.Info("Shutting down")
+	if backend.Health != nil {
+		backend.Health.Draining()
+	}
+	time.Sleep(backend.ShutdownDelay)
+
+	timeout := backend.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// streams never end by themselves, their clients resume on another instance
+	if backend.Feed != nil {
+		backend.Feed.Close()
+	}
+	var drain errgroup.Group
+	drain.Go(func() error {
+		return servers.http.Shutdown(ctx)
+	})
+	if servers.grpc != nil {
+		drain.Go(func() error {
+			return stopGrpc(ctx, servers.grpc)
+		})
+	}
+	errs := []error{drain.Wait()}
+	log.Info("Requests drained")
+
+	if backend.Relay != nil {
+		errs = append(errs, backend.Relay.Flush(ctx))
+	}
+	if backend.Webhooks != nil {
+		errs = append(errs, backend.Webhooks.Wait(ctx))
+	}
+	stopWorkers()
+	for _, onShutdown := range backend.OnShutdown {
+		errs = append(errs, onShutdown(ctx))
+	}
+	errs = append(errs, servers.metrics.Shutdown(ctx))
+	if backend.HealthServer != nil {
+		errs = append(errs, backend.HealthServer.server.Shutdown(ctx))
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		log.WithError(err).Error("Shutdown incomplete")
+		return err
+	}
+	log.Info("Shutdown complete")
+	return nil
+}
+
+// stopGrpc waits for the running calls and cancels them when the context is done
+func stopGrpc(ctx context.Context, server *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,118 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations holds one directory per driver with files named <version>_<name>.sql
+//
+//go:embed migrations
+var migrations embed.FS
+
+// migrationLockId is the advisory lock that keeps PostgreSQL replicas from
+// migrating at the same time
+const migrationLockId = 7_245_300_111
+
+type migration struct {
+	version int
+	name    string
+	script  string
+}
+
+func loadMigrations(driver string) ([]migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return nil, err
+	}
+	loaded := []migration{}
+	for _, entry := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", entry.Name())
+		}
+		script, err := fs.ReadFile(migrations, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, migration{version: version, name: name, script: string(script)})
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].version < loaded[j].version
+	})
+	return loaded, nil
+}
+
+// migrate applies the missing migrations, each one in its own transaction
+func (s *server) migrate(ctx context.Context) error {
+	pending, err := loadMigrations(s.driver)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create the migrations table: %w", err)
+	}
+	for _, migration := range pending {
+		applied, err := s.apply(ctx, migration)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d %s: %w", migration.version, migration.name, err)
+		}
+		if applied {
+			log.WithField("version", migration.version).WithField("name", migration.name).Info("Applied migration")
+		}
+	}
+	return nil
+}
+
+func (s *server) apply(ctx context.Context, migration migration) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if s.driver == DriverPostgres {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockId); err != nil {
+			return false, err
+		}
+	}
+	var count int
+	err = tx.QueryRowContext(ctx, s.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), migration.version).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, migration.script); err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, s.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+		migration.version, migration.name, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// schemaVersion returns the version of the last applied migration
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	return int(version.Int64), err
+}
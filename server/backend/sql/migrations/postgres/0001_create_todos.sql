@@ -0,0 +1,28 @@
+CREATE TABLE todos (
+    id          TEXT PRIMARY KEY,
+    title       TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    status      TEXT NOT NULL DEFAULT '',
+    list        TEXT NOT NULL DEFAULT '',
+    revision    BIGINT NOT NULL
+);
+
+CREATE INDEX todos_list ON todos (list);
+CREATE INDEX todos_status ON todos (status);
+
+CREATE TABLE todo_tags (
+    todo_id  TEXT NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    tag      TEXT NOT NULL,
+    PRIMARY KEY (todo_id, position)
+);
+
+CREATE INDEX todo_tags_tag ON todo_tags (tag);
+
+-- the revision of the last change, shared by all todos
+CREATE TABLE todo_sequence (
+    id    INTEGER PRIMARY KEY CHECK (id = 1),
+    value BIGINT NOT NULL
+);
+
+INSERT INTO todo_sequence (id, value) VALUES (1, 0);
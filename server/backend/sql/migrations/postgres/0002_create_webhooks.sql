@@ -0,0 +1,14 @@
+-- the subscriptions and their deliveries are JSON, only what is queried is a column
+CREATE TABLE webhook_subscriptions (
+    id         TEXT PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    data       TEXT NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+    position        BIGSERIAL PRIMARY KEY,
+    subscription_id TEXT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    data            TEXT NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_subscription ON webhook_deliveries (subscription_id, position);
@@ -0,0 +1,392 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	_ "modernc.org/sqlite"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// sqlitePragmas are added to a SQLite DSN without pragmas, the busy timeout
+// lets writers wait for each other instead of failing
+const sqlitePragmas = "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+
+type server struct {
+	db     *sql.DB
+	driver string
+}
+
+type Config struct {
+	// Driver is DriverSQLite or DriverPostgres
+	Driver string
+	// DSN is the file name for SQLite and the connection string for PostgreSQL
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func NewServer(config *Config) (*server, error) {
+	log.WithField("driver", config.Driver).Info("Creating new sql server")
+	driverName, dsn := "", config.DSN
+	switch config.Driver {
+	case DriverSQLite:
+		driverName = "sqlite"
+		if !strings.Contains(dsn, "_pragma") {
+			separator := "?"
+			if strings.Contains(dsn, "?") {
+				separator = "&"
+			}
+			dsn += separator + sqlitePragmas
+		}
+	case DriverPostgres:
+		driverName = "pgx"
+	default:
+		return nil, fmt.Errorf("unknown driver %s", config.Driver)
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if config.Driver == DriverSQLite {
+		// SQLite has a single writer, more connections only wait for each other
+		db.SetMaxOpenConns(1)
+	} else if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	myServer := &server{
+		db:     db,
+		driver: config.Driver,
+	}
+	ctx := context.Background()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	if err := myServer.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.WithField("version", version).Info("Database schema is up to date")
+	// ensure server implements the interface
+	var _ repository.TodoRepository = myServer
+	return myServer, nil
+}
+
+func (s *server) Name() string {
+	return "sql"
+}
+
+func (s *server) Close() error {
+	return s.db.Close()
+}
+
+// Check pings the database
+func (s *server) Check(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// rebind replaces the ? placeholders by $1, $2, ... for PostgreSQL
+func (s *server) rebind(query string) string {
+	if s.driver != DriverPostgres {
+		return query
+	}
+	var builder strings.Builder
+	argument := 0
+	for _, r := range query {
+		if r == '?' {
+			argument++
+			builder.WriteString("$" + strconv.Itoa(argument))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+func (s *server) Create(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "Create")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Creating new todo")
+	todo, err := s.write(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+func (s *server) Update(ctx context.Context, req *repository.CreateOrUpdateRequest) (resp *repository.CreateOrUpdateResponse, err error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "Update")
+	defer span.End()
+	log.WithField("id", req.Todo.Id).WithField("title", req.Todo.Title).Info("Updating todo")
+	todo, err := s.write(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.CreateOrUpdateResponse{
+		Todo: todo,
+	}, nil
+}
+
+// write replaces the todo and its tags in one transaction
+func (s *server) write(ctx context.Context, req *repository.CreateOrUpdateRequest) (*repository.Todo, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// taking the revision first serializes the writers
+	revision, err := s.nextRevision(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRevision(ctx, tx, req.Todo.Id, req.IfRevision, req.IfAbsent); err != nil {
+		return nil, err
+	}
+	todo := *req.Todo
+	todo.Revision = revision
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO todos (id, title, description, status, list, revision)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			title = excluded.title,
+			description = excluded.description,
+			status = excluded.status,
+			list = excluded.list,
+			revision = excluded.revision`),
+		todo.Id, todo.Title, todo.Description, todo.Status, todo.List, todo.Revision)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind("DELETE FROM todo_tags WHERE todo_id = ?"), todo.Id); err != nil {
+		return nil, err
+	}
+	for position, tag := range todo.Tags {
+		_, err := tx.ExecContext(ctx, s.rebind("INSERT INTO todo_tags (todo_id, position, tag) VALUES (?, ?, ?)"), todo.Id, position, tag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &todo, nil
+}
+
+func (s *server) nextRevision(ctx context.Context, tx *sql.Tx) (uint64, error) {
+	var revision uint64
+	err := tx.QueryRowContext(ctx, "UPDATE todo_sequence SET value = value + 1 WHERE id = 1 RETURNING value").Scan(&revision)
+	return revision, err
+}
+
+// checkRevision returns repository.ErrConflict if the stored todo does not have
+// the revision, or with ifAbsent if there is a stored todo
+func (s *server) checkRevision(ctx context.Context, tx *sql.Tx, id string, ifRevision uint64, ifAbsent bool) error {
+	if ifRevision == 0 && !ifAbsent {
+		return nil
+	}
+	var current uint64
+	err := tx.QueryRowContext(ctx, s.rebind("SELECT revision FROM todos WHERE id = ?"), id).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows && ifRevision == 0:
+		return nil
+	case err == sql.ErrNoRows || (err == nil && (ifAbsent || current != ifRevision)):
+		return repository.ErrConflict
+	}
+	return err
+}
+
+func (s *server) GetAll(ctx context.Context, req *repository.GetAllRequest) (resp *repository.GetAllResponse, err error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "GetAll")
+	defer span.End()
+	selection, args := s.selection(req)
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer tx.Rollback()
+	todos, err := s.query(ctx, tx, "SELECT id, title, description, status, list, revision FROM todos"+selection, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	err = s.queryTags(ctx, tx, todos, "SELECT todo_id, tag FROM todo_tags WHERE todo_id IN (SELECT id FROM todos"+selection+") ORDER BY todo_id, position", args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("todos", len(todos)))
+	log.WithField("count", len(todos)).Info("Getting all todos")
+	return &repository.GetAllResponse{
+		Todos: todos,
+	}, nil
+}
+
+// selection returns the WHERE, ORDER BY, LIMIT and OFFSET clauses of the request
+func (s *server) selection(req *repository.GetAllRequest) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	if req.List != "" {
+		conditions = append(conditions, "list = ?")
+		args = append(args, req.List)
+	}
+	if req.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, req.Status)
+	}
+	if req.Tag != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM todo_tags WHERE todo_tags.todo_id = todos.id AND todo_tags.tag = ?)")
+		args = append(args, req.Tag)
+	}
+	clauses := ""
+	if len(conditions) > 0 {
+		clauses = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if s.driver == DriverPostgres {
+		// the byte order like SQLite and the other backends, not that of the database locale
+		clauses += ` ORDER BY id COLLATE "C"`
+	} else {
+		clauses += " ORDER BY id"
+	}
+	if req.Limit > 0 {
+		clauses += " LIMIT ?"
+		args = append(args, req.Limit)
+	} else if req.Offset > 0 && s.driver == DriverSQLite {
+		// SQLite needs a limit in front of an offset
+		clauses += " LIMIT -1"
+	}
+	if req.Offset > 0 {
+		clauses += " OFFSET ?"
+		args = append(args, req.Offset)
+	}
+	return clauses, args
+}
+
+func (s *server) query(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]*repository.Todo, error) {
+	rows, err := tx.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	todos := []*repository.Todo{}
+	for rows.Next() {
+		todo := &repository.Todo{}
+		if err := rows.Scan(&todo.Id, &todo.Title, &todo.Description, &todo.Status, &todo.List, &todo.Revision); err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+// queryTags adds the tags to the todos, the query returns pairs of todo id and tag
+func (s *server) queryTags(ctx context.Context, tx *sql.Tx, todos []*repository.Todo, query string, args ...interface{}) error {
+	byId := make(map[string]*repository.Todo, len(todos))
+	for _, todo := range todos {
+		byId[todo.Id] = todo
+	}
+	rows, err := tx.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		if todo, ok := byId[id]; ok {
+			todo.Tags = append(todo.Tags, tag)
+		}
+	}
+	return rows.Err()
+}
+
+func (s *server) Get(ctx context.Context, req *repository.GetRequest) (resp *repository.GetResponse, err error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "Get")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Getting todo")
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer tx.Rollback()
+	todos, err := s.query(ctx, tx, "SELECT id, title, description, status, list, revision FROM todos WHERE id = ?", req.Id)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if len(todos) == 0 {
+		return &repository.GetResponse{}, nil
+	}
+	if err := s.queryTags(ctx, tx, todos, "SELECT todo_id, tag FROM todo_tags WHERE todo_id = ? ORDER BY position", req.Id); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.GetResponse{
+		Todo: todos[0],
+	}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *repository.DeleteRequest) (resp *repository.DeleteResponse, err error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "Delete")
+	defer span.End()
+	log.WithField("id", req.Id).Info("Deleting todo")
+	err = s.delete(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &repository.DeleteResponse{
+		Id: req.Id,
+	}, nil
+}
+
+func (s *server) delete(ctx context.Context, req *repository.DeleteRequest) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := s.nextRevision(ctx, tx); err != nil {
+		return err
+	}
+	if err := s.checkRevision(ctx, tx, req.Id, req.IfRevision, false); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind("DELETE FROM todo_tags WHERE todo_id = ?"), req.Id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind("DELETE FROM todos WHERE id = ?"), req.Id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,106 @@
+package sql
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/repository/repositorytest"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"github.com/dkrizic/todo/server/backend/webhook/webhooktest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	dsn := filepath.Join(t.TempDir(), "todo.db")
+	s, err := NewServer(&Config{Driver: DriverSQLite, DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, todo := range []*repository.Todo{
+		{Id: "1", Title: "first", List: "work", Tags: []string{"b", "a"}},
+		{Id: "2", Title: "second", List: "work", Status: repository.StatusCompleted},
+		{Id: "3", Title: "third", List: "home", Tags: []string{"a"}},
+	} {
+		if _, err := s.Create(ctx, &repository.CreateOrUpdateRequest{Todo: todo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.Get(ctx, &repository.GetRequest{Id: "1"})
+	if err != nil || got.Todo == nil || got.Todo.Revision != 1 || len(got.Todo.Tags) != 2 || got.Todo.Tags[0] != "b" {
+		t.Fatalf("Expected todo 1 with its tags in order, got %+v %v", got, err)
+	}
+	page, err := s.GetAll(ctx, &repository.GetAllRequest{List: "work", Limit: 1, Offset: 1})
+	if err != nil || len(page.Todos) != 1 || page.Todos[0].Id != "2" {
+		t.Errorf("Expected the second todo of the list, got %+v %v", page, err)
+	}
+	tagged, _ := s.GetAll(ctx, &repository.GetAllRequest{Tag: "a"})
+	if len(tagged.Todos) != 2 || tagged.Todos[1].Tags[0] != "a" {
+		t.Errorf("Expected two tagged todos, got %+v", tagged.Todos)
+	}
+	skipped, _ := s.GetAll(ctx, &repository.GetAllRequest{Offset: 2})
+	if len(skipped.Todos) != 1 || skipped.Todos[0].Id != "3" {
+		t.Errorf("Expected only the last todo, got %+v", skipped.Todos)
+	}
+
+	_, err = s.Update(ctx, &repository.CreateOrUpdateRequest{Todo: &repository.Todo{Id: "1", Title: "stale"}, IfRevision: 2})
+	if err != repository.ErrConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if _, err := s.Delete(ctx, &repository.DeleteRequest{Id: "1", IfRevision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get(ctx, &repository.GetRequest{Id: "1"}); got.Todo != nil {
+		t.Errorf("Expected todo 1 to be deleted")
+	}
+	s.Close()
+
+	// migrations are only applied once
+	reopened, err := NewServer(&Config{Driver: DriverSQLite, DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	all, _ := reopened.GetAll(ctx, &repository.GetAllRequest{})
+	if len(all.Todos) != 2 {
+		t.Errorf("Expected 2 todos after reopening, got %d", len(all.Todos))
+	}
+}
+
+func TestRebind(t *testing.T) {
+	s := &server{driver: DriverPostgres}
+	if got := s.rebind("SELECT ? WHERE a = ?"); got != "SELECT $1 WHERE a = $2" {
+		t.Errorf("Unexpected query %s", got)
+	}
+}
+
+// PostgreSQL orders by the collation of the database unless told otherwise
+func TestSelection(t *testing.T) {
+	s := &server{driver: DriverPostgres}
+	if got, _ := s.selection(&repository.GetAllRequest{Limit: 2}); got != ` ORDER BY id COLLATE "C" LIMIT ?` {
+		t.Errorf("Unexpected clauses %s", got)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.TodoRepository {
+		s, err := NewServer(&Config{Driver: DriverSQLite, DSN: filepath.Join(t.TempDir(), "todo.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestWebhookStore(t *testing.T) {
+	webhooktest.Run(t, func(t *testing.T) webhook.Store {
+		s, err := NewServer(&Config{Driver: DriverSQLite, DSN: filepath.Join(t.TempDir(), "todo.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s.WebhookStore()
+	})
+}
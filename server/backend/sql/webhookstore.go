@@ -0,0 +1,161 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"go.opentelemetry.io/otel"
+)
+
+type webhookStore struct {
+	server *server
+}
+
+// WebhookStore returns a store that keeps the webhook subscriptions in the same database
+func (s *server) WebhookStore() webhook.Store {
+	return &webhookStore{server: s}
+}
+
+func (ws *webhookStore) CreateSubscription(ctx context.Context, subscription *webhook.Subscription) error {
+	ctx, span := otel.Tracer("sql").Start(ctx, "CreateSubscription")
+	defer span.End()
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	_, err = ws.server.db.ExecContext(ctx, ws.server.rebind("INSERT INTO webhook_subscriptions (id, created_at, data) VALUES (?, ?, ?)"),
+		subscription.Id, subscription.CreatedAt.UTC(), string(data))
+	return err
+}
+
+func (ws *webhookStore) UpdateSubscription(ctx context.Context, subscription *webhook.Subscription) error {
+	ctx, span := otel.Tracer("sql").Start(ctx, "UpdateSubscription")
+	defer span.End()
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	result, err := ws.server.db.ExecContext(ctx, ws.server.rebind("UPDATE webhook_subscriptions SET data = ? WHERE id = ?"),
+		string(data), subscription.Id)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return webhook.ErrNotFound
+	}
+	return nil
+}
+
+func (ws *webhookStore) GetSubscription(ctx context.Context, id string) (*webhook.Subscription, error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "GetSubscription")
+	defer span.End()
+	var data string
+	err := ws.server.db.QueryRowContext(ctx, ws.server.rebind("SELECT data FROM webhook_subscriptions WHERE id = ?"), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, webhook.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	subscription := &webhook.Subscription{}
+	if err := json.Unmarshal([]byte(data), subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func (ws *webhookStore) ListSubscriptions(ctx context.Context) ([]*webhook.Subscription, error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "ListSubscriptions")
+	defer span.End()
+	rows, err := ws.server.db.QueryContext(ctx, "SELECT data FROM webhook_subscriptions ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subscriptions := []*webhook.Subscription{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		subscription := &webhook.Subscription{}
+		if err := json.Unmarshal([]byte(data), subscription); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+// DeleteSubscription also deletes the deliveries of the subscription
+func (ws *webhookStore) DeleteSubscription(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("sql").Start(ctx, "DeleteSubscription")
+	defer span.End()
+	result, err := ws.server.db.ExecContext(ctx, ws.server.rebind("DELETE FROM webhook_subscriptions WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return webhook.ErrNotFound
+	}
+	return nil
+}
+
+// AddDelivery keeps the last webhook.MaxDeliveries deliveries of the subscription
+func (ws *webhookStore) AddDelivery(ctx context.Context, delivery *webhook.Delivery) error {
+	ctx, span := otel.Tracer("sql").Start(ctx, "AddDelivery")
+	defer span.End()
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	tx, err := ws.server.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, ws.server.rebind("INSERT INTO webhook_deliveries (subscription_id, data) VALUES (?, ?)"),
+		delivery.SubscriptionId, string(data))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, ws.server.rebind(`DELETE FROM webhook_deliveries WHERE subscription_id = ? AND position NOT IN (
+		SELECT position FROM webhook_deliveries WHERE subscription_id = ? ORDER BY position DESC LIMIT ?)`),
+		delivery.SubscriptionId, delivery.SubscriptionId, webhook.MaxDeliveries)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ws *webhookStore) ListDeliveries(ctx context.Context, subscriptionId string) ([]*webhook.Delivery, error) {
+	ctx, span := otel.Tracer("sql").Start(ctx, "ListDeliveries")
+	defer span.End()
+	rows, err := ws.server.db.QueryContext(ctx, ws.server.rebind("SELECT data FROM webhook_deliveries WHERE subscription_id = ? ORDER BY position"), subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*webhook.Delivery{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		delivery := &webhook.Delivery{}
+		if err := json.Unmarshal([]byte(data), delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"encoding/json"
+	"github.com/dkrizic/todo/server/backend/delta"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"strconv"
+)
+
+// PushRequest is the body of a push, the changes are applied in order
+type PushRequest struct {
+	Changes []delta.PushChange
+}
+
+// PushResponse has one result per change of the request
+type PushResponse struct {
+	Results []*delta.PushResult
+}
+
+// SyncHandler returns the changes since a token on GET and applies client changes on POST
+func SyncHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("backend").Start(r.Context(), "sync")
+	defer span.End()
+	switch r.Method {
+	case "GET":
+		since := r.URL.Query().Get("since")
+		limit := delta.DefaultLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 || parsed > delta.MaxLimit {
+				writeError(ctx, w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(delta.MaxLimit))
+				return
+			}
+			limit = parsed
+		}
+		changes, err := ActiveBackend.Sync.Changes(ctx, since, limit)
+		if err != nil {
+			log.WithError(err).WithField("since", since).Error("Error while getting changes")
+			span.RecordError(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		span.SetAttributes(
+			attribute.Int("upserts", len(changes.Upserts)),
+			attribute.Int("deletes", len(changes.Deletes)),
+			attribute.Bool("reset", changes.Reset),
+		)
+		writeJson(ctx, w, http.StatusOK, changes)
+	case "POST":
+		request := PushRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(ctx, w, http.StatusBadRequest, err.Error())
+			return
+		}
+		response := PushResponse{
+			Results: make([]*delta.PushResult, 0, len(request.Changes)),
+		}
+		for _, change := range request.Changes {
+			if change.Id == "" {
+				response.Results = append(response.Results, &delta.PushResult{Error: "id must not be empty"})
+				continue
+			}
+			if change.Todo != nil && change.Todo.Id != "" && change.Todo.Id != change.Id {
+				response.Results = append(response.Results, &delta.PushResult{Id: change.Id, Error: "id of the todo does not match"})
+				continue
+			}
+			result, err := delta.Push(ctx, ActiveBackend.Implementation, change)
+			if err != nil {
+				log.WithError(err).WithField("id", change.Id).Warn("Error while pushing change")
+				span.RecordError(err)
+				result = &delta.PushResult{Id: change.Id, Error: err.Error()}
+			}
+			response.Results = append(response.Results, result)
+		}
+		writeJson(ctx, w, http.StatusOK, response)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
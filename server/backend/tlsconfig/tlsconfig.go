@@ -0,0 +1,237 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// CertFile and KeyFile are the PEM certificate and key of the server, TLS is off if both are empty
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle, clients must present a certificate signed by it if set
+	ClientCAFile string
+	// CAFile is a PEM bundle that verifies the servers a client connects to, see NewClientConfig
+	CAFile string
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, defaults to 1.2
+	MinVersion string
+	// ReloadInterval is how often the files are checked for changes, defaults to 10s
+	ReloadInterval time.Duration
+}
+
+// Enabled tells whether the listener serves TLS
+func (c *Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// NewServerConfig creates the TLS configuration of a listener, nil if TLS is
+// off. The files are read again when they change, so that rotated
+// certificates are used without a restart. A file that cannot be loaded
+// keeps the previous one in use.
+func NewServerConfig(config *Config) (*tls.Config, error) {
+	if !config.Enabled() {
+		if config.ClientCAFile != "" {
+			return nil, errors.New("a client CA needs a certificate and key")
+		}
+		return nil, nil
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key are needed")
+	}
+	minVersion, err := ParseVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	interval := reloadInterval(config)
+	certificate, err := newReloader(interval, func() (*tls.Certificate, error) {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		return &certificate, err
+	}, config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certificate.get(), nil
+		},
+	}
+	if config.ClientCAFile != "" {
+		clientCAs, err := newReloader(interval, func() (*x509.CertPool, error) {
+			return LoadPool(config.ClientCAFile)
+		}, config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// verified here instead of with ClientCAs, which cannot change once the server runs
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyClient(state, clientCAs.get())
+		}
+	}
+	return tlsConfig, nil
+}
+
+// NewClientConfig creates the TLS configuration to connect to servers whose
+// certificates are signed by CAFile, CertFile and KeyFile are presented to
+// servers that want a client certificate. The certificate is reloaded when it
+// changes, the CA is read once.
+func NewClientConfig(config *Config) (*tls.Config, error) {
+	if config.CAFile == "" {
+		return nil, errors.New("a CA to verify the servers is needed")
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("both a certificate and a key are needed")
+	}
+	minVersion, err := ParseVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := LoadPool(config.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+		RootCAs:    roots,
+	}
+	if config.CertFile != "" {
+		certificate, err := newReloader(reloadInterval(config), func() (*tls.Certificate, error) {
+			certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			return &certificate, err
+		}, config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificate.get(), nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+func reloadInterval(config *Config) time.Duration {
+	if config.ReloadInterval <= 0 {
+		return 10 * time.Second
+	}
+	return config.ReloadInterval
+}
+
+// verifyClient does what tls.RequireAndVerifyClientCert does with the current CA bundle
+func verifyClient(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("client certificate required")
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// ParseVersion parses a TLS version like 1.2, the empty string is 1.2
+func ParseVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "", "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s, use 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// LoadPool reads a PEM bundle of CA certificates
+func LoadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// reloader loads a value from files again when their size or modification
+// time changed, it checks at most once per interval during a handshake. This
+// also follows the symlinks Kubernetes swaps when it updates a secret.
+type reloader[T any] struct {
+	files    []string
+	load     func() (T, error)
+	interval time.Duration
+	lock     sync.Mutex
+	value    T
+	version  string
+	checked  time.Time
+}
+
+func newReloader[T any](interval time.Duration, load func() (T, error), files ...string) (*reloader[T], error) {
+	r := &reloader[T]{files: files, load: load, interval: interval}
+	version, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if r.value, err = load(); err != nil {
+		return nil, err
+	}
+	r.version = version
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *reloader[T]) get() T {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.checked) < r.interval {
+		return r.value
+	}
+	r.checked = time.Now()
+	llog := log.WithField("files", r.files)
+	version, err := r.stat()
+	if err != nil {
+		llog.WithError(err).Warn("Failed to check TLS files, keeping the previous ones")
+		return r.value
+	}
+	if version == r.version {
+		return r.value
+	}
+	value, err := r.load()
+	if err != nil {
+		// a rotation may have replaced only some of the files yet
+		llog.WithError(err).Warn("Failed to reload TLS files, keeping the previous ones")
+		return r.value
+	}
+	r.value, r.version = value, version
+	llog.Info("Reloaded TLS files")
+	return r.value
+}
+
+// stat returns the size and modification time of all files
+func (r *reloader[T]) stat() (string, error) {
+	var version strings.Builder
+	for _, file := range r.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&version, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return version.String(), nil
+}
@@ -0,0 +1,243 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type authority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newAuthority(t *testing.T) *authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "todo ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authority{certificate: certificate, key: key}
+}
+
+// issue writes a certificate and key signed by the authority to dir and returns their files
+func (a *authority) issue(t *testing.T, dir string, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.certificate, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePem(t, certFile, "CERTIFICATE", der)
+	writePem(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func (a *authority) write(t *testing.T, file string) {
+	t.Helper()
+	writePem(t, file, "CERTIFICATE", a.certificate.Raw)
+}
+
+func writePem(t *testing.T, file string, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve accepts connections until the test ends and completes their handshakes
+func serve(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dial returns the serial number of the server certificate
+func dial(address string, config *tls.Config) (int64, error) {
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	// the client sees a rejected certificate only when it reads
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestNewServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	ca.write(t, caFile)
+	certFile, keyFile := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+	clientCertFile, clientKeyFile := ca.issue(t, dir, "client", 3, x509.ExtKeyUsageClientAuth)
+
+	config, err := NewServerConfig(&Config{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientCAFile:   caFile,
+		MinVersion:     "1.3",
+		ReloadInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := serve(t, config)
+	roots, err := LoadPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCertificate, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dial(address, &tls.Config{RootCAs: roots}); err == nil {
+		t.Error("Expected a client without certificate to be rejected")
+	}
+	if _, err := dial(address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCertificate}, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("Expected TLS 1.2 to be rejected")
+	}
+	serial, err := dial(address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCertificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial != 2 {
+		t.Errorf("Expected certificate 2, got %d", serial)
+	}
+
+	// the rotated certificate is used for the next connection
+	ca.issue(t, dir, "server", 4, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		os.Chtimes(file, later, later)
+	}
+	serial, err = dial(address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCertificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial != 4 {
+		t.Errorf("Expected the rotated certificate 4, got %d", serial)
+	}
+}
+
+// test that a client verifies the server with its CA and presents its certificate
+func TestNewClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	ca.write(t, caFile)
+	certFile, keyFile := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+	clientCertFile, clientKeyFile := ca.issue(t, dir, "client", 3, x509.ExtKeyUsageClientAuth)
+	serverConfig, err := NewServerConfig(&Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := serve(t, serverConfig)
+
+	config, err := NewClientConfig(&Config{CertFile: clientCertFile, KeyFile: clientKeyFile, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(address, config); err != nil {
+		t.Errorf("Expected the client to connect, got %v", err)
+	}
+	// the certificate is not valid for another name
+	named := config.Clone()
+	named.ServerName = "elsewhere"
+	if _, err := dial(address, named); err == nil {
+		t.Error("Expected a server with the wrong name to be rejected")
+	}
+	// a server signed by another CA is rejected
+	otherFile := filepath.Join(dir, "other.crt")
+	newAuthority(t).write(t, otherFile)
+	other, err := NewClientConfig(&Config{CertFile: clientCertFile, KeyFile: clientKeyFile, CAFile: otherFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(address, other); err == nil {
+		t.Error("Expected a server of another CA to be rejected")
+	}
+}
+
+func TestNewServerConfigInvalid(t *testing.T) {
+	if config, err := NewServerConfig(&Config{}); config != nil || err != nil {
+		t.Errorf("Expected no TLS without certificate, got %v %v", config, err)
+	}
+	for _, config := range []*Config{
+		{ClientCAFile: "ca.crt"},
+		{CertFile: "server.crt"},
+		{CertFile: "missing.crt", KeyFile: "missing.key"},
+	} {
+		if _, err := NewServerConfig(config); err == nil {
+			t.Errorf("Expected %+v to fail", config)
+		}
+	}
+	if _, err := ParseVersion("1.4"); err == nil {
+		t.Error("Expected an unknown version to fail")
+	}
+}
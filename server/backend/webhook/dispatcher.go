@@ -0,0 +1,278 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	Store Store
+	// Client is used for the deliveries, http.DefaultClient with a timeout if nil
+	Client *http.Client
+	// Workers is the number of concurrent deliveries
+	Workers int
+	// QueueSize is the number of deliveries that can be pending
+	QueueSize int
+	// MaxAttempts is the number of attempts per delivery before giving up
+	MaxAttempts int
+	// InitialBackoff is the wait time after the first failed attempt, it doubles on every retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait time between two attempts
+	MaxBackoff time.Duration
+	// DisableAfter disables a subscription after that many consecutive failed deliveries, 0 never disables
+	DisableAfter int
+}
+
+type job struct {
+	subscriptionId string
+	changeType     repository.ChangeType
+	payload        []byte
+}
+
+type Dispatcher struct {
+	store          Store
+	client         *http.Client
+	workers        int
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	disableAfter   int
+	queue          chan job
+	// pending counts the queued deliveries and the ones in progress
+	pending atomic.Int64
+	// failuresLock serializes the updates of the failure counters
+	failuresLock sync.Mutex
+}
+
+func NewDispatcher(config *Config) *Dispatcher {
+	dispatcher := &Dispatcher{
+		store:          config.Store,
+		client:         config.Client,
+		workers:        config.Workers,
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: config.InitialBackoff,
+		maxBackoff:     config.MaxBackoff,
+		disableAfter:   config.DisableAfter,
+	}
+	if dispatcher.client == nil {
+		dispatcher.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if dispatcher.workers <= 0 {
+		dispatcher.workers = 1
+	}
+	if dispatcher.maxAttempts <= 0 {
+		dispatcher.maxAttempts = 1
+	}
+	if dispatcher.initialBackoff <= 0 {
+		dispatcher.initialBackoff = time.Second
+	}
+	if dispatcher.maxBackoff < dispatcher.initialBackoff {
+		dispatcher.maxBackoff = dispatcher.initialBackoff
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	dispatcher.queue = make(chan job, queueSize)
+	log.WithFields(log.Fields{
+		"workers":      dispatcher.workers,
+		"maxAttempts":  dispatcher.maxAttempts,
+		"disableAfter": dispatcher.disableAfter,
+	}).Info("Webhook dispatcher created")
+	return dispatcher
+}
+
+// Store returns the store that holds the subscriptions
+func (d *Dispatcher) Store() Store {
+	return d.store
+}
+
+// Start launches the delivery workers, they stop when the context is done
+func (d *Dispatcher) Start(ctx context.Context) {
+	for i := 0; i < d.workers; i++ {
+		go d.work(ctx)
+	}
+}
+
+// Dispatch queues a delivery of the change for every matching subscription
+func (d *Dispatcher) Dispatch(ctx context.Context, change repository.Change) error {
+	ctx, span := otel.Tracer("webhook").Start(ctx, "Dispatch")
+	defer span.End()
+	subscriptions, err := d.store.ListSubscriptions(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	payload, err := json.Marshal(change)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if !subscription.Matches(change.ChangeType) {
+			continue
+		}
+		d.pending.Add(1)
+		select {
+		case d.queue <- job{subscriptionId: subscription.Id, changeType: change.ChangeType, payload: payload}:
+		default:
+			d.pending.Add(-1)
+			log.WithField("subscription", subscription.Id).Warn("Webhook queue is full, dropping delivery")
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-d.queue:
+			d.deliver(ctx, j)
+			d.pending.Add(-1)
+		}
+	}
+}
+
+// Wait returns when all queued deliveries are done, retries included. It is
+// called on shutdown after the last change was dispatched.
+func (d *Dispatcher) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for d.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d webhook deliveries are lost: %w", d.pending.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, j job) {
+	ctx, span := otel.Tracer("webhook").Start(ctx, "deliver")
+	defer span.End()
+	span.SetAttributes(attribute.String("subscription", j.subscriptionId))
+	llog := log.WithFields(log.Fields{
+		"subscription": j.subscriptionId,
+		"changeType":   j.changeType,
+	})
+	deliveryId := uuid.New().String()
+	backoff := d.initialBackoff
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		// re-read the subscription on every attempt, it might have been disabled or deleted meanwhile
+		subscription, err := d.store.GetSubscription(ctx, j.subscriptionId)
+		if err != nil {
+			llog.WithError(err).Info("Subscription is gone, dropping delivery")
+			return
+		}
+		if !subscription.Enabled {
+			llog.Info("Subscription is disabled, dropping delivery")
+			return
+		}
+		delivery := d.attempt(ctx, subscription, j, deliveryId, attempt)
+		if err := d.store.AddDelivery(ctx, delivery); err != nil {
+			llog.WithError(err).Warn("Failed to store delivery log")
+		}
+		if delivery.Success {
+			d.recordResult(ctx, j.subscriptionId, true, llog)
+			return
+		}
+		llog.WithField("attempt", attempt).WithField("error", delivery.Error).Warn("Webhook delivery failed")
+		if attempt == d.maxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+	}
+	span.SetStatus(codes.Error, "delivery failed")
+	d.recordResult(ctx, j.subscriptionId, false, llog)
+}
+
+// recordResult counts the consecutive failures and disables the subscription
+// after too many. The subscription is read right before it is written and
+// only these two fields are changed, an edit made through the API during the
+// delivery is kept.
+func (d *Dispatcher) recordResult(ctx context.Context, id string, success bool, llog *log.Entry) {
+	d.failuresLock.Lock()
+	defer d.failuresLock.Unlock()
+	subscription, err := d.store.GetSubscription(ctx, id)
+	if err != nil {
+		return
+	}
+	if success {
+		if subscription.Failures == 0 {
+			return
+		}
+		subscription.Failures = 0
+	} else {
+		subscription.Failures++
+		if d.disableAfter > 0 && subscription.Failures >= d.disableAfter && subscription.Enabled {
+			llog.WithField("failures", subscription.Failures).Warn("Disabling failing webhook subscription")
+			subscription.Enabled = false
+		}
+	}
+	d.updateSubscription(ctx, subscription)
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, subscription *Subscription, j job, deliveryId string, attempt int) *Delivery {
+	delivery := &Delivery{
+		Id:             deliveryId,
+		SubscriptionId: subscription.Id,
+		ChangeType:     j.changeType,
+		Attempt:        attempt,
+		Timestamp:      time.Now(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Url, bytes.NewReader(j.payload))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(j.changeType))
+	req.Header.Set(DeliveryHeader, deliveryId)
+	req.Header.Set(SignatureHeader, Sign(subscription.Secret, j.payload))
+
+	resp, err := d.client.Do(req)
+	delivery.Duration = time.Since(delivery.Timestamp)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		delivery.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+		return delivery
+	}
+	delivery.Success = true
+	return delivery
+}
+
+func (d *Dispatcher) updateSubscription(ctx context.Context, subscription *Subscription) {
+	if err := d.store.UpdateSubscription(ctx, subscription); err != nil {
+		log.WithError(err).WithField("subscription", subscription.Id).Warn("Failed to update subscription")
+	}
+}
@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStore keeps the subscriptions in a JSON file that is rewritten on
+// every change, the delivery logs stay in memory
+type fileStore struct {
+	*memoryStore
+	path string
+	// lock serializes the changes so that the file is written in their order
+	lock sync.Mutex
+}
+
+// NewFileStore creates a store that keeps the subscriptions in the file,
+// for backends whose todos are files on a single node
+func NewFileStore(path string) (Store, error) {
+	store := &fileStore{memoryStore: NewMemoryStore().(*memoryStore), path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := []*Subscription{}
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, err
+	}
+	for _, subscription := range subscriptions {
+		store.subscriptions[subscription.Id] = subscription
+	}
+	return store, nil
+}
+
+func (f *fileStore) CreateSubscription(ctx context.Context, subscription *Subscription) error {
+	return f.change(func() error {
+		return f.memoryStore.CreateSubscription(ctx, subscription)
+	})
+}
+
+func (f *fileStore) UpdateSubscription(ctx context.Context, subscription *Subscription) error {
+	return f.change(func() error {
+		return f.memoryStore.UpdateSubscription(ctx, subscription)
+	})
+}
+
+func (f *fileStore) DeleteSubscription(ctx context.Context, id string) error {
+	return f.change(func() error {
+		return f.memoryStore.DeleteSubscription(ctx, id)
+	})
+}
+
+// change applies the change in memory and writes the file, a failed write undoes the change
+func (f *fileStore) change(apply func() error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	previous, err := f.memoryStore.ListSubscriptions(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	subscriptions, err := f.memoryStore.ListSubscriptions(context.Background())
+	if err == nil {
+		err = f.write(subscriptions)
+	}
+	if err != nil {
+		f.mutex.Lock()
+		f.subscriptions = map[string]*Subscription{}
+		for _, subscription := range previous {
+			f.subscriptions[subscription.Id] = subscription
+		}
+		f.mutex.Unlock()
+	}
+	return err
+}
+
+// write replaces the file atomically
+func (f *fileStore) write(subscriptions []*Subscription) error {
+	data, err := json.MarshalIndent(subscriptions, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), f.path)
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MaxDeliveries is the number of delivery log entries kept per subscription
+const MaxDeliveries = 100
+
+type memoryStore struct {
+	mutex         sync.RWMutex
+	subscriptions map[string]*Subscription
+	deliveries    map[string][]*Delivery
+}
+
+// NewMemoryStore creates a store that keeps subscriptions in the local process
+func NewMemoryStore() Store {
+	return &memoryStore{
+		subscriptions: map[string]*Subscription{},
+		deliveries:    map[string][]*Delivery{},
+	}
+}
+
+func (m *memoryStore) CreateSubscription(ctx context.Context, subscription *Subscription) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.subscriptions[subscription.Id] = copySubscription(subscription)
+	return nil
+}
+
+func (m *memoryStore) UpdateSubscription(ctx context.Context, subscription *Subscription) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.subscriptions[subscription.Id]; !ok {
+		return ErrNotFound
+	}
+	m.subscriptions[subscription.Id] = copySubscription(subscription)
+	return nil
+}
+
+func (m *memoryStore) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	subscription, ok := m.subscriptions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copySubscription(subscription), nil
+}
+
+func (m *memoryStore) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	subscriptions := make([]*Subscription, 0, len(m.subscriptions))
+	for _, subscription := range m.subscriptions {
+		subscriptions = append(subscriptions, copySubscription(subscription))
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+	return subscriptions, nil
+}
+
+func (m *memoryStore) DeleteSubscription(ctx context.Context, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.subscriptions[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.subscriptions, id)
+	delete(m.deliveries, id)
+	return nil
+}
+
+func (m *memoryStore) AddDelivery(ctx context.Context, delivery *Delivery) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	copied := *delivery
+	deliveries := append(m.deliveries[delivery.SubscriptionId], &copied)
+	if len(deliveries) > MaxDeliveries {
+		deliveries = deliveries[len(deliveries)-MaxDeliveries:]
+	}
+	m.deliveries[delivery.SubscriptionId] = deliveries
+	return nil
+}
+
+func (m *memoryStore) ListDeliveries(ctx context.Context, subscriptionId string) ([]*Delivery, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	deliveries := make([]*Delivery, 0, len(m.deliveries[subscriptionId]))
+	for _, delivery := range m.deliveries[subscriptionId] {
+		copied := *delivery
+		deliveries = append(deliveries, &copied)
+	}
+	return deliveries, nil
+}
+
+func copySubscription(subscription *Subscription) *Subscription {
+	copied := *subscription
+	copied.Events = append([]string(nil), subscription.Events...)
+	return &copied
+}
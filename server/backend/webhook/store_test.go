@@ -0,0 +1,45 @@
+package webhook_test
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"github.com/dkrizic/todo/server/backend/webhook/webhooktest"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	webhooktest.Run(t, func(t *testing.T) webhook.Store {
+		return webhook.NewMemoryStore()
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	webhooktest.Run(t, func(t *testing.T) webhook.Store {
+		store, err := webhook.NewFileStore(filepath.Join(t.TempDir(), "webhooks.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// test that the subscriptions are read again
+func TestFileStoreReopened(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	store, err := webhook.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CreateSubscription(ctx, &webhook.Subscription{Id: "1", Url: "http://localhost", Enabled: true})
+	store.CreateSubscription(ctx, &webhook.Subscription{Id: "2", Url: "http://localhost", Enabled: true})
+	store.DeleteSubscription(ctx, "1")
+	reopened, err := webhook.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := reopened.ListSubscriptions(ctx); len(list) != 1 || list[0].Id != "2" {
+		t.Errorf("Expected subscription 2, got %+v", list)
+	}
+}
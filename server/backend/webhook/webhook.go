@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 signature of the request body
+	SignatureHeader = "X-Todo-Signature"
+	// EventHeader carries the change type of the delivered change
+	EventHeader = "X-Todo-Event"
+	// DeliveryHeader carries the unique id of the delivery
+	DeliveryHeader = "X-Todo-Delivery"
+
+	signaturePrefix = "sha256="
+)
+
+var ErrNotFound = errors.New("webhook subscription not found")
+
+// Subscription is a registered receiver for change events
+type Subscription struct {
+	Id     string
+	Url    string
+	Secret string
+	// Events contains the change types (CREATE, UPDATE, DELETE) the subscription
+	// is interested in. An empty list matches all events.
+	Events  []string
+	Enabled bool
+	// Failures counts the consecutive failed deliveries
+	Failures  int
+	CreatedAt time.Time
+}
+
+// Delivery is a log entry for a single attempt to deliver a change
+type Delivery struct {
+	Id             string
+	SubscriptionId string
+	ChangeType     repository.ChangeType
+	Attempt        int
+	StatusCode     int
+	Error          string
+	Success        bool
+	Duration       time.Duration
+	Timestamp      time.Time
+}
+
+// Store persists subscriptions and their delivery logs
+type Store interface {
+	CreateSubscription(ctx context.Context, subscription *Subscription) error
+	UpdateSubscription(ctx context.Context, subscription *Subscription) error
+	GetSubscription(ctx context.Context, id string) (*Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]*Subscription, error)
+	DeleteSubscription(ctx context.Context, id string) error
+	AddDelivery(ctx context.Context, delivery *Delivery) error
+	ListDeliveries(ctx context.Context, subscriptionId string) ([]*Delivery, error)
+}
+
+// Matches returns true if the subscription wants to receive the given change type
+func (s *Subscription) Matches(changeType repository.ChangeType) bool {
+	if !s.Enabled {
+		return false
+	}
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, event := range s.Events {
+		if event == string(changeType) || event == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign computes the value of the signature header for the given body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a received delivery. It is meant
+// to be used by receivers.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
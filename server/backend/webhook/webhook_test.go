@@ -0,0 +1,162 @@
+package webhook
+
+import (
+	"context"
+	repository "github.com/dkrizic/todo/server/backend/repository"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDispatcher(store Store) *Dispatcher {
+	return NewDispatcher(&Config{
+		Store:          store,
+		Workers:        1,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		DisableAfter:   2,
+	})
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout while waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// test that a delivery is signed and only sent for matching events
+func TestDeliverySigned(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewMemoryStore()
+	store.CreateSubscription(ctx, &Subscription{
+		Id:      "1",
+		Url:     receiver.URL,
+		Secret:  "secret",
+		Events:  []string{"CREATE"},
+		Enabled: true,
+	})
+	dispatcher := newTestDispatcher(store)
+	dispatcher.Start(ctx)
+
+	dispatcher.Dispatch(ctx, repository.Change{
+		After:      &repository.Todo{Id: "a"},
+		ChangeType: repository.ChangeTypeUpdate,
+	})
+	dispatcher.Dispatch(ctx, repository.Change{
+		After:      &repository.Todo{Id: "b"},
+		ChangeType: repository.ChangeTypeCreate,
+	})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if r.Header.Get(EventHeader) != "CREATE" {
+			t.Errorf("Expected event CREATE, got %v", r.Header.Get(EventHeader))
+		}
+		if !Verify("secret", body, r.Header.Get(SignatureHeader)) {
+			t.Errorf("Signature %v does not match body %s", r.Header.Get(SignatureHeader), body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No delivery received")
+	}
+
+	waitFor(t, func() bool {
+		deliveries, _ := store.ListDeliveries(ctx, "1")
+		return len(deliveries) == 1 && deliveries[0].Success
+	})
+}
+
+// test that a failing endpoint is retried and disabled
+func TestFailingEndpointDisabled(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewMemoryStore()
+	store.CreateSubscription(ctx, &Subscription{
+		Id:      "1",
+		Url:     receiver.URL,
+		Secret:  "secret",
+		Enabled: true,
+	})
+	dispatcher := newTestDispatcher(store)
+	dispatcher.Start(ctx)
+
+	for i := 0; i < 2; i++ {
+		dispatcher.Dispatch(ctx, repository.Change{
+			After:      &repository.Todo{Id: "a"},
+			ChangeType: repository.ChangeTypeCreate,
+		})
+	}
+
+	waitFor(t, func() bool {
+		subscription, _ := store.GetSubscription(ctx, "1")
+		return !subscription.Enabled
+	})
+	if atomic.LoadInt32(&calls) != 6 {
+		t.Errorf("Expected 6 attempts, got %v", atomic.LoadInt32(&calls))
+	}
+	deliveries, _ := store.ListDeliveries(ctx, "1")
+	if len(deliveries) != 6 || deliveries[5].StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 6 failed deliveries in the log, got %v", len(deliveries))
+	}
+}
+
+// test that an edit made while a delivery is sent is not reverted
+func TestEditDuringDelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewMemoryStore()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscription, _ := store.GetSubscription(ctx, "1")
+		subscription.Secret = "rotated"
+		store.UpdateSubscription(ctx, subscription)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+	store.CreateSubscription(ctx, &Subscription{
+		Id:       "1",
+		Url:      receiver.URL,
+		Secret:   "secret",
+		Enabled:  true,
+		Failures: 1,
+	})
+	dispatcher := newTestDispatcher(store)
+	dispatcher.Start(ctx)
+
+	dispatcher.Dispatch(ctx, repository.Change{
+		After:      &repository.Todo{Id: "a"},
+		ChangeType: repository.ChangeTypeCreate,
+	})
+	waitFor(t, func() bool {
+		subscription, _ := store.GetSubscription(ctx, "1")
+		return subscription.Failures == 0
+	})
+	if subscription, _ := store.GetSubscription(ctx, "1"); subscription.Secret != "rotated" {
+		t.Errorf("Expected the rotated secret, got %v", subscription.Secret)
+	}
+}
@@ -0,0 +1,127 @@
+// Package webhooktest is the conformance suite every webhook Store has to pass
+package webhooktest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Factory returns a new, empty store for every test
+type Factory func(t *testing.T) webhook.Store
+
+// Run checks the semantics all stores share:
+//   - a missing subscription is webhook.ErrNotFound for Get, Update and Delete
+//   - subscriptions are listed in the order they were created
+//   - deleting a subscription deletes its deliveries
+//   - only the last webhook.MaxDeliveries deliveries are kept, oldest first
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s webhook.Store)
+	}{
+		{"Subscriptions", testSubscriptions},
+		{"Missing", testMissing},
+		{"Deliveries", testDeliveries},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, factory(t))
+		})
+	}
+}
+
+func subscription(id string, created time.Time) *webhook.Subscription {
+	return &webhook.Subscription{
+		Id:        id,
+		Url:       "http://localhost/" + id,
+		Secret:    "secret",
+		Events:    []string{"CREATE", "DELETE"},
+		Enabled:   true,
+		CreatedAt: created,
+	}
+}
+
+func testSubscriptions(t *testing.T, s webhook.Store) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, id := range []string{"b", "a", "c"} {
+		if err := s.CreateSubscription(ctx, subscription(id, now.Add(time.Duration(i)*time.Second))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updated := subscription("a", now.Add(time.Second))
+	updated.Enabled, updated.Failures = false, 3
+	if err := s.UpdateSubscription(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetSubscription(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Enabled || got.Failures != 3 || got.Url != updated.Url || !slices.Equal(got.Events, updated.Events) || !got.CreatedAt.Equal(updated.CreatedAt) {
+		t.Errorf("Expected %+v, got %+v", updated, got)
+	}
+	list, err := s.ListSubscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, subscription := range list {
+		ids = append(ids, subscription.Id)
+	}
+	if !slices.Equal(ids, []string{"b", "a", "c"}) {
+		t.Errorf("Expected the order of creation, got %v", ids)
+	}
+}
+
+func testMissing(t *testing.T, s webhook.Store) {
+	ctx := context.Background()
+	if _, err := s.GetSubscription(ctx, "missing"); !errors.Is(err, webhook.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for Get, got %v", err)
+	}
+	if err := s.UpdateSubscription(ctx, subscription("missing", time.Now())); !errors.Is(err, webhook.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for Update, got %v", err)
+	}
+	if err := s.DeleteSubscription(ctx, "missing"); !errors.Is(err, webhook.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for Delete, got %v", err)
+	}
+	if list, err := s.ListSubscriptions(ctx); err != nil || len(list) != 0 {
+		t.Errorf("Expected no subscriptions, got %v %v", list, err)
+	}
+}
+
+func testDeliveries(t *testing.T, s webhook.Store) {
+	ctx := context.Background()
+	if err := s.CreateSubscription(ctx, subscription("1", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	for i := range webhook.MaxDeliveries + 5 {
+		err := s.AddDelivery(ctx, &webhook.Delivery{
+			Id:             fmt.Sprintf("d%d", i),
+			SubscriptionId: "1",
+			Attempt:        i,
+			Success:        true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := s.ListDeliveries(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != webhook.MaxDeliveries || deliveries[0].Attempt != 5 || deliveries[len(deliveries)-1].Attempt != webhook.MaxDeliveries+4 {
+		t.Fatalf("Expected the last %d deliveries, got %d", webhook.MaxDeliveries, len(deliveries))
+	}
+	if err := s.DeleteSubscription(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries, err := s.ListDeliveries(ctx, "1"); err != nil || len(deliveries) != 0 {
+		t.Errorf("Expected the deliveries to be deleted, got %d %v", len(deliveries), err)
+	}
+}
@@ -0,0 +1,219 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WebhookRequest is the body accepted when creating or updating a subscription
+type WebhookRequest struct {
+	Url     string
+	Secret  string
+	Events  []string
+	Enabled *bool
+}
+
+func WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("backend").Start(r.Context(), "webhooks")
+	defer span.End()
+	store := ActiveBackend.Webhooks.Store()
+	switch r.Method {
+	case "GET":
+		subscriptions, err := store.ListSubscriptions(ctx)
+		if err != nil {
+			log.WithError(err).Error("Error while listing webhooks")
+			span.RecordError(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, subscription := range subscriptions {
+			subscription.Secret = ""
+		}
+		writeJson(ctx, w, http.StatusOK, subscriptions)
+	case "POST":
+		request, err := extractWebhookRequest(ctx, r)
+		if err != nil {
+			log.WithError(err).Error("Error while extracting webhook from request")
+			span.SetStatus(codes.Error, err.Error())
+			writeError(ctx, w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if request.Secret == "" {
+			writeError(ctx, w, http.StatusBadRequest, "secret must not be empty")
+			return
+		}
+		subscription := &webhook.Subscription{
+			Id:        uuid.New().String(),
+			Url:       request.Url,
+			Secret:    request.Secret,
+			Events:    request.Events,
+			Enabled:   request.Enabled == nil || *request.Enabled,
+			CreatedAt: time.Now().UTC(),
+		}
+		log.WithField("id", subscription.Id).WithField("url", subscription.Url).Info("Creating webhook")
+		err = store.CreateSubscription(ctx, subscription)
+		if err != nil {
+			log.WithError(err).Error("Error while creating webhook")
+			span.RecordError(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		subscription.Secret = ""
+		writeJson(ctx, w, http.StatusCreated, subscription)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("backend").Start(r.Context(), "webhooks/{id}")
+	defer span.End()
+	id := chi.URLParam(r, "id")
+	span.SetAttributes(attribute.KeyValue{Key: "id", Value: attribute.StringValue(id)})
+	store := ActiveBackend.Webhooks.Store()
+	switch r.Method {
+	case "GET":
+		subscription, err := store.GetSubscription(ctx, id)
+		if err != nil {
+			writeWebhookStoreError(ctx, w, err)
+			return
+		}
+		subscription.Secret = ""
+		writeJson(ctx, w, http.StatusOK, subscription)
+	case "PUT":
+		request, err := extractWebhookRequest(ctx, r)
+		if err != nil {
+			log.WithError(err).Error("Error while extracting webhook from request")
+			span.SetStatus(codes.Error, err.Error())
+			writeError(ctx, w, http.StatusBadRequest, err.Error())
+			return
+		}
+		subscription, err := store.GetSubscription(ctx, id)
+		if err != nil {
+			writeWebhookStoreError(ctx, w, err)
+			return
+		}
+		subscription.Url = request.Url
+		subscription.Events = request.Events
+		// keep the current secret if none is given
+		if request.Secret != "" {
+			subscription.Secret = request.Secret
+		}
+		if request.Enabled != nil {
+			if *request.Enabled && !subscription.Enabled {
+				subscription.Failures = 0
+			}
+			subscription.Enabled = *request.Enabled
+		}
+		log.WithField("id", id).Info("Updating webhook")
+		err = store.UpdateSubscription(ctx, subscription)
+		if err != nil {
+			writeWebhookStoreError(ctx, w, err)
+			return
+		}
+		subscription.Secret = ""
+		writeJson(ctx, w, http.StatusOK, subscription)
+	case "DELETE":
+		log.WithField("id", id).Info("Deleting webhook")
+		err := store.DeleteSubscription(ctx, id)
+		if err != nil {
+			writeWebhookStoreError(ctx, w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("backend").Start(r.Context(), "webhooks/{id}/deliveries")
+	defer span.End()
+	id := chi.URLParam(r, "id")
+	span.SetAttributes(attribute.KeyValue{Key: "id", Value: attribute.StringValue(id)})
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	store := ActiveBackend.Webhooks.Store()
+	if _, err := store.GetSubscription(ctx, id); err != nil {
+		writeWebhookStoreError(ctx, w, err)
+		return
+	}
+	deliveries, err := store.ListDeliveries(ctx, id)
+	if err != nil {
+		writeWebhookStoreError(ctx, w, err)
+		return
+	}
+	writeJson(ctx, w, http.StatusOK, deliveries)
+}
+
+func extractWebhookRequest(ctx context.Context, r *http.Request) (request WebhookRequest, err error) {
+	data, err := extractDataFromRequest(ctx, r)
+	if err != nil {
+		return request, err
+	}
+	err = json.Unmarshal(data, &request)
+	if err != nil {
+		return request, err
+	}
+	target, err := url.Parse(request.Url)
+	if err != nil {
+		return request, err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return request, fmt.Errorf("invalid webhook url %q", request.Url)
+	}
+	for _, event := range request.Events {
+		switch event {
+		case "CREATE", "UPDATE", "DELETE", "*":
+		default:
+			return request, fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return request, nil
+}
+
+func writeWebhookStoreError(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(err, webhook.ErrNotFound) {
+		writeError(ctx, w, http.StatusNotFound, err.Error())
+		return
+	}
+	log.WithError(err).Error("Error while accessing webhook store")
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func writeJson(ctx context.Context, w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.WithError(err).Error("Error while converting response to json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeError(ctx context.Context, w http.ResponseWriter, status int, message string) {
+	data, err := createErrorJson(ctx, message)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
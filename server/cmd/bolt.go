@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/backend"
+	"github.com/dkrizic/todo/server/backend/bolt"
+	"github.com/dkrizic/todo/server/backend/notification"
+	"github.com/dkrizic/todo/server/sender"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"path/filepath"
+	"time"
+)
+
+const (
+	boltPathFlag    = "bolt-path"
+	boltTimeoutFlag = "bolt-timeout"
+	boltNoSyncFlag  = "bolt-no-sync"
+	// the backup is a full copy of the data and has no authentication
+	boltBackupEnabledFlag = "bolt-backup-enabled"
+)
+
+var boltFlags = pflag.NewFlagSet("bolt", pflag.ContinueOnError)
+
+var boltCmd = &cobra.Command{
+	Use:   "bolt",
+	Short: "Use the embedded bolt backend",
+	Long: `Stores the todos in a single bbolt file, no external database is needed.
+Only one process can open the file at a time. With --bolt-backup-enabled a
+consistent backup can be downloaded from /admin/backup on the metrics port
+while the server is running.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		httpPort, _ := serveCmd.PersistentFlags().GetInt(httpPortFlag)
+		grpcPort, _ := serveCmd.PersistentFlags().GetInt(grpcPortFlag)
+		healthPort, _ := serveCmd.PersistentFlags().GetInt(healthPortFlag)
+		metricsPort, _ := serveCmd.PersistentFlags().GetInt(metricsPortFlag)
+		notificationsEnabled, _ := cmd.Flags().GetBool(notificationsEnabledFlag)
+		senderType := viper.GetString(senderTypeFlag)
+		log.WithFields(log.Fields{
+			"httpPort":             httpPort,
+			"grpcPort":             grpcPort,
+			"healthPort":           healthPort,
+			"metricsPort":          metricsPort,
+			"path":                 viper.GetString(boltPathFlag),
+			"notificationsEnabled": notificationsEnabled,
+			"senderType":           senderType,
+		}).Info("Starting bolt backend")
+
+		if viper.GetBool(outboxEnabledFlag) {
+			log.Warn("The bolt backend has no outbox, notifications are sent directly")
+		}
+		bolt, err := bolt.NewServer(boltConfig())
+		if err != nil {
+			return err
+		}
+		checkDiskSpace(filepath.Dir(viper.GetString(boltPathFlag)))
+
+		var senderClient sender.Publisher
+		if notificationsEnabled {
+			senderClient, err = newPublisher()
+			if err != nil {
+				return err
+			}
+		}
+		var backuper backend.Backuper
+		if viper.GetBool(boltBackupEnabledFlag) {
+			log.Warn("The backup is served without authentication on the metrics port, keep that port internal")
+			backuper = bolt
+		}
+		changeFeed := newFeed()
+		webhooks := newWebhookDispatcher(bolt.WebhookStore())
+
+		mirrored, err := newMirror(cmd.Name(), newMetrics(bolt))
+		if err != nil {
+			return err
+		}
+		cached, cacheCloser := newCache(mirrored, nil)
+		notification := notification.NewServer(&notification.NotificationConfig{
+			Sender:   senderClient,
+			Original: cached,
+			Enabled:  notificationsEnabled,
+			Webhooks: webhooks,
+			Feed:     changeFeed,
+		})
+
+		backend.ActiveBackend = backend.Backend{
+			HttpPort:        httpPort,
+			GrpcPort:        grpcPort,
+			HealthPort:      healthPort,
+			MetricsPort:     metricsPort,
+			HttpTLS:         httpTLS,
+			GrpcTLS:         grpcTLS,
+			MetricsTLS:      metricsTLS,
+			Implementation:  notification,
+			Health:          probes,
+			HealthServer:    healthServer,
+			ShutdownDelay:   viper.GetDuration(shutdownDelayFlag),
+			ShutdownTimeout: viper.GetDuration(shutdownTimeoutFlag),
+			OnShutdown:      onShutdown(senderClient, cacheCloser, bolt),
+			Webhooks:        webhooks,
+			Feed:            changeFeed,
+			Backup:          backuper,
+			Inventory:       newInventory(bolt),
+		}
+		return backend.ActiveBackend.Start(serveContext(cmd))
+	},
+}
+
+func init() {
+	serveCmd.AddCommand(boltCmd)
+
+	boltFlags.String(boltPathFlag, "todo.bolt", "The bolt database file")
+	boltFlags.Duration(boltTimeoutFlag, 10*time.Second, "How long to wait for another process to release the file")
+	boltFlags.Bool(boltNoSyncFlag, false, "Do not sync after every write, faster but changes can get lost on a crash")
+	boltFlags.Bool(boltBackupEnabledFlag, false, "Serve a backup of the database at /admin/backup on the metrics port")
+
+	addBackendFlags(boltFlags)
+
+	bindEnv(boltPathFlag, "TODO_BOLT_PATH")
+	bindEnv(boltTimeoutFlag, "TODO_BOLT_TIMEOUT")
+	bindEnv(boltNoSyncFlag, "TODO_BOLT_NO_SYNC")
+	bindEnv(boltBackupEnabledFlag, "TODO_BOLT_BACKUP_ENABLED")
+}
+
+func boltConfig() *bolt.Config {
+	return &bolt.Config{
+		Path:    viper.GetString(boltPathFlag),
+		Timeout: viper.GetDuration(boltTimeoutFlag),
+		NoSync:  viper.GetBool(boltNoSyncFlag),
+	}
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/cache"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/spf13/viper"
+	"io"
+	"time"
+)
+
+const (
+	cacheEnabledFlag = "cache-enabled"
+	cacheSizeFlag    = "cache-size"
+	cacheTTLFlag     = "cache-ttl"
+)
+
+func init() {
+	serveCmd.PersistentFlags().Bool(cacheEnabledFlag, false, "Cache reads of the backend in memory, not supported by backends whose replicas cannot invalidate each other (dapr, postgres, cluster)")
+	serveCmd.PersistentFlags().Int(cacheSizeFlag, 10000, "The maximum number of cached todos and lists")
+	serveCmd.PersistentFlags().Duration(cacheTTLFlag, 30*time.Second, "How long a cached entry is used at most")
+	bindEnv(cacheEnabledFlag, "TODO_CACHE_ENABLED")
+	bindEnv(cacheSizeFlag, "TODO_CACHE_SIZE")
+	bindEnv(cacheTTLFlag, "TODO_CACHE_TTL")
+}
+
+// newCache returns the original if the cache is disabled, the invalidator may
+// be nil. The closer ends the subscription of the cache, it is nil without one.
+func newCache(original repository.TodoRepository, invalidator cache.Invalidator) (repository.TodoRepository, io.Closer) {
+	if !viper.GetBool(cacheEnabledFlag) {
+		return original, nil
+	}
+	cached := cache.NewServer(&cache.Config{
+		Original:    original,
+		MaxEntries:  viper.GetInt(cacheSizeFlag),
+		TTL:         viper.GetDuration(cacheTTLFlag),
+		Invalidator: invalidator,
+	})
+	return cached, cached
+}
+
+// refuseCache fails if the cache is enabled for a backend that runs as
+// several replicas over shared state without an invalidator. A write on one
+// replica would not drop the cached reads of the others.
+func refuseCache(backend string) error {
+	if viper.GetBool(cacheEnabledFlag) {
+		return fmt.Errorf("--%s is not supported by %s, its replicas cannot invalidate each other's caches", cacheEnabledFlag, backend)
+	}
+	return nil
+}
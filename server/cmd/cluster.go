@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/cluster"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/tlsconfig"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	clusterIdFlag                = "cluster-id"
+	clusterBindFlag              = "cluster-bind"
+	clusterApiFlag               = "cluster-api"
+	clusterPeersFlag             = "cluster-peers"
+	clusterJoinFlag              = "cluster-join"
+	clusterLinearizableReadsFlag = "cluster-linearizable-reads"
+	clusterTimeoutFlag           = "cluster-timeout"
+	clusterTLSCertFileFlag       = "cluster" + tlsCertFileSuffix
+	clusterTLSKeyFileFlag        = "cluster" + tlsKeyFileSuffix
+	clusterTLSCAFileFlag         = "cluster-tls-ca-file"
+	clusterTLSMinVersionFlag     = "cluster" + tlsMinVersionSuffix
+)
+
+func init() {
+	memoryCmd.Flags().String(clusterIdFlag, "", "The unique name of this node, enables the clustered mode")
+	memoryCmd.Flags().String(clusterBindFlag, "127.0.0.1:7000", "The Raft address of this node, must be reachable by the other nodes")
+	memoryCmd.Flags().String(clusterApiFlag, "127.0.0.1:7001", "The address other nodes forward writes to, must be reachable by the other nodes")
+	memoryCmd.Flags().StringSlice(clusterPeersFlag, nil, "The nodes of a new cluster as id=host:port of their Raft address")
+	memoryCmd.Flags().String(clusterJoinFlag, "", "The cluster API address of a member to join an existing cluster")
+	memoryCmd.Flags().Bool(clusterLinearizableReadsFlag, false, "Confirm with the leader that a read sees all previous writes")
+	memoryCmd.Flags().Duration(clusterTimeoutFlag, 10*time.Second, "How long to wait for the leader when writing")
+	memoryCmd.Flags().String(clusterTLSCertFileFlag, "", "The PEM certificate of this node for mutual TLS between the nodes, it needs server and client usage")
+	memoryCmd.Flags().String(clusterTLSKeyFileFlag, "", "The PEM key of this node")
+	memoryCmd.Flags().String(clusterTLSCAFileFlag, "", "The PEM CA bundle the certificates of all nodes are signed by")
+	memoryCmd.Flags().String(clusterTLSMinVersionFlag, "1.2", "The minimum TLS version between the nodes (1.0, 1.1, 1.2, 1.3)")
+
+	bindEnv(clusterIdFlag, "TODO_CLUSTER_ID")
+	bindEnv(clusterBindFlag, "TODO_CLUSTER_BIND")
+	bindEnv(clusterApiFlag, "TODO_CLUSTER_API")
+	bindEnv(clusterPeersFlag, "TODO_CLUSTER_PEERS")
+	bindEnv(clusterJoinFlag, "TODO_CLUSTER_JOIN")
+	bindEnv(clusterLinearizableReadsFlag, "TODO_CLUSTER_LINEARIZABLE_READS")
+	bindEnv(clusterTimeoutFlag, "TODO_CLUSTER_TIMEOUT")
+	bindEnv(clusterTLSCertFileFlag, "TODO_CLUSTER_TLS_CERT_FILE")
+	bindEnv(clusterTLSKeyFileFlag, "TODO_CLUSTER_TLS_KEY_FILE")
+	bindEnv(clusterTLSCAFileFlag, "TODO_CLUSTER_TLS_CA_FILE")
+	bindEnv(clusterTLSMinVersionFlag, "TODO_CLUSTER_TLS_MIN_VERSION")
+}
+
+// newClusterServer replicates the memory backend, --data-dir keeps the Raft log
+func newClusterServer(maxEntries int) (repository.TodoRepository, error) {
+	serverTLS, clientTLS, err := clusterTLS()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster TLS configuration: %w", err)
+	}
+	return cluster.NewServer(&cluster.Config{
+		ID:                viper.GetString(clusterIdFlag),
+		BindAddr:          viper.GetString(clusterBindFlag),
+		APIAddr:           viper.GetString(clusterApiFlag),
+		Peers:             viper.GetStringSlice(clusterPeersFlag),
+		Join:              viper.GetString(clusterJoinFlag),
+		DataDir:           viper.GetString(dataDirFlag),
+		LinearizableReads: viper.GetBool(clusterLinearizableReadsFlag),
+		MaxEntries:        maxEntries,
+		Timeout:           viper.GetDuration(clusterTimeoutFlag),
+		TLS:               serverTLS,
+		ClientTLS:         clientTLS,
+	})
+}
+
+// clusterTLS requires the certificate of every node both ways, nil if the
+// nodes talk plaintext
+func clusterTLS() (*tls.Config, *tls.Config, error) {
+	config := &tlsconfig.Config{
+		CertFile:     viper.GetString(clusterTLSCertFileFlag),
+		KeyFile:      viper.GetString(clusterTLSKeyFileFlag),
+		ClientCAFile: viper.GetString(clusterTLSCAFileFlag),
+		CAFile:       viper.GetString(clusterTLSCAFileFlag),
+		MinVersion:   viper.GetString(clusterTLSMinVersionFlag),
+	}
+	if !config.Enabled() && config.CAFile == "" {
+		return nil, nil, nil
+	}
+	if !config.Enabled() || config.CAFile == "" {
+		return nil, nil, errors.New("a certificate, key and CA are needed")
+	}
+	serverTLS, err := tlsconfig.NewServerConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientTLS, err := tlsconfig.NewClientConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return serverTLS, clientTLS, nil
+}
@@ -0,0 +1,346 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	configFlag   = "config"
+	logLevelFlag = "log-level"
+)
+
+// envFlags maps the environment variables to the settings they are bound to
+var envFlags = map[string]string{}
+
+// loadedSettings are the values of all settings after the last (re)load
+var loadedSettings map[string]any
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON schema of the configuration file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(configSchema())
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the configuration file given by --config",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString(configFlag) == "" {
+			return errors.New("no config file given, use --config or TODO_CONFIG")
+		}
+		// the file was already validated on startup
+		fmt.Fprintln(cmd.OutOrStdout(), "ok")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configSchemaCmd)
+	configCmd.AddCommand(configValidateCmd)
+
+	rootCmd.PersistentFlags().String(configFlag, "", "A YAML or TOML file with settings named like the flags, flags and environment variables take precedence")
+	rootCmd.PersistentFlags().String(logLevelFlag, "", "The log level (trace, debug, info, warn, error), overrides --verbose and can be changed at runtime")
+	viper.BindPFlag(configFlag, rootCmd.PersistentFlags().Lookup(configFlag))
+	viper.BindPFlag(logLevelFlag, rootCmd.PersistentFlags().Lookup(logLevelFlag))
+	bindEnv(configFlag, "TODO_CONFIG")
+	bindEnv(logLevelFlag, "TODO_LOG_LEVEL")
+}
+
+// bindEnv binds the environment variable to the setting, see readSecretFiles
+func bindEnv(flag string, env string) {
+	viper.BindEnv(flag, env)
+	envFlags[env] = flag
+}
+
+// readSecretFiles sets every bound environment variable that is empty from
+// the file named by the same variable with _FILE appended, like
+// TODO_REDIS_PASS_FILE=/run/secrets/redis. Secrets then never show up in
+// the environment of the container.
+func readSecretFiles() error {
+	for env := range envFlags {
+		path := os.Getenv(env + "_FILE")
+		if path == "" || os.Getenv(env) != "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %w", env, err)
+		}
+		os.Setenv(env, strings.TrimRight(string(data), "\r\n"))
+	}
+	return nil
+}
+
+// loadConfig reads the file given by --config after validating it
+func loadConfig() error {
+	file := viper.GetString(configFlag)
+	if file == "" {
+		return nil
+	}
+	if err := readConfig(file); err != nil {
+		return err
+	}
+	log.WithField("file", file).Info("Read config file")
+	return nil
+}
+
+// readConfig reads the file into a viper of its own and validates it there,
+// only a valid file replaces the settings of the global one
+func readConfig(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	kind := strings.TrimPrefix(filepath.Ext(file), ".")
+	config := viper.New()
+	config.SetConfigType(kind)
+	if err := config.ReadConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := validateConfig(file, config); err != nil {
+		return err
+	}
+	viper.SetConfigType(kind)
+	return viper.ReadConfig(bytes.NewReader(data))
+}
+
+// settings returns every flag of every command by name, they are the schema of the config file
+func settings() map[string]*pflag.Flag {
+	flags := map[string]*pflag.Flag{}
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		add := func(flag *pflag.Flag) {
+			if flag.Name != "help" && flag.Name != configFlag {
+				flags[flag.Name] = flag
+			}
+		}
+		cmd.PersistentFlags().VisitAll(add)
+		cmd.Flags().VisitAll(add)
+		for _, child := range cmd.Commands() {
+			visit(child)
+		}
+	}
+	visit(rootCmd)
+	return flags
+}
+
+// validateConfig reports all unknown settings and values of the wrong type in the file
+func validateConfig(file string, config *viper.Viper) error {
+	known := settings()
+	var problems []string
+	for _, key := range config.AllKeys() {
+		flag, ok := known[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting", key))
+			continue
+		}
+		if err := validateValue(flag.Value.Type(), config.Get(key)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return fmt.Errorf("invalid config file %s:\n  %s", file, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func validateValue(kind string, value any) (err error) {
+	switch kind {
+	case "bool":
+		_, err = cast.ToBoolE(value)
+	case "int", "count":
+		_, err = cast.ToIntE(value)
+	case "uint64":
+		_, err = cast.ToUint64E(value)
+	case "duration":
+		_, err = cast.ToDurationE(value)
+	case "stringSlice":
+		_, err = cast.ToStringSliceE(value)
+	case "string":
+		_, err = cast.ToStringE(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%v is not a valid %s", value, kind)
+	}
+	return nil
+}
+
+// configSchema is the JSON schema of the config file
+func configSchema() map[string]any {
+	properties := map[string]any{}
+	for name, flag := range settings() {
+		property := map[string]any{"description": flag.Usage}
+		switch flag.Value.Type() {
+		case "bool":
+			property["type"] = "boolean"
+		case "int", "count", "uint64":
+			property["type"] = "integer"
+		case "stringSlice":
+			property["type"] = "array"
+			property["items"] = map[string]any{"type": "string"}
+		case "duration":
+			property["type"] = "string"
+			property["pattern"] = `^([0-9.]+(ns|us|µs|ms|s|m|h))+$`
+		default:
+			property["type"] = "string"
+		}
+		properties[name] = property
+	}
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "todo",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// applyLogLevel sets the level of --log-level if given
+func applyLogLevel() error {
+	name := viper.GetString(logLevelFlag)
+	if name == "" {
+		return nil
+	}
+	level, err := log.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	return nil
+}
+
+// reloadable are the settings that take effect without a restart, the
+// sender settings include the pubsub name and topic
+func reloadable(name string) bool {
+	return name == logLevelFlag || (strings.HasPrefix(name, "sender-") && name != notificationsEnabledFlag)
+}
+
+// watchConfig reloads the config file when it changes and on SIGHUP
+func watchConfig() {
+	loadedSettings = currentSettings()
+	if file := viper.GetString(configFlag); file != "" {
+		if err := watchFile(file); err != nil {
+			log.WithError(err).WithField("file", file).Warn("Failed to watch config file, reload it with SIGHUP")
+		}
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			log.Info("Received SIGHUP")
+			reloadConfig()
+		}
+	}()
+}
+
+// watchFile watches the directory of the file, so that replacing the file and
+// the symlinks Kubernetes swaps when it updates a config map are noticed
+func watchFile(file string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+	target, _ := filepath.EvalSymlinks(file)
+	go func() {
+		for event := range watcher.Events {
+			current, _ := filepath.EvalSymlinks(file)
+			written := filepath.Clean(event.Name) == file && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create))
+			if written || (current != "" && current != target) {
+				target = current
+				log.WithField("file", event.Name).Info("Config file changed")
+				reloadConfig()
+			}
+		}
+	}()
+	go func() {
+		for err := range watcher.Errors {
+			log.WithError(err).Warn("Failed to watch config file")
+		}
+	}()
+	return nil
+}
+
+// reloadLock serializes the reloads of the file watcher and SIGHUP
+var reloadLock sync.Mutex
+
+// reloadConfig applies the reloadable settings that changed, the others are
+// only reported. An invalid file is ignored.
+func reloadConfig() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	if file := viper.GetString(configFlag); file != "" {
+		if err := readConfig(file); err != nil {
+			log.WithError(err).Error("Ignoring invalid config file")
+			return
+		}
+	}
+	current := currentSettings()
+	var changed []string
+	for name, value := range current {
+		if reflect.DeepEqual(value, loadedSettings[name]) {
+			continue
+		}
+		if !reloadable(name) {
+			log.WithField("setting", name).Warn("Setting changed, restart to apply it")
+			continue
+		}
+		changed = append(changed, name)
+	}
+	loadedSettings = current
+	if len(changed) == 0 {
+		return
+	}
+	slices.Sort(changed)
+	log.WithField("settings", changed).Info("Reloading settings")
+	var errs []error
+	if slices.Contains(changed, logLevelFlag) {
+		errs = append(errs, applyLogLevel())
+	}
+	if slices.ContainsFunc(changed, func(name string) bool { return name != logLevelFlag }) {
+		reloadSender()
+	}
+	if err := errors.Join(errs...); err != nil {
+		log.WithError(err).Error("Failed to reload settings")
+	}
+}
+
+func currentSettings() map[string]any {
+	values := map[string]any{}
+	for name := range settings() {
+		values[name] = viper.Get(name)
+	}
+	return values
+}
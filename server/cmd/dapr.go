@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/backend"
+	"github.com/dkrizic/todo/server/backend/dapr"
+	"github.com/dkrizic/todo/server/backend/notification"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"github.com/dkrizic/todo/server/sender"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	daprStoreNameFlag = "dapr-store-name"
+	daprAddressFlag   = "dapr-address"
+)
+
+var daprFlags = pflag.NewFlagSet("dapr", pflag.ContinueOnError)
+
+var daprCmd = &cobra.Command{
+	Use:   "dapr",
+	Short: "Use a Dapr state store backend",
+	Long: `Stores the todos through the state API of the Dapr sidecar, the actual
+storage is whatever state store component is configured. Listing with a
+status or list filter uses the query API if the store supports it.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		httpPort, _ := serveCmd.PersistentFlags().GetInt(httpPortFlag)
+		grpcPort, _ := serveCmd.PersistentFlags().GetInt(grpcPortFlag)
+		healthPort, _ := serveCmd.PersistentFlags().GetInt(healthPortFlag)
+		metricsPort, _ := serveCmd.PersistentFlags().GetInt(metricsPortFlag)
+		notificationsEnabled, _ := cmd.Flags().GetBool(notificationsEnabledFlag)
+		senderType := viper.GetString(senderTypeFlag)
+		log.WithFields(log.Fields{
+			"httpPort":             httpPort,
+			"grpcPort":             grpcPort,
+			"healthPort":           healthPort,
+			"metricsPort":          metricsPort,
+			"storeName":            viper.GetString(daprStoreNameFlag),
+			"notificationsEnabled": notificationsEnabled,
+			"senderType":           senderType,
+		}).Info("Starting dapr backend")
+
+		if viper.GetBool(outboxEnabledFlag) {
+			log.Warn("The dapr backend has no outbox, notifications are sent directly")
+		}
+		if err := refuseCache("the dapr backend"); err != nil {
+			return err
+		}
+		if err := refuseWebhooks("the dapr backend"); err != nil {
+			return err
+		}
+		dapr, err := dapr.NewServer(daprConfig())
+		if err != nil {
+			return err
+		}
+		probes.AddReadiness("dapr", dapr)
+
+		var senderClient sender.Publisher
+		if notificationsEnabled {
+			senderClient, err = newPublisher()
+			if err != nil {
+				return err
+			}
+		}
+		changeFeed := noFeed("the dapr backend")
+		webhooks := newWebhookDispatcher(webhook.NewMemoryStore())
+
+		mirrored, err := newMirror(cmd.Name(), newMetrics(dapr))
+		if err != nil {
+			return err
+		}
+		cached, cacheCloser := newCache(mirrored, nil)
+		notification := notification.NewServer(&notification.NotificationConfig{
+			Sender:   senderClient,
+			Original: cached,
+			Enabled:  notificationsEnabled,
+			Webhooks: webhooks,
+			Feed:     changeFeed,
+		})
+
+		backend.ActiveBackend = backend.Backend{
+			HttpPort:        httpPort,
+			GrpcPort:        grpcPort,
+			HealthPort:      healthPort,
+			MetricsPort:     metricsPort,
+			HttpTLS:         httpTLS,
+			GrpcTLS:         grpcTLS,
+			MetricsTLS:      metricsTLS,
+			Implementation:  notification,
+			Health:          probes,
+			HealthServer:    healthServer,
+			ShutdownDelay:   viper.GetDuration(shutdownDelayFlag),
+			ShutdownTimeout: viper.GetDuration(shutdownTimeoutFlag),
+			OnShutdown:      onShutdown(senderClient, cacheCloser, dapr),
+			Webhooks:        webhooks,
+			Feed:            changeFeed,
+			Inventory:       newInventory(dapr),
+		}
+		return backend.ActiveBackend.Start(serveContext(cmd))
+	},
+}
+
+func init() {
+	serveCmd.AddCommand(daprCmd)
+
+	daprFlags.String(daprStoreNameFlag, "todo-statestore", "The name of the Dapr state store component")
+	daprFlags.String(daprAddressFlag, "", "The gRPC address of the Dapr sidecar, defaults to localhost:$DAPR_GRPC_PORT")
+
+	addBackendFlags(daprFlags)
+
+	bindEnv(daprStoreNameFlag, "TODO_DAPR_STORE_NAME")
+	bindEnv(daprAddressFlag, "TODO_DAPR_ADDRESS")
+}
+
+func daprConfig() *dapr.Config {
+	return &dapr.Config{
+		StoreName: viper.GetString(daprStoreNameFlag),
+		Address:   viper.GetString(daprAddressFlag),
+	}
+}
@@ -0,0 +1,14 @@
+package cmd
+
+const (
+	eventSourcingFlag      = "event-sourcing"
+	eventSnapshotEveryFlag = "event-snapshot-every"
+)
+
+func init() {
+	serveCmd.PersistentFlags().Bool(eventSourcingFlag, false, "Keep every change in an append-only event stream and derive the todos from it (memory and redis)")
+	serveCmd.PersistentFlags().Int(eventSnapshotEveryFlag, 1000, "The number of events between two snapshots of the event stream, 0 disables them")
+
+	bindEnv(eventSourcingFlag, "TODO_EVENT_SOURCING")
+	bindEnv(eventSnapshotEveryFlag, "TODO_EVENT_SNAPSHOT_EVERY")
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/backend/feed"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	feedHistoryFlag = "feed-history"
+)
+
+func init() {
+	serveCmd.PersistentFlags().IntP(feedHistoryFlag, "", 1000, "The number of changes kept for clients resuming the live feed")
+	bindEnv(feedHistoryFlag, "TODO_FEED_HISTORY")
+}
+
+// newFeed returns the live feed of this process
+func newFeed() feed.Broker {
+	return feed.NewMemoryBroker(viper.GetInt(feedHistoryFlag))
+}
+
+// noFeed is the feed of a backend whose replicas share the todos. The feed of
+// a process only sees the changes made through it, a client watching one
+// replica would miss those of the others, so Watch and the event streams
+// answer that there is none.
+func noFeed(backend string) feed.Broker {
+	log.Warnf("%s has no live feed, its replicas do not see each other's changes", backend)
+	return nil
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/backend"
+	"github.com/dkrizic/todo/server/backend/health"
+	"github.com/dkrizic/todo/server/sender"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	healthTimeoutFlag     = "health-timeout"
+	healthCacheTTLFlag    = "health-cache-ttl"
+	healthMinFreeDiskFlag = "health-min-free-disk"
+)
+
+// probes and healthServer are created before the backend so that the startup probe answers while it loads
+var (
+	probes       *health.Probes
+	healthServer *backend.HealthServer
+)
+
+func init() {
+	serveCmd.PersistentFlags().Duration(healthTimeoutFlag, 2*time.Second, "The timeout of a single health check")
+	serveCmd.PersistentFlags().Duration(healthCacheTTLFlag, 5*time.Second, "How long the result of a health check is reused")
+	serveCmd.PersistentFlags().Uint64(healthMinFreeDiskFlag, 64<<20, "The bytes that must be free for the file backends to be ready")
+	bindEnv(healthTimeoutFlag, "TODO_HEALTH_TIMEOUT")
+	bindEnv(healthCacheTTLFlag, "TODO_HEALTH_CACHE_TTL")
+	bindEnv(healthMinFreeDiskFlag, "TODO_HEALTH_MIN_FREE_DISK")
+}
+
+// startProbes serves /livez, /readyz and /startupz on the health port, the
+// backend shuts the server down last
+func startProbes() (err error) {
+	probes = health.NewProbes(&health.Config{
+		Timeout:  viper.GetDuration(healthTimeoutFlag),
+		CacheTTL: viper.GetDuration(healthCacheTTLFlag),
+	})
+	healthPort := viper.GetInt(healthPortFlag)
+	healthServer, err = backend.ServeHealth(healthPort, probes.Handler(), healthTLS)
+	if err != nil {
+		return err
+	}
+	log.WithField("healthPort", healthPort).WithField("tls", healthTLS != nil).Info("Serving health")
+	return nil
+}
+
+// checkDiskSpace makes the server not ready when the disk of a file backend is full
+func checkDiskSpace(path string) {
+	probes.AddReadiness("disk", health.DiskSpace(path, viper.GetUint64(healthMinFreeDiskFlag)))
+}
+
+// checkSender adds the sender to the readiness checks if it can tell whether it is reachable
+func checkSender(publisher sender.Publisher) {
+	if checker, ok := publisher.(health.Checker); ok {
+		probes.AddReadiness("sender", checker)
+	}
+}
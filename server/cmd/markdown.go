@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"github.com/dkrizic/todo/server/backend"
+	"github.com/dkrizic/todo/server/backend/cache"
+	"github.com/dkrizic/todo/server/backend/markdown"
+	"github.com/dkrizic/todo/server/backend/notification"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	"github.com/dkrizic/todo/server/sender"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"path/filepath"
+)
+
+const (
+	markdownDirFlag = "markdown-dir"
+)
+
+var markdownFlags = pflag.NewFlagSet("markdown", pflag.ContinueOnError)
+
+var markdownCmd = &cobra.Command{
+	Use:   "markdown",
+	Short: "Use the markdown files backend",
+	Long: `Stores every todo as a Markdown file with YAML front matter in a directory.
+The files can be edited with any editor or kept in git, changes made to them
+show up in the API and are published like any other change.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		httpPort, _ := serveCmd.PersistentFlags().GetInt(httpPortFlag)
+		grpcPort, _ := serveCmd.PersistentFlags().GetInt(grpcPortFlag)
+		healthPort, _ := serveCmd.PersistentFlags().GetInt(healthPortFlag)
+		metricsPort, _ := serveCmd.PersistentFlags().GetInt(metricsPortFlag)
+		notificationsEnabled, _ := cmd.Flags().GetBool(notificationsEnabledFlag)
+		senderType := viper.GetString(senderTypeFlag)
+		log.WithFields(log.Fields{
+			"httpPort":             httpPort,
+			"grpcPort":             grpcPort,
+			"healthPort":           healthPort,
+			"metricsPort":          metricsPort,
+			"dir":                  viper.GetString(markdownDirFlag),
+			"notificationsEnabled": notificationsEnabled,
+			"senderType":           senderType,
+		}).Info("Starting markdown backend")
+
+		if viper.GetBool(outboxEnabledFlag) {
+			log.Warn("The markdown backend has no outbox, notifications are sent directly")
+		}
+		markdown, err := markdown.NewServer(markdownConfig())
+		if err != nil {
+			return err
+		}
+		checkDiskSpace(viper.GetString(markdownDirFlag))
+
+		var senderClient sender.Publisher
+		if notificationsEnabled {
+			senderClient, err = newPublisher()
+			if err != nil {
+				return err
+			}
+		}
+		changeFeed := newFeed()
+		// a hidden file is not a todo
+		webhookStore, err := webhook.NewFileStore(filepath.Join(viper.GetString(markdownDirFlag), ".webhooks.json"))
+		if err != nil {
+			return err
+		}
+		webhooks := newWebhookDispatcher(webhookStore)
+
+		mirrored, err := newMirror(cmd.Name(), newMetrics(markdown))
+		if err != nil {
+			return err
+		}
+		// edits of the files bypass the cache, the watcher invalidates them
+		invalidator := cache.NewLocalInvalidator()
+		cached, cacheCloser := newCache(mirrored, invalidator)
+		notification := notification.NewServer(&notification.NotificationConfig{
+			Sender:   senderClient,
+			Original: cached,
+			Enabled:  notificationsEnabled,
+			Webhooks: webhooks,
+			Feed:     changeFeed,
+		})
+		// the watcher stops with the server, before the feed and the relay are closed
+		ctx := serveContext(cmd)
+		err = markdown.Watch(ctx, func(ctx context.Context, change repository.Change) error {
+			if change.Before != nil {
+				invalidator.Publish(ctx, change.Before.Id)
+			}
+			if change.After != nil {
+				invalidator.Publish(ctx, change.After.Id)
+			}
+			return notification.Deliver(ctx, change)
+		})
+		if err != nil {
+			return err
+		}
+
+		backend.ActiveBackend = backend.Backend{
+			HttpPort:        httpPort,
+			GrpcPort:        grpcPort,
+			HealthPort:      healthPort,
+			MetricsPort:     metricsPort,
+			HttpTLS:         httpTLS,
+			GrpcTLS:         grpcTLS,
+			MetricsTLS:      metricsTLS,
+			Implementation:  notification,
+			Health:          probes,
+			HealthServer:    healthServer,
+			ShutdownDelay:   viper.GetDuration(shutdownDelayFlag),
+			ShutdownTimeout: viper.GetDuration(shutdownTimeoutFlag),
+			OnShutdown:      onShutdown(senderClient, cacheCloser, markdown),
+			Webhooks:        webhooks,
+			Feed:            changeFeed,
+			Inventory:       newInventory(markdown),
+		}
+		return backend.ActiveBackend.Start(ctx)
+	},
+}
+
+func init() {
+	serveCmd.AddCommand(markdownCmd)
+
+	markdownFlags.String(markdownDirFlag, "todos", "The directory with the todo files")
+
+	addBackendFlags(markdownFlags)
+
+	bindEnv(markdownDirFlag, "TODO_MARKDOWN_DIR")
+}
+
+func markdownConfig() *markdown.Config {
+	return &markdown.Config{
+		Dir: viper.GetString(markdownDirFlag),
+	}
+}
@@ -1,74 +1,215 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"github.com/dkrizic/todo/server/backend"
+	"github.com/dkrizic/todo/server/backend/delta"
+	"github.com/dkrizic/todo/server/backend/eventsource"
 	"github.com/dkrizic/todo/server/backend/memory"
 	"github.com/dkrizic/todo/server/backend/notification"
+	"github.com/dkrizic/todo/server/backend/outbox"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/webhook"
 	"github.com/dkrizic/todo/server/sender"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"path/filepath"
+	"time"
 )
 
 const (
 	maxEntriesFlag = "max-entries"
+	evictionFlag   = "eviction"
+	shardsFlag     = "shards"
+	// dataDir enables the snapshots and the write-ahead log
+	dataDirFlag          = "data-dir"
+	fsyncFlag            = "fsync"
+	snapshotIntervalFlag = "snapshot-interval"
+	// tombstones are kept for the delta sync
+	tombstoneRetentionFlag = "tombstone-retention"
 )
 
+var memoryFlags = pflag.NewFlagSet("memory", pflag.ContinueOnError)
+
 // memoryCmd represents the memory command
 var memoryCmd = &cobra.Command{
 	Use:   "memory",
 	Short: "Use the in memory backend",
 	Long: `Be aware that this backend is only in the local process.
-It will not work if there are multiple instances running concurrently.`,
+It will not work if there are multiple instances running concurrently,
+unless they form a cluster with --cluster-id: then every change is
+replicated to all instances through Raft.`,
 	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		httpPort, _ := serveCmd.PersistentFlags().GetInt(httpPortFlag)
 		grpcPort, _ := serveCmd.PersistentFlags().GetInt(grpcPortFlag)
 		healthPort, _ := serveCmd.PersistentFlags().GetInt(healthPortFlag)
 		metricsPort, _ := serveCmd.PersistentFlags().GetInt(metricsPortFlag)
-		maxEntries, _ := cmd.Flags().GetInt(maxEntriesFlag)
+		maxEntries := viper.GetInt(maxEntriesFlag)
 		notificationsEnabled, _ := cmd.Flags().GetBool(notificationsEnabledFlag)
-		pubsubName := viper.GetString(notificationsPubSubNameFlag)
-		topicName := viper.GetString(notificationsPubSubTopicFlag)
+		senderType := viper.GetString(senderTypeFlag)
 		log.WithFields(log.Fields{
 			"httpPort":             httpPort,
 			"grpcPort":             grpcPort,
 			"healthPort":           healthPort,
 			"metricsPort":          metricsPort,
 			"maxEntries":           maxEntries,
+			"eviction":             viper.GetString(evictionFlag),
+			"dataDir":              viper.GetString(dataDirFlag),
 			"notificationsEnabled": notificationsEnabled,
-			"pubsubName":           pubsubName,
-			"topicName":            topicName,
+			"senderType":           senderType,
 		}).Info("Starting memory backend")
 
-		memory := memory.NewServer(maxEntries)
+		outboxEnabled := viper.GetBool(outboxEnabledFlag)
+		var original repository.TodoRepository
+		var outboxStore outbox.Store
+		var syncStore delta.Store
+		var history backend.HistoryReader
+		if viper.GetString(clusterIdFlag) != "" && viper.GetBool(eventSourcingFlag) {
+			return errors.New("the clustered memory backend does not support event sourcing")
+		}
+		if viper.GetBool(eventSourcingFlag) {
+			if outboxEnabled {
+				log.Warn("The event sourced memory backend has no outbox, notifications are sent directly")
+				outboxEnabled = false
+			}
+			eventsource, err := eventsource.NewServer(context.Background(), &eventsource.Config{
+				Store:         eventsource.NewMemoryStore(),
+				SnapshotEvery: viper.GetInt(eventSnapshotEveryFlag),
+			})
+			if err != nil {
+				return err
+			}
+			original, history = eventsource, eventsource
+		} else if viper.GetString(clusterIdFlag) != "" {
+			if outboxEnabled {
+				log.Warn("The clustered memory backend has no outbox, notifications are sent directly")
+				outboxEnabled = false
+			}
+			if viper.GetString(evictionFlag) != memory.EvictionReject {
+				log.Warn("The clustered memory backend only supports the reject eviction")
+			}
+			// cached reads would also bypass --cluster-linearizable-reads
+			if err := refuseCache("the clustered memory backend"); err != nil {
+				return err
+			}
+			if err := refuseWebhooks("the clustered memory backend"); err != nil {
+				return err
+			}
+			cluster, err := newClusterServer(maxEntries)
+			if err != nil {
+				return err
+			}
+			original = cluster
+		} else {
+			memory, err := memory.NewServer(memoryConfig(outboxEnabled))
+			if err != nil {
+				return err
+			}
+			original, outboxStore, syncStore = memory, memory.Outbox(), memory
+		}
+
+		if dataDir := viper.GetString(dataDirFlag); dataDir != "" {
+			checkDiskSpace(dataDir)
+		}
+		store := original
+		inventory := newInventory(original)
+		original, err = newMirror(cmd.Name(), newMetrics(original))
+		if err != nil {
+			return err
+		}
 
-		var senderClient *sender.Sender
+		var senderClient sender.Publisher
 		if notificationsEnabled {
-			senderClient, err = sender.NewSender(pubsubName, topicName)
+			senderClient, err = newPublisher()
+			if err != nil {
+				return err
+			}
+		}
+		changeFeed := newFeed()
+		if viper.GetString(clusterIdFlag) != "" {
+			changeFeed = noFeed("the clustered memory backend")
+		}
+		// without --data-dir the subscriptions are gone after a restart like the todos
+		webhookStore := webhook.NewMemoryStore()
+		if dataDir := viper.GetString(dataDirFlag); dataDir != "" && viper.GetString(clusterIdFlag) == "" {
+			webhookStore, err = webhook.NewFileStore(filepath.Join(dataDir, "webhooks.json"))
 			if err != nil {
 				return err
 			}
 		}
+		webhooks := newWebhookDispatcher(webhookStore)
+
+		cached, cacheCloser := newCache(original, nil)
 		notification := notification.NewServer(&notification.NotificationConfig{
 			Sender:   senderClient,
-			Original: memory,
+			Original: cached,
 			Enabled:  notificationsEnabled,
+			Webhooks: webhooks,
+			Feed:     changeFeed,
+			Outbox:   outboxEnabled,
 		})
+		relay := newOutboxRelay(outboxStore, notification.DeliverPending)
 
 		backend.ActiveBackend = backend.Backend{
-			HttpPort:       httpPort,
-			GrpcPort:       grpcPort,
-			HealthPort:     healthPort,
-			MetricsPort:    metricsPort,
-			Implementation: notification,
+			HttpPort:        httpPort,
+			GrpcPort:        grpcPort,
+			HealthPort:      healthPort,
+			MetricsPort:     metricsPort,
+			HttpTLS:         httpTLS,
+			GrpcTLS:         grpcTLS,
+			MetricsTLS:      metricsTLS,
+			Implementation:  notification,
+			Health:          probes,
+			HealthServer:    healthServer,
+			ShutdownDelay:   viper.GetDuration(shutdownDelayFlag),
+			ShutdownTimeout: viper.GetDuration(shutdownTimeoutFlag),
+			OnShutdown:      onShutdown(senderClient, cacheCloser, store),
+			Webhooks:        webhooks,
+			Relay:           relay,
+			Feed:            changeFeed,
+			Sync:            syncStore,
+			History:         history,
+			Inventory:       inventory,
 		}
-		backend.ActiveBackend.Start()
-		return nil
+		return backend.ActiveBackend.Start(serveContext(cmd))
 	},
 }
 
 func init() {
 	serveCmd.AddCommand(memoryCmd)
-	memoryCmd.Flags().IntP(maxEntriesFlag, "", 100, "The maximum number of entries to store in memory")
+	memoryFlags.IntP(maxEntriesFlag, "", 100, "The maximum number of entries to store in memory, 0 is unlimited")
+	memoryFlags.String(evictionFlag, memory.EvictionReject, "What to do if max-entries is reached, one of reject, lru or completed")
+	memoryFlags.Int(shardsFlag, memory.DefaultShards, "The number of shards of the memory store")
+
+	memoryFlags.String(dataDirFlag, "", "The directory for snapshots and the write-ahead log, nothing is persisted if empty")
+	memoryFlags.String(fsyncFlag, memory.FsyncAlways, "When to sync the write-ahead log, one of always, interval or never")
+	memoryFlags.Duration(snapshotIntervalFlag, 5*time.Minute, "The time between two snapshots, 0 only writes one on shutdown")
+	memoryFlags.Uint64(tombstoneRetentionFlag, memory.DefaultTombstoneRetention, "The number of revisions deletions are kept for sync, older clients get a reset")
+
+	addBackendFlags(memoryFlags)
+
+	bindEnv(maxEntriesFlag, "TODO_MAX_ENTRIES")
+	bindEnv(evictionFlag, "TODO_EVICTION")
+	bindEnv(shardsFlag, "TODO_SHARDS")
+	bindEnv(dataDirFlag, "TODO_DATA_DIR")
+	bindEnv(fsyncFlag, "TODO_FSYNC")
+	bindEnv(snapshotIntervalFlag, "TODO_SNAPSHOT_INTERVAL")
+	bindEnv(tombstoneRetentionFlag, "TODO_TOMBSTONE_RETENTION")
+}
+
+func memoryConfig(outbox bool) *memory.Config {
+	return &memory.Config{
+		MaxEntries:         viper.GetInt(maxEntriesFlag),
+		Eviction:           viper.GetString(evictionFlag),
+		Shards:             viper.GetInt(shardsFlag),
+		Outbox:             outbox,
+		DataDir:            viper.GetString(dataDirFlag),
+		Fsync:              viper.GetString(fsyncFlag),
+		SnapshotInterval:   viper.GetDuration(snapshotIntervalFlag),
+		TombstoneRetention: viper.GetUint64(tombstoneRetentionFlag),
+	}
 }
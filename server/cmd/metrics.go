@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/backend/metrics"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	metricsInventoryIntervalFlag = "metrics-inventory-interval"
+)
+
+func init() {
+	serveCmd.PersistentFlags().Duration(metricsInventoryIntervalFlag, time.Minute, "How often the todos are counted by status for the metrics, 0 disables it")
+	bindEnv(metricsInventoryIntervalFlag, "TODO_METRICS_INVENTORY_INTERVAL")
+}
+
+// newMetrics measures the operations of a backend
+func newMetrics(original repository.TodoRepository) repository.TodoRepository {
+	return metrics.NewServer(&metrics.Config{Original: original})
+}
+
+// newInventory returns nil if the inventory is disabled, it reads the
+// backend directly so that its reads are not measured
+func newInventory(original repository.TodoRepository) *metrics.Inventory {
+	interval := viper.GetDuration(metricsInventoryIntervalFlag)
+	if interval <= 0 {
+		return nil
+	}
+	return metrics.NewInventory(original, interval)
+}
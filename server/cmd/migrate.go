@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/mirror"
+	"github.com/dkrizic/todo/server/backend/repository"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+)
+
+const (
+	migrateFromFlag           = "from"
+	migrateToFlag             = "to"
+	migrateCheckpointFileFlag = "checkpoint-file"
+	migrateBatchSizeFlag      = "batch-size"
+	migrateVerifyFlag         = "verify"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copy all todos from one backend to another",
+	Long: `Backfills the target backend with every todo of the source that is missing or
+different there, then compares both. Both backends are configured by their
+usual flags. To migrate without downtime serve from the source with
+--mirror-to the target first, so that changes during the backfill reach both.
+An interrupted backfill resumes from the checkpoint file.`,
+	Example: "  todo migrate --from redis --to sql --sql-driver postgres --sql-dsn postgres://...",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from := viper.GetString(migrateFromFlag)
+		to := viper.GetString(migrateToFlag)
+		if from == "" || to == "" {
+			return errors.New("--from and --to are required")
+		}
+		if from == to {
+			return errors.New("--from and --to must be different backends")
+		}
+		log.WithFields(log.Fields{
+			"from":           from,
+			"to":             to,
+			"checkpointFile": viper.GetString(migrateCheckpointFileFlag),
+			"batchSize":      viper.GetInt(migrateBatchSizeFlag),
+		}).Info("Starting migration")
+		source, err := openRepository(from)
+		if err != nil {
+			return err
+		}
+		defer closeRepository(source)
+		target, err := openRepository(to)
+		if err != nil {
+			return err
+		}
+		defer closeRepository(target)
+
+		config := &mirror.MigrateConfig{
+			From:           source,
+			To:             target,
+			BatchSize:      viper.GetInt(migrateBatchSizeFlag),
+			CheckpointFile: viper.GetString(migrateCheckpointFileFlag),
+		}
+		checkpoint, err := mirror.Backfill(cmd.Context(), config)
+		if err != nil {
+			return err
+		}
+		log.WithField("copied", checkpoint.Copied).WithField("unchanged", checkpoint.Unchanged).Info("Backfill finished")
+		if !viper.GetBool(migrateVerifyFlag) {
+			return nil
+		}
+		report, err := mirror.Verify(cmd.Context(), config)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"checked":   report.Checked,
+			"missing":   report.Missing,
+			"different": report.Different,
+			"extra":     report.Extra,
+		}).Info("Verification finished")
+		if !report.Ok() {
+			return fmt.Errorf("%s and %s differ in %d todos", from, to, len(report.Missing)+len(report.Different)+len(report.Extra))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().String(migrateFromFlag, "", "The backend to copy from, one of memory, redis, sql, bolt, markdown or dapr")
+	migrateCmd.Flags().String(migrateToFlag, "", "The backend to copy to")
+	migrateCmd.Flags().String(migrateCheckpointFileFlag, "migrate.checkpoint", "The file the progress is saved to, nothing is saved if empty")
+	migrateCmd.Flags().Int(migrateBatchSizeFlag, mirror.DefaultBatchSize, "The number of todos read per page")
+	migrateCmd.Flags().Bool(migrateVerifyFlag, true, "Compare both backends after the backfill")
+
+	bindEnv(migrateFromFlag, "TODO_MIGRATE_FROM")
+	bindEnv(migrateToFlag, "TODO_MIGRATE_TO")
+	bindEnv(migrateCheckpointFileFlag, "TODO_MIGRATE_CHECKPOINT_FILE")
+	bindEnv(migrateBatchSizeFlag, "TODO_MIGRATE_BATCH_SIZE")
+	bindEnv(migrateVerifyFlag, "TODO_MIGRATE_VERIFY")
+}
+
+// closeRepository releases the files and connections of backends that hold them
+func closeRepository(repository repository.TodoRepository) {
+	closer, ok := repository.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		log.WithError(err).WithField("backend", repository.Name()).Warn("Failed to close backend")
+	}
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/bolt"
+	"github.com/dkrizic/todo/server/backend/dapr"
+	"github.com/dkrizic/todo/server/backend/markdown"
+	"github.com/dkrizic/todo/server/backend/memory"
+	"github.com/dkrizic/todo/server/backend/mirror"
+	"github.com/dkrizic/todo/server/backend/redis"
+	"github.com/dkrizic/todo/server/backend/repository"
+	"github.com/dkrizic/todo/server/backend/sql"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	mirrorToFlag          = "mirror-to"
+	mirrorShadowReadsFlag = "mirror-shadow-reads"
+)
+
+func init() {
+	serveCmd.PersistentFlags().String(mirrorToFlag, "", "Also write every change to this backend, configured by its flags, to migrate without downtime")
+	serveCmd.PersistentFlags().Bool(mirrorShadowReadsFlag, false, "Also read from the mirror backend and report any difference")
+	bindEnv(mirrorToFlag, "TODO_MIRROR_TO")
+	bindEnv(mirrorShadowReadsFlag, "TODO_MIRROR_SHADOW_READS")
+}
+
+// addBackendFlags makes the flags of a backend available to every serve
+// command, for the mirror, and to migrate. They are one set so that viper
+// binds the same flags whichever command runs.
+func addBackendFlags(flags *pflag.FlagSet) {
+	serveCmd.PersistentFlags().AddFlagSet(flags)
+	migrateCmd.Flags().AddFlagSet(flags)
+}
+
+// openRepository creates a backend without notifications, outbox or cache
+func openRepository(name string) (repository.TodoRepository, error) {
+	switch name {
+	case "memory":
+		if viper.GetString(dataDirFlag) == "" {
+			return nil, errors.New("the memory backend needs --data-dir to keep the todos")
+		}
+		return memory.NewServer(memoryConfig(false))
+	case "redis":
+		return redis.NewServer(redisConfig(false))
+	case "sql":
+		return sql.NewServer(sqlConfig())
+	case "bolt":
+		return bolt.NewServer(boltConfig())
+	case "markdown":
+		return markdown.NewServer(markdownConfig())
+	case "dapr":
+		return dapr.NewServer(daprConfig())
+	}
+	return nil, fmt.Errorf("unknown backend %s, one of memory, redis, sql, bolt, markdown or dapr", name)
+}
+
+// newMirror returns the original unless --mirror-to is set
+func newMirror(name string, original repository.TodoRepository) (repository.TodoRepository, error) {
+	secondary := viper.GetString(mirrorToFlag)
+	if secondary == "" {
+		return original, nil
+	}
+	if secondary == name {
+		return nil, errors.New("the mirror must be another backend than the primary")
+	}
+	log.WithField("primary", name).WithField("secondary", secondary).Info("Mirroring all writes")
+	mirrored, err := openRepository(secondary)
+	if err != nil {
+		return nil, err
+	}
+	return mirror.NewServer(&mirror.Config{
+		Primary:     original,
+		Secondary:   newMetrics(mirrored),
+		ShadowReads: viper.GetBool(mirrorShadowReadsFlag),
+	}), nil
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/backend/outbox"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	outboxEnabledFlag        = "outbox-enabled"
+	outboxIntervalFlag       = "outbox-interval"
+	outboxBatchSizeFlag      = "outbox-batch-size"
+	outboxMaxAttemptsFlag    = "outbox-max-attempts"
+	outboxInitialBackoffFlag = "outbox-initial-backoff"
+	outboxMaxBackoffFlag     = "outbox-max-backoff"
+)
+
+func init() {
+	serveCmd.PersistentFlags().BoolP(outboxEnabledFlag, "", false, "Write changes to an outbox in the same transaction as the todo and relay them from there")
+	serveCmd.PersistentFlags().DurationP(outboxIntervalFlag, "", time.Second, "The interval between two polls of the outbox")
+	serveCmd.PersistentFlags().IntP(outboxBatchSizeFlag, "", 100, "The maximum number of changes relayed per poll")
+	serveCmd.PersistentFlags().IntP(outboxMaxAttemptsFlag, "", 10, "The number of attempts before a change is moved to the dead letters")
+	serveCmd.PersistentFlags().DurationP(outboxInitialBackoffFlag, "", time.Second, "The wait time after the first failed attempt, doubles on every retry")
+	serveCmd.PersistentFlags().DurationP(outboxMaxBackoffFlag, "", time.Minute, "The maximum wait time between two attempts")
+	bindEnv(outboxEnabledFlag, "TODO_OUTBOX_ENABLED")
+	bindEnv(outboxIntervalFlag, "TODO_OUTBOX_INTERVAL")
+	bindEnv(outboxBatchSizeFlag, "TODO_OUTBOX_BATCH_SIZE")
+	bindEnv(outboxMaxAttemptsFlag, "TODO_OUTBOX_MAX_ATTEMPTS")
+	bindEnv(outboxInitialBackoffFlag, "TODO_OUTBOX_INITIAL_BACKOFF")
+	bindEnv(outboxMaxBackoffFlag, "TODO_OUTBOX_MAX_BACKOFF")
+}
+
+// newOutboxRelay returns nil if the backend has no outbox
+func newOutboxRelay(store outbox.Store, publish outbox.PublishFunc) *outbox.Relay {
+	if store == nil {
+		return nil
+	}
+	config := &outbox.RelayConfig{
+		Store:          store,
+		Publish:        publish,
+		Interval:       viper.GetDuration(outboxIntervalFlag),
+		BatchSize:      viper.GetInt(outboxBatchSizeFlag),
+		MaxAttempts:    viper.GetInt(outboxMaxAttemptsFlag),
+		InitialBackoff: viper.GetDuration(outboxInitialBackoffFlag),
+		MaxBackoff:     viper.GetDuration(outboxMaxBackoffFlag),
+	}
+	log.WithFields(log.Fields{
+		"interval":       config.Interval,
+		"batchSize":      config.BatchSize,
+		"maxAttempts":    config.MaxAttempts,
+		"initialBackoff": config.InitialBackoff,
+		"maxBackoff":     config.MaxBackoff,
+	}).Info("Outbox enabled")
+	return outbox.NewRelay(config)
+}
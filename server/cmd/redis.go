@@ -1,22 +1,49 @@
 package cmd
 
 import (
+	"context"
 	"github.com/dkrizic/todo/server/backend"
+	"github.com/dkrizic/todo/server/backend/delta"
+	"github.com/dkrizic/todo/server/backend/eventsource"
 	"github.com/dkrizic/todo/server/backend/notification"
 	"github.com/dkrizic/todo/server/backend/redis"
+	"github.com/dkrizic/todo/server/backend/repository"
 	"github.com/dkrizic/todo/server/sender"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"time"
 )
 
 const (
-	redisHostFlag = "redis-host"
-	redisPortFlag = "redis-port"
-	redisUserFlag = "redis-user"
-	redisPassFlag = "redis-pass"
+	redisHostFlag      = "redis-host"
+	redisPortFlag      = "redis-port"
+	redisUserFlag      = "redis-user"
+	redisPassFlag      = "redis-pass"
+	redisKeyPrefixFlag = "redis-key-prefix"
+	// comma separated host:port of the server, the sentinels or the cluster nodes
+	redisAddrsFlag                 = "redis-addrs"
+	redisModeFlag                  = "redis-mode"
+	redisDBFlag                    = "redis-db"
+	redisSentinelMasterFlag        = "redis-sentinel-master"
+	redisSentinelUserFlag          = "redis-sentinel-user"
+	redisSentinelPassFlag          = "redis-sentinel-pass"
+	redisTLSEnabledFlag            = "redis-tls-enabled"
+	redisTLSCAFileFlag             = "redis-tls-ca-file"
+	redisTLSCertFileFlag           = "redis-tls-cert-file"
+	redisTLSKeyFileFlag            = "redis-tls-key-file"
+	redisTLSInsecureSkipVerifyFlag = "redis-tls-insecure-skip-verify"
+	redisPoolSizeFlag              = "redis-pool-size"
+	redisMinIdleConnsFlag          = "redis-min-idle-conns"
+	redisDialTimeoutFlag           = "redis-dial-timeout"
+	redisReadTimeoutFlag           = "redis-read-timeout"
+	redisWriteTimeoutFlag          = "redis-write-timeout"
+	redisConnectTimeoutFlag        = "redis-connect-timeout"
 )
 
+var redisFlags = pflag.NewFlagSet("redis", pflag.ContinueOnError)
+
 var redisCmd = &cobra.Command{
 	Use:   "redis",
 	Short: "Use the in redis backend",
@@ -29,10 +56,8 @@ var redisCmd = &cobra.Command{
 		redisHost, _ := cmd.Flags().GetString(redisHostFlag)
 		redisPort, _ := cmd.Flags().GetInt(redisPortFlag)
 		redisUser, _ := cmd.Flags().GetString(redisUserFlag)
-		redisPass, _ := cmd.Flags().GetString(redisPassFlag)
 		notificationsEnabled, _ := cmd.Flags().GetBool(notificationsEnabledFlag)
-		pubsubName := viper.GetString(notificationsPubSubNameFlag)
-		topicName := viper.GetString(notificationsPubSubTopicFlag)
+		senderType := viper.GetString(senderTypeFlag)
 
 		log.WithFields(log.Fields{
 			"httpPort":             httpPort,
@@ -42,57 +67,173 @@ var redisCmd = &cobra.Command{
 			"redisHost":            redisHost,
 			"redisPort":            redisPort,
 			"redisUser":            redisUser,
+			"redisAddrs":           viper.GetStringSlice(redisAddrsFlag),
+			"redisMode":            viper.GetString(redisModeFlag),
+			"redisDB":              viper.GetInt(redisDBFlag),
+			"redisTLS":             viper.GetBool(redisTLSEnabledFlag),
 			"notificationsEnabled": notificationsEnabled,
-			"pubsubName":           pubsubName,
-			"topicName":            topicName,
+			"senderType":           senderType,
 		}).Info("Starting redis backend")
 
-		var senderClient *sender.Sender
+		outboxEnabled := viper.GetBool(outboxEnabledFlag)
+		eventSourcing := viper.GetBool(eventSourcingFlag)
+		if eventSourcing && outboxEnabled {
+			log.Warn("The event sourced redis backend has no outbox, notifications are sent directly")
+			outboxEnabled = false
+		}
+
+		var senderClient sender.Publisher
 		if notificationsEnabled {
-			senderClient, err = sender.NewSender(pubsubName, topicName)
+			senderClient, err = newPublisher()
 			if err != nil {
 				return err
 			}
 		}
 
-		redis := redis.NewServer(&redis.Config{
-			Host: redisHost,
-			Port: redisPort,
-			User: redisUser,
-			Pass: redisPass,
-		})
+		redis, err := redis.NewServer(redisConfig(outboxEnabled))
+		if err != nil {
+			return err
+		}
+		probes.AddReadiness("redis", redis)
+
+		var original repository.TodoRepository = redis
+		var syncStore delta.Store = redis
+		var history backend.HistoryReader
+		if eventSourcing {
+			eventsource, err := eventsource.NewServer(context.Background(), &eventsource.Config{
+				Store:         redis.EventStore(),
+				SnapshotEvery: viper.GetInt(eventSnapshotEveryFlag),
+			})
+			if err != nil {
+				return err
+			}
+			original, syncStore, history = eventsource, nil, eventsource
+		}
+
+		inventory := newInventory(original)
+		original, err = newMirror(cmd.Name(), newMetrics(original))
+		if err != nil {
+			return err
+		}
 
+		changeFeed := redis.Feed(viper.GetInt64(feedHistoryFlag))
+		webhooks := newWebhookDispatcher(redis.WebhookStore())
+
+		cached, cacheCloser := newCache(original, redis.CacheInvalidator())
 		notification := notification.NewServer(&notification.NotificationConfig{
 			Sender:   senderClient,
-			Original: redis,
+			Original: cached,
 			Enabled:  notificationsEnabled,
+			Webhooks: webhooks,
+			Feed:     changeFeed,
+			Outbox:   outboxEnabled,
 		})
+		relay := newOutboxRelay(redis.Outbox(), notification.DeliverPending)
 
 		backend.ActiveBackend = backend.Backend{
-			HttpPort:       httpPort,
-			GrpcPort:       grpcPort,
-			HealthPort:     healthPort,
-			MetricsPort:    metricsPort,
-			Implementation: notification,
+			HttpPort:        httpPort,
+			GrpcPort:        grpcPort,
+			HealthPort:      healthPort,
+			MetricsPort:     metricsPort,
+			HttpTLS:         httpTLS,
+			GrpcTLS:         grpcTLS,
+			MetricsTLS:      metricsTLS,
+			Implementation:  notification,
+			Health:          probes,
+			HealthServer:    healthServer,
+			ShutdownDelay:   viper.GetDuration(shutdownDelayFlag),
+			ShutdownTimeout: viper.GetDuration(shutdownTimeoutFlag),
+			OnShutdown:      onShutdown(senderClient, cacheCloser, redis),
+			Webhooks:        webhooks,
+			Relay:           relay,
+			Feed:            changeFeed,
+			Sync:            syncStore,
+			History:         history,
+			Inventory:       inventory,
 		}
-		backend.ActiveBackend.Start()
-		return nil
+		return backend.ActiveBackend.Start(serveContext(cmd))
 	},
 }
 
 func init() {
 	serveCmd.AddCommand(redisCmd)
 
-	redisCmd.Flags().String(redisHostFlag, "localhost", "The redis host")
-	redisCmd.Flags().Int(redisPortFlag, 6379, "The redis port")
-	redisCmd.Flags().String(redisUserFlag, "", "The redis user")
-	redisCmd.Flags().String(redisPassFlag, "", "The redis password")
+	redisFlags.String(redisHostFlag, "localhost", "The redis host")
+	redisFlags.Int(redisPortFlag, 6379, "The redis port")
+	redisFlags.String(redisUserFlag, "", "The redis user")
+	redisFlags.String(redisPassFlag, "", "The redis password")
+	redisFlags.String(redisKeyPrefixFlag, redis.DefaultKeyPrefix, "The prefix of all keys written to redis")
+
+	redisFlags.StringSlice(redisAddrsFlag, nil, "The addresses of the server, the sentinels or the cluster nodes, overrides host and port")
+	redisFlags.String(redisModeFlag, redis.ModeSingle, "The redis mode, one of single, sentinel or cluster")
+	redisFlags.Int(redisDBFlag, 0, "The redis database, must be 0 in cluster mode")
+	redisFlags.String(redisSentinelMasterFlag, "", "The name of the master watched by the sentinels")
+	redisFlags.String(redisSentinelUserFlag, "", "The user of the sentinels")
+	redisFlags.String(redisSentinelPassFlag, "", "The password of the sentinels")
+	redisFlags.Bool(redisTLSEnabledFlag, false, "Connect to redis with TLS")
+	redisFlags.String(redisTLSCAFileFlag, "", "The CA certificate to verify redis, the system pool if empty")
+	redisFlags.String(redisTLSCertFileFlag, "", "The client certificate for mutual TLS")
+	redisFlags.String(redisTLSKeyFileFlag, "", "The client key for mutual TLS")
+	redisFlags.Bool(redisTLSInsecureSkipVerifyFlag, false, "Do not verify the certificate of redis")
+	redisFlags.Int(redisPoolSizeFlag, 0, "The maximum number of connections, 10 per CPU if 0")
+	redisFlags.Int(redisMinIdleConnsFlag, 0, "The minimum number of idle connections")
+	redisFlags.Duration(redisDialTimeoutFlag, 5*time.Second, "The timeout to establish a connection")
+	redisFlags.Duration(redisReadTimeoutFlag, 3*time.Second, "The timeout of a read")
+	redisFlags.Duration(redisWriteTimeoutFlag, 3*time.Second, "The timeout of a write")
+	redisFlags.Duration(redisConnectTimeoutFlag, time.Minute, "How long to retry connecting to redis on startup")
 
-	redisCmd.MarkFlagRequired(redisHostFlag)
-	redisCmd.MarkFlagRequired(redisPortFlag)
+	addBackendFlags(redisFlags)
+
+	bindEnv(redisHostFlag, "TODO_REDIS_HOST")
+	bindEnv(redisPortFlag, "TODO_REDIS_PORT")
+	bindEnv(redisUserFlag, "TODO_REDIS_USER")
+	bindEnv(redisPassFlag, "TODO_REDIS_PASS")
+	bindEnv(redisKeyPrefixFlag, "TODO_REDIS_KEY_PREFIX")
+	bindEnv(redisAddrsFlag, "TODO_REDIS_ADDRS")
+	bindEnv(redisModeFlag, "TODO_REDIS_MODE")
+	bindEnv(redisDBFlag, "TODO_REDIS_DB")
+	bindEnv(redisSentinelMasterFlag, "TODO_REDIS_SENTINEL_MASTER")
+	bindEnv(redisSentinelUserFlag, "TODO_REDIS_SENTINEL_USER")
+	bindEnv(redisSentinelPassFlag, "TODO_REDIS_SENTINEL_PASS")
+	bindEnv(redisTLSEnabledFlag, "TODO_REDIS_TLS_ENABLED")
+	bindEnv(redisTLSCAFileFlag, "TODO_REDIS_TLS_CA_FILE")
+	bindEnv(redisTLSCertFileFlag, "TODO_REDIS_TLS_CERT_FILE")
+	bindEnv(redisTLSKeyFileFlag, "TODO_REDIS_TLS_KEY_FILE")
+	bindEnv(redisTLSInsecureSkipVerifyFlag, "TODO_REDIS_TLS_INSECURE_SKIP_VERIFY")
+	bindEnv(redisPoolSizeFlag, "TODO_REDIS_POOL_SIZE")
+	bindEnv(redisMinIdleConnsFlag, "TODO_REDIS_MIN_IDLE_CONNS")
+	bindEnv(redisDialTimeoutFlag, "TODO_REDIS_DIAL_TIMEOUT")
+	bindEnv(redisReadTimeoutFlag, "TODO_REDIS_READ_TIMEOUT")
+	bindEnv(redisWriteTimeoutFlag, "TODO_REDIS_WRITE_TIMEOUT")
+	bindEnv(redisConnectTimeoutFlag, "TODO_REDIS_CONNECT_TIMEOUT")
+}
 
-	viper.BindEnv(redisHostFlag, "TODO_REDIS_HOST")
-	viper.BindEnv(redisPortFlag, "TODO_REDIS_PORT")
-	viper.BindEnv(redisUserFlag, "TODO_REDIS_USER")
-	viper.BindEnv(redisPassFlag, "TODO_REDIS_PASS")
+func redisConfig(outbox bool) *redis.Config {
+	return &redis.Config{
+		Addrs:          viper.GetStringSlice(redisAddrsFlag),
+		Host:           viper.GetString(redisHostFlag),
+		Port:           viper.GetInt(redisPortFlag),
+		Mode:           viper.GetString(redisModeFlag),
+		User:           viper.GetString(redisUserFlag),
+		Pass:           viper.GetString(redisPassFlag),
+		DB:             viper.GetInt(redisDBFlag),
+		SentinelMaster: viper.GetString(redisSentinelMasterFlag),
+		SentinelUser:   viper.GetString(redisSentinelUserFlag),
+		SentinelPass:   viper.GetString(redisSentinelPassFlag),
+		TLS: redis.TLSConfig{
+			Enabled:            viper.GetBool(redisTLSEnabledFlag),
+			CAFile:             viper.GetString(redisTLSCAFileFlag),
+			CertFile:           viper.GetString(redisTLSCertFileFlag),
+			KeyFile:            viper.GetString(redisTLSKeyFileFlag),
+			InsecureSkipVerify: viper.GetBool(redisTLSInsecureSkipVerifyFlag),
+		},
+		PoolSize:       viper.GetInt(redisPoolSizeFlag),
+		MinIdleConns:   viper.GetInt(redisMinIdleConnsFlag),
+		DialTimeout:    viper.GetDuration(redisDialTimeoutFlag),
+		ReadTimeout:    viper.GetDuration(redisReadTimeoutFlag),
+		WriteTimeout:   viper.GetDuration(redisWriteTimeoutFlag),
+		ConnectTimeout: viper.GetDuration(redisConnectTimeoutFlag),
+		Outbox:         outbox,
+		KeyPrefix:      viper.GetString(redisKeyPrefixFlag),
+	}
 }
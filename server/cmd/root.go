@@ -32,7 +32,7 @@ func init() {
 	})
 
 	rootCmd.PersistentFlags().CountVarP(&verbose, keyVerbose, "v", "Verbosity (repeat for more verbose output")
-	viper.BindEnv(keyVerbose, "TODO_VERBOSE")
+	bindEnv(keyVerbose, "TODO_VERBOSE")
 	viper.SetDefault(keyVerbose, 4)
 	// viper.BindPFlag(keyVerbose, rootCmd.PersistentFlags().Lookup(keyVerbose))
 }
@@ -41,6 +41,8 @@ func init() {
 func initConfig() {
 
 	viper.AutomaticEnv() // read in environment variables that match
+	cobra.CheckErr(readSecretFiles())
+	cobra.CheckErr(loadConfig())
 
 	fmt.Println("verbose=", verbose)
 	switch verbose {
@@ -62,6 +64,7 @@ func initConfig() {
 	default:
 		log.SetLevel(log.InfoLevel)
 	}
+	cobra.CheckErr(applyLogLevel())
 }
 
 func postInitCommands(commands []*cobra.Command) {
@@ -76,8 +79,12 @@ func postInitCommands(commands []*cobra.Command) {
 func presetRequiredFlags(cmd *cobra.Command) {
 	viper.BindPFlags(cmd.Flags())
 	cmd.Flags().VisitAll(func(f *pflag.Flag) {
-		if viper.IsSet(f.Name) && viper.GetString(f.Name) != "" {
-			cmd.Flags().Set(f.Name, viper.GetString(f.Name))
+		if !f.Changed && viper.IsSet(f.Name) && viper.GetString(f.Name) != "" {
+			if err := cmd.Flags().Set(f.Name, viper.GetString(f.Name)); err != nil {
+				cobra.CheckErr(fmt.Errorf("invalid value %q for %s: %w", viper.GetString(f.Name), f.Name, err))
+			}
+			// only the command line overrides the environment and the config file, so that a reload sees their changes
+			f.Changed = false
 		}
 	})
 }
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/sender"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	senderTypeFlag             = "sender-type"
+	senderNatsUrlFlag          = "sender-nats-url"
+	senderNatsSubjectFlag      = "sender-nats-subject"
+	senderNatsEmbeddedFlag     = "sender-nats-embedded"
+	senderNatsEmbeddedHostFlag = "sender-nats-embedded-host"
+	senderNatsEmbeddedPortFlag = "sender-nats-embedded-port"
+	senderHttpUrlFlag          = "sender-http-url"
+	senderHttpTimeoutFlag      = "sender-http-timeout"
+	senderFilePathFlag         = "sender-file-path"
+)
+
+func init() {
+	serveCmd.PersistentFlags().StringP(senderTypeFlag, "", sender.TypeDapr, "The sender implementation (dapr, nats, http, file, memory)")
+	serveCmd.PersistentFlags().StringP(senderNatsUrlFlag, "", "nats://localhost:4222", "The url of the NATS server")
+	serveCmd.PersistentFlags().StringP(senderNatsSubjectFlag, "", "todo", "The NATS subject to publish notifications to")
+	serveCmd.PersistentFlags().BoolP(senderNatsEmbeddedFlag, "", false, "Start an embedded NATS server instead of connecting to one")
+	serveCmd.PersistentFlags().StringP(senderNatsEmbeddedHostFlag, "", "0.0.0.0", "The host the embedded NATS server listens on")
+	serveCmd.PersistentFlags().IntP(senderNatsEmbeddedPortFlag, "", 4222, "The port the embedded NATS server listens on")
+	serveCmd.PersistentFlags().StringP(senderHttpUrlFlag, "", "", "The url notifications are POSTed to")
+	serveCmd.PersistentFlags().DurationP(senderHttpTimeoutFlag, "", 10*time.Second, "The timeout for POSTing a notification")
+	serveCmd.PersistentFlags().StringP(senderFilePathFlag, "", "-", "The file notifications are appended to as JSON lines, - is stdout")
+	bindEnv(senderTypeFlag, "TODO_SENDER_TYPE")
+	bindEnv(senderNatsUrlFlag, "TODO_SENDER_NATS_URL")
+	bindEnv(senderNatsSubjectFlag, "TODO_SENDER_NATS_SUBJECT")
+	bindEnv(senderNatsEmbeddedFlag, "TODO_SENDER_NATS_EMBEDDED")
+	bindEnv(senderNatsEmbeddedHostFlag, "TODO_SENDER_NATS_EMBEDDED_HOST")
+	bindEnv(senderNatsEmbeddedPortFlag, "TODO_SENDER_NATS_EMBEDDED_PORT")
+	bindEnv(senderHttpUrlFlag, "TODO_SENDER_HTTP_URL")
+	bindEnv(senderHttpTimeoutFlag, "TODO_SENDER_HTTP_TIMEOUT")
+	bindEnv(senderFilePathFlag, "TODO_SENDER_FILE_PATH")
+}
+
+// activeSender is the sender of the running server, it is replaced when the sender settings change
+var activeSender *sender.Switch
+
+func newPublisher() (sender.Publisher, error) {
+	publisher, err := sender.NewPublisher(senderConfig())
+	if err != nil {
+		return nil, err
+	}
+	activeSender = sender.NewSwitch(publisher)
+	checkSender(activeSender)
+	return activeSender, nil
+}
+
+func senderConfig() *sender.Config {
+	return &sender.Config{
+		Type: viper.GetString(senderTypeFlag),
+		Dapr: sender.DaprConfig{
+			PubSubName: viper.GetString(notificationsPubSubNameFlag),
+			TopicName:  viper.GetString(notificationsPubSubTopicFlag),
+		},
+		Nats: sender.NatsConfig{
+			Url:          viper.GetString(senderNatsUrlFlag),
+			Subject:      viper.GetString(senderNatsSubjectFlag),
+			Embedded:     viper.GetBool(senderNatsEmbeddedFlag),
+			EmbeddedHost: viper.GetString(senderNatsEmbeddedHostFlag),
+			EmbeddedPort: viper.GetInt(senderNatsEmbeddedPortFlag),
+		},
+		Http: sender.HttpConfig{
+			Url:     viper.GetString(senderHttpUrlFlag),
+			Timeout: viper.GetDuration(senderHttpTimeoutFlag),
+		},
+		File: sender.FileConfig{
+			Path: viper.GetString(senderFilePathFlag),
+		},
+	}
+}
+
+// reloadSender creates a new sender with the current settings, the previous
+// one is kept if that fails
+func reloadSender() {
+	if activeSender == nil {
+		return
+	}
+	publisher, err := sender.NewPublisher(senderConfig())
+	if err != nil {
+		log.WithError(err).Error("Failed to create sender with the new settings, keeping the previous one")
+		return
+	}
+	if err := activeSender.Swap(publisher); err != nil {
+		log.WithError(err).Warn("Failed to close the previous sender")
+	}
+}
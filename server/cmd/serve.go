@@ -29,6 +29,7 @@ const (
 	tracingEndpointFlag          = "tracing-endpoint"
 )
 
+// shutdown flushes the traces, it is nil if tracing is disabled
 var shutdown func(context.Context) error
 
 // serveCmd represents the serve command
@@ -39,6 +40,13 @@ var serveCmd = &cobra.Command{
 memory, redis, etc. This command will start the service with the
 given backend.`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := loadTLS(); err != nil {
+			return err
+		}
+		if err := startProbes(); err != nil {
+			return err
+		}
+		watchConfig()
 		tracingEnabled := viper.GetBool(tracingEnabledFlag)
 		tracingEndpoint := viper.GetString(tracingEndpointFlag)
 		log.WithFields(log.Fields{
@@ -55,16 +63,6 @@ given backend.`,
 		}
 		return nil
 	},
-	PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
-		log.Info("Shutting down TracerProvider")
-		ctx, cancel := context.WithTimeout(cmd.Context(), time.Second*5)
-		defer cancel()
-		if err := shutdown(ctx); err != nil {
-			log.WithError(err).Fatal("Failed to shutdown TracerProvider")
-			return err
-		}
-		return nil
-	},
 	ValidArgs: []string{"memory", "redis"},
 }
 
@@ -80,15 +78,15 @@ func init() {
 	serveCmd.PersistentFlags().StringP(notificationsPubSubTopicFlag, "", "todo", "The name of the topic to use for notifications")
 	serveCmd.PersistentFlags().BoolP(tracingEnabledFlag, "t", false, "Enable tracing")
 	serveCmd.PersistentFlags().StringP(tracingEndpointFlag, "", "localhost:4317", "The endpoint to send traces to")
-	viper.BindEnv(httpPortFlag, "TODO_HTTP_PORT")
-	viper.BindEnv(grpcPortFlag, "TODO_GRPC_PORT")
-	viper.BindEnv(healthPortFlag, "TODO_HEALTH_PORT")
-	viper.BindEnv(metricsPortFlag, "TODO_METRICS_PORT")
-	viper.BindEnv(notificationsEnabledFlag, "TODO_NOTIFICATIONS_ENABLED")
-	viper.BindEnv(notificationsPubSubNameFlag, "TODO_NOTIFICATIONS_PUBSUB_NAME")
-	viper.BindEnv(notificationsPubSubTopicFlag, "TODO_NOTIFICATIONS_PUBSUB_TOPIC")
-	viper.BindEnv(tracingEnabledFlag, "TODO_TRACING_ENABLED")
-	viper.BindEnv(tracingEndpointFlag, "TODO_TRACING_ENDPOINT")
+	bindEnv(httpPortFlag, "TODO_HTTP_PORT")
+	bindEnv(grpcPortFlag, "TODO_GRPC_PORT")
+	bindEnv(healthPortFlag, "TODO_HEALTH_PORT")
+	bindEnv(metricsPortFlag, "TODO_METRICS_PORT")
+	bindEnv(notificationsEnabledFlag, "TODO_NOTIFICATIONS_ENABLED")
+	bindEnv(notificationsPubSubNameFlag, "TODO_NOTIFICATIONS_PUBSUB_NAME")
+	bindEnv(notificationsPubSubTopicFlag, "TODO_NOTIFICATIONS_PUBSUB_TOPIC")
+	bindEnv(tracingEnabledFlag, "TODO_TRACING_ENABLED")
+	bindEnv(tracingEndpointFlag, "TODO_TRACING_ENDPOINT")
 }
 
 func initProvider(tracingEnabled bool, tracingEndpoint string) (func(context.Context) error, error) {
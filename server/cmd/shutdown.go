@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"context"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	shutdownDelayFlag   = "shutdown-delay"
+	shutdownTimeoutFlag = "shutdown-timeout"
+)
+
+func init() {
+	serveCmd.PersistentFlags().Duration(shutdownDelayFlag, 0, "How long to report not ready before draining the requests, so that load balancers stop sending new ones")
+	serveCmd.PersistentFlags().Duration(shutdownTimeoutFlag, 30*time.Second, "How long to wait for the requests, the outbox and the webhooks on shutdown")
+	bindEnv(shutdownDelayFlag, "TODO_SHUTDOWN_DELAY")
+	bindEnv(shutdownTimeoutFlag, "TODO_SHUTDOWN_TIMEOUT")
+}
+
+// serveContext is done on SIGTERM or SIGINT, a second signal ends the process right away
+func serveContext(cmd *cobra.Command) context.Context {
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGTERM, os.Interrupt)
+	context.AfterFunc(ctx, stop)
+	return ctx
+}
+
+// onShutdown closes the sender and the backends in order, values that are
+// nil or no io.Closer are skipped, and finally flushes the traces
+func onShutdown(values ...any) []func(ctx context.Context) error {
+	var functions []func(ctx context.Context) error
+	for _, value := range values {
+		if closer, ok := value.(io.Closer); ok {
+			functions = append(functions, func(ctx context.Context) error {
+				return closer.Close()
+			})
+		}
+	}
+	if shutdown != nil {
+		functions = append(functions, shutdown)
+	}
+	return functions
+}
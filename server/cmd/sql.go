@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"github.com/dkrizic/todo/server/backend"
+	"github.com/dkrizic/todo/server/backend/notification"
+	"github.com/dkrizic/todo/server/backend/sql"
+	"github.com/dkrizic/todo/server/sender"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	sqlDriverFlag          = "sql-driver"
+	sqlDSNFlag             = "sql-dsn"
+	sqlMaxOpenConnsFlag    = "sql-max-open-conns"
+	sqlMaxIdleConnsFlag    = "sql-max-idle-conns"
+	sqlConnMaxLifetimeFlag = "sql-conn-max-lifetime"
+)
+
+var sqlFlags = pflag.NewFlagSet("sql", pflag.ContinueOnError)
+
+var sqlCmd = &cobra.Command{
+	Use:   "sql",
+	Short: "Use the sql backend",
+	Long: `Stores the todos in SQLite or PostgreSQL. The schema is migrated on startup.
+The DSN is a file name for SQLite and a connection string for PostgreSQL.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		httpPort, _ := serveCmd.PersistentFlags().GetInt(httpPortFlag)
+		grpcPort, _ := serveCmd.PersistentFlags().GetInt(grpcPortFlag)
+		healthPort, _ := serveCmd.PersistentFlags().GetInt(healthPortFlag)
+		metricsPort, _ := serveCmd.PersistentFlags().GetInt(metricsPortFlag)
+		notificationsEnabled, _ := cmd.Flags().GetBool(notificationsEnabledFlag)
+		senderType := viper.GetString(senderTypeFlag)
+		log.WithFields(log.Fields{
+			"httpPort":             httpPort,
+			"grpcPort":             grpcPort,
+			"healthPort":           healthPort,
+			"metricsPort":          metricsPort,
+			"driver":               viper.GetString(sqlDriverFlag),
+			"notificationsEnabled": notificationsEnabled,
+			"senderType":           senderType,
+		}).Info("Starting sql backend")
+
+		if viper.GetBool(outboxEnabledFlag) {
+			log.Warn("The sql backend has no outbox, notifications are sent directly")
+		}
+		// several replicas can share a postgres database
+		postgres := viper.GetString(sqlDriverFlag) == sql.DriverPostgres
+		if postgres {
+			if err := refuseCache("the sql backend on postgres"); err != nil {
+				return err
+			}
+		}
+		sql, err := sql.NewServer(sqlConfig())
+		if err != nil {
+			return err
+		}
+		probes.AddReadiness("sql", sql)
+
+		var senderClient sender.Publisher
+		if notificationsEnabled {
+			senderClient, err = newPublisher()
+			if err != nil {
+				return err
+			}
+		}
+		changeFeed := newFeed()
+		if postgres {
+			changeFeed = noFeed("the sql backend on postgres")
+		}
+		webhooks := newWebhookDispatcher(sql.WebhookStore())
+
+		mirrored, err := newMirror(cmd.Name(), newMetrics(sql))
+		if err != nil {
+			return err
+		}
+		cached, cacheCloser := newCache(mirrored, nil)
+		notification := notification.NewServer(&notification.NotificationConfig{
+			Sender:   senderClient,
+			Original: cached,
+			Enabled:  notificationsEnabled,
+			Webhooks: webhooks,
+			Feed:     changeFeed,
+		})
+
+		backend.ActiveBackend = backend.Backend{
+			HttpPort:        httpPort,
+			GrpcPort:        grpcPort,
+			HealthPort:      healthPort,
+			MetricsPort:     metricsPort,
+			HttpTLS:         httpTLS,
+			GrpcTLS:         grpcTLS,
+			MetricsTLS:      metricsTLS,
+			Implementation:  notification,
+			Health:          probes,
+			HealthServer:    healthServer,
+			ShutdownDelay:   viper.GetDuration(shutdownDelayFlag),
+			ShutdownTimeout: viper.GetDuration(shutdownTimeoutFlag),
+			OnShutdown:      onShutdown(senderClient, cacheCloser, sql),
+			Webhooks:        webhooks,
+			Feed:            changeFeed,
+			Inventory:       newInventory(sql),
+		}
+		return backend.ActiveBackend.Start(serveContext(cmd))
+	},
+}
+
+func init() {
+	serveCmd.AddCommand(sqlCmd)
+
+	sqlFlags.String(sqlDriverFlag, sql.DriverSQLite, "The database, one of sqlite or postgres")
+	sqlFlags.String(sqlDSNFlag, "todo.db", "The file name for sqlite or the connection string for postgres")
+	sqlFlags.Int(sqlMaxOpenConnsFlag, 0, "The maximum number of open connections, unlimited if 0, always 1 for sqlite")
+	sqlFlags.Int(sqlMaxIdleConnsFlag, 0, "The maximum number of idle connections, 2 if 0")
+	sqlFlags.Duration(sqlConnMaxLifetimeFlag, 30*time.Minute, "The maximum time a connection is reused")
+
+	addBackendFlags(sqlFlags)
+
+	bindEnv(sqlDriverFlag, "TODO_SQL_DRIVER")
+	bindEnv(sqlDSNFlag, "TODO_SQL_DSN")
+	bindEnv(sqlMaxOpenConnsFlag, "TODO_SQL_MAX_OPEN_CONNS")
+	bindEnv(sqlMaxIdleConnsFlag, "TODO_SQL_MAX_IDLE_CONNS")
+	bindEnv(sqlConnMaxLifetimeFlag, "TODO_SQL_CONN_MAX_LIFETIME")
+}
+
+func sqlConfig() *sql.Config {
+	return &sql.Config{
+		Driver:          viper.GetString(sqlDriverFlag),
+		DSN:             viper.GetString(sqlDSNFlag),
+		MaxOpenConns:    viper.GetInt(sqlMaxOpenConnsFlag),
+		MaxIdleConns:    viper.GetInt(sqlMaxIdleConnsFlag),
+		ConnMaxLifetime: viper.GetDuration(sqlConnMaxLifetimeFlag),
+	}
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/tlsconfig"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+const (
+	tlsCertFileSuffix     = "-tls-cert-file"
+	tlsKeyFileSuffix      = "-tls-key-file"
+	tlsClientCAFileSuffix = "-tls-client-ca-file"
+	tlsMinVersionSuffix   = "-tls-min-version"
+)
+
+// the TLS configurations of the listeners, nil if they serve plaintext
+var (
+	httpTLS    *tls.Config
+	grpcTLS    *tls.Config
+	healthTLS  *tls.Config
+	metricsTLS *tls.Config
+)
+
+// listeners are the prefixes of the TLS flags of every port
+var listeners = map[string]**tls.Config{
+	"http":    &httpTLS,
+	"grpc":    &grpcTLS,
+	"health":  &healthTLS,
+	"metrics": &metricsTLS,
+}
+
+func init() {
+	for listener := range listeners {
+		env := "TODO_" + strings.ToUpper(listener)
+		serveCmd.PersistentFlags().String(listener+tlsCertFileSuffix, "", fmt.Sprintf("The PEM certificate of the %s port, it serves TLS if set and is reloaded when it changes", listener))
+		serveCmd.PersistentFlags().String(listener+tlsKeyFileSuffix, "", fmt.Sprintf("The PEM key of the %s port", listener))
+		serveCmd.PersistentFlags().String(listener+tlsClientCAFileSuffix, "", fmt.Sprintf("The PEM CA bundle the clients of the %s port must have certificates of (mutual TLS)", listener))
+		serveCmd.PersistentFlags().String(listener+tlsMinVersionSuffix, "1.2", fmt.Sprintf("The minimum TLS version of the %s port (1.0, 1.1, 1.2, 1.3)", listener))
+		bindEnv(listener+tlsCertFileSuffix, env+"_TLS_CERT_FILE")
+		bindEnv(listener+tlsKeyFileSuffix, env+"_TLS_KEY_FILE")
+		bindEnv(listener+tlsClientCAFileSuffix, env+"_TLS_CLIENT_CA_FILE")
+		bindEnv(listener+tlsMinVersionSuffix, env+"_TLS_MIN_VERSION")
+	}
+}
+
+// loadTLS creates the TLS configurations of all listeners, so that a missing
+// or invalid certificate fails the start
+func loadTLS() error {
+	for listener, tlsConfig := range listeners {
+		var err error
+		*tlsConfig, err = tlsconfig.NewServerConfig(&tlsconfig.Config{
+			CertFile:     viper.GetString(listener + tlsCertFileSuffix),
+			KeyFile:      viper.GetString(listener + tlsKeyFileSuffix),
+			ClientCAFile: viper.GetString(listener + tlsClientCAFileSuffix),
+			MinVersion:   viper.GetString(listener + tlsMinVersionSuffix),
+		})
+		if err != nil {
+			return fmt.Errorf("invalid TLS configuration of the %s port: %w", listener, err)
+		}
+	}
+	return nil
+}
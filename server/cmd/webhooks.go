@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/dkrizic/todo/server/backend/webhook"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	webhooksEnabledFlag        = "webhooks-enabled"
+	webhooksWorkersFlag        = "webhooks-workers"
+	webhooksMaxAttemptsFlag    = "webhooks-max-attempts"
+	webhooksInitialBackoffFlag = "webhooks-initial-backoff"
+	webhooksMaxBackoffFlag     = "webhooks-max-backoff"
+	webhooksDisableAfterFlag   = "webhooks-disable-after"
+)
+
+func init() {
+	serveCmd.PersistentFlags().BoolP(webhooksEnabledFlag, "", false, "Enable outgoing webhooks")
+	serveCmd.PersistentFlags().IntP(webhooksWorkersFlag, "", 4, "The number of concurrent webhook deliveries")
+	serveCmd.PersistentFlags().IntP(webhooksMaxAttemptsFlag, "", 5, "The number of attempts per webhook delivery")
+	serveCmd.PersistentFlags().DurationP(webhooksInitialBackoffFlag, "", time.Second, "The wait time after the first failed webhook delivery, doubles on every retry")
+	serveCmd.PersistentFlags().DurationP(webhooksMaxBackoffFlag, "", time.Minute, "The maximum wait time between two webhook delivery attempts")
+	serveCmd.PersistentFlags().IntP(webhooksDisableAfterFlag, "", 10, "Disable a webhook after that many consecutive failed deliveries (0 = never)")
+	bindEnv(webhooksEnabledFlag, "TODO_WEBHOOKS_ENABLED")
+	bindEnv(webhooksWorkersFlag, "TODO_WEBHOOKS_WORKERS")
+	bindEnv(webhooksMaxAttemptsFlag, "TODO_WEBHOOKS_MAX_ATTEMPTS")
+	bindEnv(webhooksInitialBackoffFlag, "TODO_WEBHOOKS_INITIAL_BACKOFF")
+	bindEnv(webhooksMaxBackoffFlag, "TODO_WEBHOOKS_MAX_BACKOFF")
+	bindEnv(webhooksDisableAfterFlag, "TODO_WEBHOOKS_DISABLE_AFTER")
+}
+
+// newWebhookDispatcher returns nil if webhooks are disabled
+func newWebhookDispatcher(store webhook.Store) *webhook.Dispatcher {
+	if !viper.GetBool(webhooksEnabledFlag) {
+		return nil
+	}
+	config := &webhook.Config{
+		Store:          store,
+		Workers:        viper.GetInt(webhooksWorkersFlag),
+		MaxAttempts:    viper.GetInt(webhooksMaxAttemptsFlag),
+		InitialBackoff: viper.GetDuration(webhooksInitialBackoffFlag),
+		MaxBackoff:     viper.GetDuration(webhooksMaxBackoffFlag),
+		DisableAfter:   viper.GetInt(webhooksDisableAfterFlag),
+	}
+	log.WithFields(log.Fields{
+		"workers":        config.Workers,
+		"maxAttempts":    config.MaxAttempts,
+		"initialBackoff": config.InitialBackoff,
+		"maxBackoff":     config.MaxBackoff,
+		"disableAfter":   config.DisableAfter,
+	}).Info("Webhooks enabled")
+	return webhook.NewDispatcher(config)
+}
+
+// refuseWebhooks fails if webhooks are enabled for a backend that cannot keep
+// the subscriptions where all replicas see them, each replica would only
+// deliver to the subscriptions registered with it until it restarts.
+func refuseWebhooks(backend string) error {
+	if viper.GetBool(webhooksEnabledFlag) {
+		return fmt.Errorf("--%s is not supported by %s, it has no shared store for the subscriptions", webhooksEnabledFlag, backend)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package sender
+
+import (
+	"context"
+	dapr "github.com/dapr/go-sdk/client"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"os"
+	"sync"
+)
+
+const (
+	// the same environment and default as dapr.NewClient
+	daprPortEnv     = "DAPR_GRPC_PORT"
+	daprPortDefault = "50001"
+)
+
+type DaprConfig struct {
+	PubSubName string
+	TopicName  string
+}
+
+// daprPublisher publishes through the pubsub API of the Dapr sidecar. The
+// client is created on first use and reused afterwards. It is owned by the
+// publisher: dapr.NewClient returns one client for the whole process, which
+// the dapr backend uses too and which must not be closed on a swap.
+type daprPublisher struct {
+	pubSubName string
+	topicName  string
+	mutex      sync.Mutex
+	client     dapr.Client
+}
+
+func NewDaprPublisher(config *DaprConfig) (Publisher, error) {
+	log.WithFields(log.Fields{
+		"pubsubName": config.PubSubName,
+		"topicName":  config.TopicName,
+	}).Info("Creating dapr sender")
+	return &daprPublisher{
+		pubSubName: config.PubSubName,
+		topicName:  config.TopicName,
+	}, nil
+}
+
+func (d *daprPublisher) Name() string {
+	return TypeDapr
+}
+
+func (d *daprPublisher) Publish(ctx context.Context, message []byte) error {
+	ctx, span := otel.Tracer("sender").Start(ctx, "Dapr/Publish")
+	defer span.End()
+
+	llog := log.WithFields(log.Fields{
+		"pubsubName": d.pubSubName,
+		"topicName":  d.topicName,
+		"message":    string(message),
+	})
+	llog.Debug("Sending notification")
+
+	client, err := d.getClient()
+	if err != nil {
+		llog.WithError(err).Warn("Unable to create dapr client")
+		span.SetStatus(codes.Error, err.Error())
+		span.RecordError(err)
+		return err
+	}
+
+	err = client.PublishEvent(ctx, d.pubSubName, d.topicName, message, dapr.PublishEventWithContentType(cloudEventsContentType))
+	if err != nil {
+		llog.WithError(err).Warn("Unable to send notification")
+		span.SetStatus(codes.Error, err.Error())
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// Check asks the sidecar for its metadata to see that it is reachable
+func (d *daprPublisher) Check(ctx context.Context) error {
+	client, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.GetMetadata(ctx)
+	return err
+}
+
+func (d *daprPublisher) getClient() (dapr.Client, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+	port := os.Getenv(daprPortEnv)
+	if port == "" {
+		port = daprPortDefault
+	}
+	client, err := dapr.NewClientWithPort(port)
+	if err != nil {
+		return nil, err
+	}
+	d.client = client
+	return client, nil
+}
+
+func (d *daprPublisher) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.client != nil {
+		d.client.Close()
+		d.client = nil
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"os"
+	"sync"
+)
+
+type FileConfig struct {
+	// Path of the file the messages are appended to, "-" is stdout
+	Path string
+}
+
+// filePublisher writes every message as a line, which results in JSONL for
+// JSON messages
+type filePublisher struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewFilePublisher(config *FileConfig) (Publisher, error) {
+	publisher := &filePublisher{}
+	if config.Path == "" || config.Path == "-" {
+		publisher.file = os.Stdout
+	} else {
+		file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sender file: %w", err)
+		}
+		publisher.file = file
+	}
+	log.WithField("path", publisher.file.Name()).Info("Creating file sender")
+	return publisher, nil
+}
+
+func (f *filePublisher) Name() string {
+	return TypeFile
+}
+
+func (f *filePublisher) Publish(ctx context.Context, message []byte) error {
+	_, span := otel.Tracer("sender").Start(ctx, "File/Publish")
+	defer span.End()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	line := make([]byte, 0, len(message)+1)
+	line = append(line, message...)
+	line = append(line, '\n')
+	_, err := f.file.Write(line)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func (f *filePublisher) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == os.Stdout {
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,102 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type HttpConfig struct {
+	Url         string
+	ContentType string
+	Timeout     time.Duration
+}
+
+// httpPublisher POSTs every message to a fixed url
+type httpPublisher struct {
+	url         string
+	contentType string
+	client      *http.Client
+}
+
+func NewHttpPublisher(config *HttpConfig) (Publisher, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("http sender needs an url")
+	}
+	publisher := &httpPublisher{
+		url:         config.Url,
+		contentType: config.ContentType,
+		client:      &http.Client{Timeout: config.Timeout},
+	}
+	if publisher.contentType == "" {
+		publisher.contentType = cloudEventsContentType
+	}
+	log.WithField("url", config.Url).Info("Creating http sender")
+	return publisher, nil
+}
+
+func (h *httpPublisher) Name() string {
+	return TypeHttp
+}
+
+func (h *httpPublisher) Publish(ctx context.Context, message []byte) error {
+	ctx, span := otel.Tracer("sender").Start(ctx, "Http/Publish")
+	defer span.End()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(message))
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	req.Header.Set("Content-Type", h.contentType)
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := h.client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.WithError(err).WithField("url", h.url).Warn("Unable to send notification")
+		span.SetStatus(codes.Error, err.Error())
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// Check connects to the host of the url, a request could be taken for a message
+func (h *httpPublisher) Check(ctx context.Context) error {
+	target, err := url.Parse(h.url)
+	if err != nil {
+		return err
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(target.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (h *httpPublisher) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
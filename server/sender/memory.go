@@ -0,0 +1,38 @@
+package sender
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryPublisher keeps all messages in memory, it is meant for tests
+type MemoryPublisher struct {
+	mutex    sync.Mutex
+	messages [][]byte
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (m *MemoryPublisher) Name() string {
+	return TypeMemory
+}
+
+func (m *MemoryPublisher) Publish(ctx context.Context, message []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = append(m.messages, append([]byte(nil), message...))
+	return nil
+}
+
+// Messages returns a copy of all published messages
+func (m *MemoryPublisher) Messages() [][]byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([][]byte(nil), m.messages...)
+}
+
+func (m *MemoryPublisher) Close() error {
+	return nil
+}
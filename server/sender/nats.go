@@ -0,0 +1,112 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"time"
+)
+
+type NatsConfig struct {
+	// Url of the NATS server, ignored if Embedded is set
+	Url     string
+	Subject string
+	// Embedded starts a NATS server inside the process
+	Embedded     bool
+	EmbeddedHost string
+	EmbeddedPort int
+	// Timeout is the maximum time to wait for the server to confirm a message
+	Timeout time.Duration
+}
+
+type natsPublisher struct {
+	subject string
+	timeout time.Duration
+	conn    *nats.Conn
+	server  *natsserver.Server
+}
+
+func NewNatsPublisher(config *NatsConfig) (Publisher, error) {
+	llog := log.WithFields(log.Fields{
+		"url":      config.Url,
+		"subject":  config.Subject,
+		"embedded": config.Embedded,
+	})
+	publisher := &natsPublisher{
+		subject: config.Subject,
+		timeout: config.Timeout,
+	}
+	if publisher.timeout <= 0 {
+		publisher.timeout = 5 * time.Second
+	}
+	url := config.Url
+	if config.Embedded {
+		server, err := natsserver.NewServer(&natsserver.Options{
+			Host:   config.EmbeddedHost,
+			Port:   config.EmbeddedPort,
+			NoSigs: true,
+			NoLog:  true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create embedded nats server: %w", err)
+		}
+		go server.Start()
+		if !server.ReadyForConnections(10 * time.Second) {
+			server.Shutdown()
+			return nil, fmt.Errorf("embedded nats server did not start")
+		}
+		publisher.server = server
+		url = server.ClientURL()
+		llog.WithField("clientUrl", url).Info("Started embedded nats server")
+	}
+	conn, err := nats.Connect(url, nats.Name("todo"), nats.MaxReconnects(-1))
+	if err != nil {
+		if publisher.server != nil {
+			publisher.server.Shutdown()
+		}
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	publisher.conn = conn
+	llog.Info("Creating nats sender")
+	return publisher, nil
+}
+
+func (n *natsPublisher) Name() string {
+	return TypeNats
+}
+
+func (n *natsPublisher) Publish(ctx context.Context, message []byte) error {
+	ctx, span := otel.Tracer("sender").Start(ctx, "Nats/Publish")
+	defer span.End()
+	err := n.conn.Publish(n.subject, message)
+	if err == nil {
+		err = n.conn.FlushTimeout(n.timeout)
+	}
+	if err != nil {
+		log.WithError(err).WithField("subject", n.subject).Warn("Unable to send notification")
+		span.SetStatus(codes.Error, err.Error())
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// Check fails while the connection is lost, it reconnects in the background
+func (n *natsPublisher) Check(ctx context.Context) error {
+	if !n.conn.IsConnected() {
+		return fmt.Errorf("not connected to nats, status %s", n.conn.Status())
+	}
+	return nil
+}
+
+func (n *natsPublisher) Close() error {
+	n.conn.Close()
+	if n.server != nil {
+		n.server.Shutdown()
+	}
+	return nil
+}
@@ -2,50 +2,50 @@ package sender
 
 import (
 	"context"
-	dapr "github.com/dapr/go-sdk/client"
-	log "github.com/sirupsen/logrus"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/codes"
+	"fmt"
 )
 
-type Sender struct {
-	PubSubName string
-	TopicName  string
-}
-
-func NewSender(pubSubName string, topicName string) (notification *Sender, err error) {
-	return &Sender{
-		PubSubName: pubSubName,
-		TopicName:  topicName,
-	}, nil
-}
+const (
+	TypeDapr   = "dapr"
+	TypeNats   = "nats"
+	TypeHttp   = "http"
+	TypeFile   = "file"
+	TypeMemory = "memory"
 
-func (n *Sender) SendNotification(ctx context.Context, message []byte) error {
-	ctx, span := otel.Tracer("sender").Start(ctx, "SendNotification")
-	defer span.End()
+	// cloudEventsContentType marks messages that already are structured cloud events
+	cloudEventsContentType = "application/cloudevents+json"
+)
 
-	llog := log.WithFields(log.Fields{
-		"pubsubName": n.PubSubName,
-		"topicName":  n.TopicName,
-		"message":    string(message),
-	})
-	llog.Debug("Sending sender")
+// Publisher sends a notification message to whatever transport it implements
+type Publisher interface {
+	Name() string
+	Publish(ctx context.Context, message []byte) error
+	Close() error
+}
 
-	client, err := dapr.NewClient()
-	if err != nil {
-		llog.WithError(err).Warn("Unable to create dapr client")
-		span.SetStatus(codes.Error, err.Error())
-		span.RecordError(err)
-		return err
-	}
-	defer client.Close()
+type Config struct {
+	// Type selects the implementation, one of dapr, nats, http, file or memory
+	Type string
+	Dapr DaprConfig
+	Nats NatsConfig
+	Http HttpConfig
+	File FileConfig
+}
 
-	err = client.PublishEvent(ctx, n.PubSubName, n.TopicName, message)
-	if err != nil {
-		llog.WithError(err).Warn("Unable to send sender")
-		span.SetStatus(codes.Error, err.Error())
-		span.RecordError(err)
-		return err
+// NewPublisher creates the publisher selected by the config
+func NewPublisher(config *Config) (Publisher, error) {
+	switch config.Type {
+	case TypeDapr, "":
+		return NewDaprPublisher(&config.Dapr)
+	case TypeNats:
+		return NewNatsPublisher(&config.Nats)
+	case TypeHttp:
+		return NewHttpPublisher(&config.Http)
+	case TypeFile:
+		return NewFilePublisher(&config.File)
+	case TypeMemory:
+		return NewMemoryPublisher(), nil
+	default:
+		return nil, fmt.Errorf("unknown sender type %q", config.Type)
 	}
-	return nil
 }
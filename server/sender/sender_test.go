@@ -0,0 +1,172 @@
+package sender
+
+import (
+	"context"
+	pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// test publishing through an embedded nats server
+func TestNatsPublisherEmbedded(t *testing.T) {
+	publisher, err := NewPublisher(&Config{
+		Type: TypeNats,
+		Nats: NatsConfig{
+			Subject:      "todo",
+			Embedded:     true,
+			EmbeddedHost: "127.0.0.1",
+			EmbeddedPort: -1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error creating nats publisher: %v", err)
+	}
+	defer publisher.Close()
+
+	conn, err := nats.Connect(publisher.(*natsPublisher).server.ClientURL())
+	if err != nil {
+		t.Fatalf("Error connecting to embedded nats: %v", err)
+	}
+	defer conn.Close()
+	subscription, err := conn.SubscribeSync("todo")
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	conn.Flush()
+
+	if err := publisher.Publish(context.Background(), []byte("hello")); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	message, err := subscription.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+	if string(message.Data) != "hello" {
+		t.Errorf("Expected hello, got %v", string(message.Data))
+	}
+}
+
+// test that the http publisher reports non 2xx responses as errors
+func TestHttpPublisher(t *testing.T) {
+	status := http.StatusOK
+	var received []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	publisher, err := NewPublisher(&Config{
+		Type: TypeHttp,
+		Http: HttpConfig{Url: receiver.URL, Timeout: time.Second},
+	})
+	if err != nil {
+		t.Fatalf("Error creating http publisher: %v", err)
+	}
+	if err := publisher.Publish(context.Background(), []byte("hello")); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if string(received) != "hello" {
+		t.Errorf("Expected hello, got %v", string(received))
+	}
+	status = http.StatusServiceUnavailable
+	if err := publisher.Publish(context.Background(), []byte("hello")); err == nil {
+		t.Errorf("Expected an error for status %v", status)
+	}
+}
+
+// test that the file publisher writes one line per message
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.jsonl")
+	publisher, err := NewPublisher(&Config{
+		Type: TypeFile,
+		File: FileConfig{Path: path},
+	})
+	if err != nil {
+		t.Fatalf("Error creating file publisher: %v", err)
+	}
+	publisher.Publish(context.Background(), []byte(`{"a":1}`))
+	publisher.Publish(context.Background(), []byte(`{"a":2}`))
+	publisher.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	expected := "{\"a\":1}\n{\"a\":2}\n"
+	if string(data) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(data))
+	}
+}
+
+// test that messages go to the new publisher after a swap
+func TestSwitch(t *testing.T) {
+	ctx := context.Background()
+	first := NewMemoryPublisher()
+	second := NewMemoryPublisher()
+	publisher := NewSwitch(first)
+	publisher.Publish(ctx, []byte("one"))
+	if err := publisher.Swap(second); err != nil {
+		t.Fatalf("Error swapping publisher: %v", err)
+	}
+	publisher.Publish(ctx, []byte("two"))
+	if len(first.Messages()) != 1 || len(second.Messages()) != 1 {
+		t.Errorf("Expected one message per publisher, got %d and %d", len(first.Messages()), len(second.Messages()))
+	}
+}
+
+// fakeSidecar counts the events published through the Dapr gRPC API
+type fakeSidecar struct {
+	pb.UnimplementedDaprServer
+	lock   sync.Mutex
+	events int
+}
+
+func (f *fakeSidecar) PublishEvent(ctx context.Context, req *pb.PublishEventRequest) (*emptypb.Empty, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.events++
+	return &emptypb.Empty{}, nil
+}
+
+// test that a reload, which swaps the dapr publisher, does not close the client of the new one
+func TestSwitchDapr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar := &fakeSidecar{}
+	grpcServer := grpc.NewServer()
+	pb.RegisterDaprServer(grpcServer, sidecar)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	t.Setenv(daprPortEnv, port)
+
+	ctx := context.Background()
+	first, _ := NewDaprPublisher(&DaprConfig{PubSubName: "pubsub", TopicName: "first"})
+	publisher := NewSwitch(first)
+	if err := publisher.Publish(ctx, []byte("{}")); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	second, _ := NewDaprPublisher(&DaprConfig{PubSubName: "pubsub", TopicName: "second"})
+	if err := publisher.Swap(second); err != nil {
+		t.Fatalf("Error swapping publisher: %v", err)
+	}
+	if err := publisher.Publish(ctx, []byte("{}")); err != nil {
+		t.Fatalf("Error publishing after the swap: %v", err)
+	}
+	if sidecar.events != 2 {
+		t.Errorf("Expected 2 events, got %d", sidecar.events)
+	}
+}
@@ -0,0 +1,61 @@
+package sender
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// Switch forwards to a publisher that can be replaced while it is in use,
+// so that the sender settings can be changed without a restart
+type Switch struct {
+	lock      sync.RWMutex
+	publisher Publisher
+}
+
+func NewSwitch(publisher Publisher) *Switch {
+	return &Switch{publisher: publisher}
+}
+
+func (s *Switch) Name() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.publisher.Name()
+}
+
+func (s *Switch) Publish(ctx context.Context, message []byte) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.publisher.Publish(ctx, message)
+}
+
+// checker is implemented by the publishers that can tell whether their server is reachable
+type checker interface {
+	Check(ctx context.Context) error
+}
+
+// Check checks the current publisher if it is a checker
+func (s *Switch) Check(ctx context.Context) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if checker, ok := s.publisher.(checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// Swap replaces the publisher and closes the previous one once the messages it is sending are done
+func (s *Switch) Swap(publisher Publisher) error {
+	s.lock.Lock()
+	previous := s.publisher
+	s.publisher = publisher
+	s.lock.Unlock()
+	log.WithField("previous", previous.Name()).WithField("current", publisher.Name()).Info("Switched sender")
+	return previous.Close()
+}
+
+func (s *Switch) Close() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.publisher.Close()
+}